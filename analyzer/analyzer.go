@@ -8,28 +8,76 @@
 // Checks implemented (see website/content/docs/language-reference.md):
 //
 // Structural (Error):
-//  1. undefined pattern call
-//  2. pattern arg-count mismatch
+//  1. undefined pattern or function call (or a pattern called as a value)
+//  2. pattern, function or built-in arg-count mismatch
 //  3. undefined binding (let / loop variable)
 //  4. unknown instrument (track instrument / program change)
 //  5. unresolved playable (note / chord / kit alias / binding)
 //  6. channel out of range (1..16)
-//  7. bar overflow / missing grid
+//  7. bar overflow / missing grid / invalid tuplet ratio
 //  8. velocity number out of range (0..127)
 //
 // Light harmony (Warning):
 //  9. resolved note out of MIDI range (0..127)
 //  10. chord-shaped spelling rejected by go-harmony
-//  11. absolute beat out of range (1..beats)
+//  11. absolute beat out of range (1..beats; compound meters count dotted beats)
+//
+// Settings (Error):
+//  12. non-positive tempo, a tempo ramp over an empty span, or an additive
+//     meter group smaller than 1 (time 3+0 8)
+//
+// Timing (Warning):
+//  13. tie (~) with no preceding note to extend, in this bar or the last
+//  14. tuplet whose step count is not a multiple of its actual count
+//
+// Expressions (Error):
+//  15. non-numeric, fractional or out-of-range constant list index
+//  16. constant range step that is zero or not a whole number
+//
+// Feel (Error):
+//  17. humanize timing over half a step, gate over 100%, or velocity over 127
+//  18. arp rate longer than the span it fills, or arp gate outside 1..100%
+//
+// Feel (Warning):
+//  19. arp rate that does not divide its span evenly, or an arp with no room
+//
+// Dynamics (Error):
+//  20. hairpin over an empty span
+//
+// Dynamics (Warning):
+//  21. cresc that does not get louder, or dim that does not get softer
+//
+// Automation (Error):
+//  22. cc or bend ramp over an empty span
+//  23. unknown controller name, controller outside 0..127, or mixer or pressure
+//     value out of range
+//  24. rpn/nrpn parameter or 14-bit value outside 0..16383, unknown rpn name, or
+//     cc14 controller outside 0..31
+//
+// Voicing (Error):
+//  25. voicing on a kit alias, or one a literal chord cannot take (drop N on
+//     fewer than N tones, or voiced out of MIDI range)
+//  26. voicelead range end that is not a note or MIDI key, or a range
+//     narrower than an octave
+//
+// Settings (Error):
+//  27. key with a tonic that is not a note name, an unknown mode, or no key
+//     signature (more than seven sharps or flats)
+//
+// Harmony (Error):
+//  28. roman numeral or scale degree that names no valid chord or note in the
+//     active key
 package analyzer
 
 import (
 	"fmt"
+	"math"
 	"strings"
 
 	"github.com/poolpOrg/earmuff/ast"
 	"github.com/poolpOrg/earmuff/midi"
 	"github.com/poolpOrg/earmuff/token"
+	"github.com/poolpOrg/earmuff/value"
 	"github.com/poolpOrg/go-harmony/chords"
 	"github.com/poolpOrg/go-harmony/notes"
 )
@@ -75,14 +123,12 @@ func Analyze(prog *ast.Program) []Diagnostic {
 	if prog == nil {
 		return nil
 	}
-	// Collect top-level (program-scope) pattern definitions first; these are
-	// shared across every project and track.
+	// Collect top-level (program-scope) pattern definitions first, imported
+	// ones included; these are shared across every project and track.
 	root := newScope(nil)
-	for _, it := range prog.Items {
-		if pd, ok := it.(*ast.PatternDef); ok && pd != nil {
-			root.patterns[pd.Name] = pd
-		}
-	}
+	root.patterns = prog.Patterns()
+	root.funcs = prog.Funcs()
+	a.analyzeImports(prog, map[*ast.Program]bool{})
 	for _, it := range prog.Items {
 		switch n := it.(type) {
 		case *ast.Project:
@@ -90,16 +136,57 @@ func Analyze(prog *ast.Program) []Diagnostic {
 		case *ast.PatternDef:
 			// Analyze the pattern body in a scope where its params are bound.
 			a.analyzePatternDef(n, root)
+		case *ast.FuncDef:
+			a.analyzeFuncDef(n, root)
 		}
 	}
 	return a.diags
 }
 
+// analyzeImports analyzes the patterns and functions of every imported file
+// once, each in the scope of its own file, so their diagnostics carry that
+// file's name. Imports the parser's Loader could not resolve were already
+// reported by it.
+func (a *analysis) analyzeImports(prog *ast.Program, seen map[*ast.Program]bool) {
+	for _, it := range prog.Items {
+		imp, ok := it.(*ast.Import)
+		if !ok || imp.Program == nil || seen[imp.Program] {
+			continue
+		}
+		lib := imp.Program
+		seen[lib] = true
+		root := newScope(nil)
+		root.patterns = lib.Patterns()
+		root.funcs = lib.Funcs()
+		for _, it := range lib.Items {
+			switch n := it.(type) {
+			case *ast.PatternDef:
+				a.analyzePatternDef(n, root)
+			case *ast.FuncDef:
+				a.analyzeFuncDef(n, root)
+			}
+		}
+		a.analyzeImports(lib, seen)
+	}
+}
+
 // analysis accumulates diagnostics during the walk.
 type analysis struct {
 	diags []Diagnostic
+	tie   tieState // what a `~` at the current point of the walk would extend
 }
 
+// tieState tracks, in source order, whether the previous step sounded. Control
+// flow and pattern calls make it depend on elaboration, so it becomes unknown
+// and check #13 stays quiet.
+type tieState int
+
+const (
+	tieUnknown tieState = iota
+	tieNothing          // track start, a rest, or a raw event
+	tieNote             // a sounding step
+)
+
 func (a *analysis) errorf(pos token.Position, format string, args ...interface{}) {
 	a.diags = append(a.diags, Diagnostic{Pos: pos, Severity: Error, Msg: fmt.Sprintf(format, args...)})
 }
@@ -113,29 +200,53 @@ func (a *analysis) warnf(pos token.Position, format string, args ...interface{})
 // ---------------------------------------------------------------------------
 
 // scope is a lexical name environment. It resolves value bindings (let / loop
-// vars), pattern definitions, and kit aliases, chaining to its parent.
+// vars), pattern and function definitions, and kit aliases, chaining to its
+// parent.
 type scope struct {
 	parent   *scope
 	bindings map[string]bool // let names and loop variables
 	patterns map[string]*ast.PatternDef
+	funcs    map[string]*ast.FuncDef
 	kits     map[string]string // alias -> percussion/note value
 	beats    int               // active time-signature numerator (default 4)
+	unit     int               // active time-signature denominator (default 4)
+	groups   []int             // additive meter grouping (3+3+2); nil if plain
+	key      value.Key         // active key, for roman numerals and degrees
 }
 
 func newScope(parent *scope) *scope {
-	beats := 4
+	beats, unit := 4, 4
+	var groups []int
+	var key value.Key
 	if parent != nil {
-		beats = parent.beats
+		beats, unit, groups, key = parent.beats, parent.unit, parent.groups, parent.key
 	}
 	return &scope{
 		parent:   parent,
 		bindings: map[string]bool{},
 		patterns: map[string]*ast.PatternDef{},
+		funcs:    map[string]*ast.FuncDef{},
 		kits:     map[string]string{},
 		beats:    beats,
+		unit:     unit,
+		groups:   groups,
+		key:      key,
 	}
 }
 
+// barBeats is the number of `on beat` positions in a bar of the scope's meter:
+// the numerator, the number of dotted beats in a compound meter (2 in 6/8), or
+// the number of groups in an additive one (3 in 3+3+2).
+func (sc *scope) barBeats() int {
+	if len(sc.groups) > 0 {
+		return len(sc.groups)
+	}
+	if sc.unit >= 8 && sc.beats > 3 && sc.beats%3 == 0 {
+		return sc.beats / 3
+	}
+	return sc.beats
+}
+
 // isBarePitch reports whether text is a letter A-G followed only by accidentals
 // (# or b) — no octave digit, no chord quality — i.e. a plain note at the
 // default octave. Mirrors the elaborator's classification.
@@ -169,6 +280,15 @@ func (s *scope) lookupPattern(name string) (*ast.PatternDef, bool) {
 	return nil, false
 }
 
+func (s *scope) lookupFunc(name string) (*ast.FuncDef, bool) {
+	for sc := s; sc != nil; sc = sc.parent {
+		if fd, ok := sc.funcs[name]; ok {
+			return fd, true
+		}
+	}
+	return nil, false
+}
+
 func (s *scope) lookupKit(name string) (string, bool) {
 	for sc := s; sc != nil; sc = sc.parent {
 		if v, ok := sc.kits[name]; ok {
@@ -188,21 +308,27 @@ func (a *analysis) analyzeProject(proj *ast.Project, parent *scope) {
 	}
 	sc := newScope(parent)
 	// Apply project-level time signature, if any.
-	for _, set := range proj.Settings {
-		if set.Kind == ast.SettingTime && set.TimeBeats > 0 {
-			sc.beats = set.TimeBeats
-		}
+	for i := range proj.Settings {
+		a.analyzeSetting(&proj.Settings[i], sc)
 	}
-	// Project-level patterns are visible to every track.
+	// Project-level patterns and functions are visible to every track.
 	for _, pd := range proj.Patterns {
 		if pd != nil {
 			sc.patterns[pd.Name] = pd
 		}
 	}
+	for _, fd := range proj.Funcs {
+		if fd != nil {
+			sc.funcs[fd.Name] = fd
+		}
+	}
 	// Analyze the project patterns themselves.
 	for _, pd := range proj.Patterns {
 		a.analyzePatternDef(pd, sc)
 	}
+	for _, fd := range proj.Funcs {
+		a.analyzeFuncDef(fd, sc)
+	}
 	for _, tr := range proj.Tracks {
 		a.analyzeTrack(tr, sc)
 	}
@@ -216,7 +342,25 @@ func (a *analysis) analyzePatternDef(pd *ast.PatternDef, parent *scope) {
 	for _, param := range pd.Params {
 		sc.bindings[param] = true
 	}
+	// A pattern body plays wherever it is called, after anything at all.
+	saved := a.tie
+	a.tie = tieUnknown
 	a.analyzeBody(pd.Body, sc)
+	a.tie = saved
+}
+
+// analyzeFuncDef makes a function visible in sc, then analyzes its body with
+// the parameters bound; the function sees itself, so it may recurse.
+func (a *analysis) analyzeFuncDef(fd *ast.FuncDef, sc *scope) {
+	if fd == nil {
+		return
+	}
+	sc.funcs[fd.Name] = fd
+	inner := newScope(sc)
+	for _, param := range fd.Params {
+		inner.bindings[param] = true
+	}
+	a.analyzeExpr(fd.Body, inner)
 }
 
 func (a *analysis) analyzeTrack(tr *ast.Track, parent *scope) {
@@ -237,6 +381,7 @@ func (a *analysis) analyzeTrack(tr *ast.Track, parent *scope) {
 	a.checkVelocity(tr.Velocity)
 
 	sc := newScope(parent)
+	a.tie = tieNothing
 	a.analyzeBody(tr.Body, sc)
 }
 
@@ -277,11 +422,16 @@ func (a *analysis) analyzeStmt(st ast.Stmt, sc *scope) {
 		a.analyzeFor(n, sc)
 	case *ast.If:
 		a.analyzeIf(n, sc)
+	case *ast.VoiceLead:
+		a.analyzeVoiceLead(n, sc)
 	case *ast.Let:
 		// The value is analyzed in the *current* scope (before the binding is
 		// visible to itself), then the name becomes visible to later siblings.
 		a.analyzeExpr(n.Value, sc)
 		sc.bindings[n.Name] = true
+	case *ast.FuncDef:
+		// Like a let, a function is visible to the statements after it.
+		a.analyzeFuncDef(n, sc)
 	case *ast.Kit:
 		// Already collected in analyzeBody; validate each aliased percussion.
 		for _, al := range n.Aliases {
@@ -291,10 +441,9 @@ func (a *analysis) analyzeStmt(st ast.Stmt, sc *scope) {
 		}
 	case *ast.PatternCall:
 		a.analyzePatternCall(n.Position, n.Name, n.Args, sc)
+		a.tie = tieUnknown
 	case *ast.SettingStmt:
-		if n.Setting.Kind == ast.SettingTime && n.Setting.TimeBeats > 0 {
-			sc.beats = n.Setting.TimeBeats
-		}
+		a.analyzeSetting(&n.Setting, sc)
 	case *ast.Swing:
 		a.analyzeExpr(n.Percent, sc)
 		// Range-check a literal percentage; expressions are checked at elaboration.
@@ -303,15 +452,38 @@ func (a *analysis) analyzeStmt(st ast.Stmt, sc *scope) {
 				a.errorf(n.Position, "swing %g%% out of range; expected 50 (straight) to 75", lit.Value)
 			}
 		}
+	case *ast.Humanize:
+		if n.Timing.Percent && n.Timing.Amount > 50 {
+			a.errorf(n.Position, "humanize timing %g%% could swap steps; expected at most 50%%", n.Timing.Amount)
+		}
+		if n.Gate.Percent && n.Gate.Amount > 100 {
+			a.errorf(n.Position, "humanize gate %g%% out of range; expected at most 100%%", n.Gate.Amount)
+		}
+		if n.Velocity > 127 {
+			a.errorf(n.Position, "humanize velocity %g out of range; expected at most 127", n.Velocity)
+		}
+	case *ast.Hairpin:
+		a.checkHairpin(n)
+	case *ast.Mixer:
+		a.checkMixer(n, sc)
+	case *ast.Param:
+		a.checkParam(n, sc)
+		a.tie = tieNothing
 	case *ast.CC:
-		// The controller position accepts a named-CC keyword (e.g. `cutoff`),
-		// which the parser leaves as a bare Ident; it is not a let/loop binding,
-		// so we don't resolve it. The value is a normal expression.
+		// The controller position accepts a named controller (e.g. `cutoff`),
+		// which the parser leaves as a bare Ident. The value is a normal
+		// expression.
+		a.checkController(n.Controller, sc)
 		a.analyzeExpr(n.Value, sc)
+		a.analyzeRamp(n.Position, "cc", n.Ramp, sc)
+		a.tie = tieNothing
 	case *ast.Bend:
 		a.analyzeExpr(n.Value, sc)
+		a.analyzeRamp(n.Position, "bend", n.Ramp, sc)
+		a.tie = tieNothing
 	case *ast.Pressure:
-		a.analyzeExpr(n.Value, sc)
+		a.checkPressure(n, sc)
+		a.tie = tieNothing
 	case *ast.Program_:
 		// Check #4: unknown instrument on a program (patch) change by name.
 		if n.HasName {
@@ -319,20 +491,61 @@ func (a *analysis) analyzeStmt(st ast.Stmt, sc *scope) {
 				a.errorf(n.Position, "unknown instrument %q", n.Name)
 			}
 		}
-	case *ast.Meta, *ast.Sysex:
+		a.tie = tieNothing
+	case *ast.Sysex:
+		a.tie = tieNothing
+	case *ast.Meta:
 		// nothing to check
 	case *ast.PatternDef:
 		// already registered by analyzeBody's pre-scan; analyze its body.
 		a.analyzePatternDef(n, sc)
 	case *ast.Absolute:
 		a.analyzeExpr(n.Beat, sc)
+		saved := a.tie // an `on beat` event never breaks a tie
 		a.analyzeStmt(n.Event, sc)
+		a.tie = saved
 	case *ast.Step:
 		// a top-level step (e.g. inside an `on beat` event) — validate playable.
 		a.analyzeStep(n, sc)
 	}
 }
 
+// analyzeSetting validates a bpm/time/key setting and tracks the running
+// meter.
+func (a *analysis) analyzeSetting(set *ast.Setting, sc *scope) {
+	switch set.Kind {
+	case ast.SettingTime:
+		for _, g := range set.TimeGroups {
+			if g < 1 {
+				a.errorf(set.Position, "additive meter groups must be at least 1, got %d", g)
+				return
+			}
+		}
+		if set.TimeBeats > 0 && set.TimeUnit > 0 {
+			sc.beats, sc.unit, sc.groups = set.TimeBeats, set.TimeUnit, set.TimeGroups
+		}
+	case ast.SettingBPM:
+		if set.Number <= 0 {
+			a.errorf(set.Position, "tempo must be positive, got %g", set.Number)
+		}
+		if r := set.Ramp; r != nil {
+			if r.To <= 0 {
+				a.errorf(set.Position, "tempo must be positive, got %g", r.To)
+			}
+			if r.Over.Note == 0 && r.Over.Bars <= 0 {
+				a.errorf(set.Position, "tempo ramp over %g bars: the span must be positive", r.Over.Bars)
+			}
+		}
+	case ast.SettingKey:
+		k, err := value.ParseKey(set.Tonic, set.Mode)
+		if err != nil {
+			a.errorf(set.Position, "%v", err)
+			return
+		}
+		sc.key = k
+	}
+}
+
 func (a *analysis) analyzeFor(n *ast.For, parent *scope) {
 	if n == nil {
 		return
@@ -342,7 +555,53 @@ func (a *analysis) analyzeFor(n *ast.For, parent *scope) {
 	if n.Var != "" {
 		sc.bindings[n.Var] = true
 	}
+	if n.Index != "" {
+		sc.bindings[n.Index] = true
+		if n.Index == n.Var {
+			a.errorf(n.Position, "loop index and element are both named %q", n.Var)
+		}
+	}
+	a.tie = tieUnknown
 	a.analyzeBody(n.Body, sc)
+	a.tie = tieUnknown
+}
+
+// analyzeVoiceLead checks a voicelead block's range (check #26), then its
+// body as a block of its own.
+func (a *analysis) analyzeVoiceLead(n *ast.VoiceLead, parent *scope) {
+	if n == nil {
+		return
+	}
+	if n.Lo != nil {
+		a.analyzeExpr(n.Lo, parent)
+		a.analyzeExpr(n.Hi, parent)
+		lo, okLo := a.leadBound(n.Lo)
+		hi, okHi := a.leadBound(n.Hi)
+		if okLo && okHi && hi-lo < 12 {
+			a.errorf(n.Position, "voicelead range %d..%d is narrower than an octave", lo, hi)
+		}
+	}
+	a.analyzeBody(n.Body, newScope(parent))
+}
+
+// leadBound resolves a voicelead range end written as a literal note or MIDI
+// key. It reports false for anything else, flagging a literal chord.
+func (a *analysis) leadBound(x ast.Expr) (int, bool) {
+	if k, ok := constInt(x); ok {
+		return k, true
+	}
+	if _, ok := x.(*ast.MusicLit); !ok {
+		return 0, false
+	}
+	v, err := value.Eval(x, value.NewEnv(nil))
+	if err != nil {
+		return 0, false
+	}
+	if keys, _ := v.Keys(); len(keys) == 1 {
+		return int(keys[0]), true
+	}
+	a.errorf(x.Pos(), "voicelead range ends must be notes or MIDI keys, got a %s", v.Kind)
+	return 0, false
 }
 
 func (a *analysis) analyzeIf(n *ast.If, parent *scope) {
@@ -350,12 +609,15 @@ func (a *analysis) analyzeIf(n *ast.If, parent *scope) {
 		return
 	}
 	a.analyzeExpr(n.Cond, parent)
+	a.tie = tieUnknown
 	a.analyzeBody(n.Then, newScope(parent))
+	a.tie = tieUnknown
 	if n.ElseIf != nil {
 		a.analyzeIf(n.ElseIf, parent)
 	} else if n.Else != nil {
 		a.analyzeBody(n.Else, newScope(parent))
 	}
+	a.tie = tieUnknown
 }
 
 func (a *analysis) analyzePatternCall(pos token.Position, name string, args []ast.Expr, sc *scope) {
@@ -384,11 +646,6 @@ func (a *analysis) analyzeBar(bar *ast.Bar, parent *scope) {
 	}
 	a.checkVelocity(bar.Velocity)
 
-	beats := parent.beats
-	if beats <= 0 {
-		beats = 4
-	}
-
 	// Track the active grid: starts at the bar grid, rebindable via GridSwitch.
 	barGrid := 0
 	if bar.HasGrid {
@@ -397,13 +654,9 @@ func (a *analysis) analyzeBar(bar *ast.Bar, parent *scope) {
 	curGrid := barGrid
 
 	// advance is measured in whole-note fractions: a step on a grid of value g
-	// advances 1/g of a whole note. A full bar is beats/unit; for the default
-	// 4/4 (and the parser's note-value grids) the bar length is beats*(1/4)
-	// whole notes when the unit is a quarter. We measure the capacity in grid
-	// steps relative to a whole note: capacity = beats/unit whole notes. We work
-	// in units of whole notes as a float.
-	const unit = 4.0                // default denominator (quarter-note beat)
-	barLen := float64(beats) / unit // whole notes per bar
+	// advances 1/g of a whole note, and a full bar holds beats/unit whole notes
+	// (3/4 of one in 6/8 or 3/4, 7/8 of one in 7/8).
+	barLen := float64(parent.beats) / float64(parent.unit) // whole notes per bar
 
 	var advance float64 // whole notes consumed so far
 	missingGridReported := false
@@ -417,6 +670,7 @@ func (a *analysis) analyzeBar(bar *ast.Bar, parent *scope) {
 			curGrid = barGrid
 		case *ast.Step:
 			a.analyzeStep(it, parent)
+			a.trackTie(it)
 			rep := it.Repeat
 			if rep < 1 {
 				rep = 1
@@ -430,27 +684,83 @@ func (a *analysis) analyzeBar(bar *ast.Bar, parent *scope) {
 				continue
 			}
 			advance += float64(rep) / float64(g)
+		case *ast.Tuplet:
+			count := 0
+			for _, st := range it.Steps {
+				a.analyzeStep(st, parent)
+				a.trackTie(st)
+				count += max(st.Repeat, 1)
+			}
+			if it.Actual <= 0 || it.Normal <= 0 {
+				a.errorf(it.Position, "invalid tuplet %d:%d", it.Actual, it.Normal)
+				continue
+			}
+			if count%it.Actual != 0 {
+				a.warnf(it.Position, "tuplet %d:%d holds %d steps, not a multiple of %d", it.Actual, it.Normal, count, it.Actual)
+			}
+			if curGrid == 0 {
+				if !missingGridReported {
+					a.errorf(bar.Position, "no grid: bar needs a default duration or per-step duration")
+					missingGridReported = true
+				}
+				continue
+			}
+			// Each step lasts Normal/Actual grid steps.
+			advance += float64(count*it.Normal) / float64(it.Actual*curGrid)
+		case *ast.Arp:
+			a.checkVelocity(it.Velocity)
+			a.analyzePlayable(it.Play, parent)
+			a.tie = tieNote
+			rate := curGrid
+			if it.Rate > 0 {
+				rate = it.Rate
+			}
+			if rate == 0 {
+				if !missingGridReported {
+					a.errorf(bar.Position, "no grid: bar needs a default duration or per-step duration")
+					missingGridReported = true
+				}
+				continue
+			}
+			a.checkArp(it, rate, barLen-advance)
+			if it.Over > 0 {
+				advance += 1 / float64(it.Over)
+			} else {
+				advance = max(advance, barLen) // fills the rest of the bar
+			}
 		case *ast.Absolute:
-			a.analyzeAbsolute(it, beats, parent)
+			a.analyzeAbsolute(it, parent.barBeats(), parent)
 			// 'on beat' does not advance the cursor.
 		case *ast.For:
 			a.analyzeFor(it, parent)
 		case *ast.If:
 			a.analyzeIf(it, parent)
 		case *ast.CC:
-			// See analyzeStmt: the controller may be a named-CC keyword.
+			// See analyzeStmt: the controller may be a named controller.
+			a.checkController(it.Controller, parent)
 			a.analyzeExpr(it.Value, parent)
+			a.analyzeRamp(it.Position, "cc", it.Ramp, parent)
+			a.tie = tieNothing
 		case *ast.Bend:
 			a.analyzeExpr(it.Value, parent)
+			a.analyzeRamp(it.Position, "bend", it.Ramp, parent)
+			a.tie = tieNothing
+		case *ast.Param:
+			a.checkParam(it, parent)
+			a.tie = tieNothing
 		case *ast.Pressure:
-			a.analyzeExpr(it.Value, parent)
+			a.checkPressure(it, parent)
+			a.tie = tieNothing
 		case *ast.Program_:
 			if it.HasName {
 				if _, err := midi.InstrumentToPC(it.Name); err != nil {
 					a.errorf(it.Position, "unknown instrument %q", it.Name)
 				}
 			}
-		case *ast.Meta, *ast.Sysex:
+			a.tie = tieNothing
+		case *ast.Sysex:
+			a.tie = tieNothing
+		case *ast.Meta:
 			// nothing to check
 		}
 	}
@@ -465,6 +775,43 @@ func (a *analysis) analyzeBar(bar *ast.Bar, parent *scope) {
 	}
 }
 
+// checkArp validates an arp stepping every 1/rate of a whole note, with left
+// whole notes of the bar still free. Checks #18 and #19.
+func (a *analysis) checkArp(n *ast.Arp, rate int, left float64) {
+	const eps = 1e-9
+	if n.Gate <= 0 || n.Gate > 100 {
+		a.errorf(n.Position, "arp gate %g%% out of range; expected 1 to 100%%", n.Gate)
+	}
+	span, what := left, fmt.Sprintf("%s left in the bar", wholeFraction(left))
+	if n.Over > 0 {
+		span, what = 1/float64(n.Over), fmt.Sprintf("1/%d it lasts", n.Over)
+		if span > left+eps {
+			return // the bar overflow check reports it
+		}
+	}
+	step := 1 / float64(rate)
+	switch {
+	case span <= eps:
+		a.warnf(n.Position, "arp has no room left in the bar")
+	case step > span+eps:
+		a.errorf(n.Position, "arp rate 1/%d is longer than the %s", rate, what)
+	default:
+		if q := span / step; q-math.Floor(q+eps) > eps {
+			a.warnf(n.Position, "arp rate 1/%d does not divide the %s evenly; its last step is cut short", rate, what)
+		}
+	}
+}
+
+// wholeFraction renders a length in whole notes as a fraction, e.g. "3/8".
+func wholeFraction(w float64) string {
+	for d := 1; d <= 128; d *= 2 {
+		if n := w * float64(d); math.Abs(n-math.Round(n)) < 1e-9 {
+			return fmt.Sprintf("%d/%d", int(math.Round(n)), d)
+		}
+	}
+	return fmt.Sprintf("%g", w)
+}
+
 // overflowSteps reports how many grid steps the bar overflows by. It uses the
 // bar grid as the step size when known; otherwise it falls back to expressing
 // the surplus in 16th notes for a stable, readable count.
@@ -493,7 +840,25 @@ func (a *analysis) analyzeAbsolute(n *ast.Absolute, beats int, sc *scope) {
 		}
 	}
 	if n.Event != nil {
+		saved := a.tie // an `on beat` event never breaks a tie
 		a.analyzeStmt(n.Event, sc)
+		a.tie = saved
+	}
+}
+
+// trackTie applies a bar step to the tie state. Check #13: a `~` right after a
+// rest, a raw event, or the start of the track has no note to extend.
+func (a *analysis) trackTie(st *ast.Step) {
+	switch st.Play.(type) {
+	case *ast.Rest:
+		a.tie = tieNothing
+	case *ast.Tie:
+		if a.tie == tieNothing {
+			a.warnf(st.Position, "tie (~) has no preceding note to extend")
+			a.tie = tieUnknown // one warning per run of ties
+		}
+	default:
+		a.tie = tieNote
 	}
 }
 
@@ -538,11 +903,23 @@ func (a *analysis) analyzeNoteRef(n *ast.NoteRef, sc *scope) {
 		if _, err := midi.PercussionKeyMap(val); err != nil {
 			a.errorf(n.Position, "kit alias %q maps to unknown percussion %q", text, val)
 		}
+		if len(n.Voicing) > 0 {
+			a.errorf(n.Voicing[0].Position, "cannot voice kit alias %q", text)
+		}
 		return
 	}
 	if sc.hasBinding(text) {
 		return
 	}
+	// A roman numeral or scale degree is checked as the note or chord it
+	// names in the active key.
+	if abs, ok := sc.key.ResolveDegree(text); ok {
+		if !resolvable(abs) {
+			a.errorf(n.Position, "%q in %s is %q, not a valid note or chord", text, sc.key, abs)
+			return
+		}
+		text = abs
+	}
 	// "^" forces a note and carries its octave (defaulting to 4): C^, C^5.
 	if i := strings.IndexByte(text, '^'); i >= 0 {
 		head, oct := text[:i], text[i+1:]
@@ -552,6 +929,8 @@ func (a *analysis) analyzeNoteRef(n *ast.NoteRef, sc *scope) {
 		if note, err := notes.Parse(head + oct); err == nil {
 			if m := note.MIDI(); m > 127 {
 				a.warnf(n.Position, "note %q resolves to MIDI %d, out of range (0..127)", text, m)
+			} else {
+				a.checkVoicing(n, []uint8{m})
 			}
 			return
 		}
@@ -560,11 +939,21 @@ func (a *analysis) analyzeNoteRef(n *ast.NoteRef, sc *scope) {
 	}
 	// A bare pitch (letter + accidentals only) is a note at the default octave.
 	if isBarePitch(text) {
+		if note, err := notes.Parse(text + "4"); err == nil {
+			a.checkVoicing(n, []uint8{note.MIDI()})
+		}
 		return
 	}
 	// Otherwise a quality/octave digit makes it a chord. (No note fallback: a
 	// bare octave like "C4" is a chord; the note is written "C^4".)
-	if _, err := chords.Parse(text); err == nil {
+	if ch, err := chords.Parse(text); err == nil {
+		if len(n.Voicing) > 0 {
+			var keys []uint8
+			for _, note := range ch.Notes() {
+				keys = append(keys, note.MIDI())
+			}
+			a.checkVoicing(n, keys)
+		}
 		return
 	}
 	// Slash chord whose bass is not a chord tone (e.g. "Dm7/G"): valid, but
@@ -587,6 +976,29 @@ func (a *analysis) analyzeNoteRef(n *ast.NoteRef, sc *scope) {
 	a.errorf(n.Position, "unknown note/chord/percussion %q", text)
 }
 
+// resolvable reports whether the spelling a roman numeral or scale degree
+// resolved to is a note or a chord go-harmony knows (check #28).
+func resolvable(text string) bool {
+	if i := strings.IndexByte(text, '^'); i >= 0 {
+		_, err := notes.Parse(text[:i] + text[i+1:])
+		return err == nil
+	}
+	_, err := chords.Parse(text)
+	return err == nil
+}
+
+// checkVoicing applies n's voicings to the keys its literal resolves to and
+// reports the first one that cannot apply (check #25).
+func (a *analysis) checkVoicing(n *ast.NoteRef, keys []uint8) {
+	for _, v := range n.Voicing {
+		var err error
+		if keys, err = value.Voice(keys, v); err != nil {
+			a.errorf(v.Position, "%s: %v", n.Text, err)
+			return
+		}
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Velocity (check #8)
 // ---------------------------------------------------------------------------
@@ -600,10 +1012,205 @@ func (a *analysis) checkVelocity(v *ast.Velocity) {
 	}
 }
 
+// checkController validates the controller of a cc (checks #3, #23): a name
+// from the controller table, a binding, or a number in 0..127.
+func (a *analysis) checkController(x ast.Expr, sc *scope) {
+	if id, ok := x.(*ast.Ident); ok {
+		if _, err := midi.ControllerNumber(id.Name); err == nil || sc.hasBinding(id.Name) {
+			return
+		}
+		a.errorf(id.Position, "unknown controller %q", id.Name)
+		return
+	}
+	a.analyzeExpr(x, sc)
+	if n, ok := constInt(x); ok && (n < 0 || n > 127) {
+		a.errorf(x.Pos(), "controller %d out of range (must be 0..127)", n)
+	}
+}
+
+// checkParam validates rpn, nrpn and cc14 (checks #3, #23, #24).
+func (a *analysis) checkParam(n *ast.Param, sc *scope) {
+	switch id, isIdent := n.Number.(*ast.Ident); {
+	case n.Kind == ast.ParamCC14:
+		a.checkController(n.Number, sc)
+		if c, ok := constInt(n.Number); ok && (c < 0 || c > 31) {
+			a.errorf(n.Number.Pos(), "cc14 controller %d out of range (must be 0..31)", c)
+		} else if isIdent {
+			if c, err := midi.ControllerNumber(id.Name); err == nil && c > 31 {
+				a.errorf(id.Position, "cc14 controller %s is %d, not a 14-bit controller (0..31)", id.Name, c)
+			}
+		}
+	case n.Kind == ast.ParamRPN && isIdent:
+		if _, err := midi.RPNNumber(id.Name); err != nil && !sc.hasBinding(id.Name) {
+			a.errorf(id.Position, "unknown registered parameter %q", id.Name)
+		}
+	default:
+		a.analyzeExpr(n.Number, sc)
+		if p, ok := constInt(n.Number); ok && (p < 0 || p > 16383) {
+			a.errorf(n.Number.Pos(), "parameter %d out of range (must be 0..16383)", p)
+		}
+	}
+	a.analyzeExpr(n.Value, sc)
+	if v, ok := constInt(n.Value); ok && (v < 0 || v > 16383) {
+		a.errorf(n.Value.Pos(), "14-bit value %d out of range (must be 0..16383)", v)
+	}
+}
+
+// checkMixer validates `volume 100;`, `pan -20;` and the like (check #23).
+func (a *analysis) checkMixer(n *ast.Mixer, sc *scope) {
+	a.analyzeExpr(n.Value, sc)
+	lo, hi := 0, 127
+	if n.Name == "pan" {
+		lo, hi = -64, 63
+	}
+	if v, ok := constInt(n.Value); ok && (v < lo || v > hi) {
+		a.errorf(n.Position, "%s %d out of range (must be %d..%d)", n.Name, v, lo, hi)
+	}
+}
+
+// checkPressure validates channel and poly pressure (checks #5, #23): the
+// value is a MIDI data byte in 0..127.
+func (a *analysis) checkPressure(n *ast.Pressure, sc *scope) {
+	if n.Key != nil {
+		a.analyzePlayable(n.Key, sc)
+	}
+	a.analyzeExpr(n.Value, sc)
+	if v, ok := constInt(n.Value); ok && (v < 0 || v > 127) {
+		a.errorf(n.Value.Pos(), "pressure %d out of range (must be 0..127)", v)
+	}
+}
+
+// analyzeRamp checks the tail of a cc or bend ramp (checks #3, #22), if any.
+func (a *analysis) analyzeRamp(pos token.Position, what string, r *ast.Ramp, sc *scope) {
+	if r == nil {
+		return
+	}
+	a.analyzeExpr(r.To, sc)
+	if r.Over.Note == 0 && r.Over.Bars <= 0 {
+		a.errorf(pos, "%s ramp over %g bars: the span must be positive", what, r.Over.Bars)
+	}
+}
+
+// checkHairpin validates a cresc/dim (checks #8, #20, #21).
+func (a *analysis) checkHairpin(n *ast.Hairpin) {
+	a.checkVelocity(n.From)
+	a.checkVelocity(n.To)
+	if n.Over.Note == 0 && n.Over.Bars <= 0 {
+		a.errorf(n.Position, "hairpin over %g bars: the span must be positive", n.Over.Bars)
+	}
+	from, to := hairpinLevel(n.From), hairpinLevel(n.To)
+	switch {
+	case n.Dim && to >= from:
+		a.warnf(n.Position, "dim from %s to %s does not get softer", levelText(n.From), levelText(n.To))
+	case !n.Dim && to <= from:
+		a.warnf(n.Position, "cresc from %s to %s does not get louder", levelText(n.From), levelText(n.To))
+	}
+}
+
+// hairpinLevel is the velocity a hairpin level stands for.
+func hairpinLevel(v *ast.Velocity) int {
+	if v.HasNumber {
+		return v.Number
+	}
+	return value.DynamicVelocity[v.Dynamic]
+}
+
+func levelText(v *ast.Velocity) string {
+	if v.HasNumber {
+		return fmt.Sprint(v.Number)
+	}
+	return v.Dynamic
+}
+
 // ---------------------------------------------------------------------------
 // Expressions (checks #1, #2, #3)
 // ---------------------------------------------------------------------------
 
+// analyzeCall checks a function call in expression position.
+func (a *analysis) analyzeCall(n *ast.Call, sc *scope) {
+	for _, arg := range n.Args {
+		a.analyzeExpr(arg, sc)
+	}
+	if fd, ok := sc.lookupFunc(n.Name); ok {
+		// Check #2: arg-count mismatch.
+		if len(n.Args) != len(fd.Params) {
+			a.errorf(n.Position, "function %q called with %d argument(s), expected %d", n.Name, len(n.Args), len(fd.Params))
+		}
+		return
+	}
+	if b, ok := value.Builtins[n.Name]; ok {
+		if len(n.Args) != len(b.Params) {
+			a.errorf(n.Position, "function %q called with %d argument(s), expected %d", n.Name, len(n.Args), len(b.Params))
+		}
+		return
+	}
+	if sc.hasBinding(n.Name) {
+		// a parameter or binding holding a function; known only when called
+		return
+	}
+	// Check #1: a pattern is a statement, not a value; anything else is unknown.
+	if _, ok := sc.lookupPattern(n.Name); ok {
+		a.errorf(n.Position, "pattern %q cannot be called as a value (patterns are statements)", n.Name)
+		return
+	}
+	a.errorf(n.Position, "call to undefined function %q", n.Name)
+}
+
+// analyzeIndex analyzes a list index or slice bound. An unbound name there is
+// reported even when it reads as a roman numeral: `xs[i]` is a missing loop
+// variable, not the tonic chord.
+func (a *analysis) analyzeIndex(e ast.Expr, sc *scope) {
+	if id, ok := e.(*ast.Ident); ok {
+		if _, isFunc := sc.lookupFunc(id.Name); !sc.hasBinding(id.Name) && !isFunc {
+			a.errorf(id.Position, "undefined binding %q", id.Name)
+			return
+		}
+	}
+	a.analyzeExpr(e, sc)
+}
+
+// checkIndexed applies check #15 to x[idx] or x[lo..hi]: what is known
+// before elaboration, literals, is checked here; the rest when evaluated.
+func (a *analysis) checkIndexed(x ast.Expr, idxs ...ast.Expr) {
+	switch x.(type) {
+	case *ast.NumberLit, *ast.BoolLit, *ast.StringLit, *ast.MusicLit, *ast.IntervalLit, *ast.DynamicLit:
+		a.errorf(x.Pos(), "cannot index a literal that is not a list")
+		return
+	}
+	list, isList := x.(*ast.ListLit)
+	for _, idx := range idxs {
+		switch idx.(type) {
+		case *ast.BoolLit, *ast.StringLit, *ast.MusicLit, *ast.IntervalLit, *ast.ListLit:
+			a.errorf(idx.Pos(), "list index must be a number")
+			continue
+		case *ast.NumberLit:
+			if v := idx.(*ast.NumberLit).Value; v != float64(int(v)) {
+				a.errorf(idx.Pos(), "list index %g is not a whole number", v)
+				continue
+			}
+		}
+		i, ok := constInt(idx)
+		if !ok || !isList {
+			continue
+		}
+		if n := len(list.Elements); i >= n || i < -n {
+			a.errorf(idx.Pos(), "index %d out of range for a list of %d", i, n)
+		}
+	}
+}
+
+// constInt reports the value of a whole-number literal, possibly negated.
+func constInt(e ast.Expr) (int, bool) {
+	sign := 1
+	if u, ok := e.(*ast.Unary); ok && u.Op == token.MINUS {
+		sign, e = -1, u.Operand
+	}
+	if n, ok := e.(*ast.NumberLit); ok && n.Value == float64(int(n.Value)) {
+		return sign * int(n.Value), true
+	}
+	return 0, false
+}
+
 func (a *analysis) analyzeExpr(e ast.Expr, sc *scope) {
 	switch n := e.(type) {
 	case nil:
@@ -612,12 +1219,17 @@ func (a *analysis) analyzeExpr(e ast.Expr, sc *scope) {
 		// Check #3: a bare identifier in expression position must be a known
 		// binding. MusicLit / IntervalLit / DynamicLit are classified by the
 		// parser and are NOT idents.
-		if !sc.hasBinding(n.Name) {
+		if _, isFunc := sc.lookupFunc(n.Name); !sc.hasBinding(n.Name) && !isFunc {
+			if abs, ok := sc.key.ResolveDegree(n.Name); ok {
+				if !resolvable(abs) {
+					a.errorf(n.Position, "%q in %s is %q, not a valid note or chord", n.Name, sc.key, abs)
+				}
+				return
+			}
 			a.errorf(n.Position, "undefined binding %q", n.Name)
 		}
 	case *ast.Call:
-		// A pattern call in expression position: same checks as a statement call.
-		a.analyzePatternCall(n.Position, n.Name, n.Args, sc)
+		a.analyzeCall(n, sc)
 	case *ast.Unary:
 		a.analyzeExpr(n.Operand, sc)
 	case *ast.Binary:
@@ -626,11 +1238,27 @@ func (a *analysis) analyzeExpr(e ast.Expr, sc *scope) {
 	case *ast.Range:
 		a.analyzeExpr(n.Lo, sc)
 		a.analyzeExpr(n.Hi, sc)
+		a.analyzeExpr(n.Step, sc)
+		// Check #16: the stride is a whole number; its sign sets the direction.
+		if lit, ok := n.Step.(*ast.NumberLit); ok && (lit.Value == 0 || lit.Value != float64(int(lit.Value))) {
+			a.errorf(lit.Position, "range step must be a non-zero whole number, got %g", lit.Value)
+		} else if i, ok := constInt(n.Step); ok && i == 0 {
+			a.errorf(n.Step.Pos(), "range step must be a non-zero whole number, got %d", i)
+		}
+	case *ast.Index:
+		a.analyzeExpr(n.X, sc)
+		a.analyzeIndex(n.Index, sc)
+		a.checkIndexed(n.X, n.Index)
+	case *ast.Slice:
+		a.analyzeExpr(n.X, sc)
+		a.analyzeIndex(n.Lo, sc)
+		a.analyzeIndex(n.Hi, sc)
+		a.checkIndexed(n.X, n.Lo, n.Hi)
 	case *ast.ListLit:
 		for _, el := range n.Elements {
 			a.analyzeExpr(el, sc)
 		}
-	case *ast.NumberLit, *ast.BoolLit, *ast.MusicLit, *ast.IntervalLit, *ast.DynamicLit:
+	case *ast.NumberLit, *ast.BoolLit, *ast.StringLit, *ast.MusicLit, *ast.IntervalLit, *ast.DynamicLit:
 		// literals — nothing to resolve
 	}
 }
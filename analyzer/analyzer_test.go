@@ -436,3 +436,377 @@ func TestClean_FullMidiPrimitives(t *testing.T) {
 	}`)
 	wantClean(t, ds)
 }
+
+func TestTempoRampChecks(t *testing.T) {
+	ds := analyze(t, `project "p" {
+		track "t" instrument "piano" {
+			bpm 120 to 0 over 2 bars;
+			bpm 120 to 90 over 0 bars;
+			bar 4 { C D E F }
+		}
+	}`)
+	wantMsg(t, ds, Error, "tempo must be positive")
+	wantMsg(t, ds, Error, "the span must be positive")
+	wantClean(t, analyze(t, `project "p" {
+		track "t" instrument "piano" {
+			bpm 120 to 90 over 2 bars curve exp;
+			bar 4 { C D E F }
+		}
+	}`))
+}
+
+func TestCompoundAndOddMeters(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { time 6 8;
+		track "t" instrument "piano" {
+			bar 8 { C D E F G A }
+			bar 8 { on beat 2 C }
+			time 7 8;
+			bar 8 { C D E F G A B }
+			time 12 8;
+			bar 8 { C*12 }
+		}
+	}`))
+	ds := analyze(t, `project "p" { time 6 8;
+		track "t" instrument "piano" {
+			bar 8 { C D E F G A B }
+			bar 8 { on beat 3 C }
+		}
+	}`)
+	wantMsg(t, ds, Error, "bar overflows: 1 steps")
+	wantMsg(t, ds, Warning, "beat 3 out of range (must be 1..2)")
+}
+
+func TestAdditiveMeter(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { time 3+3+2 8;
+		track "t" instrument "piano" { bar 8 { C*8 } bar 8 { on beat 3 C } }
+	}`))
+	ds := analyze(t, `project "p" { time 2+2+3 8;
+		track "t" instrument "piano" { bar 8 { C*8 } bar 8 { on beat 4 C } }
+	}`)
+	wantMsg(t, ds, Error, "bar overflows")
+	wantMsg(t, ds, Warning, "must be 1..3")
+
+	ds = analyze(t, `project "p" { time 3+0 8;
+		track "t" instrument "piano" { time 0+2 4; bar 8 { C } }
+	}`)
+	wantMsg(t, ds, Error, "additive meter groups must be at least 1, got 0")
+	if len(ds) != 2 {
+		t.Errorf("want one diagnostic per meter, got:\n%s", dump(ds))
+	}
+}
+
+func TestTieWithNothingToExtend(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" {
+		track "t" instrument "piano" {
+			bar 4 { C D E F }
+			bar 4 { ~ ~ G A }
+		}
+	}`))
+	for _, src := range []string{
+		`project "p" { track "t" instrument "piano" { bar 4 { ~ C D E } } }`,
+		`project "p" { track "t" instrument "piano" { bar 4 { C D E _ } bar 4 { ~ C D E } } }`,
+		`project "p" { track "t" instrument "piano" { bar 4 { C D cc 1 = 0; _ } bar 4 { ~ C D E } } }`,
+	} {
+		wantMsg(t, analyze(t, src), Warning, "tie (~) has no preceding note to extend")
+	}
+	// After control flow the analyzer cannot tell, so it stays quiet.
+	wantClean(t, analyze(t, `project "p" {
+		track "t" instrument "piano" {
+			for i in 1..2 { bar 4 { C D E F } }
+			bar 4 { ~ G A B }
+		}
+	}`))
+}
+
+func TestTupletCounting(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { track "t" instrument "piano" {
+		bar quarter { 3:2 { C D E } F G }
+		bar 8 { 3:2 { C D E } 5:4 { C*5 } C D }
+	} }`))
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+		bar quarter { 3:2 { C D E } F G A }
+		bar quarter { 3:2 { C D } F G }
+		bar quarter { 3:0 { C D E } }
+	} }`)
+	wantMsg(t, ds, Error, "bar overflows")
+	wantMsg(t, ds, Warning, "tuplet 3:2 holds 2 steps")
+	wantMsg(t, ds, Error, "invalid tuplet 3:0")
+}
+
+func TestImportedPatterns(t *testing.T) {
+	lib := `pattern helper { bar quarter { C D E F } }
+pattern groove(n) { helper missing }`
+	l := &parser.Loader{ReadFile: func(string) ([]byte, error) { return []byte(lib), nil }}
+	prog, perrs := l.Load(`import "lib.ear" as lib;
+project "p" { track "t" instrument "piano" {
+	lib.groove(C)
+	lib.groove
+	helper
+} }`, "song.ear")
+	if len(perrs) != 0 {
+		t.Fatalf("load diagnostics: %v", perrs)
+	}
+	ds := Analyze(prog)
+	wantMsg(t, ds, Error, `pattern "lib.groove" called with 0 argument(s), expected 1`)
+	wantMsg(t, ds, Error, `call to undefined pattern "helper"`)
+	// A library's own findings carry the library's file name.
+	for _, d := range ds {
+		if strings.Contains(d.Msg, `"missing"`) && d.Pos.Filename != "lib.ear" {
+			t.Errorf("library diagnostic in %q, want lib.ear: %s", d.Pos.Filename, d)
+		}
+	}
+	wantMsg(t, ds, Error, `undefined pattern "missing"`)
+}
+
+func TestFunctions(t *testing.T) {
+	ds := analyze(t, `fn pair(a, b) = [a, b];
+fn fall(n) = fall(n); // recursion is legal; the elaborator bounds its depth
+pattern riff { bar quarter { C } }
+project "p" { track "t" instrument "piano" {
+	let x = pair(C);
+	let y = nope(1);
+	let z = riff(2);
+	fn up(n) = n + octave;
+	let w = up(pair(C, D));
+} }`)
+	wantMsg(t, ds, Error, `function "pair" called with 1 argument(s), expected 2`)
+	wantMsg(t, ds, Error, `call to undefined function "nope"`)
+	wantMsg(t, ds, Error, `pattern "riff" cannot be called as a value`)
+	if len(ds) != 3 {
+		t.Errorf("want exactly 3 diagnostics, got:\n%s", dump(ds))
+	}
+}
+
+func TestBuiltinArity(t *testing.T) {
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+	let a = transpose([C, E], maj2);
+	let b = scale(D);
+	let c = root(Dm7, 1);
+} }`)
+	wantMsg(t, ds, Error, `function "scale" called with 1 argument(s), expected 2`)
+	wantMsg(t, ds, Error, `function "root" called with 2 argument(s), expected 1`)
+	if len(ds) != 2 {
+		t.Errorf("want exactly 2 diagnostics, got:\n%s", dump(ds))
+	}
+
+	// a user function shadows the built-in of the same name
+	wantClean(t, analyze(t, `fn len(a, b) = a + b;
+project "p" { track "t" instrument "piano" { let n = len(1, 2); } }`))
+}
+
+func TestCheck15_Indexing(t *testing.T) {
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+	let xs = [C, E, G];
+	let a = xs[i];
+	let b = [C, E, G][3];
+	let c = xs[C];
+	let d = xs[0.5..1];
+	let e = C[0];
+	let f = [C, E, G][-3] ;
+} }`)
+	wantMsg(t, ds, Error, `undefined binding "i"`)
+	wantMsg(t, ds, Error, `index 3 out of range for a list of 3`)
+	wantMsg(t, ds, Error, `list index must be a number`)
+	wantMsg(t, ds, Error, `list index 0.5 is not a whole number`)
+	wantMsg(t, ds, Error, `cannot index a literal that is not a list`)
+	if len(ds) != 5 {
+		t.Errorf("want exactly 5 diagnostics, got:\n%s", dump(ds))
+	}
+}
+
+func TestCheck16_ForIndexAndStep(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { track "t" instrument "piano" {
+	let changes = [Am7, D7];
+	for i, ch in changes { if i % 2 == 0 { bar quarter { ch } } }
+	for i in 16..1 step -4 { bar quarter { C } }
+} }`))
+
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+	for i in 1..8 step 0 { }
+	for i in 1..8 step 1.5 { }
+	for i, i in [C] { }
+} }`)
+	wantMsg(t, ds, Error, `range step must be a non-zero whole number, got 0`)
+	wantMsg(t, ds, Error, `range step must be a non-zero whole number, got 1.5`)
+	wantMsg(t, ds, Error, `loop index and element are both named "i"`)
+}
+
+func TestCheck17_Humanize(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { track "t" instrument "piano" {
+	humanize timing 50% velocity 127 gate 100%;
+	humanize timing 200;
+} }`))
+
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+	humanize timing 60%;
+	humanize gate 120% velocity 200;
+} }`)
+	wantMsg(t, ds, Error, `humanize timing 60% could swap steps; expected at most 50%`)
+	wantMsg(t, ds, Error, `humanize gate 120% out of range; expected at most 100%`)
+	wantMsg(t, ds, Error, `humanize velocity 200 out of range; expected at most 127`)
+}
+
+func TestCheck18_19_Arp(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { track "t" instrument "piano" {
+	bar 8 { C D arp Cmaj7 rate 4 }
+	bar { arp Am7 rate 16 over half  arp G7 rate 8 }
+} }`))
+
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+	bar 8 { arp Cmaj7 rate whole over half }
+	bar 8 { C C C C C arp C rate quarter }
+	bar 8 { C*8 arp C }
+	bar 8 { arp C gate 0% }
+} }`)
+	wantMsg(t, ds, Error, `arp rate 1/1 is longer than the 1/2 it lasts`)
+	wantMsg(t, ds, Warning, `arp rate 1/4 does not divide the 3/8 left in the bar evenly; its last step is cut short`)
+	wantMsg(t, ds, Warning, `arp has no room left in the bar`)
+	wantMsg(t, ds, Error, `arp gate 0% out of range; expected 1 to 100%`)
+}
+
+func TestCheck20_21_Hairpin(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { track "t" instrument "piano" {
+	cresc p to ff over 2 bars;
+	dim ff to 40 over quarter;
+} }`))
+
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+	cresc p to ff over 0 bars;
+	cresc f to p over 1 bar;
+	dim 40 to 90 over 1 bar;
+	dim mf to 200 over 1 bar;
+} }`)
+	wantMsg(t, ds, Error, `hairpin over 0 bars: the span must be positive`)
+	wantMsg(t, ds, Warning, `cresc from f to p does not get louder`)
+	wantMsg(t, ds, Warning, `dim from 40 to 90 does not get softer`)
+	wantMsg(t, ds, Error, `velocity 200 out of range (must be 0..127)`)
+}
+
+func TestCheck22_Ramps(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { track "t" instrument "piano" {
+	let top = 127;
+	cc 74 from 0 to top over 2 bars;
+	bar 4 { C bend 0 to +2 over quarter }
+} }`))
+
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+	cc 74 from 0 to 127 over 0 bars;
+	bar 4 { C bend 0 to nowhere over quarter }
+} }`)
+	wantMsg(t, ds, Error, `cc ramp over 0 bars: the span must be positive`)
+	wantMsg(t, ds, Error, `undefined binding "nowhere"`)
+}
+
+func TestCheck23_Controllers(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { track "t" instrument "piano" {
+	volume 100;
+	pan -64;
+	let c = 74;
+	cc c = 10;
+	pressure 0;
+	bar 4 { C cc cutoff = 64 cc 127 = 0 on beat 2 pressure C^4 = 127; }
+} }`))
+
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+	pan 80;
+	volume -1;
+	cc wobble = 3;
+	pressure 128;
+	bar 4 { C cc 128 = 0 on beat 2 pressure E^4 = -5; }
+} }`)
+	wantMsg(t, ds, Error, `pan 80 out of range (must be -64..63)`)
+	wantMsg(t, ds, Error, `volume -1 out of range (must be 0..127)`)
+	wantMsg(t, ds, Error, `unknown controller "wobble"`)
+	wantMsg(t, ds, Error, `controller 128 out of range (must be 0..127)`)
+	wantMsg(t, ds, Error, `pressure 128 out of range (must be 0..127)`)
+	wantMsg(t, ds, Error, `pressure -5 out of range (must be 0..127)`)
+}
+
+func TestCheck25_Voicings(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { track "t" instrument "piano" {
+	let ch = Cmaj;
+	bar 4 { Cmaj7 inv 3 C7 drop 3 ch drop 4 Dm7 open octave 2 }
+} }`))
+
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+	kit { sn = "acoustic snare"; }
+	bar 4 { sn inv 1 Cmaj drop 4 Cmaj7 octave 9 C inv 1 }
+} }`)
+	wantMsg(t, ds, Error, `cannot voice kit alias "sn"`)
+	wantMsg(t, ds, Error, `Cmaj: drop 4 needs a chord of at least 4 tones, this one has 3`)
+	wantMsg(t, ds, Error, `Cmaj7: octave 9 is out of MIDI range`)
+}
+
+func TestCheck26_VoiceLead(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { track "t" instrument "piano" {
+	let lo = C^3;
+	voicelead { bar 4 { Dm7 G7 Cmaj7 _ } }
+	voicelead lo to C^4 { bar 4 { Dm7 G7 Cmaj7 _ } }
+	voicelead 40 to 64 { bar 1 { C } }
+} }`))
+
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+	voicelead C^3 to A^3 { bar 1 { C } }
+	voicelead Cmaj to 80 { bar 1 { C } }
+	voicelead { bar 1 { nope } }
+} }`)
+	wantMsg(t, ds, Error, `voicelead range 48..57 is narrower than an octave`)
+	wantMsg(t, ds, Error, `voicelead range ends must be notes or MIDI keys, got a chord`)
+	wantMsg(t, ds, Warning, `unrecognized chord/note spelling "nope"`)
+}
+
+func TestCheck27_Key(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { key D minor; track "t" instrument "piano" {
+	key Bb;
+	key F# dorian;
+	bar 1 { C }
+} }`))
+
+	ds := analyze(t, `project "p" { key H minor; track "t" instrument "piano" {
+	key D blues;
+	key G# major;
+	bar 1 { C }
+} }`)
+	wantMsg(t, ds, Error, `"H" is not a tonic; expected a note name such as D, Bb or F#`)
+	wantMsg(t, ds, Error, `unknown key mode "blues"`)
+	wantMsg(t, ds, Error, `G# major has no key signature: it would need 8 sharps`)
+}
+
+func TestCheck28_Degrees(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { key D minor; track "t" instrument "piano" {
+	let prog = [ii7, V7, i];
+	bar 1 { bVII }
+	bar quarter { ^1 b3 #7 (v) }
+	for ch in prog { bar 1 { ch inv 1 } }
+} }`))
+
+	ds := analyze(t, `project "p" { key Eb; track "t" instrument "piano" {
+	let x = ii13;
+	bar 1 { Vadd11 }
+} }`)
+	wantMsg(t, ds, Error, `"ii13" in Eb major is "Fm13", not a valid note or chord`)
+	wantMsg(t, ds, Error, `"Vadd11" in Eb major is "Bbadd11", not a valid note or chord`)
+}
+
+func TestCheck24_Params(t *testing.T) {
+	wantClean(t, analyze(t, `project "p" { track "t" instrument "piano" {
+	let p = 5;
+	rpn finetune = 8192 reset;
+	rpn p = 0;
+	nrpn 16383 = 16383;
+	bar 4 { C cc14 modulation = 9000 cc14 31 = 0 }
+} }`))
+
+	ds := analyze(t, `project "p" { track "t" instrument "piano" {
+	rpn wobble = 0;
+	nrpn 16384 = 0;
+	rpn 0 = -1;
+	cc14 32 = 0;
+	cc14 sustain = 0;
+} }`)
+	wantMsg(t, ds, Error, `unknown registered parameter "wobble"`)
+	wantMsg(t, ds, Error, `parameter 16384 out of range (must be 0..16383)`)
+	wantMsg(t, ds, Error, `14-bit value -1 out of range (must be 0..16383)`)
+	wantMsg(t, ds, Error, `cc14 controller 32 out of range (must be 0..31)`)
+	wantMsg(t, ds, Error, `cc14 controller sustain is 64, not a 14-bit controller (0..31)`)
+}
@@ -7,7 +7,11 @@
 // flow, pattern calls, and raw events; a Bar holds step-grid items.
 package ast
 
-import "github.com/poolpOrg/earmuff/token"
+import (
+	"strconv"
+
+	"github.com/poolpOrg/earmuff/token"
+)
 
 // Node is implemented by every AST node.
 type Node interface {
@@ -21,20 +25,81 @@ type Node interface {
 // Program is the whole source file.
 type Program struct {
 	Position token.Position
-	Items    []Item // projects and top-level pattern definitions
+	Items    []Item // imports, projects, and top-level pattern and function definitions
 }
 
 func (n *Program) Pos() token.Position { return n.Position }
 
-// Item is a top-level construct (Project or PatternDef).
+// Patterns returns the pattern definitions visible at the top level of the
+// file: those of its resolved imports, qualified as `alias.name` when the
+// import is namespaced, then its own, which shadow imported ones of the same
+// name.
+func (n *Program) Patterns() map[string]*PatternDef {
+	out := map[string]*PatternDef{}
+	for _, it := range n.Items {
+		if imp, ok := it.(*Import); ok && imp.Program != nil {
+			for name, pd := range imp.Program.Patterns() {
+				if imp.Alias != "" {
+					name = imp.Alias + "." + name
+				}
+				out[name] = pd
+			}
+		}
+	}
+	for _, it := range n.Items {
+		if pd, ok := it.(*PatternDef); ok && pd != nil {
+			out[pd.Name] = pd
+		}
+	}
+	return out
+}
+
+// Funcs returns the functions visible at the top level of the file, resolved
+// like Patterns: imported ones (qualified for a namespaced import), then the
+// file's own.
+func (n *Program) Funcs() map[string]*FuncDef {
+	out := map[string]*FuncDef{}
+	for _, it := range n.Items {
+		if imp, ok := it.(*Import); ok && imp.Program != nil {
+			for name, fd := range imp.Program.Funcs() {
+				if imp.Alias != "" {
+					name = imp.Alias + "." + name
+				}
+				out[name] = fd
+			}
+		}
+	}
+	for _, it := range n.Items {
+		if fd, ok := it.(*FuncDef); ok && fd != nil {
+			out[fd.Name] = fd
+		}
+	}
+	return out
+}
+
+// Item is a top-level construct (Import, Project, PatternDef or FuncDef).
 type Item interface{ Node }
 
+// Import pulls the pattern and function definitions of another file into this
+// one:
+// `import "lib/grooves.ear";`, or namespaced, `import "lib/grooves.ear" as
+// grooves;` whose patterns are then called as `grooves.bossa()`.
+type Import struct {
+	Position token.Position
+	Path     string   // as written; a relative path is relative to the importing file
+	Alias    string   // namespace; "" imports the names unqualified
+	Program  *Program // the imported file, set by parser.Loader; nil if unresolved
+}
+
+func (n *Import) Pos() token.Position { return n.Position }
+
 // Project is a named collection of settings and tracks.
 type Project struct {
 	Position token.Position
 	Name     string
 	Settings []Setting // bpm/time/copyright/text encountered at project scope
 	Patterns []*PatternDef
+	Funcs    []*FuncDef
 	Tracks   []*Track
 }
 
@@ -44,16 +109,48 @@ func (n *Project) Pos() token.Position { return n.Position }
 type Setting struct {
 	Position token.Position
 	Kind     SettingKind
-	// Number holds bpm; TimeBeats/TimeUnit hold a time signature; Text holds a
-	// string for copyright/text.
+	// Number holds bpm or a random seed; TimeBeats/TimeUnit hold a time
+	// signature; Text holds a string for copyright/text.
 	Number    float64
 	TimeBeats int
 	TimeUnit  int
 	Text      string
+	// TimeGroups holds the summands of an additive meter (`time 3+3+2 8` has
+	// groups 3, 3, 2 and TimeBeats 8); nil for a plain time signature.
+	TimeGroups []int
+	// Ramp is set for a gradual tempo change (`bpm 120 to 90 over 4 bars`);
+	// Number then holds the starting tempo.
+	Ramp *TempoRamp
+	// Tonic and Mode hold a key signature (`key D minor` has tonic "D" and
+	// mode "minor"); Mode is "major" when the source leaves it out.
+	Tonic string
+	Mode  string
 }
 
 func (n *Setting) Pos() token.Position { return n.Position }
 
+// TempoRamp is the `to <bpm> over <span> [curve <shape>]` tail of a bpm setting.
+type TempoRamp struct {
+	To    float64
+	Over  Span
+	Curve Curve
+}
+
+// Span is the length of a ramp: a number of bars (`over 4 bars`) or a single
+// note value (`over quarter`, `over 2`). Exactly one of Bars and Note is set.
+type Span struct {
+	Bars float64
+	Note int
+}
+
+// Curve is the shape of a ramp between its endpoints.
+type Curve int
+
+const (
+	CurveLinear Curve = iota // equal steps per tick
+	CurveExp                 // equal ratios per tick
+)
+
 // SettingKind distinguishes the Setting variants.
 type SettingKind int
 
@@ -62,6 +159,8 @@ const (
 	SettingTime
 	SettingCopyright
 	SettingText
+	SettingSeed
+	SettingKey
 )
 
 // ---------------------------------------------------------------------------
@@ -92,6 +191,18 @@ type PatternDef struct {
 
 func (n *PatternDef) Pos() token.Position { return n.Position }
 
+// FuncDef is a pure, elaboration-time function: `fn name(params) = expr;`.
+// Calling it evaluates Body with the parameters bound, in the scope the
+// function was defined in (a closure over the `let` bindings there).
+type FuncDef struct {
+	Position token.Position
+	Name     string
+	Params   []string
+	Body     Expr
+}
+
+func (n *FuncDef) Pos() token.Position { return n.Position }
+
 // Stmt is anything that can appear in a track or pattern body.
 type Stmt interface{ Node }
 
@@ -120,15 +231,29 @@ type Let struct {
 func (n *Let) Pos() token.Position { return n.Position }
 
 // For iterates a bound name over a range or list, elaborating Body each round.
+// `for i, ch in xs` also binds Index to each element's 0-based position.
 type For struct {
 	Position token.Position
-	Var      string
-	Iterable Expr // a Range, ListLit, or expr evaluating to a list
+	Index    string // "" unless enumerated
+	Var      string // "" for `for each`
+	Iterable Expr   // a Range, ListLit, or expr evaluating to a list
 	Body     []Stmt
 }
 
 func (n *For) Pos() token.Position { return n.Position }
 
+// VoiceLead voices each chord sounded in Body, unless it is voiced
+// explicitly, at the inversion and octave that moves least from the chord
+// before it, keeping every tone between Lo and Hi (nil for the default
+// range).
+type VoiceLead struct {
+	Position token.Position
+	Lo, Hi   Expr // notes or MIDI keys; both nil or both set
+	Body     []Stmt
+}
+
+func (n *VoiceLead) Pos() token.Position { return n.Position }
+
 // If is structured, elaboration-time conditional flow.
 type If struct {
 	Position token.Position
@@ -151,10 +276,50 @@ type Swing struct {
 
 func (n *Swing) Pos() token.Position { return n.Position }
 
+// Humanize sets random variations for the steps that follow it in a track
+// body: each onset moves by up to ±Timing, each velocity by up to ±Velocity,
+// and each gate by up to ±Gate. Like Swing it is a running modifier; `humanize
+// off` (all amounts zero) turns it back off.
+type Humanize struct {
+	Position token.Position
+	Timing   Jitter  // ticks, or percent of the step
+	Velocity float64 // MIDI velocity units
+	Gate     Jitter  // ticks, or percent of the gate
+}
+
+func (n *Humanize) Pos() token.Position { return n.Position }
+
+// Off reports whether n varies nothing.
+func (n *Humanize) Off() bool {
+	return n.Timing.Amount == 0 && n.Velocity == 0 && n.Gate.Amount == 0
+}
+
+// Jitter is the largest random deviation of a humanized timing or gate: Amount
+// ticks, or Amount percent of the step or gate when Percent is set.
+type Jitter struct {
+	Amount  float64
+	Percent bool
+}
+
+// Hairpin is a crescendo or diminuendo starting where it appears in a track
+// body: `cresc p to ff over 2 bars`. The velocity of each note onset in the
+// span is interpolated from From to To, and To holds afterwards until the next
+// hairpin. With Expression set, CC 11 follows the same ramp.
+type Hairpin struct {
+	Position   token.Position
+	Dim        bool // written `dim` rather than `cresc`
+	From, To   *Velocity
+	Over       Span
+	Curve      Curve
+	Expression bool
+}
+
+func (n *Hairpin) Pos() token.Position { return n.Position }
+
 // PatternCall invokes a defined pattern with arguments.
 type PatternCall struct {
 	Position token.Position
-	Name     string
+	Name     string // qualified (`grooves.bossa`) for a namespaced import
 	Args     []Expr
 }
 
@@ -201,6 +366,60 @@ type GridSwitch struct {
 
 func (n *GridSwitch) Pos() token.Position { return n.Position }
 
+// Tuplet plays its steps as Actual notes in the time of Normal steps of the
+// current grid: `3:2 { C D E }` is a triplet spanning two steps.
+type Tuplet struct {
+	Position token.Position
+	Actual   int
+	Normal   int
+	Steps    []*Step
+}
+
+func (n *Tuplet) Pos() token.Position { return n.Position }
+
+// Arp arpeggiates a chord or note group: `arp Am7 up-down octaves 2 rate 16
+// gate 50%`. The tones of Play, ordered by Mode and repeated an octave higher
+// for each of Octaves, sound one per Rate note value, cycling, for Over or to
+// the end of the bar.
+type Arp struct {
+	Position token.Position
+	Play     Playable
+	Mode     ArpMode
+	Octaves  int     // octaves spanned; 1 = the tones as written
+	Rate     int     // note value of each arp step; 0 = the current grid step
+	Gate     float64 // sounding length, percent of a step
+	Over     int     // note value the arp lasts; 0 = to the end of the bar
+	Velocity *Velocity
+}
+
+func (n *Arp) Pos() token.Position { return n.Position }
+
+// ArpMode is the order in which an Arp plays its tones.
+type ArpMode int
+
+const (
+	ArpUp       ArpMode = iota // lowest to highest
+	ArpDown                    // highest to lowest
+	ArpUpDown                  // up, then back down without repeating the ends
+	ArpRandom                  // a seeded random tone each step
+	ArpAsPlayed                // the order the tones are written in
+)
+
+// ArpModeNames maps each mode's source spelling to the mode.
+var ArpModeNames = map[string]ArpMode{
+	"up": ArpUp, "down": ArpDown, "up-down": ArpUpDown,
+	"random": ArpRandom, "as-played": ArpAsPlayed,
+}
+
+func (m ArpMode) String() string {
+	for name, mode := range ArpModeNames {
+		if mode == m {
+			return name
+		}
+	}
+	return "ArpMode(?)"
+}
+
 // BarSep is the optional `|` separator (also terminates a grid region).
 type BarSep struct{ Position token.Position }
 
@@ -229,6 +448,7 @@ type NoteRef struct {
 	Position token.Position
 	Text     string // exact lexed text: "C#", "Am7", "hh", ...
 	Channel  int    // @channel override; -1 if none
+	Voicing  []Voicing
 }
 
 func (n *NoteRef) Pos() token.Position { return n.Position }
@@ -257,23 +477,101 @@ type ExprPlay struct {
 	Position token.Position
 	Value    Expr
 	Channel  int // @channel override; -1 if none
+	Voicing  []Voicing
 }
 
 func (n *ExprPlay) Pos() token.Position { return n.Position }
 
+// Voicing rearranges the tones of a chord once it resolves, e.g. the `inv 2`
+// of `Cmaj7 inv 2`. A playable's voicings apply in the order written.
+type Voicing struct {
+	Position token.Position
+	Kind     VoicingKind
+	N        int // the inversion, dropped voice or octave; unused by open
+}
+
+// VoicingKind is what a Voicing does to a chord.
+type VoicingKind int
+
+const (
+	VoiceInvert VoicingKind = iota // inv N: the N lowest tones up an octave
+	VoiceDrop                      // drop N: the Nth tone from the top down an octave
+	VoiceOpen                      // open: every other tone from the bottom up an octave
+	VoiceOctave                    // octave N: the lowest tone into octave N
+)
+
+// VoicingNames maps each voicing's source word to its kind.
+var VoicingNames = map[string]VoicingKind{
+	"inv": VoiceInvert, "drop": VoiceDrop, "open": VoiceOpen, "octave": VoiceOctave,
+}
+
+func (v Voicing) String() string {
+	for name, kind := range VoicingNames {
+		if kind == v.Kind {
+			if kind == VoiceOpen {
+				return name
+			}
+			return name + " " + strconv.Itoa(v.N)
+		}
+	}
+	return "Voicing(?)"
+}
+
 // ---------------------------------------------------------------------------
 // Raw MIDI / meta event statements
 // ---------------------------------------------------------------------------
 
-// CC is a control-change event.
+// CC is a control-change event, or a ramp of them when Ramp is set
+// (`cc 74 from 0 to 127 over 2 bars`).
 type CC struct {
 	Position   token.Position
 	Controller Expr // number or named-CC ident
 	Value      Expr
+	Ramp       *Ramp
 }
 
 func (n *CC) Pos() token.Position { return n.Position }
 
+// ParamKind distinguishes the Param variants.
+type ParamKind int
+
+const (
+	ParamRPN  ParamKind = iota // rpn finetune = 8192
+	ParamNRPN                  // nrpn 300 = 64
+	ParamCC14                  // cc14 modulation = 9000
+)
+
+// Param writes a 14-bit Value: to a registered (RPN) or non-registered (NRPN)
+// parameter, or to a controller and its LSB partner 32 above (cc14). Number
+// is the parameter or controller, a number or a name. Reset ends an rpn or
+// nrpn with the null RPN so later data entry goes nowhere.
+type Param struct {
+	Position token.Position
+	Kind     ParamKind
+	Number   Expr
+	Value    Expr
+	Reset    bool
+}
+
+func (n *Param) Pos() token.Position { return n.Position }
+
+// Mixer is a channel-mixer statement in a track body: `volume 100;`, `pan
+// -20;`. It sends the controller of the same name where it stands, usually
+// the start of the track. Pan runs from -64 (left) through 0 to 63 (right);
+// the others take 0..127.
+type Mixer struct {
+	Position token.Position
+	Name     string // one of MixerNames
+	Value    Expr
+}
+
+func (n *Mixer) Pos() token.Position { return n.Position }
+
+// MixerNames are the words that start a Mixer statement.
+var MixerNames = map[string]bool{
+	"volume": true, "pan": true, "expression": true, "reverb": true, "chorus": true,
+}
+
 // BendMode distinguishes the bend variants.
 type BendMode int
 
@@ -283,18 +581,33 @@ const (
 	BendRange                     // bend range 12
 )
 
-// Bend is a pitch-bend event.
+// Bend is a pitch-bend event, or a ramp of them when Ramp is set
+// (`bend 0 to +2 over quarter`).
 type Bend struct {
 	Position token.Position
 	Mode     BendMode
 	Value    Expr
+	Ramp     *Ramp
 }
 
 func (n *Bend) Pos() token.Position { return n.Position }
 
-// Pressure is channel aftertouch.
+// Ramp is the `to <value> over <span> [curve <shape>] [every <duration>]`
+// tail that turns a cc or bend into a stream of events moving from its Value
+// to To. Every is the spacing of the events as a note value, 0 for the
+// default.
+type Ramp struct {
+	To    Expr
+	Over  Span
+	Curve Curve
+	Every int
+}
+
+// Pressure is channel aftertouch (`pressure 90`), or polyphonic aftertouch
+// on the keys of Key when it is set (`pressure C^4 = 90`).
 type Pressure struct {
 	Position token.Position
+	Key      Playable // nil for channel pressure
 	Value    Expr
 }
 
@@ -375,6 +688,15 @@ type BoolLit struct {
 
 func (n *BoolLit) Pos() token.Position { return n.Position }
 
+// StringLit is a quoted string in expression position, such as the mode name
+// in `scale(D, "dorian")`.
+type StringLit struct {
+	Position token.Position
+	Value    string
+}
+
+func (n *StringLit) Pos() token.Position { return n.Position }
+
 // Ident references a binding (let/loop var) or a note/chord/interval/dynamic
 // keyword in expression position. The analyzer resolves which.
 type Ident struct {
@@ -417,11 +739,13 @@ type ListLit struct {
 
 func (n *ListLit) Pos() token.Position { return n.Position }
 
-// Range is `lo..hi` (inclusive integer range).
+// Range is `lo..hi [step n]`: an inclusive integer range counting up by Step,
+// empty when lo > hi. A negative Step counts down instead: `4..1 step -1`.
 type Range struct {
 	Position token.Position
 	Lo       Expr
 	Hi       Expr
+	Step     Expr // nil = 1
 }
 
 func (n *Range) Pos() token.Position { return n.Position }
@@ -435,7 +759,28 @@ type Unary struct {
 
 func (n *Unary) Pos() token.Position { return n.Position }
 
-// Binary is an infix operation; Op is one of +,-,*,/,==,!=,<,<=,>,>=,&&,||.
+// Index is `xs[i]`: the element at i, counting from 0 (negative counts back
+// from the end).
+type Index struct {
+	Position token.Position
+	X        Expr
+	Index    Expr
+}
+
+func (n *Index) Pos() token.Position { return n.Position }
+
+// Slice is `xs[lo..hi]`: the elements lo through hi inclusive, like the range
+// lo..hi.
+type Slice struct {
+	Position token.Position
+	X        Expr
+	Lo       Expr
+	Hi       Expr
+}
+
+func (n *Slice) Pos() token.Position { return n.Position }
+
+// Binary is an infix operation; Op is one of +,-,*,/,%,div,==,!=,<,<=,>,>=,&&,||.
 type Binary struct {
 	Position token.Position
 	Op       token.Type
@@ -445,7 +790,8 @@ type Binary struct {
 
 func (n *Binary) Pos() token.Position { return n.Position }
 
-// Call is a pattern call used in expression position (rare; mostly statements).
+// Call is a function call in expression position: `tritoneSub(ch)`, or
+// `voicings.shell(ch)` for a namespaced import.
 type Call struct {
 	Position token.Position
 	Name     string
@@ -28,6 +28,7 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"syscall/js"
 
 	"github.com/poolpOrg/earmuff/analyzer"
@@ -54,10 +55,10 @@ type event struct {
 	Track int    `json:"track"` // track index
 	Kind  int    `json:"kind"`  // elaborator.MsgKind
 	Ch    uint8  `json:"ch"`
-	Key   uint8  `json:"key,omitempty"`
+	Key   uint8  `json:"key,omitempty"` // note, or the key of a poly pressure
 	Vel   uint8  `json:"vel,omitempty"`
 	Ctrl  uint8  `json:"ctrl,omitempty"`
-	Val   uint8  `json:"val,omitempty"`
+	Val   uint8  `json:"val,omitempty"` // controller value, or pressure
 	Prog  uint8  `json:"prog,omitempty"`
 	Bend  int16  `json:"bend,omitempty"`
 	Text  string `json:"text,omitempty"`
@@ -95,7 +96,11 @@ type result struct {
 func compile(source string) string {
 	res := result{PPQ: elaborator.PPQ, Diagnostics: []diag{}}
 
-	prog, pdiags := parser.New(source, "<playground>").Parse()
+	// The playground has no filesystem: an import is reported, not resolved.
+	loader := &parser.Loader{ReadFile: func(string) ([]byte, error) {
+		return nil, errors.New("imports are not available in the playground")
+	}}
+	prog, pdiags := loader.Load(source, "<playground>")
 	seen := map[diag]bool{}
 	add := func(d diag) {
 		if !seen[d] {
@@ -15,11 +15,23 @@
 //	-ly file.ly     write LilyPond sheet-music source
 //	-pdf file.pdf   render a sheet-music PDF (requires lilypond)
 //	-lilypond path  path to the lilypond binary (for -pdf)
+//	-project name   elaborate the named project instead of the first one
+//	-all            write every project, one file each (see below)
+//	-smf2           write every project into one SMF format 2 file (-out);
+//	                not with -project, -all, -ly, -pdf or -svg
+//	-seed N         override every project's random seed
+//	-nohumanize     ignore humanize statements (quantized, e.g. for engraving)
 //
 // When -out is unset and not -quiet, earmuff plays the result through an
 // available synth (see the player package): a -player/EARMUFF_PLAYER override,
 // the platform-native player, or fluidsynth with a SoundFont. With -ly or -pdf,
 // earmuff emits sheet music instead of MIDI.
+//
+// With -all, the -out/-ly/-pdf/-svg paths are name templates: "{project}" is
+// replaced by the project name (spaces and path separators become "-") and
+// "{n}" by its 1-based position in the file. A path with neither gets
+// "-{project}" inserted before its extension, so projects never overwrite each
+// other.
 package main
 
 import (
@@ -28,6 +40,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/poolpOrg/earmuff/analyzer"
@@ -53,6 +66,11 @@ func main() {
 		optImport   bool
 		optFaithful bool
 		optGrid     int
+		optProject  string
+		optAll      bool
+		optSMF2     bool
+		optSeed     int64
+		optNoHuman  bool
 	)
 	flag.StringVar(&optOut, "out", "", "output file (.mid)")
 	flag.BoolVar(&optQuiet, "quiet", false, "suppress summary and playback")
@@ -65,12 +83,29 @@ func main() {
 	flag.BoolVar(&optImport, "import", false, "read a .mid and emit .ear source (to -out or stdout)")
 	flag.BoolVar(&optFaithful, "faithful", false, "with -import: exact `on beat` timing instead of a quantized grid")
 	flag.IntVar(&optGrid, "grid", 16, "with -import: quantization grid as a note value (16 = sixteenth)")
+	flag.StringVar(&optProject, "project", "", "elaborate the named project instead of the first one")
+	flag.BoolVar(&optAll, "all", false, "write every project; output paths are templates (\"{project}\", \"{n}\")")
+	flag.BoolVar(&optSMF2, "smf2", false, "write every project into one SMF format 2 file (needs -out)")
+	flag.Int64Var(&optSeed, "seed", 0, "override every project's seed (to explore variations)")
+	flag.BoolVar(&optNoHuman, "nohumanize", false, "ignore humanize statements: keep notes on the grid (e.g. for engraving)")
 	flag.Parse()
+	seedSet := false
+	flag.Visit(func(f *flag.Flag) { seedSet = seedSet || f.Name == "seed" })
 
 	if flag.NArg() == 0 {
 		fmt.Fprintln(os.Stderr, "usage: earmuff [flags] source.ear  |  earmuff -import [flags] source.mid")
 		os.Exit(2)
 	}
+	if optSMF2 {
+		if optOut == "" {
+			fmt.Fprintln(os.Stderr, "earmuff: -smf2 needs -out")
+			os.Exit(2)
+		}
+		if bad := smf2Conflicts(optProject, optAll, optLy, optPDF, optSVG); len(bad) > 0 {
+			fmt.Fprintf(os.Stderr, "earmuff: -smf2 writes every project to -out; it cannot be combined with %s\n", strings.Join(bad, ", "))
+			os.Exit(2)
+		}
+	}
 
 	file := flag.Arg(0)
 	src, err := os.ReadFile(file)
@@ -101,8 +136,9 @@ func main() {
 		return
 	}
 
-	// Parse: report diagnostics, abort on any.
-	prog, pdiags := parser.New(string(src), file).Parse()
+	// Parse the file and everything it imports: report diagnostics, abort on
+	// any.
+	prog, pdiags := (&parser.Loader{}).Load(string(src), file)
 	for _, d := range pdiags {
 		fmt.Fprintln(os.Stderr, d)
 	}
@@ -116,7 +152,11 @@ func main() {
 	}
 
 	// Elaborate every project to a Song.
-	songs, eerrs := elaborator.Elaborate(prog)
+	eopts := elaborator.Options{NoHumanize: optNoHuman}
+	if seedSet {
+		eopts.Seed, eopts.OverrideSeed = optSeed, true
+	}
+	songs, eerrs := elaborator.ElaborateWith(prog, eopts)
 	for _, e := range eerrs {
 		fmt.Fprintf(os.Stderr, "elaborate: %v\n", e)
 	}
@@ -137,61 +177,184 @@ func main() {
 		}
 	}
 
-	// Write the first project's score (the common single-project case).
-	song := songs[0]
+	// Several projects together as one format 2 file: one sequence each.
+	if optSMF2 {
+		out := smfwriter.WriteSequences(songs)
+		if err := os.WriteFile(optOut, out, 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "earmuff: %v\n", err)
+			os.Exit(1)
+		}
+		if !optQuiet {
+			fmt.Printf("%s: %d projects, %d bytes -> %s\n", file, len(songs), len(out), optOut)
+		}
+		return
+	}
+
+	// Pick the projects to write: the named one, all of them, or the first
+	// (the common single-project case).
+	selected, err := selectProjects(songs, optProject, optAll)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "earmuff: %s: %v\n", file, err)
+		os.Exit(1)
+	}
+	if optProject == "" && !optAll && len(songs) > 1 && !optQuiet {
+		fmt.Fprintf(os.Stderr, "earmuff: %s has %d projects, writing %q (use -project or -all)\n",
+			file, len(songs), songs[0].Name)
+	}
+
+	o := output{
+		file: file, out: optOut, ly: optLy, pdf: optPDF, svg: optSVG,
+		quiet: optQuiet, player: optPlayer, lilypond: optLilypond,
+	}
+	for i, song := range selected {
+		oo := o
+		if optAll {
+			oo = o.expand(song.Name, i+1)
+		}
+		if err := oo.write(song); err != nil {
+			fmt.Fprintf(os.Stderr, "earmuff: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// selectProjects picks the Songs to write: the one named project, every
+// project with all, or else the first.
+func selectProjects(songs []elaborator.Song, project string, all bool) ([]elaborator.Song, error) {
+	switch {
+	case project != "":
+		for _, song := range songs {
+			if song.Name == project {
+				return []elaborator.Song{song}, nil
+			}
+		}
+		return nil, fmt.Errorf("no project %q (have %s)", project, projectNames(songs))
+	case all:
+		return songs, nil
+	}
+	return songs[:1], nil
+}
 
-	// Sheet music: -ly writes LilyPond source; -pdf renders a PDF via lilypond.
-	// Either short-circuits the MIDI/playback path.
-	if optLy != "" || optPDF != "" || optSVG != "" {
+// smf2Conflicts lists the flags -smf2 cannot honor: it always bundles every
+// project into the one -out file, and writes no sheet music.
+func smf2Conflicts(project string, all bool, ly, pdf, svg string) []string {
+	var bad []string
+	if project != "" {
+		bad = append(bad, "-project")
+	}
+	if all {
+		bad = append(bad, "-all")
+	}
+	for _, f := range []struct{ name, val string }{{"-ly", ly}, {"-pdf", pdf}, {"-svg", svg}} {
+		if f.val != "" {
+			bad = append(bad, f.name)
+		}
+	}
+	return bad
+}
+
+// output is where one Song goes: a MIDI file, sheet music, or playback.
+type output struct {
+	file              string // source path, for the summary line
+	out, ly, pdf, svg string
+	quiet             bool
+	player, lilypond  string
+}
+
+// expand returns o with its paths instantiated as name templates for the
+// project name at 1-based position n (see the package doc).
+func (o output) expand(name string, n int) output {
+	o.out = projectPath(o.out, name, n)
+	o.ly = projectPath(o.ly, name, n)
+	o.pdf = projectPath(o.pdf, name, n)
+	o.svg = projectPath(o.svg, name, n)
+	return o
+}
+
+// write emits one Song. Sheet music (-ly/-pdf/-svg) short-circuits the
+// MIDI/playback path.
+func (o output) write(song elaborator.Song) error {
+	if o.ly != "" || o.pdf != "" || o.svg != "" {
 		ly := lilypond.Render(song)
-		if optLy != "" {
-			if err := os.WriteFile(optLy, []byte(ly), 0o644); err != nil {
-				fmt.Fprintf(os.Stderr, "earmuff: %v\n", err)
-				os.Exit(1)
+		if o.ly != "" {
+			if err := os.WriteFile(o.ly, []byte(ly), 0o644); err != nil {
+				return err
 			}
 		}
-		if optPDF != "" {
-			if err := renderScore(ly, optPDF, "pdf", optLilypond); err != nil {
-				fmt.Fprintf(os.Stderr, "earmuff: %v\n", err)
-				os.Exit(1)
+		if o.pdf != "" {
+			if err := renderScore(ly, o.pdf, "pdf", o.lilypond); err != nil {
+				return err
 			}
 		}
-		if optSVG != "" {
-			if err := renderScore(ly, optSVG, "svg", optLilypond); err != nil {
-				fmt.Fprintf(os.Stderr, "earmuff: %v\n", err)
-				os.Exit(1)
+		if o.svg != "" {
+			if err := renderScore(ly, o.svg, "svg", o.lilypond); err != nil {
+				return err
 			}
 		}
-		if !optQuiet {
-			fmt.Printf("%s: %q -> sheet music\n", file, song.Name)
+		if !o.quiet {
+			fmt.Printf("%s: %q -> sheet music\n", o.file, song.Name)
 		}
-		return
+		return nil
 	}
 
 	out := smfwriter.Write(song)
 
-	if optOut != "" {
-		if err := os.WriteFile(optOut, out, 0o644); err != nil {
-			fmt.Fprintf(os.Stderr, "earmuff: %v\n", err)
-			os.Exit(1)
+	if o.out != "" {
+		if err := os.WriteFile(o.out, out, 0o644); err != nil {
+			return err
 		}
 	}
 
-	if !optQuiet {
+	if !o.quiet {
 		fmt.Printf("%s: %q: %d tracks, %d events, %d bytes",
-			file, song.Name, len(song.Tracks), len(song.Events), len(out))
-		if optOut != "" {
-			fmt.Printf(" -> %s", optOut)
+			o.file, song.Name, len(song.Tracks), len(song.Events), len(out))
+		if o.out != "" {
+			fmt.Printf(" -> %s", o.out)
 		}
 		fmt.Println()
 
 		// If we did not write to disk, play through an available synth.
-		if optOut == "" {
-			if err := player.Play(out, optPlayer); err != nil {
+		if o.out == "" {
+			if err := player.Play(out, o.player); err != nil {
 				fmt.Fprintf(os.Stderr, "earmuff: %v\n", err)
 			}
 		}
 	}
+	return nil
+}
+
+// projectPath instantiates the name template tmpl for a project. "{project}"
+// becomes the file-safe project name and "{n}" its position; a template with
+// neither gets "-{project}" before its extension. An empty tmpl stays empty.
+func projectPath(tmpl, name string, n int) string {
+	if tmpl == "" {
+		return ""
+	}
+	if !strings.Contains(tmpl, "{project}") && !strings.Contains(tmpl, "{n}") {
+		ext := filepath.Ext(tmpl)
+		tmpl = strings.TrimSuffix(tmpl, ext) + "-{project}" + ext
+	}
+	safe := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '/', '\\', ':':
+			return '-'
+		}
+		return r
+	}, name)
+	if safe == "" {
+		safe = strconv.Itoa(n)
+	}
+	tmpl = strings.ReplaceAll(tmpl, "{project}", safe)
+	return strings.ReplaceAll(tmpl, "{n}", strconv.Itoa(n))
+}
+
+// projectNames lists the projects' names for a diagnostic.
+func projectNames(songs []elaborator.Song) string {
+	names := make([]string, len(songs))
+	for i, song := range songs {
+		names[i] = strconv.Quote(song.Name)
+	}
+	return strings.Join(names, ", ")
 }
 
 // analyze runs the analyzer, printing diagnostics. It returns true if any
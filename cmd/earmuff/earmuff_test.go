@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/poolpOrg/earmuff/elaborator"
+)
+
+func TestProjectPath(t *testing.T) {
+	for _, tc := range []struct {
+		tmpl, name string
+		n          int
+		want       string
+	}{
+		{"", "verse", 1, ""},
+		{"out/{project}.mid", "verse", 1, "out/verse.mid"},
+		{"take-{n}.mid", "verse", 3, "take-3.mid"},
+		{"{n}-{project}.ly", "a b/c:d", 2, "2-a-b-c-d.ly"},
+		{"song.mid", "chorus", 2, "song-chorus.mid"},
+		{"song", "chorus", 2, "song-chorus"},
+		{"{project}.mid", "", 4, "4.mid"},
+	} {
+		if got := projectPath(tc.tmpl, tc.name, tc.n); got != tc.want {
+			t.Errorf("projectPath(%q, %q, %d) = %q, want %q", tc.tmpl, tc.name, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestSelectProjects(t *testing.T) {
+	songs := []elaborator.Song{{Name: "intro"}, {Name: "verse"}, {Name: "outro"}}
+	names := func(ss []elaborator.Song) []string {
+		var out []string
+		for _, s := range ss {
+			out = append(out, s.Name)
+		}
+		return out
+	}
+	for _, tc := range []struct {
+		project string
+		all     bool
+		want    []string
+	}{
+		{"", false, []string{"intro"}},
+		{"verse", false, []string{"verse"}},
+		{"", true, []string{"intro", "verse", "outro"}},
+	} {
+		got, err := selectProjects(songs, tc.project, tc.all)
+		if err != nil || !reflect.DeepEqual(names(got), tc.want) {
+			t.Errorf("selectProjects(%q, %v) = %v, %v; want %v", tc.project, tc.all, names(got), err, tc.want)
+		}
+	}
+	if _, err := selectProjects(songs, "bridge", false); err == nil || !strings.Contains(err.Error(), `no project "bridge" (have "intro", "verse", "outro")`) {
+		t.Errorf("unknown project: err = %v", err)
+	}
+}
+
+func TestSMF2Conflicts(t *testing.T) {
+	if bad := smf2Conflicts("", false, "", "", ""); len(bad) != 0 {
+		t.Errorf("plain -smf2 conflicts with %v", bad)
+	}
+	want := []string{"-project", "-all", "-ly", "-svg"}
+	if bad := smf2Conflicts("verse", true, "x.ly", "", "x.svg"); !reflect.DeepEqual(bad, want) {
+		t.Errorf("conflicts = %v, want %v", bad, want)
+	}
+}
@@ -13,15 +13,18 @@
 //   - Gate (sounding length) defaults to one grid step; a :dur suffix sets it to
 //     an absolute note value = 960*4/dur ticks.
 //   - Tie (~) extends the previous note's gate by one grid step and advances the
-//     cursor one step.
+//     cursor one step; a leading tie extends the previous bar's last notes.
 //   - GridSwitch rebinds the step within the bar; BarSep resets to the bar's
-//     base grid and does not advance; Absolute (on beat B) places at (B-1)*960
-//     and does not move the cursor.
-//   - Bar k starts at k * beats * 960 ticks (beats from the time signature).
+//     base grid and does not advance; Absolute (on beat B) places at the start
+//     of beat B and does not move the cursor.
+//   - A bar lasts beats * (960*4/unit) ticks (from the time signature). A beat
+//     is one unit, or a dotted unit in compound meters (6/8 has two beats).
 package elaborator
 
 import (
 	"fmt"
+	"math"
+	"slices"
 	"sort"
 	"strings"
 
@@ -60,6 +63,7 @@ const (
 	MsgProgram
 	MsgMeta
 	MsgSysex
+	MsgPolyPressure
 )
 
 // MIDIMsg is the semantic content of an event, independent of any wire format;
@@ -70,6 +74,7 @@ const (
 //   - CC:             Channel, Controller, Value
 //   - PitchBend:      Channel, Bend (-8192..8191, 0 = center)
 //   - Pressure:       Channel, Value
+//   - PolyPressure:   Channel, Key, Value
 //   - Program:        Channel, Program (0-based)
 //   - Sysex:          Bytes (full payload incl. F0..F7)
 //   - Meta:           MetaKind, Text (or Beats/Unit/BPM/Copyright for headers)
@@ -105,6 +110,28 @@ type Event struct {
 	order int
 }
 
+// Tuplet records where a track played a tuplet (`3:2 { C D E }`): Actual notes
+// in the time of Normal grid steps, between Start and End. The score renderers
+// use it to engrave a tuplet rather than quantize the uneven notes.
+type Tuplet struct {
+	Track      int
+	Start, End uint32
+	Actual     int
+	Normal     int
+}
+
+// Hairpin records where a track played a crescendo or diminuendo (`cresc p to
+// ff over 2 bars`), between Start and End. From and To are velocities;
+// FromMark and ToMark are the dynamics they were written as, or "" for a
+// velocity number. The score renderers engrave it as a hairpin.
+type Hairpin struct {
+	Track            int
+	Start, End       uint32
+	From, To         int
+	FromMark, ToMark string
+	Dim              bool
+}
+
 // TrackInfo is the per-track metadata smfwriter needs for SMF headers.
 type TrackInfo struct {
 	Name       string
@@ -114,38 +141,113 @@ type TrackInfo struct {
 	HasProgram bool
 }
 
+// TempoChange is one entry of a Song's tempo map: from Tick on, the piece
+// plays at BPM quarter notes per minute.
+type TempoChange struct {
+	Tick uint32
+	BPM  float64
+}
+
+// TempoRamp records a gradual tempo change (`bpm 120 to 90 over 4 bars`). Its
+// steps are already expanded into the tempo map; the ramp itself is kept so the
+// score renderers can engrave rit./accel. instead of a stream of tempo marks.
+type TempoRamp struct {
+	Start, End uint32
+	From, To   float64
+}
+
+// MeterChange is one entry of a Song's meter map: from Tick on, each bar holds
+// Beats notes of value Unit. Groups is set for an additive meter (3+3+2 in
+// `time 3+3+2 8`) and sums to Beats.
+type MeterChange struct {
+	Tick   uint32
+	Beats  int
+	Unit   int
+	Groups []int
+}
+
+// KeyChange is one entry of a Song's key map: from Tick on, the notes of
+// Track are written in Key. A project-level `key` applies to every track and
+// has Track -1.
+type KeyChange struct {
+	Tick  uint32
+	Track int
+	Key   value.Key
+}
+
 // Song is one project's elaboration: a flat event stream plus per-track and
 // project metadata.
+//
+// BPM is the opening tempo; Tempos is the full tempo map, sorted by tick, whose
+// first entry is always at tick 0 and equals BPM. A piece without mid-song
+// `bpm` changes has a single-entry map. Ramps lists the gradual changes whose
+// steps make up part of that map.
+//
+// TimeBeats/TimeUnit (and TimeGroups for an additive meter) are the opening
+// meter and Meters the meter map, built the same way: sorted by tick, first
+// entry at tick 0, one entry per actual change.
+//
+// Keys is the key map, sorted by tick: the project key, if any, then every
+// track-level `key` change. It is empty for a song that sets no key.
 type Song struct {
-	Name      string
-	Events    []Event
-	Tracks    []TrackInfo
-	BPM       float64
-	TimeBeats int
-	TimeUnit  int
-	Copyright string
-	Texts     []string
+	Name       string
+	Events     []Event
+	Tracks     []TrackInfo
+	BPM        float64
+	Tempos     []TempoChange
+	Ramps      []TempoRamp
+	TimeBeats  int
+	TimeUnit   int
+	TimeGroups []int
+	Meters     []MeterChange
+	Tuplets    []Tuplet
+	Hairpins   []Hairpin
+	Keys       []KeyChange
+	Copyright  string
+	Texts      []string
+}
+
+// Options tunes elaboration.
+type Options struct {
+	// Seed replaces the `seed` of every project when OverrideSeed is set, to
+	// try variations of a generative part without editing it. A track's own
+	// `seed` statements still pin that track.
+	Seed         int64
+	OverrideSeed bool
+	// NoHumanize ignores `humanize` statements, so every onset, gate and
+	// velocity stays on the grid; scores engrave better from quantized notes.
+	NoHumanize bool
 }
 
 // Elaborate turns a program into one Song per project. It is pure and
-// deterministic: the same program yields identical Songs.
+// deterministic: the same program yields identical Songs. Randomness comes
+// from each project's `seed` (0 when absent).
 func Elaborate(prog *ast.Program) ([]Song, []error) {
+	return ElaborateWith(prog, Options{})
+}
+
+// ElaborateWith is Elaborate with options.
+func ElaborateWith(prog *ast.Program, opts Options) ([]Song, []error) {
 	if prog == nil {
 		return nil, nil
 	}
-	global := map[string]*ast.PatternDef{}
-	for _, it := range prog.Items {
-		if pd, ok := it.(*ast.PatternDef); ok && pd != nil {
-			global[pd.Name] = pd
-		}
-	}
+	global := prog.Patterns()
+	home := map[*ast.PatternDef]map[string]*ast.PatternDef{}
+	owner := map[*ast.FuncDef]*ast.Program{}
 	var songs []Song
 	var errs []error
+	funcOwners(prog, owner)
+	importHomes(prog, home, owner, map[*ast.Program]bool{}, &errs)
+	funcs := funcEnv(prog, owner, map[*ast.Program]*value.Env{})
 	for _, it := range prog.Items {
 		if proj, ok := it.(*ast.Project); ok {
 			e := &elab{
 				song:          &Song{Name: proj.Name, BPM: 120, TimeBeats: 4, TimeUnit: 4},
 				globalPattern: global,
+				home:          home,
+				funcs:         funcs,
+				opts:          opts,
+				key:           &value.Key{},
 			}
 			e.elabProject(proj)
 			e.finalize()
@@ -156,6 +258,63 @@ func Elaborate(prog *ast.Program) ([]Song, []error) {
 	return songs, errs
 }
 
+// importHomes records, for every top-level pattern of an imported file, the
+// patterns visible in that file, so a library pattern calls its own helpers
+// whatever namespace the importer gave them; and, for every function, the
+// file defining it. Only patterns and functions are taken from an imported
+// file; its projects are not elaborated. An import the parser's Loader did not
+// resolve is an error.
+func importHomes(prog *ast.Program, home map[*ast.PatternDef]map[string]*ast.PatternDef,
+	owner map[*ast.FuncDef]*ast.Program, seen map[*ast.Program]bool, errs *[]error) {
+	for _, it := range prog.Items {
+		imp, ok := it.(*ast.Import)
+		if !ok {
+			continue
+		}
+		lib := imp.Program
+		if lib == nil {
+			*errs = append(*errs, fmt.Errorf("%s: import %q is not loaded", imp.Position, imp.Path))
+			continue
+		}
+		if seen[lib] {
+			continue
+		}
+		seen[lib] = true
+		visible := lib.Patterns()
+		for _, it := range lib.Items {
+			if pd, ok := it.(*ast.PatternDef); ok && pd != nil {
+				home[pd] = visible
+			}
+		}
+		funcOwners(lib, owner)
+		importHomes(lib, home, owner, seen, errs)
+	}
+}
+
+// funcOwners records prog as the file defining each of its top-level functions.
+func funcOwners(prog *ast.Program, owner map[*ast.FuncDef]*ast.Program) {
+	for _, it := range prog.Items {
+		if fd, ok := it.(*ast.FuncDef); ok && fd != nil {
+			owner[fd] = prog
+		}
+	}
+}
+
+// funcEnv returns the environment of prog's top level: every function visible
+// there, each closed over the environment of the file that defines it, so
+// functions call their own file's helpers and may recurse.
+func funcEnv(prog *ast.Program, owner map[*ast.FuncDef]*ast.Program, envs map[*ast.Program]*value.Env) *value.Env {
+	if env, ok := envs[prog]; ok {
+		return env
+	}
+	env := value.NewEnv(nil)
+	envs[prog] = env
+	for name, fd := range prog.Funcs() {
+		env.Set(name, value.FuncVal(fd, funcEnv(owner[fd], owner, envs)))
+	}
+	return env
+}
+
 // ---------------------------------------------------------------------------
 // Scope: bindings (delegated to value.Env), patterns, and kit aliases
 // ---------------------------------------------------------------------------
@@ -207,20 +366,40 @@ type elab struct {
 	errs []error
 
 	globalPattern map[string]*ast.PatternDef
+	home          map[*ast.PatternDef]map[string]*ast.PatternDef // imported patterns' own file scope
+	funcs         *value.Env                                     // top-level functions, imported ones included
+	opts          Options
+	seed          int64         // the project's seed
+	rng           *value.Random // the current track's source, reseeded by `seed`
+	projectKey    value.Key     // the project's `key`; C major when unset
 
 	curTrack    int
 	trackChan   uint8
 	timeBeats   int
 	timeUnit    int
-	trackVel    int  // track-level velocity default; -1 if unset
-	bendRangeRP bool // RPN pitch-bend-range already emitted for this track?
+	timeGroups  []int // additive meter grouping; nil for a plain meter
+	trackVel    int   // track-level velocity default; -1 if unset
+	bendRangeRP bool  // RPN pitch-bend-range already emitted for this track?
 	bendRange   uint8
 
 	trackOffset uint32 // running tick offset where the next bar starts
 	orderCtr    int
 
-	swing   float64 // current swing ratio (0.5 = straight); a running modifier
-	curLine int     // source line of the construct currently emitting (for tooling)
+	swing     float64       // current swing ratio (0.5 = straight); a running modifier
+	humanize  *ast.Humanize // current humanize amounts; nil when off
+	humanized []humanNote   // notes whose onsets and gates finalize varies
+	hairpins  []hairpin     // the current track's hairpins, in order
+	lead      *voiceLead    // voice leading in force; nil outside voicelead
+	key       *value.Key    // the key in force, shared with the root scope; `key` changes it
+	curLine   int           // source line of the construct currently emitting (for tooling)
+
+	// lastNoteOffs holds the NoteOff events of the previous sounding step so a
+	// tilde can extend their gate, even from the next bar. Only a rest or a raw
+	// event in between breaks the tie.
+	lastNoteOffs []int // indices into song.Events
+
+	tempos []TempoChange // body-level `bpm` changes, in elaboration order
+	meters []MeterChange // body-level `time` changes, in elaboration order
 }
 
 func (e *elab) errorf(pos token.Position, format string, args ...interface{}) {
@@ -244,15 +423,33 @@ func (e *elab) emit(tick uint32, msg MIDIMsg) {
 
 func (e *elab) elabProject(proj *ast.Project) {
 	root := newScope(nil)
+	root.env = value.NewEnv(e.funcs)
 	for name, pd := range e.globalPattern {
 		root.patterns[name] = pd
 	}
 	for _, pd := range proj.Patterns {
 		root.patterns[pd.Name] = pd
 	}
+	for _, fd := range proj.Funcs {
+		root.env.Set(fd.Name, value.FuncVal(fd, root.env))
+	}
+	var ramps []ast.Setting
 	for _, s := range proj.Settings {
 		e.applyProjectSetting(s)
+		if s.Kind == ast.SettingBPM && s.Ramp != nil {
+			ramps = append(ramps, s)
+		}
+	}
+	// A project ramp counts bars of the project meter, wherever in the
+	// project its `time` is written.
+	for _, s := range ramps {
+		e.rampTempo(s, 0, uint32(e.song.TimeBeats)*durTicks(e.song.TimeUnit))
+	}
+	if e.opts.OverrideSeed {
+		e.seed = e.opts.Seed
 	}
+	root.env.SetRandom(value.NewRandom(e.seed, ""))
+	root.env.SetKey(e.key)
 
 	nextChan := uint8(0)
 	for _, tr := range proj.Tracks {
@@ -265,13 +462,62 @@ func (e *elab) applyProjectSetting(s ast.Setting) {
 	case ast.SettingBPM:
 		e.song.BPM = s.Number
 	case ast.SettingTime:
+		if !e.validGroups(s) {
+			return
+		}
 		e.song.TimeBeats = s.TimeBeats
+		e.song.TimeGroups = s.TimeGroups
 		e.song.TimeUnit = s.TimeUnit
 	case ast.SettingCopyright:
 		e.song.Copyright = s.Text
 	case ast.SettingText:
 		e.song.Texts = append(e.song.Texts, s.Text)
+	case ast.SettingSeed:
+		e.seed = int64(s.Number)
+	case ast.SettingKey:
+		if k, ok := e.setKey(s, -1, 0); ok {
+			e.projectKey = k
+		}
+	}
+}
+
+// validGroups reports whether every group of an additive meter holds at least
+// one unit; `time 3+0 8` would make a beat of no length.
+func (e *elab) validGroups(s ast.Setting) bool {
+	for _, g := range s.TimeGroups {
+		if g < 1 {
+			e.errorf(s.Position, "additive meter groups must be at least 1, got %d", g)
+			return false
+		}
+	}
+	return true
+}
+
+// setKey records a key change for track (-1 for every track) at tick.
+func (e *elab) setKey(s ast.Setting, track int, tick uint32) (value.Key, bool) {
+	k, err := value.ParseKey(s.Tonic, s.Mode)
+	if err != nil {
+		e.errorf(s.Position, "%v", err)
+		return value.Key{}, false
 	}
+	e.song.Keys = append(e.song.Keys, KeyChange{Tick: tick, Track: track, Key: k})
+	return k, true
+}
+
+// KeyAt returns the key track is written in at tick: the latest change for
+// that track or the whole song at or before tick, or C major when there is
+// none.
+func (s Song) KeyAt(track int, tick uint32) value.Key {
+	var k value.Key
+	for _, c := range s.Keys {
+		if c.Tick > tick {
+			break
+		}
+		if c.Track == -1 || c.Track == track {
+			k = c.Key
+		}
+	}
+	return k
 }
 
 // allocChannel returns the next free channel, skipping 9 (percussion) and
@@ -292,12 +538,22 @@ func (e *elab) elabTrack(tr *ast.Track, parent *scope, nextChan *uint8) {
 	e.curTrack = len(e.song.Tracks)
 	e.timeBeats = e.song.TimeBeats
 	e.timeUnit = e.song.TimeUnit
+	e.timeGroups = e.song.TimeGroups
 	e.trackOffset = 0
 	e.bendRangeRP = false
 	e.bendRange = 2
 	e.swing = 0.5 // straight until a `swing` statement says otherwise
-
+	e.humanize = nil
+	e.hairpins = nil
+	e.lead = nil
+	e.lastNoteOffs = nil
+	*e.key = e.projectKey
+
+	// Each track draws from its own stream, so adding a random call to one
+	// track leaves the others as they were.
 	sc := newScope(parent)
+	e.rng = value.NewRandom(e.seed, tr.Name)
+	sc.env.SetRandom(e.rng)
 
 	percussion := e.trackIsPercussion(tr, sc)
 
@@ -363,6 +619,8 @@ func (e *elab) trackIsPercussion(tr *ast.Track, parent *scope) bool {
 				walkBar(n)
 			case *ast.For:
 				walk(n.Body)
+			case *ast.VoiceLead:
+				walk(n.Body)
 			case *ast.If:
 				walk(n.Then)
 				walk(n.Else)
@@ -385,6 +643,8 @@ func collectKits(items []ast.Stmt, sc *scope) {
 			}
 		case *ast.For:
 			collectKits(n.Body, sc)
+		case *ast.VoiceLead:
+			collectKits(n.Body, sc)
 		case *ast.If:
 			collectKits(n.Then, sc)
 			collectKits(n.Else, sc)
@@ -436,12 +696,17 @@ func (e *elab) elabStmt(st ast.Stmt, sc *scope, vel int) {
 			return
 		}
 		sc.env.Set(n.Name, v)
+	case *ast.FuncDef:
+		// like a let: visible to the statements after it, closing over sc
+		sc.env.Set(n.Name, value.FuncVal(n, sc.env))
 	case *ast.Bar:
 		e.elabBar(n, sc, vel)
 	case *ast.For:
 		e.elabFor(n, sc, vel)
 	case *ast.If:
 		e.elabIf(n, sc, vel)
+	case *ast.VoiceLead:
+		e.elabVoiceLead(n, sc, vel)
 	case *ast.PatternCall:
 		e.elabPatternCall(n, sc, vel)
 	case *ast.SettingStmt:
@@ -453,6 +718,15 @@ func (e *elab) elabStmt(st ast.Stmt, sc *scope, vel int) {
 			return
 		}
 		e.swing = pct / 100.0
+	case *ast.Humanize:
+		e.humanize = n
+		if n.Off() || e.opts.NoHumanize {
+			e.humanize = nil
+		}
+	case *ast.Hairpin:
+		e.hairpin(n)
+	case *ast.Mixer:
+		e.elabMixer(n, sc)
 	case *ast.Meta:
 		e.emitMeta(e.trackOffset, n)
 	case *ast.PatternDef:
@@ -465,7 +739,7 @@ func (e *elab) elabStmt(st ast.Stmt, sc *scope, vel int) {
 			e.errs = append(e.errs, err)
 			return
 		}
-		at := e.trackOffset + uint32((beat-1)*float64(PPQ))
+		at := e.trackOffset + e.beatOffset(beat)
 		switch ev := n.Event.(type) {
 		case *ast.Step:
 			gate := durTicks(4)
@@ -486,18 +760,219 @@ func (e *elab) elabStmt(st ast.Stmt, sc *scope, vel int) {
 	default:
 		// Raw event statement at track level: placed at the current offset.
 		e.elabEventStmt(st, sc, e.trackOffset, e.trackChan, vel)
+		e.lastNoteOffs = nil
 	}
 }
 
 func (e *elab) applyTrackSetting(s ast.Setting) {
 	switch s.Kind {
 	case ast.SettingTime:
+		// The new meter shapes this track's bars from here on and, like a
+		// tempo change, is recorded song-wide for the file and the score.
+		if !e.validGroups(s) {
+			return
+		}
 		e.timeBeats = s.TimeBeats
 		e.timeUnit = s.TimeUnit
+		e.timeGroups = s.TimeGroups
+		e.meters = append(e.meters, MeterChange{Tick: e.trackOffset, Beats: s.TimeBeats, Unit: s.TimeUnit, Groups: s.TimeGroups})
 	case ast.SettingBPM:
-		// A mid-song tempo change is not representable in the per-song header;
-		// the first project-scope bpm wins. Ignore here for determinism.
+		// A mid-song tempo change: it takes effect where the next bar starts
+		// and applies to the whole song, not just this track.
+		if s.Ramp != nil {
+			e.rampTempo(s, e.trackOffset, uint32(e.timeBeats)*durTicks(e.timeUnit))
+			return
+		}
+		e.tempos = append(e.tempos, TempoChange{Tick: e.trackOffset, BPM: s.Number})
+	case ast.SettingSeed:
+		// Draws from here on restart from the new seed, whatever the project's.
+		e.rng.Reseed(int64(s.Number))
+	case ast.SettingKey:
+		// A key change for this track only, from where it stands.
+		if k, ok := e.setKey(s, e.curTrack, e.trackOffset); ok {
+			*e.key = k
+		}
+	}
+}
+
+// compoundMeter reports whether a time signature groups its units in threes
+// under a dotted beat (6/8, 9/8, 12/8, 6/16, ...). 3/8 is felt as three beats.
+func compoundMeter(beats, unit int) bool {
+	return unit >= 8 && beats > 3 && beats%3 == 0
+}
+
+// BeatLens returns the length in ticks of each beat of a bar of the meter
+// `time beats unit` (groups set for an additive one): one time-signature unit
+// (a quarter in 3/4, an eighth in 7/8), a dotted unit in a compound meter, or
+// one group of an additive meter (3+3+2). These are the beats `on beat` counts.
+func BeatLens(beats, unit int, groups []int) []uint32 {
+	if len(groups) > 0 {
+		lens := make([]uint32, len(groups))
+		for i, g := range groups {
+			lens[i] = uint32(g) * durTicks(unit)
+		}
+		return lens
+	}
+	n, per := beats, uint32(1)
+	if compoundMeter(beats, unit) {
+		n, per = beats/3, 3
+	}
+	if n < 1 {
+		n = 1
+	}
+	lens := make([]uint32, n)
+	for i := range lens {
+		lens[i] = per * durTicks(unit)
+	}
+	return lens
+}
+
+// beatLens returns the beat lengths of the current meter.
+func (e *elab) beatLens() []uint32 {
+	return BeatLens(e.timeBeats, e.timeUnit, e.timeGroups)
+}
+
+// beatOffset maps `on beat B` to a within-bar tick: beat 1 is the downbeat and
+// a fractional beat lands proportionally inside its beat, to the nearest tick
+// (beat 1.333333 of a 6/8 bar is the second eighth). Beats past the end of the
+// bar keep the last beat's length.
+func (e *elab) beatOffset(beat float64) uint32 {
+	lens := e.beatLens()
+	var at float64
+	for i, b := 0, beat-1; b > 0; i, b = i+1, b-1 {
+		l := float64(lens[min(i, len(lens)-1)])
+		if b < 1 {
+			at += b * l
+			break
+		}
+		at += l
+	}
+	return uint32(math.Round(at))
+}
+
+// beatAt returns the start and length of the beat containing a within-bar
+// tick.
+func (e *elab) beatAt(tick uint32) (start, length uint32) {
+	lens := e.beatLens()
+	for i, l := range lens {
+		if tick < start+l || i == len(lens)-1 {
+			return start, l
+		}
+		start += l
+	}
+	return start, lens[len(lens)-1]
+}
+
+// rampStep is the spacing of the events a ramp expands into by default.
+const rampStep = PPQ / 4
+
+// rampTempo expands `bpm <from> to <to> over <span>` starting at tick at into
+// one tempo change every rampStep ticks, landing exactly on the target at the
+// end of the span. Tracks that share a ramp record it in Song.Ramps once.
+func (e *elab) rampTempo(s ast.Setting, at, barLen uint32) {
+	r := s.Ramp
+	from, to := s.Number, r.To
+	if from <= 0 || to <= 0 {
+		e.errorf(s.Position, "tempo ramp needs positive tempos, got %g to %g", from, to)
+		return
+	}
+	span := spanTicks(r.Over, barLen)
+	if span == 0 {
+		e.errorf(s.Position, "tempo ramp has an empty span")
+		return
+	}
+	for t := uint32(0); t < span; t += rampStep {
+		e.tempos = append(e.tempos, TempoChange{Tick: at + t, BPM: rampValue(from, to, float64(t)/float64(span), r.Curve)})
+	}
+	e.tempos = append(e.tempos, TempoChange{Tick: at + span, BPM: to})
+	if ramp := (TempoRamp{Start: at, End: at + span, From: from, To: to}); !slices.Contains(e.song.Ramps, ramp) {
+		e.song.Ramps = append(e.song.Ramps, ramp)
+	}
+}
+
+// spanTicks returns the length of a ramp span given the current bar length.
+func spanTicks(sp ast.Span, barLen uint32) uint32 {
+	if sp.Note > 0 {
+		return durTicks(sp.Note)
+	}
+	if sp.Bars <= 0 {
+		return 0
+	}
+	return uint32(sp.Bars*float64(barLen) + 0.5)
+}
+
+// rampValue interpolates between from and to at fraction f (0..1) of a ramp.
+// An exponential curve moves by equal ratios, so a tempo ramp of that shape
+// sounds even to the ear. Ratios need both endpoints positive; otherwise (a
+// filter sweep from 0, a bend through the center) an exponential curve takes
+// the same shape over seven doublings: slow then fast going up, fast then
+// slow going down.
+func rampValue(from, to, f float64, c ast.Curve) float64 {
+	if c != ast.CurveExp {
+		return from + (to-from)*f
+	}
+	if from > 0 && to > 0 {
+		return from * math.Pow(to/from, f)
+	}
+	shape := func(f float64) float64 { return (math.Pow(2, 7*f) - 1) / 127 }
+	if to < from {
+		return from + (to-from)*(1-shape(1-f))
+	}
+	return from + (to-from)*shape(f)
+}
+
+// hairpin is a Hairpin with the shape the velocities follow.
+type hairpin struct {
+	Hairpin
+	curve ast.Curve
+}
+
+// hairpin starts `cresc|dim <from> to <to> over <span>` at the track offset.
+// With `expression`, CC 11 follows the ramp too, one value every rampStep
+// ticks, skipping repeats.
+func (e *elab) hairpin(n *ast.Hairpin) {
+	barLen := uint32(e.timeBeats) * durTicks(e.timeUnit)
+	span := spanTicks(n.Over, barLen)
+	if span == 0 {
+		e.errorf(n.Position, "hairpin has an empty span")
+		return
+	}
+	at := e.trackOffset
+	h := hairpin{
+		Hairpin: Hairpin{
+			Track: e.curTrack, Start: at, End: at + span,
+			From: velocityValue(n.From), To: velocityValue(n.To),
+			FromMark: n.From.Dynamic, ToMark: n.To.Dynamic, Dim: n.Dim,
+		},
+		curve: n.Curve,
+	}
+	e.hairpins = append(e.hairpins, h)
+	e.song.Hairpins = append(e.song.Hairpins, h.Hairpin)
+	if !n.Expression {
+		return
+	}
+	ch := e.trackChan
+	e.emitRamp(at, span, rampStep, float64(h.From), float64(h.To), h.curve,
+		func(v float64) int { return max(0, min(127, int(math.Round(v)))) },
+		func(v int) MIDIMsg { return MIDIMsg{Kind: MsgCC, Channel: ch, Controller: 11, Value: uint8(v)} })
+}
+
+// hairpinVelocity returns the velocity the latest hairpin sets at tick: the
+// ramp inside its span, its target after it, when done is set.
+func (e *elab) hairpinVelocity(tick uint32) (v int, done, ok bool) {
+	for i := len(e.hairpins) - 1; i >= 0; i-- {
+		h := e.hairpins[i]
+		if h.Start > tick {
+			continue
+		}
+		if tick >= h.End {
+			return h.To, true, true
+		}
+		f := float64(tick-h.Start) / float64(h.End-h.Start)
+		v := int(math.Round(rampValue(float64(h.From), float64(h.To), f, h.curve)))
+		return max(1, min(127, v)), false, true
 	}
+	return 0, false, false
 }
 
 func (e *elab) elabPatternCall(call *ast.PatternCall, sc *scope, vel int) {
@@ -511,6 +986,9 @@ func (e *elab) elabPatternCall(call *ast.PatternCall, sc *scope, vel int) {
 		return
 	}
 	inner := newScope(sc)
+	for name, d := range e.home[pd] {
+		inner.patterns[name] = d
+	}
 	for i, p := range pd.Params {
 		v, err := value.Eval(call.Args[i], sc.env)
 		if err != nil {
@@ -528,8 +1006,11 @@ func (e *elab) elabFor(n *ast.For, sc *scope, vel int) {
 		e.errs = append(e.errs, err)
 		return
 	}
-	for _, item := range items {
+	for i, item := range items {
 		inner := newScope(sc)
+		if n.Index != "" {
+			inner.env.Set(n.Index, value.Number(float64(i)))
+		}
 		inner.env.Set(n.Var, item)
 		e.elabBody(n.Body, inner, vel)
 	}
@@ -558,6 +1039,177 @@ func (e *elab) elabIf(n *ast.If, sc *scope, vel int) {
 	}
 }
 
+// ---------------------------------------------------------------------------
+// Voice leading
+// ---------------------------------------------------------------------------
+
+// The range a voicelead block keeps its chords in unless it sets one: C^3 to
+// C^6.
+const (
+	leadLo = 48
+	leadHi = 84
+)
+
+// voiceLead is the state of a voicelead block: its range and the last chord
+// it sounded.
+type voiceLead struct {
+	lo, hi int
+	prev   []uint8
+}
+
+// elabVoiceLead elaborates a voicelead block's body with voice leading in
+// force. A nested block leads on from the chord its parent sounded last, and
+// hands its own last chord back.
+func (e *elab) elabVoiceLead(n *ast.VoiceLead, sc *scope, vel int) {
+	lead := &voiceLead{lo: leadLo, hi: leadHi}
+	if n.Lo != nil {
+		var ok bool
+		if lead.lo, ok = e.leadBound(n.Lo, sc); !ok {
+			return
+		}
+		if lead.hi, ok = e.leadBound(n.Hi, sc); !ok {
+			return
+		}
+	}
+	if lead.hi-lead.lo < 12 {
+		e.errorf(n.Position, "voicelead range %d..%d is narrower than an octave", lead.lo, lead.hi)
+		return
+	}
+	outer := e.lead
+	if outer != nil {
+		lead.prev = outer.prev
+	}
+	e.lead = lead
+	e.elabBody(n.Body, newScope(sc), vel)
+	if outer != nil {
+		outer.prev = lead.prev
+	}
+	e.lead = outer
+}
+
+// leadBound evaluates one end of a voicelead range: a note or a MIDI key.
+func (e *elab) leadBound(x ast.Expr, sc *scope) (int, bool) {
+	v, err := value.Eval(x, sc.env)
+	if err != nil {
+		e.errs = append(e.errs, err)
+		return 0, false
+	}
+	keys, ok := v.Keys()
+	if !ok || len(keys) != 1 {
+		e.errorf(x.Pos(), "voicelead range ends must be notes or MIDI keys, got a %s", v.Kind)
+		return 0, false
+	}
+	return int(keys[0]), true
+}
+
+// leadChord places a chord sounded inside voicelead. A chord voiced
+// explicitly sounds as written; a slash chord keeps its bass at the bottom
+// and only moves by octaves. Either way, the next chord leads on from it.
+// Single notes pass through.
+func (e *elab) leadChord(keys []uint8, voiced, slash bool) []uint8 {
+	if e.lead == nil || len(keys) < 2 {
+		return keys
+	}
+	if !voiced {
+		keys = e.lead.place(keys, !slash)
+	}
+	e.lead.prev = keys
+	return keys
+}
+
+// place picks the inversion (when invert is set) and octave of keys that
+// moves least from the previous chord, with every tone in range. The first
+// chord keeps its written voicing and moves by the fewest octaves that fit
+// it. Ties go to the placement whose average pitch is closest to the
+// previous chord's, then to the lower inversion and octave, so the result
+// only depends on the source. A chord that cannot fit sounds as written.
+func (l *voiceLead) place(keys []uint8, invert bool) []uint8 {
+	cand := make([]int, len(keys))
+	for i, k := range keys {
+		cand[i] = int(k)
+	}
+	slices.Sort(cand)
+	inversions := len(cand)
+	if l.prev == nil || !invert {
+		inversions = 1
+	}
+	var best []int
+	bestCost, bestDrift := math.MaxInt, math.MaxInt
+	for inv := 0; inv < inversions; inv++ {
+		if inv > 0 {
+			cand = append(cand[1:], cand[0]+12)
+			slices.Sort(cand)
+		}
+		for shift := -120; shift <= 120; shift += 12 {
+			if cand[0]+shift < l.lo || cand[len(cand)-1]+shift > l.hi {
+				continue
+			}
+			placed := make([]int, len(cand))
+			for i, k := range cand {
+				placed[i] = k + shift
+			}
+			cost, drift := abs(shift), 0
+			if l.prev != nil {
+				cost, drift = movement(placed, l.prev)
+			}
+			if cost < bestCost || cost == bestCost && drift < bestDrift {
+				best, bestCost, bestDrift = placed, cost, drift
+			}
+		}
+	}
+	if best == nil {
+		return keys
+	}
+	out := make([]uint8, len(best))
+	for i, k := range best {
+		out[i] = uint8(k)
+	}
+	return out
+}
+
+// movement measures how far a chord moves to reach another: each tone's
+// distance to the nearest tone of the other chord, summed both ways so
+// chords of different sizes compare fairly. It also returns the distance
+// between their average pitches, scaled by both sizes to stay whole.
+func movement(to []int, from []uint8) (int, int) {
+	prev := make([]int, len(from))
+	for i, k := range from {
+		prev[i] = int(k)
+	}
+	cost := 0
+	for _, x := range to {
+		cost += nearest(x, prev)
+	}
+	for _, y := range prev {
+		cost += nearest(y, to)
+	}
+	return cost, abs(sum(to)*len(prev) - sum(prev)*len(to))
+}
+
+// nearest is the distance from key x to the closest of keys.
+func nearest(x int, keys []int) int {
+	d := math.MaxInt
+	for _, k := range keys {
+		d = min(d, abs(x-k))
+	}
+	return d
+}
+
+func sum(xs []int) int {
+	t := 0
+	for _, x := range xs {
+		t += x
+	}
+	return t
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
 // ---------------------------------------------------------------------------
 // Bars and the step grid (docs §3a)
 // ---------------------------------------------------------------------------
@@ -582,6 +1234,7 @@ func (e *elab) elabBar(bar *ast.Bar, sc *scope, parentVel int) {
 		curStep:  baseGrid,
 		baseGrid: baseGrid,
 		barVel:   barVel,
+		fixedVel: bar.Velocity != nil,
 		swing:    e.swing,
 	}
 	bc.run(bar.Items)
@@ -603,11 +1256,20 @@ type barCtx struct {
 	curStep  int    // current grid step note-value
 	baseGrid int    // bar's base grid (BarSep / "|" resets to this)
 	barVel   int
+	fixedVel bool    // the bar set its own velocity, over any hairpin
 	swing    float64 // swing ratio (0.5 = straight) for this bar
+}
 
-	// lastNoteOffs holds the NoteOff events of the previous sounding step so a
-	// tilde can extend their gate.
-	lastNoteOffs []int // indices into song.Events
+// velocityAt returns the velocity of a step without its own, sounding at
+// tick: the bar's, else the running hairpin's, else the track's. A finished
+// hairpin's target holds only where the track sets no velocity of its own.
+func (bc *barCtx) velocityAt(tick uint32) int {
+	if !bc.fixedVel {
+		if v, done, ok := bc.e.hairpinVelocity(tick); ok && (!done || bc.barVel < 0) {
+			return v
+		}
+	}
+	return bc.barVel
 }
 
 func (bc *barCtx) run(items []ast.BarItem) {
@@ -619,6 +1281,10 @@ func (bc *barCtx) run(items []ast.BarItem) {
 			bc.curStep = bc.baseGrid
 		case *ast.Step:
 			bc.step(n)
+		case *ast.Tuplet:
+			bc.tuplet(n)
+		case *ast.Arp:
+			bc.arp(n)
 		case *ast.Absolute:
 			bc.absolute(n)
 		case *ast.Meta:
@@ -627,7 +1293,7 @@ func (bc *barCtx) run(items []ast.BarItem) {
 			// Raw event statement in a bar slot: emit at cursor, advance one step.
 			bc.e.elabEventStmt(it.(ast.Stmt), bc.sc, bc.start+bc.cursor, bc.e.trackChan, bc.barVel)
 			bc.cursor += durTicks(bc.curStep)
-			bc.lastNoteOffs = nil
+			bc.e.lastNoteOffs = nil
 		}
 	}
 }
@@ -638,21 +1304,159 @@ func (bc *barCtx) step(st *ast.Step) {
 		repeat = 1
 	}
 	for i := 0; i < repeat; i++ {
-		bc.oneStep(st)
+		bc.oneStep(st, durTicks(bc.curStep))
+	}
+}
+
+// tuplet plays n.Actual steps in the time of n.Normal grid steps. Onsets are
+// placed at exact fractions of the span (rounded down to a tick), so the group
+// always ends precisely where the Normal steps would.
+func (bc *barCtx) tuplet(n *ast.Tuplet) {
+	if n.Actual <= 0 || n.Normal <= 0 {
+		bc.e.errorf(n.Position, "invalid tuplet %d:%d", n.Actual, n.Normal)
+		return
+	}
+	span := uint64(durTicks(bc.curStep)) * uint64(n.Normal)
+	start := bc.cursor
+	at := func(i int) uint32 { return start + uint32(uint64(i)*span/uint64(n.Actual)) }
+
+	// Tuplet steps are already uneven against the grid: they never swing.
+	swing := bc.swing
+	bc.swing = 0.5
+	i := 0
+	for _, st := range n.Steps {
+		for r := 0; r < max(st.Repeat, 1); r++ {
+			bc.cursor = at(i)
+			bc.oneStep(st, at(i+1)-at(i))
+			i++
+		}
+	}
+	bc.swing = swing
+	bc.cursor = at(i)
+	if i == 0 {
+		return
+	}
+	bc.e.song.Tuplets = append(bc.e.song.Tuplets, Tuplet{
+		Track: bc.e.curTrack, Start: bc.start + start, End: bc.start + bc.cursor,
+		Actual: n.Actual, Normal: n.Normal,
+	})
+}
+
+// arp plays an arpeggio from the cursor, one tone per rate step, until its
+// `over` length or the bar is used up; a last step cut short by the end keeps
+// what is left. Arp steps swing and humanize like written ones.
+func (bc *barCtx) arp(n *ast.Arp) {
+	e := bc.e
+	keys, ok := e.playableKeys(n.Play, bc.sc)
+	if !ok {
+		return
+	}
+	seq := ArpOrder(keys, n.Mode, n.Octaves)
+	if len(seq) == 0 {
+		return
+	}
+	e.curLine = n.Position.Line
+
+	rate := bc.curStep
+	if n.Rate > 0 {
+		rate = n.Rate
+	}
+	stepLen := durTicks(rate)
+	end := uint32(e.timeBeats) * durTicks(e.timeUnit)
+	if n.Over > 0 {
+		end = bc.cursor + durTicks(n.Over)
+	}
+	for i := 0; bc.cursor < end; i++ {
+		length := min(stepLen, end-bc.cursor)
+		key := seq[i%len(seq)]
+		if n.Mode == ast.ArpRandom {
+			key = seq[int(e.rng.Float(n.Position, "arp")*float64(len(seq)))]
+		}
+		gate := max(1, uint32(float64(length)*n.Gate/100))
+		on := bc.start + bc.cursor + bc.swingDelay(length)
+		v := bc.velocityAt(on)
+		if n.Velocity != nil {
+			v = velocityValue(n.Velocity)
+		}
+		if v < 0 {
+			v = 64
+		}
+		if e.humanize != nil {
+			v += int(math.Round(e.jitter(n.Position, "velocity", e.humanize.Velocity)))
+			v = max(1, min(127, v))
+		}
+		e.emit(on, MIDIMsg{Kind: MsgNoteOn, Channel: e.trackChan, Key: key, Velocity: uint8(v)})
+		onIdx := len(e.song.Events) - 1
+		e.emit(on+gate, MIDIMsg{Kind: MsgNoteOff, Channel: e.trackChan, Key: key})
+		e.lastNoteOffs = []int{len(e.song.Events) - 1}
+		if e.humanize != nil {
+			e.humanizeStep(n.Position, bc.start, length, gate, []int{onIdx}, e.lastNoteOffs)
+		}
+		bc.cursor += length
 	}
 }
 
-func (bc *barCtx) oneStep(st *ast.Step) {
-	stepLen := durTicks(bc.curStep)
+// ArpOrder returns one cycle of an arpeggio over keys: the tones as written
+// (ArpAsPlayed) or sorted, repeated an octave higher for each further octave,
+// then arranged by mode. ArpRandom returns the pool it draws from, lowest
+// first.
+func ArpOrder(keys []uint8, mode ast.ArpMode, octaves int) []uint8 {
+	base := append([]uint8(nil), keys...)
+	if mode != ast.ArpAsPlayed {
+		sort.Slice(base, func(i, j int) bool { return base[i] < base[j] })
+	}
+	var seq []uint8
+	for o := 0; o < max(octaves, 1); o++ {
+		for _, k := range base {
+			if int(k)+12*o <= 127 {
+				seq = append(seq, k+uint8(12*o))
+			}
+		}
+	}
+	switch mode {
+	case ast.ArpDown:
+		slices.Reverse(seq)
+	case ast.ArpUpDown:
+		for i := len(seq) - 2; i > 0; i-- {
+			seq = append(seq, seq[i])
+		}
+	}
+	return seq
+}
+
+// playableKeys resolves a playable to its MIDI keys without sounding it: a
+// group's voices in the order written, a chord's tones from its root up.
+func (e *elab) playableKeys(p ast.Playable, sc *scope) ([]uint8, bool) {
+	switch n := p.(type) {
+	case *ast.NoteRef:
+		return e.resolveNoteRef(n, sc)
+	case *ast.ExprPlay:
+		return e.resolveExprPlay(n, sc)
+	case *ast.Group:
+		var keys []uint8
+		for _, voice := range n.Voices {
+			k, ok := e.playableKeys(voice, sc)
+			if !ok {
+				return nil, false
+			}
+			keys = append(keys, k...)
+		}
+		return keys, true
+	}
+	e.errorf(p.Pos(), "nothing to arpeggiate")
+	return nil, false
+}
 
+// oneStep plays a single step lasting stepLen ticks at the cursor.
+func (bc *barCtx) oneStep(st *ast.Step, stepLen uint32) {
 	switch st.Play.(type) {
 	case *ast.Rest:
 		bc.cursor += stepLen
-		bc.lastNoteOffs = nil
+		bc.e.lastNoteOffs = nil
 		return
 	case *ast.Tie:
 		// Extend the previous step's gate by one grid step, then advance.
-		for _, idx := range bc.lastNoteOffs {
+		for _, idx := range bc.e.lastNoteOffs {
 			bc.e.song.Events[idx].Tick += stepLen
 		}
 		bc.cursor += stepLen
@@ -664,8 +1468,11 @@ func (bc *barCtx) oneStep(st *ast.Step) {
 		gate = durTicks(st.Gate)
 	}
 
-	// velocity precedence: per-step > bar default > track default > 64
-	vel := bc.barVel
+	onTick := bc.start + bc.cursor + bc.swingDelay(stepLen)
+	offTick := onTick + gate
+
+	// velocity precedence: per-step > bar default > hairpin > track default > 64
+	vel := bc.velocityAt(onTick)
 	if st.Velocity != nil {
 		vel = velocityValue(st.Velocity)
 	}
@@ -673,10 +1480,16 @@ func (bc *barCtx) oneStep(st *ast.Step) {
 		vel = 64
 	}
 
-	onTick := bc.start + bc.cursor + bc.swingDelay(stepLen)
-	offTick := onTick + gate
-
-	bc.lastNoteOffs = bc.e.playNote(st.Play, bc.sc, onTick, offTick, uint8(vel))
+	h := bc.e.humanize
+	if h != nil {
+		vel += int(math.Round(bc.e.jitter(st.Position, "velocity", h.Velocity)))
+		vel = max(1, min(127, vel))
+	}
+	ons, offs := bc.e.playNote(st.Play, bc.sc, onTick, offTick, uint8(vel))
+	bc.e.lastNoteOffs = offs
+	if h != nil {
+		bc.e.humanizeStep(st.Position, bc.start, stepLen, gate, ons, offs)
+	}
 	bc.cursor += stepLen
 }
 
@@ -686,24 +1499,76 @@ func (bc *barCtx) oneStep(st *ast.Step) {
 // delayed by (2s-1)*stepLen so it lands later in the pair. s=0.5 is straight,
 // so the delay is zero. Only whole, aligned grid steps swing; the offset never
 // pushes a step past the on-beat that follows it.
+//
+// In a compound or additive meter, steps shorter than a beat pair up within
+// their beat, so a dotted beat split into three eighths (already a long-short
+// lilt) stays straight, while its sixteenths swing in pairs. Simple meters
+// keep pairing steps across the bar, triplets included.
 func (bc *barCtx) swingDelay(stepLen uint32) uint32 {
 	if bc.swing == 0.5 || stepLen == 0 {
 		return 0
 	}
-	if (bc.cursor/stepLen)%2 == 0 {
+	pos := bc.cursor
+	grouped := compoundMeter(bc.e.timeBeats, bc.e.timeUnit) || len(bc.e.timeGroups) > 0
+	if start, beatLen := bc.e.beatAt(bc.cursor); grouped && stepLen < beatLen {
+		if (beatLen/stepLen)%2 != 0 {
+			return 0 // an odd subdivision has nothing to pair with
+		}
+		pos -= start
+	}
+	if (pos/stepLen)%2 == 0 {
 		return 0 // on-beat
 	}
 	return uint32((2*bc.swing - 1) * float64(stepLen))
 }
 
+// humanNote is a humanized note: the song.Events indices of its NoteOn and
+// NoteOff, the bar start its onset may not precede, and the random amounts by
+// which to move its onset and stretch its gate.
+type humanNote struct {
+	on, off int
+	floor   uint32
+	shift   int64
+	stretch int64
+}
+
+// jitter draws a deviation in [-amount, amount] for the construct at pos.
+func (e *elab) jitter(pos token.Position, what string, amount float64) float64 {
+	if amount == 0 {
+		return 0
+	}
+	return amount * (2*e.rng.Float(pos, "humanize "+what) - 1)
+}
+
+// humanizeStep draws the timing and gate deviations of the step just played at
+// pos and records them for the notes it emitted, given as the song.Events
+// indices of their NoteOns and matching NoteOffs. They are applied by
+// applyHumanize once the track is complete, when the next onset of each key,
+// which bounds them, is known.
+func (e *elab) humanizeStep(pos token.Position, barStart, stepLen, gate uint32, ons, offs []int) {
+	h := e.humanize
+	timing, stretch := h.Timing.Amount, h.Gate.Amount
+	if h.Timing.Percent {
+		timing *= float64(stepLen) / 100
+	}
+	if h.Gate.Percent {
+		stretch *= float64(gate) / 100
+	}
+	shift := int64(math.Round(e.jitter(pos, "timing", timing)))
+	grow := int64(math.Round(e.jitter(pos, "gate", stretch)))
+	for i, off := range offs {
+		e.humanized = append(e.humanized, humanNote{on: ons[i], off: off, floor: barStart, shift: shift, stretch: grow})
+	}
+}
+
 func (bc *barCtx) absolute(n *ast.Absolute) {
 	beat, err := value.EvalNumber(n.Beat, bc.sc.env)
 	if err != nil {
 		bc.e.errs = append(bc.e.errs, err)
 		return
 	}
-	// beat N -> (N-1)*PPQ within the bar; does not move the cursor.
-	at := bc.start + uint32((beat-1)*float64(PPQ))
+	// beat N -> the start of the bar's Nth beat; does not move the cursor.
+	at := bc.start + bc.e.beatOffset(beat)
 
 	switch ev := n.Event.(type) {
 	case *ast.Step:
@@ -711,7 +1576,7 @@ func (bc *barCtx) absolute(n *ast.Absolute) {
 		if ev.HasGate {
 			gate = durTicks(ev.Gate)
 		}
-		vel := bc.barVel
+		vel := bc.velocityAt(at)
 		if ev.Velocity != nil {
 			vel = velocityValue(ev.Velocity)
 		}
@@ -729,15 +1594,16 @@ func (bc *barCtx) absolute(n *ast.Absolute) {
 // ---------------------------------------------------------------------------
 
 // playNote resolves a playable to pitches and emits NoteOn at onTick / NoteOff
-// at offTick. It returns the song.Events indices of the emitted NoteOffs so a
-// following tie can extend their gate.
-func (e *elab) playNote(p ast.Playable, sc *scope, onTick, offTick uint32, vel uint8) []int {
+// at offTick. It returns the song.Events indices of the emitted NoteOns and,
+// in the same order, of their NoteOffs, so humanize can move each note and a
+// following tie can extend its gate.
+func (e *elab) playNote(p ast.Playable, sc *scope, onTick, offTick uint32, vel uint8) (ons, offs []int) {
 	if p != nil {
 		e.curLine = p.Pos().Line
 	}
-	var offs []int
 	emitPitch := func(ch uint8, key uint8) {
 		e.emit(onTick, MIDIMsg{Kind: MsgNoteOn, Channel: ch, Key: key, Velocity: vel})
+		ons = append(ons, len(e.song.Events)-1)
 		e.emit(offTick, MIDIMsg{Kind: MsgNoteOff, Channel: ch, Key: key})
 		offs = append(offs, len(e.song.Events)-1)
 	}
@@ -750,8 +1616,9 @@ func (e *elab) playNote(p ast.Playable, sc *scope, onTick, offTick uint32, vel u
 		}
 		keys, ok := e.resolveNoteRef(n, sc)
 		if !ok {
-			return nil
+			return nil, nil
 		}
+		keys = e.leadChord(keys, len(n.Voicing) > 0, strings.Contains(n.Text, "/"))
 		for _, k := range keys {
 			emitPitch(ch, k)
 		}
@@ -760,34 +1627,67 @@ func (e *elab) playNote(p ast.Playable, sc *scope, onTick, offTick uint32, vel u
 		if n.Channel >= 0 {
 			ch = clampChan(n.Channel)
 		}
-		v, err := value.Eval(n.Value, sc.env)
-		if err != nil {
-			e.errs = append(e.errs, err)
-			return nil
-		}
-		keys, ok := v.Keys()
+		keys, ok := e.resolveExprPlay(n, sc)
 		if !ok {
-			e.errorf(n.Position, "expression is not playable as a note")
-			return nil
+			return nil, nil
 		}
+		keys = e.leadChord(keys, len(n.Voicing) > 0, false)
 		for _, k := range keys {
 			emitPitch(ch, k)
 		}
 	case *ast.Group:
 		for _, voice := range n.Voices {
-			offs = append(offs, e.playNote(voice, sc, onTick, offTick, vel)...)
+			vOns, vOffs := e.playNote(voice, sc, onTick, offTick, vel)
+			ons, offs = append(ons, vOns...), append(offs, vOffs...)
 		}
 	case *ast.Rest, *ast.Tie:
 		// handled by the caller
 	default:
 		e.errorf(p.Pos(), "unsupported playable %T", p)
 	}
-	return offs
+	return ons, offs
 }
 
-// resolveNoteRef resolves a NoteRef.Text to MIDI keys, following the order:
-// kit alias -> let/loop binding -> percussion -> note -> chord.
+// resolveNoteRef resolves a NoteRef to MIDI keys, voiced as written.
 func (e *elab) resolveNoteRef(n *ast.NoteRef, sc *scope) ([]uint8, bool) {
+	keys, ok := e.resolveNoteText(n, sc)
+	if !ok {
+		return nil, false
+	}
+	return e.voice(keys, n.Voicing)
+}
+
+// resolveExprPlay evaluates a computed playable to MIDI keys, voiced as
+// written.
+func (e *elab) resolveExprPlay(n *ast.ExprPlay, sc *scope) ([]uint8, bool) {
+	v, err := value.Eval(n.Value, sc.env)
+	if err != nil {
+		e.errs = append(e.errs, err)
+		return nil, false
+	}
+	keys, ok := v.Keys()
+	if !ok {
+		e.errorf(n.Position, "expression is not playable as a note")
+		return nil, false
+	}
+	return e.voice(keys, n.Voicing)
+}
+
+// voice applies a playable's voicings (`inv 2`, `drop 2`, ...) in order.
+func (e *elab) voice(keys []uint8, vs []ast.Voicing) ([]uint8, bool) {
+	for _, v := range vs {
+		var err error
+		if keys, err = value.Voice(keys, v); err != nil {
+			e.errorf(v.Position, "%v", err)
+			return nil, false
+		}
+	}
+	return keys, true
+}
+
+// resolveNoteText resolves a NoteRef.Text to MIDI keys, following the order:
+// kit alias -> let/loop binding -> percussion -> note -> chord.
+func (e *elab) resolveNoteText(n *ast.NoteRef, sc *scope) ([]uint8, bool) {
 	if val, ok := sc.lookupKit(n.Text); ok {
 		if key, err := lmidi.PercussionKeyMap(val); err == nil {
 			return []uint8{key}, true
@@ -814,6 +1714,14 @@ func (e *elab) resolveNoteRef(n *ast.NoteRef, sc *scope) ([]uint8, bool) {
 	if keys, ok := resolvePitch(n.Text); ok {
 		return keys, true
 	}
+	// A roman numeral or scale degree names a chord or note of the key.
+	if abs, ok := sc.env.Key().ResolveDegree(n.Text); ok {
+		if keys, ok := resolvePitch(abs); ok {
+			return keys, true
+		}
+		e.errorf(n.Position, "%q in %s is %q, not a valid note or chord", n.Text, sc.env.Key(), abs)
+		return nil, false
+	}
 	e.errorf(n.Position, "cannot resolve %q to a note, chord, or percussion", n.Text)
 	return nil, false
 }
@@ -946,7 +1854,7 @@ func (e *elab) emitMeta(tick uint32, m *ast.Meta) {
 func (e *elab) elabEventStmt(st ast.Stmt, sc *scope, tick uint32, ch uint8, vel int) {
 	switch n := st.(type) {
 	case *ast.CC:
-		ctrl, err := value.EvalNumber(n.Controller, sc.env)
+		ctrl, err := controllerNumber(n.Controller, sc)
 		if err != nil {
 			e.errs = append(e.errs, err)
 			return
@@ -956,16 +1864,39 @@ func (e *elab) elabEventStmt(st ast.Stmt, sc *scope, tick uint32, ch uint8, vel
 			e.errs = append(e.errs, err)
 			return
 		}
+		if n.Ramp != nil {
+			e.evalRamp(n.Position, n.Ramp, sc, tick, val, func(v float64) int { return max(0, min(127, int(math.Round(v)))) },
+				func(v int) MIDIMsg {
+					return MIDIMsg{Kind: MsgCC, Channel: ch, Controller: uint8(ctrl), Value: uint8(v)}
+				})
+			return
+		}
 		e.emit(tick, MIDIMsg{Kind: MsgCC, Channel: ch, Controller: uint8(ctrl), Value: uint8(val)})
 	case *ast.Bend:
 		e.elabBend(n, sc, tick, ch)
+	case *ast.Param:
+		e.elabParam(n, sc, tick, ch)
 	case *ast.Pressure:
 		val, err := value.EvalNumber(n.Value, sc.env)
 		if err != nil {
 			e.errs = append(e.errs, err)
 			return
 		}
-		e.emit(tick, MIDIMsg{Kind: MsgPressure, Channel: ch, Value: uint8(val)})
+		if val < 0 || val > 127 {
+			e.errorf(n.Position, "pressure %g out of range (must be 0..127)", val)
+			return
+		}
+		if n.Key == nil {
+			e.emit(tick, MIDIMsg{Kind: MsgPressure, Channel: ch, Value: uint8(val)})
+			return
+		}
+		keys, ok := e.playableKeys(n.Key, sc)
+		if !ok {
+			return
+		}
+		for _, k := range keys {
+			e.emit(tick, MIDIMsg{Kind: MsgPolyPressure, Channel: ch, Key: k, Value: uint8(val)})
+		}
 	case *ast.Program_:
 		var pc uint8
 		if n.HasName {
@@ -993,6 +1924,33 @@ func (e *elab) elabEventStmt(st ast.Stmt, sc *scope, tick uint32, ch uint8, vel
 	}
 }
 
+// controllerNumber evaluates the controller of a cc: a name from the
+// controller table (`cutoff`), or any number expression.
+func controllerNumber(x ast.Expr, sc *scope) (float64, error) {
+	if id, ok := x.(*ast.Ident); ok {
+		if n, err := lmidi.ControllerNumber(id.Name); err == nil {
+			return float64(n), nil
+		}
+	}
+	return value.EvalNumber(x, sc.env)
+}
+
+// elabMixer sends the controller behind `volume 100;`, `pan -20;` and the
+// like at the track offset.
+func (e *elab) elabMixer(n *ast.Mixer, sc *scope) {
+	v, err := value.EvalNumber(n.Value, sc.env)
+	if err != nil {
+		e.errs = append(e.errs, err)
+		return
+	}
+	ctrl, _ := lmidi.ControllerNumber(n.Name)
+	if n.Name == "pan" {
+		v += 64
+	}
+	val := max(0, min(127, int(math.Round(v))))
+	e.emit(e.trackOffset, MIDIMsg{Kind: MsgCC, Channel: e.trackChan, Controller: ctrl, Value: uint8(val)})
+}
+
 func (e *elab) elabBend(n *ast.Bend, sc *scope, tick uint32, ch uint8) {
 	switch n.Mode {
 	case ast.BendRaw:
@@ -1002,6 +1960,12 @@ func (e *elab) elabBend(n *ast.Bend, sc *scope, tick uint32, ch uint8) {
 			return
 		}
 		// raw 14-bit value 0..16383 (8192 = center); Bend wants -8192..8191.
+		toBend := func(raw float64) int { return max(-8192, min(8191, int(math.Round(raw))-8192)) }
+		if n.Ramp != nil {
+			e.evalRamp(n.Position, n.Ramp, sc, tick, raw, toBend,
+				func(v int) MIDIMsg { return MIDIMsg{Kind: MsgPitchBend, Channel: ch, Bend: int16(v)} })
+			return
+		}
 		e.emit(tick, MIDIMsg{Kind: MsgPitchBend, Channel: ch, Bend: int16(int(raw) - 8192)})
 	case ast.BendRange:
 		semis, err := value.EvalNumber(n.Value, sc.env)
@@ -1027,24 +1991,139 @@ func (e *elab) elabBend(n *ast.Bend, sc *scope, tick uint32, ch uint8) {
 		if rng == 0 {
 			rng = 2
 		}
-		val := int16(semis / rng * 8192.0)
-		if val > 8191 {
-			val = 8191
+		toBend := func(semis float64) int { return max(-8192, min(8191, int(semis/rng*8192.0))) }
+		if n.Ramp != nil {
+			e.evalRamp(n.Position, n.Ramp, sc, tick, semis, toBend,
+				func(v int) MIDIMsg { return MIDIMsg{Kind: MsgPitchBend, Channel: ch, Bend: int16(v)} })
+			return
 		}
-		if val < -8192 {
-			val = -8192
+		e.emit(tick, MIDIMsg{Kind: MsgPitchBend, Channel: ch, Bend: int16(toBend(semis))})
+	}
+}
+
+// evalRamp evaluates the target of a cc or bend ramp starting from `from` at
+// tick and emits it. quantize turns a point of the ramp into the value msg
+// sends.
+func (e *elab) evalRamp(pos token.Position, r *ast.Ramp, sc *scope, tick uint32, from float64, quantize func(float64) int, msg func(int) MIDIMsg) {
+	to, err := value.EvalNumber(r.To, sc.env)
+	if err != nil {
+		e.errs = append(e.errs, err)
+		return
+	}
+	barLen := uint32(e.timeBeats) * durTicks(e.timeUnit)
+	span := spanTicks(r.Over, barLen)
+	if span == 0 {
+		e.errorf(pos, "ramp has an empty span")
+		return
+	}
+	every := uint32(rampStep)
+	if r.Every > 0 {
+		every = durTicks(r.Every)
+	}
+	e.emitRamp(tick, span, every, from, to, r.Curve, quantize, msg)
+}
+
+// emitRamp expands a ramp from `from` to `to` over span ticks starting at tick
+// into one event every `every` ticks, landing exactly on the target at the
+// end. Points that quantize to the value just sent are skipped.
+func (e *elab) emitRamp(tick, span, every uint32, from, to float64, c ast.Curve, quantize func(float64) int, msg func(int) MIDIMsg) {
+	last, sent := 0, false
+	point := func(at uint32, v float64) {
+		q := quantize(v)
+		if sent && q == last {
+			return
 		}
-		e.emit(tick, MIDIMsg{Kind: MsgPitchBend, Channel: ch, Bend: val})
+		e.emit(at, msg(q))
+		last, sent = q, true
+	}
+	for t := uint32(0); t < span; t += every {
+		point(tick+t, rampValue(from, to, float64(t)/float64(span), c))
 	}
+	point(tick+span, to)
 }
 
 // emitBendRangeRPN sets pitch-bend sensitivity via RPN 0
 // (CC101=0, CC100=0, CC6=semitones, CC38=0).
 func (e *elab) emitBendRangeRPN(tick uint32, ch uint8, semitones uint8) {
-	e.emit(tick, MIDIMsg{Kind: MsgCC, Channel: ch, Controller: 101, Value: 0})
-	e.emit(tick, MIDIMsg{Kind: MsgCC, Channel: ch, Controller: 100, Value: 0})
-	e.emit(tick, MIDIMsg{Kind: MsgCC, Channel: ch, Controller: 6, Value: semitones})
-	e.emit(tick, MIDIMsg{Kind: MsgCC, Channel: ch, Controller: 38, Value: 0})
+	e.emitParam(tick, ch, 101, 100, 0, uint16(semitones)<<7)
+}
+
+// emitParam writes the 14-bit value to parameter num: its MSB and LSB on the
+// msb and lsb select controllers (101/100 for an RPN, 99/98 for an NRPN),
+// then the value on data entry (CC6, CC38).
+func (e *elab) emitParam(tick uint32, ch, msb, lsb uint8, num, val uint16) {
+	e.emit14(tick, ch, msb, lsb, num)
+	e.emit14(tick, ch, 6, 38, val)
+}
+
+// emit14 sends the 14-bit value v as its MSB on controller msb and its LSB on
+// controller lsb.
+func (e *elab) emit14(tick uint32, ch, msb, lsb uint8, v uint16) {
+	e.emit(tick, MIDIMsg{Kind: MsgCC, Channel: ch, Controller: msb, Value: uint8(v >> 7 & 0x7F)})
+	e.emit(tick, MIDIMsg{Kind: MsgCC, Channel: ch, Controller: lsb, Value: uint8(v & 0x7F)})
+}
+
+// elabParam expands rpn, nrpn and cc14 into their controller sequences. Like
+// `bend range`, an rpn to the bend range also sets the range later bends
+// scale to.
+func (e *elab) elabParam(n *ast.Param, sc *scope, tick uint32, ch uint8) {
+	var num float64
+	var err error
+	switch n.Kind {
+	case ast.ParamCC14:
+		num, err = controllerNumber(n.Number, sc)
+	case ast.ParamRPN:
+		num, err = rpnNumber(n.Number, sc)
+	default:
+		num, err = value.EvalNumber(n.Number, sc.env)
+	}
+	if err != nil {
+		e.errs = append(e.errs, err)
+		return
+	}
+	v, err := value.EvalNumber(n.Value, sc.env)
+	if err != nil {
+		e.errs = append(e.errs, err)
+		return
+	}
+	val := uint16(max(0, min(16383, int(math.Round(v)))))
+	switch n.Kind {
+	case ast.ParamCC14:
+		if num < 0 || num > 31 {
+			e.errorf(n.Position, "cc14 controller %g out of range (must be 0..31)", num)
+			return
+		}
+		e.emit14(tick, ch, uint8(num), uint8(num)+32, val)
+		return
+	}
+	if num < 0 || num > 16383 {
+		e.errorf(n.Position, "parameter %g out of range (must be 0..16383)", num)
+		return
+	}
+	switch n.Kind {
+	case ast.ParamRPN:
+		e.emitParam(tick, ch, 101, 100, uint16(num), val)
+		if num == 0 {
+			e.bendRange = uint8(val >> 7)
+			e.bendRangeRP = true
+		}
+	case ast.ParamNRPN:
+		e.emitParam(tick, ch, 99, 98, uint16(num), val)
+	}
+	if n.Reset {
+		e.emit14(tick, ch, 101, 100, 0x3FFF)
+	}
+}
+
+// rpnNumber evaluates the parameter of an rpn: a name from the registered
+// parameter table (`finetune`), or any number expression.
+func rpnNumber(x ast.Expr, sc *scope) (float64, error) {
+	if id, ok := x.(*ast.Ident); ok {
+		if n, err := lmidi.RPNNumber(id.Name); err == nil {
+			return float64(n), nil
+		}
+	}
+	return value.EvalNumber(x, sc.env)
 }
 
 // ---------------------------------------------------------------------------
@@ -1070,6 +2149,13 @@ func velocityValue(v *ast.Velocity) int {
 // ---------------------------------------------------------------------------
 
 func (e *elab) finalize() {
+	e.applyHumanize()
+	e.buildTempoMap()
+	e.buildMeterMap()
+	sort.SliceStable(e.song.Keys, func(i, j int) bool {
+		return e.song.Keys[i].Tick < e.song.Keys[j].Tick
+	})
+
 	evs := e.song.Events
 	sort.SliceStable(evs, func(i, j int) bool {
 		if evs[i].Tick != evs[j].Tick {
@@ -1087,6 +2173,182 @@ func (e *elab) finalize() {
 	})
 }
 
+// applyHumanize moves the onsets and gates of humanized notes by their drawn
+// amounts. An onset never moves before the start of its bar nor, for notes of
+// one key on one channel, onto or past the next onset of that key, so repeated
+// notes keep their order; a gate that ended before the next onset of its key
+// still does. Ties extended the NoteOffs already, so a tied note keeps its
+// length.
+func (e *elab) applyHumanize() {
+	if len(e.humanized) == 0 {
+		return
+	}
+	evs := e.song.Events
+	type voice struct {
+		track   int
+		ch, key uint8
+	}
+	onsets := map[voice][]int{}
+	for i, ev := range evs {
+		if ev.Msg.Kind == MsgNoteOn {
+			v := voice{ev.Track, ev.Msg.Channel, ev.Msg.Key}
+			onsets[v] = append(onsets[v], i)
+		}
+	}
+	byOn := map[int]humanNote{}
+	for _, h := range e.humanized {
+		byOn[h.on] = h
+	}
+	for _, ons := range onsets {
+		sort.SliceStable(ons, func(i, j int) bool { return evs[ons[i]].Tick < evs[ons[j]].Tick })
+		nominal := make([]int64, len(ons))
+		for j, i := range ons {
+			nominal[j] = int64(evs[i].Tick)
+		}
+		next := func(j int) (int64, bool) {
+			if j+1 < len(ons) && nominal[j+1] > nominal[j] {
+				return nominal[j+1], true
+			}
+			return 0, false
+		}
+		final := make([]int64, len(ons))
+		for j, i := range ons {
+			final[j] = nominal[j]
+			h, ok := byOn[i]
+			if !ok {
+				continue
+			}
+			lo := int64(h.floor)
+			if j > 0 && nominal[j-1] < nominal[j] {
+				lo = max(lo, final[j-1]+1)
+			}
+			t := max(lo, nominal[j]+h.shift)
+			if n, ok := next(j); ok {
+				t = min(t, n-1)
+			}
+			final[j] = t
+		}
+		for j, i := range ons {
+			h, ok := byOn[i]
+			if !ok {
+				continue
+			}
+			off := int64(evs[h.off].Tick)
+			end := off + final[j] - nominal[j] + h.stretch
+			if n, ok := next(j); ok && off <= n {
+				end = min(end, final[j+1])
+			}
+			evs[i].Tick = uint32(final[j])
+			evs[h.off].Tick = uint32(max(end, final[j]+1))
+		}
+	}
+}
+
+// buildTempoMap folds the project tempo and every body-level `bpm` change (ramp
+// steps included) into Song.Tempos. Changes at the same tick resolve to the
+// one elaborated last, and a change that restates the running tempo is dropped.
+func (e *elab) buildTempoMap() {
+	changes := append([]TempoChange{{Tick: 0, BPM: e.song.BPM}}, e.tempos...)
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Tick < changes[j].Tick
+	})
+	var byTick []TempoChange
+	for _, c := range changes {
+		if n := len(byTick); n > 0 && byTick[n-1].Tick == c.Tick {
+			byTick[n-1] = c
+			continue
+		}
+		byTick = append(byTick, c)
+	}
+	out := byTick[:1]
+	for _, c := range byTick[1:] {
+		if c.BPM != out[len(out)-1].BPM {
+			out = append(out, c)
+		}
+	}
+	e.song.Tempos = out
+	e.song.BPM = out[0].BPM
+	sort.SliceStable(e.song.Ramps, func(i, j int) bool {
+		return e.song.Ramps[i].Start < e.song.Ramps[j].Start
+	})
+}
+
+// InsideRamp reports whether tick is one of a ramp's intermediate steps, a
+// tempo change the score renderers fold into the ramp's rit. or accel.
+func (s Song) InsideRamp(tick uint32) bool {
+	for _, r := range s.Ramps {
+		if tick > r.Start && tick < r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// buildMeterMap folds the project time signature and every body-level `time`
+// change into Song.Meters, resolving ties and restatements like buildTempoMap.
+func (e *elab) buildMeterMap() {
+	changes := append([]MeterChange{{Tick: 0, Beats: e.song.TimeBeats, Unit: e.song.TimeUnit, Groups: e.song.TimeGroups}}, e.meters...)
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Tick < changes[j].Tick
+	})
+	var byTick []MeterChange
+	for _, c := range changes {
+		if n := len(byTick); n > 0 && byTick[n-1].Tick == c.Tick {
+			byTick[n-1] = c
+			continue
+		}
+		byTick = append(byTick, c)
+	}
+	out := byTick[:1]
+	for _, c := range byTick[1:] {
+		last := out[len(out)-1]
+		if c.Beats != last.Beats || c.Unit != last.Unit || !slices.Equal(c.Groups, last.Groups) {
+			out = append(out, c)
+		}
+	}
+	e.song.Meters = out
+	e.song.TimeBeats, e.song.TimeUnit, e.song.TimeGroups = out[0].Beats, out[0].Unit, out[0].Groups
+}
+
+// MeterMap returns Meters, or for a Song that carries none its single time
+// signature (4/4 by default).
+func (s Song) MeterMap() []MeterChange {
+	if len(s.Meters) > 0 && s.Meters[0].Tick == 0 {
+		return s.Meters
+	}
+	beats, unit := s.TimeBeats, s.TimeUnit
+	if beats == 0 {
+		beats = 4
+	}
+	if unit == 0 {
+		unit = 4
+	}
+	return []MeterChange{{Tick: 0, Beats: beats, Unit: unit, Groups: s.TimeGroups}}
+}
+
+// BarAt returns the 0-based index and the start and end ticks of the bar
+// containing tick. A meter change that falls mid-bar cuts that bar short and
+// starts a new one.
+func (s Song) BarAt(tick uint32) (index int, start, end uint32) {
+	m := s.MeterMap()
+	for i, c := range m {
+		barLen := uint32(c.Beats) * durTicks(c.Unit)
+		next := ^uint32(0)
+		if i+1 < len(m) {
+			next = m[i+1].Tick
+		}
+		if tick >= next {
+			index += int((next - c.Tick + barLen - 1) / barLen)
+			continue
+		}
+		n := (tick - c.Tick) / barLen
+		start = c.Tick + n*barLen
+		end = min(start+barLen, next)
+		return index + int(n), start, end
+	}
+	return 0, 0, 0
+}
+
 func offRank(m MIDIMsg) int {
 	if m.Kind == MsgNoteOff {
 		return 0
@@ -1,12 +1,18 @@
 package elaborator
 
 import (
+	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
+	"github.com/poolpOrg/earmuff/ast"
 	"github.com/poolpOrg/earmuff/parser"
+	"github.com/poolpOrg/earmuff/value"
 )
 
 func elaborateFile(t *testing.T, name string) []Song {
@@ -33,6 +39,40 @@ func elaborateFile(t *testing.T, name string) []Song {
 	return songs
 }
 
+// elaborateSrc parses and elaborates src, failing the test on any parse
+// diagnostic or elaboration error.
+func elaborateSrc(t *testing.T, src string) []Song {
+	t.Helper()
+	return elaborateWith(t, src, Options{})
+}
+
+// elaborateWith is elaborateSrc with elaboration options.
+func elaborateWith(t *testing.T, src string, opts Options) []Song {
+	t.Helper()
+	prog, diags := parser.New(src, "<test>").Parse()
+	if len(diags) != 0 {
+		t.Fatalf("parse: %v", diags)
+	}
+	songs, errs := ElaborateWith(prog, opts)
+	if len(errs) != 0 {
+		t.Fatalf("elaborate: %v", errs)
+	}
+	return songs
+}
+
+// elaborateErr parses src and checks that elaborating it fails, the first
+// error containing want.
+func elaborateErr(t *testing.T, src, want string) {
+	t.Helper()
+	prog, diags := parser.New(src, "<test>").Parse()
+	if len(diags) != 0 {
+		t.Fatalf("parse: %v", diags)
+	}
+	if _, errs := Elaborate(prog); len(errs) == 0 || !strings.Contains(errs[0].Error(), want) {
+		t.Errorf("%s: errors = %v, want %q", src, errs, want)
+	}
+}
+
 // noteOns returns the (tick,key) of every NoteOn in the first track, sorted by
 // tick then key.
 func noteOns(song Song) [][2]int {
@@ -107,6 +147,145 @@ func TestNuagesGates(t *testing.T) {
 	}
 }
 
+func TestHairpin(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { track "t" {
+    cresc p to ff over 1 bar expression;
+    bar 4 { C C C C }
+    bar 4 { C C v 30 C C }
+    bar 4 v 20 { C }
+  } }`)
+	var vels, cc []int
+	for _, ev := range songs[0].Events {
+		switch {
+		case ev.Msg.Kind == MsgNoteOn:
+			vels = append(vels, int(ev.Msg.Velocity))
+		case ev.Msg.Kind == MsgCC && ev.Msg.Controller == 11:
+			cc = append(cc, int(ev.Msg.Value))
+		}
+	}
+	// p (48) to ff (112) over the first bar, then ff holds; the step and bar
+	// velocities still win.
+	want := []int{48, 64, 80, 96, 112, 30, 112, 112, 20}
+	if !reflect.DeepEqual(vels, want) {
+		t.Errorf("velocities = %v, want %v", vels, want)
+	}
+	if len(cc) != 17 || cc[0] != 48 || cc[len(cc)-1] != 112 {
+		t.Errorf("expression = %v, want 17 steps from 48 to 112", cc)
+	}
+	h := songs[0].Hairpins
+	if len(h) != 1 || h[0] != (Hairpin{Start: 0, End: 3840, From: 48, To: 112, FromMark: "p", ToMark: "ff"}) {
+		t.Errorf("hairpins = %+v", h)
+	}
+
+	// A track velocity takes over again once the hairpin's span ends.
+	songs = elaborateSrc(t, `project "p" { track "t" v 20 {
+    pattern riff() { bar 4 { C C } }
+    cresc p to f over 1 bar;
+    riff
+    riff
+  } }`)
+	vels = nil
+	for _, ev := range songs[0].Events {
+		if ev.Msg.Kind == MsgNoteOn {
+			vels = append(vels, int(ev.Msg.Velocity))
+		}
+	}
+	if want := []int{48, 60, 20, 20}; !reflect.DeepEqual(vels, want) {
+		t.Errorf("after the hairpin: velocities = %v, want %v", vels, want)
+	}
+}
+
+func TestRamps(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { track "t" {
+    cc 74 from 0 to 2 over quarter every 16;
+    bar 4 { C bend 0 to +2 over half every 4 }
+  } }`)
+	var cc [][2]int
+	var bend [][2]int
+	for _, ev := range songs[0].Events {
+		switch {
+		case ev.Msg.Kind == MsgCC && ev.Msg.Controller == 74:
+			cc = append(cc, [2]int{int(ev.Tick), int(ev.Msg.Value)})
+		case ev.Msg.Kind == MsgPitchBend:
+			bend = append(bend, [2]int{int(ev.Tick), int(ev.Msg.Bend)})
+		}
+	}
+	// 0, 0.5, 1, 1.5 round to 0, 1, 1, 2: the repeated 1 is dropped.
+	if want := [][2]int{{0, 0}, {240, 1}, {720, 2}}; !reflect.DeepEqual(cc, want) {
+		t.Errorf("cc = %v, want %v", cc, want)
+	}
+	// The bend sits in the second step slot and lands on the full range.
+	if want := [][2]int{{960, 0}, {1920, 4096}, {2880, 8191}}; !reflect.DeepEqual(bend, want) {
+		t.Errorf("bend = %v, want %v", bend, want)
+	}
+}
+
+func TestControllers(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { track "t" {
+    volume 100;
+    pan -20;
+    reverb 40;
+    bar 4 { C cc sustain = 127 }
+  } }`)
+	var got [][3]int
+	for _, ev := range songs[0].Events {
+		if ev.Msg.Kind == MsgCC {
+			got = append(got, [3]int{int(ev.Tick), int(ev.Msg.Controller), int(ev.Msg.Value)})
+		}
+	}
+	want := [][3]int{{0, 7, 100}, {0, 10, 44}, {0, 91, 40}, {960, 64, 127}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("controllers = %v, want %v", got, want)
+	}
+}
+
+func TestParams(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { track "t" {
+    rpn finetune = 8192 reset;
+    nrpn 300 = 64;
+    bar 4 { C cc14 modulation = 9000 }
+  } }`)
+	var got [][3]int
+	for _, ev := range songs[0].Events {
+		if ev.Msg.Kind == MsgCC {
+			got = append(got, [3]int{int(ev.Tick), int(ev.Msg.Controller), int(ev.Msg.Value)})
+		}
+	}
+	want := [][3]int{
+		{0, 101, 0}, {0, 100, 1}, {0, 6, 64}, {0, 38, 0}, {0, 101, 127}, {0, 100, 127},
+		{0, 99, 2}, {0, 98, 44}, {0, 6, 0}, {0, 38, 64},
+		{960, 1, 70}, {960, 33, 40},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("params = %v, want %v", got, want)
+	}
+}
+
+func TestPressure(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { track "t" channel 2 {
+    pressure 90;
+    bar quarter { Cmaj:2 on beat 2 pressure E^4 = 100; _ _ }
+  } }`)
+	var got [][4]int
+	for _, ev := range songs[0].Events {
+		switch ev.Msg.Kind {
+		case MsgPressure, MsgPolyPressure:
+			got = append(got, [4]int{int(ev.Tick), int(ev.Msg.Channel), int(ev.Msg.Key), int(ev.Msg.Value)})
+		}
+	}
+	want := [][4]int{{0, 1, 0, 90}, {960, 1, 64, 100}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pressure = %v, want %v", got, want)
+	}
+
+	for _, src := range []string{
+		`project "p" { track "t" { bar 4 { C on beat 2 pressure C^4 = 200; } } }`,
+		`project "p" { track "t" { let low = -5; pressure E^4 = low; } }`,
+	} {
+		elaborateErr(t, src, "out of range (must be 0..127)")
+	}
+}
+
 func TestElaborate_AllExamples(t *testing.T) {
 	for _, f := range []string{"nuages.ear", "blues.ear", "comp.ear", "bend.ear"} {
 		songs := elaborateFile(t, f)
@@ -124,6 +303,349 @@ func TestElaborate_AllExamples(t *testing.T) {
 	}
 }
 
+// TestImportedPatterns loads a file importing a namespaced library: the
+// library's patterns and functions are called qualified, and call their own
+// helpers even when the importer defines one of the same name.
+func TestImportedPatterns(t *testing.T) {
+	name := filepath.Join("testdata", "imports.ear")
+	src, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, diags := (&parser.Loader{}).Load(string(src), name)
+	if len(diags) != 0 {
+		t.Fatalf("load diagnostics: %v", diags)
+	}
+	songs, errs := Elaborate(prog)
+	if len(errs) != 0 {
+		t.Fatalf("elaborate errors: %v", errs)
+	}
+	want := [][2]int{
+		{0, 60}, {1920, 60}, // grooves.clave (C)
+		{3840, 64},             // bossa's own bar (E)
+		{7680, 67}, {9600, 67}, // the local clave (G)
+		{11520, 74}, // grooves.lift(C): D, an octave up
+	}
+	if got := noteOns(songs[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("note-ons = %v, want %v", got, want)
+	}
+
+	// Without a Loader the import stays unresolved.
+	prog, _ = parser.New(string(src), name).Parse()
+	if _, errs := Elaborate(prog); len(errs) == 0 {
+		t.Error("unresolved import elaborated without error")
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	songs := elaborateSrc(t, `
+fn fifthAbove(n) = n + fifth;
+project "p" {
+  fn stack(n) = [n, fifthAbove(n)];
+  track "t" instrument "piano" {
+    let lift = octave;
+    fn up(n) = n + lift;       // closes over the let
+    let pair = stack(up(C));
+    for n in pair { bar quarter { (n) } }
+    bar quarter { (fifthAbove(up(D))) }
+  }
+}`)
+	want := [][2]int{{0, 72}, {3840, 79}, {7680, 81}}
+	if got := noteOns(songs[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("note-ons = %v, want %v", got, want)
+	}
+
+	for src, msg := range map[string]string{
+		`fn loop(n) = loop(n + 1); project "p" { track "t" { let x = loop(0); } }`: "nested deeper than 64",
+		`fn f(a, b) = a; project "p" { track "t" { let x = f(1); } }`:              `function "f" expects 2 args, got 1`,
+		`project "p" { track "t" { let f = 3; let x = f(1); } }`:                   `"f" is a number, not a function`,
+	} {
+		elaborateErr(t, src, msg)
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { track "t" instrument "piano" {
+    for ch in transpose([Dm7, G7], maj2) { bar quarter { (root(ch)) } }
+    bar quarter { (octave(E, 3)) (invert(Cmaj, 1)) (len(scale(D, "minor pentatonic")) + 60) }
+    for n in rotate(reverse(tones(C7)), -1) { bar quarter { (n) } }
+  } }`)
+	want := [][2]int{
+		{0, 64}, {3840, 69}, // roots of Em7, A7
+		{7680, 52}, {8640, 64}, {8640, 67}, {8640, 72}, {9600, 65},
+		{11520, 60}, {15360, 70}, {19200, 67}, {23040, 64},
+	}
+	if got := noteOns(songs[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("note-ons = %v, want %v", got, want)
+	}
+
+	for src, msg := range map[string]string{
+		`let x = transpose(C, "up");`:  `<test>:1:48: transpose: argument 2 is a string, want an interval or a number`,
+		`let x = scale(D, "klingon");`: `scale: unknown mode "klingon"`,
+		`let x = invert(Cmaj, 1.5);`:   `invert: argument 2 must be a whole number, got 1.5`,
+		`let x = root(C^4);`:           `root: argument 1 is a note, want a chord`,
+		`let x = len(C, D);`:           `function "len" expects 1 args, got 2`,
+	} {
+		elaborateErr(t, `project "p" { track "t" { `+src+` } }`, msg)
+	}
+}
+
+func TestVoicings(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { track "t" instrument "piano" {
+    let ch = Cmaj7;
+    bar quarter { Cmaj7 inv 2 Cmaj7 drop 2 Cmaj open ch octave 3 }
+    bar quarter { (drop(Cmaj7, 3)) (open(Cmaj)) (octave(Cmaj, 5)) Dm7 inv 1 octave 3 }
+    bar quarter { Cmaj9 inv 1 }
+  } }`)
+	var got [][]int
+	for _, ev := range songs[0].Events {
+		if ev.Msg.Kind != MsgNoteOn {
+			continue
+		}
+		if n := len(got); n == 0 || got[n-1][0] != int(ev.Tick) {
+			got = append(got, []int{int(ev.Tick)})
+		}
+		got[len(got)-1] = append(got[len(got)-1], int(ev.Msg.Key))
+	}
+	want := [][]int{
+		{0, 67, 71, 72, 76},    // G B C E
+		{960, 55, 60, 64, 71},  // G C E B
+		{1920, 60, 67, 76},     // C G E
+		{2880, 48, 52, 55, 59}, // C^3 E^3 G^3 B^3
+		{3840, 52, 60, 67, 71}, // E C G B
+		{4800, 60, 67, 76},
+		{5760, 72, 76, 79},
+		{6720, 53, 57, 60, 62},     // F A C D
+		{7680, 64, 67, 71, 72, 74}, // E G B C D: the moved root sits under the ninth
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("chords = %v, want %v", got, want)
+	}
+
+	for src, msg := range map[string]string{
+		`bar quarter { Cmaj drop 4 }`:   `drop 4 needs a chord of at least 4 tones, this one has 3`,
+		`bar quarter { C^9 octave 10 }`: `octave 10 is out of MIDI range`,
+		`let x = drop(Cmaj7, 1);`:       `drop: the dropped voice counts from the top, starting at 2, got 1`,
+		`let x = open(C);`:              `open: argument 1 is a note, want a chord`,
+	} {
+		elaborateErr(t, `project "p" { track "t" { `+src+` } }`, msg)
+	}
+}
+
+func TestVoiceLead(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { track "t" instrument "piano" {
+    bar whole { Cmaj7 }
+    voicelead {
+      for ch in [Dm7, G7, Cmaj7, A7] { bar half { ch ch } }
+      bar half { G7 drop 2 C }
+      bar whole { Fmaj7 }
+    }
+    voicelead C^2 to C^3 { bar whole { Cmaj7 } }
+    voicelead C^5 to C^7 { bar whole { C7/E } }
+  } }`)
+	var got [][]int
+	for _, ev := range songs[0].Events {
+		if ev.Msg.Kind != MsgNoteOn {
+			continue
+		}
+		if n := len(got); n == 0 || got[n-1][0] != int(ev.Tick) {
+			got = append(got, []int{int(ev.Tick)})
+		}
+		got[len(got)-1] = append(got[len(got)-1], int(ev.Msg.Key))
+	}
+	want := [][]int{
+		{0, 60, 64, 67, 71},     // outside voicelead: as written
+		{3840, 62, 65, 69, 72},  // Dm7 as written
+		{5760, 62, 65, 69, 72},  // and again
+		{7680, 62, 65, 67, 71},  // G7: D F G B
+		{9600, 62, 65, 67, 71},  // the repeat does not move
+		{11520, 64, 67, 71, 72}, // Cmaj7: E G B C
+		{13440, 64, 67, 71, 72},
+		{15360, 64, 67, 69, 73}, // A7: E G A C#
+		{17280, 64, 67, 69, 73},
+		{19200, 62, 67, 71, 77}, // G7 drop 2 as written
+		{21120, 60},             // single notes pass through
+		{23040, 65, 69, 72, 76}, // Fmaj7 leads from the drop-2 G7
+		{26880, 36, 40, 43, 47}, // first chord of a block: moved into range
+		{30720, 76, 84, 91, 94}, // slash chord: bass stays at the bottom
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("chords = %v, want %v", got, want)
+	}
+
+	for src, msg := range map[string]string{
+		`voicelead C^3 to A^3 { bar { C } }`:  `voicelead range 48..57 is narrower than an octave`,
+		`voicelead Cmaj to C^6 { bar { C } }`: `voicelead range ends must be notes or MIDI keys, got a chord`,
+	} {
+		elaborateErr(t, `project "p" { track "t" { `+src+` } }`, msg)
+	}
+}
+
+func TestIndexSliceAndModulo(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { track "t" instrument "piano" {
+    let changes = [C, D, E, F];
+    for i in 0..5 { bar quarter { (changes[i % 4]) } }
+    for n in changes[1..2] { bar quarter { (n) } }
+    bar quarter { (changes[-1]) (60 + 7 div 2) }
+  } }`)
+	var keys []int
+	for _, on := range noteOns(songs[0]) {
+		keys = append(keys, on[1])
+	}
+	want := []int{60, 62, 64, 65, 60, 62, 62, 64, 65, 63}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+
+	for src, msg := range map[string]string{
+		`let x = [C, D][2];`:       `<test>:1:42: index 2 out of range for a list of 2`,
+		`let x = [C, D][-3];`:      `index -3 out of range for a list of 2`,
+		`let x = [C, D][0..2];`:    `slice 0..2 out of range for a list of 2`,
+		`let x = 3 % 0;`:           `% by zero`,
+		`let x = 3.5 div 2;`:       `div requires whole numbers`,
+		`let x = 4; let y = x[0];`: `cannot index a number`,
+	} {
+		elaborateErr(t, `project "p" { track "t" { `+src+` } }`, msg)
+	}
+}
+
+func TestEnumeratedAndSteppedFor(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { track "t" instrument "piano" {
+    for i, n in [60, 64] { bar quarter { (n + i) } }
+    for k in 60..66 step 3 { bar quarter { (k) } }
+    for k in 72..70 step -1 { bar quarter { (k) } }
+    for k in 72..70 { bar quarter { (k) } }
+    let empty = [];
+    for k in 0..len(empty) - 1 { bar quarter { (k) } }
+    repeat 0 { bar quarter { C } }
+  } }`)
+	var keys []int
+	for _, on := range noteOns(songs[0]) {
+		keys = append(keys, on[1])
+	}
+	// a range only counts down with a negative step: 72..70 and 0..-1 are empty
+	want := []int{60, 65, 60, 63, 66, 72, 71, 70}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+
+	elaborateErr(t, `project "p" { track "t" { let s = 0; for k in 1..4 step s { } } }`, "range step must be a non-zero whole number, got 0")
+}
+
+func TestSeededRandomness(t *testing.T) {
+	keys := func(src string, opts Options) []int {
+		t.Helper()
+		songs := elaborateWith(t, src, opts)
+		var keys []int
+		for _, on := range noteOns(songs[0]) {
+			keys = append(keys, on[1])
+		}
+		return keys
+	}
+	song := func(seed int) string {
+		return fmt.Sprintf(`project "p" { seed %d; track "t" {
+    for each 1..8 { bar eighth { (random(40, 80)) (choose([60, 62, 64, 65, 67])) } }
+  } }`, seed)
+	}
+	a := keys(song(1), Options{})
+	if len(a) != 16 {
+		t.Fatalf("keys = %v, want 16 notes", a)
+	}
+	if b := keys(song(1), Options{}); !reflect.DeepEqual(a, b) {
+		t.Errorf("same seed: %v, then %v", a, b)
+	}
+	if b := keys(song(2), Options{}); reflect.DeepEqual(a, b) {
+		t.Errorf("seeds 1 and 2 both give %v", a)
+	}
+	if b := keys(song(2), Options{Seed: 1, OverrideSeed: true}); !reflect.DeepEqual(a, b) {
+		t.Errorf("seed 2 overridden to 1 gives %v, want %v", b, a)
+	}
+
+	// A track-level seed restarts the draws, so the same calls repeat.
+	got := keys(`project "p" {
+    pattern riff { let s = shuffle([60, 62, 64, 67]); bar sixteenth { (s[0]) (s[1]) (s[2]) (s[3]) } }
+    track "t" { seed 5; riff seed 5; riff }
+  }`, Options{Seed: 9, OverrideSeed: true})
+	if len(got) != 8 || !reflect.DeepEqual(got[:4], got[4:]) {
+		t.Errorf("keys = %v, want the same shuffle twice", got)
+	}
+
+	elaborateErr(t, `project "p" { track "t" { if chance(2) { } } }`, "chance: probability 2 is outside 0..1")
+}
+
+func TestHumanize(t *testing.T) {
+	const src = `project "p" { track "t" {
+    humanize timing 40% velocity 20 gate 50%;
+    bar 8 { C C E E G G C C }
+    humanize off;
+    bar 8 { C C E E G G C C }
+  } }`
+	render := func(opts Options) []Event {
+		t.Helper()
+		songs := elaborateWith(t, src, opts)
+		return songs[0].Events
+	}
+	evs := render(Options{})
+	if !reflect.DeepEqual(evs, render(Options{})) {
+		t.Fatal("humanized renders differ")
+	}
+	if reflect.DeepEqual(evs, render(Options{Seed: 3, OverrideSeed: true})) {
+		t.Error("another seed humanizes the same way")
+	}
+
+	// Per key: onsets keep their order and a note ends by the next one starts.
+	moved := false
+	last := map[uint8]Event{}
+	for i, ev := range evs {
+		switch ev.Msg.Kind {
+		case MsgNoteOn:
+			if prev, ok := last[ev.Msg.Key]; ok && prev.Msg.Kind == MsgNoteOn {
+				t.Fatalf("event %d: key %d starts at %d before its previous note ends", i, ev.Msg.Key, ev.Tick)
+			}
+			if ev.Tick < 3840 && ev.Tick%480 != 0 {
+				moved = true
+			}
+			if ev.Tick >= 3840 && (ev.Tick%480 != 0 || ev.Msg.Velocity != 64) {
+				t.Errorf("event %d after humanize off: %+v at %d", i, ev.Msg, ev.Tick)
+			}
+		}
+		last[ev.Msg.Key] = ev
+	}
+	if !moved {
+		t.Error("no onset moved")
+	}
+
+	for i, ev := range render(Options{NoHumanize: true}) {
+		if ev.Msg.Kind == MsgNoteOn && (ev.Tick%480 != 0 || ev.Msg.Velocity != 64) {
+			t.Errorf("event %d with NoHumanize: %+v at %d", i, ev.Msg, ev.Tick)
+		}
+	}
+}
+
+func TestArp(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { track "t" {
+    bar 16 { arp (C, E, G) up-down octaves 2 over half  arp (E, C) as-played rate 8 gate 50% }
+    bar 4 { C arp Cmaj down rate 8 }
+  } }`)
+	want := [][2]int{
+		{0, 60}, {240, 64}, {480, 67}, {720, 72}, {960, 76}, {1200, 79}, {1440, 76}, {1680, 72},
+		{1920, 64}, {2400, 60}, {2880, 64}, {3360, 60},
+		{3840, 60}, {4800, 67}, {5280, 64}, {5760, 60}, {6240, 67}, {6720, 64}, {7200, 60},
+	}
+	if got := noteOns(songs[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("note ons = %v, want %v", got, want)
+	}
+	for _, ev := range songs[0].Events {
+		if ev.Msg.Kind == MsgNoteOff && ev.Tick == 1920+240 && ev.Msg.Key != 64 {
+			t.Errorf("a 50%% gate eighth should end at %d, got %+v", 1920+240, ev)
+		}
+	}
+
+	if got := ArpOrder([]uint8{67, 60, 64}, ast.ArpRandom, 1); !reflect.DeepEqual(got, []uint8{60, 64, 67}) {
+		t.Errorf("random pool = %v", got)
+	}
+}
+
 func TestBendRPNAndValue(t *testing.T) {
 	// `bend +2` should emit the RPN range setup CCs and a PitchBend event.
 	songs := elaborateFile(t, "bend.ear")
@@ -146,3 +668,353 @@ func TestBendRPNAndValue(t *testing.T) {
 		t.Errorf("bend: no RPN pitch-bend-range setup emitted")
 	}
 }
+
+func TestTempoMap(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { bpm 120; time 4 4;
+		track "a" instrument "piano" {
+			bar quarter { C D E F }
+			bpm 90;
+			bar quarter { C D E F }
+			bpm 90;
+			bar quarter { C D E F }
+			bpm 140;
+			bar quarter { C D E F }
+		}
+	}`)
+	want := []TempoChange{{0, 120}, {3840, 90}, {11520, 140}}
+	got := songs[0].Tempos
+	if len(got) != len(want) {
+		t.Fatalf("tempo map = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("tempo %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if songs[0].BPM != 120 {
+		t.Errorf("opening BPM = %g, want 120", songs[0].BPM)
+	}
+}
+
+func TestTempoRamp(t *testing.T) {
+	for _, tc := range []struct {
+		curve string
+		mid   float64 // tempo halfway through the ramp
+	}{
+		{"", 100},
+		{" curve exp", 120 * math.Sqrt(80.0/120.0)},
+	} {
+		songs := elaborateSrc(t, `project "p" { bpm 120; time 4 4;
+			track "a" instrument "piano" {
+				bar quarter { C D E F }
+				bpm 120 to 80 over 2 bars`+tc.curve+`;
+				bar quarter { C D E F }
+				bar quarter { C D E F }
+			}
+		}`)
+		song := songs[0]
+		if len(song.Ramps) != 1 || song.Ramps[0] != (TempoRamp{Start: 3840, End: 11520, From: 120, To: 80}) {
+			t.Fatalf("ramps = %+v", song.Ramps)
+		}
+		// The opening 120 absorbs the ramp's first step; then one change per
+		// 16th up to and including the target.
+		if got, want := len(song.Tempos), 1+7680/rampStep; got != want {
+			t.Fatalf("%d tempo changes, want %d", got, want)
+		}
+		last := song.Tempos[len(song.Tempos)-1]
+		if last != (TempoChange{Tick: 11520, BPM: 80}) {
+			t.Errorf("last change = %+v, want the target at the ramp's end", last)
+		}
+		if song.InsideRamp(3840) || !song.InsideRamp(7680) || song.InsideRamp(11520) {
+			t.Errorf("InsideRamp should hold strictly between 3840 and 11520")
+		}
+		for _, tm := range song.Tempos {
+			if tm.Tick == 7680 && math.Abs(tm.BPM-tc.mid) > 1e-9 {
+				t.Errorf("curve%q: midpoint tempo = %g, want %g", tc.curve, tm.BPM, tc.mid)
+			}
+		}
+	}
+}
+
+func TestTempoRamp_SharedAndProject(t *testing.T) {
+	// the same ramp in two tracks is one ramp for the score
+	songs := elaborateSrc(t, `project "p" {
+		track "a" instrument "piano" { bar 1 { C } bpm 120 to 80 over 1 bar; bar 1 { C } }
+		track "b" instrument "piano" { bar 1 { E } bpm 120 to 80 over 1 bar; bar 1 { E } }
+	}`)
+	if want := []TempoRamp{{Start: 3840, End: 7680, From: 120, To: 80}}; !reflect.DeepEqual(songs[0].Ramps, want) {
+		t.Errorf("ramps = %+v, want %+v", songs[0].Ramps, want)
+	}
+	// a project ramp's bars are in the project meter, even one set after it
+	songs = elaborateSrc(t, `project "p" { bpm 120 to 80 over 1 bar; time 3 4;
+		track "a" instrument "piano" { bar 4 { C C C } }
+	}`)
+	if want := []TempoRamp{{Start: 0, End: 2880, From: 120, To: 80}}; !reflect.DeepEqual(songs[0].Ramps, want) {
+		t.Errorf("project ramps = %+v, want %+v", songs[0].Ramps, want)
+	}
+}
+
+func TestMeterMap(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { time 4 4;
+		track "a" instrument "piano" {
+			bar quarter { C D E F }
+			time 3 4;
+			bar quarter { C D E }
+			time 3 4;
+			bar quarter { C D E }
+			time 6 8;
+			bar eighth { C D E F G A }
+			bar quarter { C }
+		}
+	}`)
+	want := []MeterChange{{Tick: 0, Beats: 4, Unit: 4}, {Tick: 3840, Beats: 3, Unit: 4}, {Tick: 9600, Beats: 6, Unit: 8}}
+	if got := songs[0].Meters; !reflect.DeepEqual(got, want) {
+		t.Fatalf("meter map = %v, want %v", got, want)
+	}
+	// The last bar starts after the 6/8 bar's 2880 ticks.
+	ons := noteOns(songs[0])
+	if last := ons[len(ons)-1]; last[0] != 9600+2880 {
+		t.Errorf("last bar starts at %d, want %d", last[0], 9600+2880)
+	}
+	for _, tc := range []struct {
+		song       Song
+		tick       uint32
+		index      int
+		start, end uint32
+	}{
+		{songs[0], 0, 0, 0, 3840},
+		{songs[0], 5000, 1, 3840, 6720},
+		{songs[0], 10000, 3, 9600, 12480},
+		{songs[0], 13000, 4, 12480, 15360},
+		{Song{}, 4000, 1, 3840, 7680}, // no meter map: 4/4
+	} {
+		if i, start, end := tc.song.BarAt(tc.tick); i != tc.index || start != tc.start || end != tc.end {
+			t.Errorf("BarAt(%d) = %d [%d, %d), want %d [%d, %d)", tc.tick, i, start, end, tc.index, tc.start, tc.end)
+		}
+	}
+}
+
+func TestKeyMap(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { key D minor;
+		track "a" instrument "piano" {
+			bar quarter { C D E F }
+			key F major;
+			bar quarter { C D E F }
+		}
+		track "b" instrument "piano" { bar quarter { C } }
+	}`)
+	want := []KeyChange{
+		{Tick: 0, Track: -1, Key: value.Key{Tonic: "D", Mode: "minor", Fifths: -1}},
+		{Tick: 3840, Track: 0, Key: value.Key{Tonic: "F", Mode: "major", Fifths: -1}},
+	}
+	song := songs[0]
+	if !reflect.DeepEqual(song.Keys, want) {
+		t.Fatalf("key map = %v, want %v", song.Keys, want)
+	}
+	if k := song.KeyAt(0, 3840); k.Tonic != "F" {
+		t.Errorf("track a at bar 2 is in %s, want F major", k)
+	}
+	if k := song.KeyAt(1, 3840); k.Tonic != "D" {
+		t.Errorf("track b at bar 2 is in %s, want D minor", k)
+	}
+
+	elaborateErr(t, `project "p" { key E# major; track "a" { bar 1 { C } } }`, "E# major has no key signature")
+}
+
+func TestRomanNumeralsFollowTheKey(t *testing.T) {
+	play := func(key string) [][2]int {
+		t.Helper()
+		songs := elaborateSrc(t, `project "p" { key `+key+`; track "a" instrument "piano" {
+			let prog = [ii7, V7];
+			for ch in prog { bar 1 { ch } }
+			bar 1 { Imaj7 }
+			bar quarter { ^3 b7 #4 v }
+		} }`)
+		return noteOns(songs[0])
+	}
+	want := [][2]int{
+		{0, 62}, {0, 65}, {0, 69}, {0, 72}, // Dm7
+		{3840, 67}, {3840, 71}, {3840, 74}, {3840, 77}, // G7
+		{7680, 60}, {7680, 64}, {7680, 67}, {7680, 71}, // Cmaj7
+		{11520, 64}, {12480, 70}, {13440, 66}, // E Bb F#
+		{14400, 67}, {14400, 70}, {14400, 74}, // Gm
+	}
+	c := play("C")
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("in C: %v\nwant %v", c, want)
+	}
+	// the same progression a tone up
+	d := play("D")
+	for i := range want {
+		want[i][1] += 2
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Fatalf("in D: %v\nwant %v", d, want)
+	}
+	// in a minor key the degrees follow its own scale: III is F, #7 is C#
+	songs := elaborateSrc(t, `project "p" { key D minor; track "a" { bar half { III #7 } } }`)
+	if got, want := noteOns(songs[0]), [][2]int{{0, 65}, {0, 69}, {0, 72}, {1920, 73}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("in D minor: %v, want %v", got, want)
+	}
+}
+
+func TestBeatsFollowTheMeterUnit(t *testing.T) {
+	for _, tc := range []struct {
+		meter string
+		beat  string
+		want  int
+	}{
+		{"4 4", "3", 1920},
+		{"6 8", "2", 1440},    // compound: two dotted-quarter beats
+		{"12 8", "2.5", 2160}, // half a dotted quarter into beat 2
+		{"7 8", "3", 960},     // odd meter: one eighth per beat
+		{"2 2", "2", 1920},    // cut time: half-note beats
+	} {
+		src := `project "p" { time ` + tc.meter + `; track "a" instrument "piano" {
+			bar 8 { on beat ` + tc.beat + ` C }
+		} }`
+		songs := elaborateSrc(t, src)
+		if ons := noteOns(songs[0]); len(ons) != 1 || ons[0][0] != tc.want {
+			t.Errorf("time %s, on beat %s: got %v, want tick %d", tc.meter, tc.beat, ons, tc.want)
+		}
+	}
+}
+
+func TestSwingCompoundMeter(t *testing.T) {
+	elab := func(grid string) [][2]int {
+		t.Helper()
+		songs := elaborateSrc(t, `project "p" { time 6 8; track "a" instrument "piano" {
+			swing 66;
+			bar `+grid+` { C C C C C C }
+		} }`)
+		return noteOns(songs[0])
+	}
+	// Eighths in a dotted beat are already ternary: they stay straight.
+	for i, on := range elab("8") {
+		if on[0] != i*480 {
+			t.Errorf("eighth %d at %d, want %d", i, on[0], i*480)
+		}
+	}
+	// Sixteenths pair up inside each beat: every second one is pushed.
+	for i, on := range elab("16") {
+		want := i * 240
+		if i%2 == 1 {
+			want += 76 // (2*0.66-1) * 240, truncated
+		}
+		if on[0] != want {
+			t.Errorf("sixteenth %d at %d, want %d", i, on[0], want)
+		}
+	}
+}
+
+func TestSwingSimpleMeter(t *testing.T) {
+	// A simple meter pairs steps across the whole bar, whatever its beat.
+	for _, meter := range []string{"3 4", "5 8", "3 2"} {
+		songs := elaborateSrc(t, `project "p" { time `+meter+`; track "a" instrument "piano" {
+			swing 66;
+			bar 16 { C C C C C C }
+		} }`)
+		for i, on := range noteOns(songs[0]) {
+			want := i * 240
+			if i%2 == 1 {
+				want += 76 // (2*0.66-1) * 240, truncated
+			}
+			if on[0] != want {
+				t.Errorf("%s: sixteenth %d at %d, want %d", meter, i, on[0], want)
+			}
+		}
+	}
+}
+
+func TestAdditiveMeter(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { time 3+3+2 8; track "a" instrument "piano" {
+		bar 8 { on beat 2 C on beat 3 D on beat 3.5 E }
+		swing 66;
+		bar 8 { C C C C C C C C }
+	} }`)
+	song := songs[0]
+	if song.TimeBeats != 8 || song.TimeUnit != 8 || !reflect.DeepEqual(song.TimeGroups, []int{3, 3, 2}) {
+		t.Fatalf("meter = %d/%d %v", song.TimeBeats, song.TimeUnit, song.TimeGroups)
+	}
+	// Beats fall on the group boundaries: 3 eighths, 3 eighths, 2 eighths.
+	want := []int{1440, 2880, 2880 + 480}
+	// Only the two-eighth group swings; the three-eighth groups stay straight.
+	for i := 0; i < 8; i++ {
+		tick := 3840 + i*480
+		if i == 7 {
+			tick += 153 // (2*0.66-1) * 480, truncated
+		}
+		want = append(want, tick)
+	}
+	ons := noteOns(song)
+	if len(ons) != len(want) {
+		t.Fatalf("got %d notes, want %d", len(ons), len(want))
+	}
+	for i, on := range ons {
+		if on[0] != want[i] {
+			t.Errorf("note %d at %d, want %d", i, on[0], want[i])
+		}
+	}
+}
+
+func TestAdditiveMeter_EmptyGroup(t *testing.T) {
+	for _, src := range []string{
+		`project "p" { time 3+0 8; track "a" { bar 8 { C } } }`,
+		`project "p" { track "a" { time 2+0+3 8; bar 8 { C } } }`,
+	} {
+		elaborateErr(t, src, "additive meter groups must be at least 1, got 0")
+	}
+}
+
+func TestTieAcrossBarLine(t *testing.T) {
+	noteOffs := func(src string) []int {
+		t.Helper()
+		songs := elaborateSrc(t, src)
+		var offs []int
+		for _, ev := range songs[0].Events {
+			if ev.Msg.Kind == MsgNoteOff {
+				offs = append(offs, int(ev.Tick))
+			}
+		}
+		return offs
+	}
+	// F is held over the barline for one and then two more quarters.
+	offs := noteOffs(`project "p" { track "a" instrument "piano" {
+		bar quarter { C D E F }
+		bar quarter { ~*2 G A }
+	} }`)
+	if !reflect.DeepEqual(offs, []int{960, 1920, 2880, 5760, 6720, 7680}) {
+		t.Errorf("note-offs = %v", offs)
+	}
+	// A rest ends the tie: the leading ~ of the next bar extends nothing.
+	offs = noteOffs(`project "p" { track "a" instrument "piano" {
+		bar quarter { C D E _ }
+		bar quarter { ~ G A B }
+	} }`)
+	if !reflect.DeepEqual(offs, []int{960, 1920, 2880, 5760, 6720, 7680}) {
+		t.Errorf("note-offs after a rest = %v", offs)
+	}
+}
+
+func TestTuplets(t *testing.T) {
+	songs := elaborateSrc(t, `project "p" { time 4 4; track "a" instrument "piano" {
+		bar quarter { 3:2 { C D E } F G }
+		bar 16 { 7:4 { C*7 } 4: D E F }
+	} }`)
+	var got []int
+	for _, on := range noteOns(songs[0]) {
+		got = append(got, on[0])
+	}
+	want := []int{
+		0, 640, 1280, 1920, 2880, // triplet quarters, then F G on the grid
+		3840, 3977, 4114, 4251, 4388, 4525, 4662, // septuplet: 960*i/7
+		4800, 5760, 6720, // the septuplet ends exactly on beat 2
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("onsets = %v\nwant      %v", got, want)
+	}
+	tup := songs[0].Tuplets
+	if len(tup) != 2 || tup[0] != (Tuplet{Track: 0, Start: 0, End: 1920, Actual: 3, Normal: 2}) || tup[1].End != 4800 {
+		t.Fatalf("tuplets = %+v", tup)
+	}
+}
@@ -79,6 +79,13 @@ func isWordPart(ch rune) bool {
 	return unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '_' || ch == '#' || ch == '^'
 }
 
+// isDegreePart accepts what may follow a leading ^ or # in a word: the scale
+// degrees "^3", "^b7" and "#4" and the raised roman numeral "#iv" lex as one
+// IDENT like any other pitch.
+func isDegreePart(ch rune) bool {
+	return isDigit(ch) || ch == 'b' || ch == '#' || ch == 'I' || ch == 'V' || ch == 'i' || ch == 'v'
+}
+
 func isDigit(ch rune) bool { return ch >= '0' && ch <= '9' }
 
 func isHexDigit(ch rune) bool {
@@ -97,7 +104,7 @@ func (l *Lexer) Next() token.Token {
 		return token.Token{Type: token.EOF, Literal: "", Pos: pos}
 	case ch == '"' || ch == '\'':
 		return l.scanString()
-	case isWordStart(ch):
+	case isWordStart(ch), (ch == '^' || ch == '#') && isDegreePart(l.peek()):
 		return l.scanWord()
 	case isDigit(ch):
 		return l.scanNumber()
@@ -128,6 +135,8 @@ func (l *Lexer) Next() token.Token {
 		return l.emit(token.COMMA, pos)
 	case ':':
 		return l.emit(token.COLON, pos)
+	case '.':
+		return l.emit(token.DOT, pos)
 	case '|':
 		if l.peek() == '|' {
 			l.readRune()
@@ -143,6 +152,8 @@ func (l *Lexer) Next() token.Token {
 		return l.emit(token.STAR, pos)
 	case '/':
 		return l.emit(token.SLASH, pos)
+	case '%':
+		return l.emit(token.PERCENT, pos)
 	case '+':
 		return l.emit(token.PLUS, pos)
 	case '-':
@@ -16,12 +16,12 @@ func types(src string) []token.Type {
 }
 
 func TestLexer_Punctuation(t *testing.T) {
-	got := types("{ } [ ] ( ) ; , : | @ * / + - .. = == != < <= > >= && || !")
+	got := types("{ } [ ] ( ) ; , : | @ * / % + - .. = == != < <= > >= && || !")
 	want := []token.Type{
 		token.LBRACE, token.RBRACE, token.LBRACKET, token.RBRACKET,
 		token.LPAREN, token.RPAREN, token.SEMICOLON, token.COMMA, token.COLON,
-		token.BAR_SEP, token.AT, token.STAR, token.SLASH, token.PLUS, token.MINUS,
-		token.DOTDOT, token.ASSIGN, token.EQ, token.NEQ, token.LT, token.LTE,
+		token.BAR_SEP, token.AT, token.STAR, token.SLASH, token.PERCENT, token.PLUS,
+		token.MINUS, token.DOTDOT, token.ASSIGN, token.EQ, token.NEQ, token.LT, token.LTE,
 		token.GT, token.GTE, token.AND, token.OR, token.NOT, token.EOF,
 	}
 	if len(got) != len(want) {
@@ -91,6 +91,7 @@ func TestLexer_WordsNotesChords(t *testing.T) {
 		"C": "C", "C#": "C#", "Eb": "Eb", "F#3": "F#3",
 		"Am7": "Am7", "C7": "C7", "Gmaj7": "Gmaj7", "C7/E": "C7/E", "F7/1": "F7/1",
 		"hh": "hh", "aTune": "aTune",
+		"ii7": "ii7", "bVII": "bVII", "#iv": "#iv", "^3": "^3", "^b7": "^b7", "#4": "#4",
 	}
 	for src, lit := range cases {
 		l := New(src, "<test>")
@@ -5,8 +5,9 @@
 // notation. Converting that to engraved notation is inherently lossy, so this
 // emitter targets the common, grid-aligned cases: it quantizes note start times
 // and durations to standard note values, lays one staff per track, and inserts
-// rests for gaps. Durations that don't map cleanly are rounded to the nearest
-// representable value rather than rendered as tuplets.
+// rests for gaps. Tuplets the source wrote as such are engraved with \tuplet;
+// other durations that don't map cleanly are rounded to the nearest
+// representable value.
 package lilypond
 
 import (
@@ -15,20 +16,14 @@ import (
 	"strings"
 
 	"github.com/poolpOrg/earmuff/elaborator"
+	"github.com/poolpOrg/earmuff/value"
 )
 
 const ppq = elaborator.PPQ // 960 ticks per quarter note
 
 // Render returns LilyPond source for song.
 func Render(song elaborator.Song) string {
-	beats, unit := song.TimeBeats, song.TimeUnit
-	if beats == 0 {
-		beats = 4
-	}
-	if unit == 0 {
-		unit = 4
-	}
-	ticksPerBar := uint32(beats) * (ppq * 4 / uint32(unit))
+	meters := song.MeterMap()
 
 	var b strings.Builder
 	fmt.Fprintf(&b, "\\version \"2.24.0\"\n\n")
@@ -45,7 +40,15 @@ func Render(song elaborator.Song) string {
 	fmt.Fprintf(&b, "\\score {\n  <<\n")
 	for i, tr := range song.Tracks {
 		notes := collectNotes(song, i)
-		staff := renderStaff(tr.Name, notes, beats, unit, ticksPerBar, song.BPM, i == 0)
+		// Every staff shows the meter changes; the tempo marks go on the top one,
+		// and each staff carries its own track's key changes and hairpins.
+		marks := append(meterMarks(meters), keyMarks(song, i)...)
+		if i == 0 {
+			marks = append(marks, tempoMarks(song)...)
+		}
+		marks = append(marks, hairpinMarks(song, i)...)
+		sort.SliceStable(marks, func(i, j int) bool { return marks[i].tick < marks[j].tick })
+		staff := renderStaff(song, i, tr.Name, notes, marks, trackTuplets(song, i))
 		b.WriteString(staff)
 	}
 	fmt.Fprintf(&b, "  >>\n  \\layout { }\n}\n")
@@ -125,56 +128,277 @@ func groupChords(notes []note) []chord {
 	return chords
 }
 
-// renderStaff emits one \new Staff { ... } block.
-func renderStaff(name string, notes []note, beats, unit int, ticksPerBar uint32, bpm float64, first bool) string {
+// mark is a score direction (a tempo change, ...) attached to an absolute tick
+// and written inline in the staff just before whatever sounds at that tick. A
+// closing mark ends a spanner, so it is written even past the last note.
+type mark struct {
+	tick    uint32
+	text    string // LilyPond source, e.g. `\tempo 4 = 90`
+	closing bool
+}
+
+// tempoMarks turns the song's tempo map into \tempo marks. A ramp is engraved
+// as a dashed "rit."/"accel." text spanner ending on a mark for its target
+// tempo, instead of one mark per expanded step.
+func tempoMarks(song elaborator.Song) []mark {
+	tempos := song.Tempos
+	if len(tempos) == 0 && song.BPM > 0 {
+		tempos = []elaborator.TempoChange{{Tick: 0, BPM: song.BPM}}
+	}
+	// Same-tick marks go in this order: close a spanner, state a tempo, open
+	// the next spanner.
+	type ranked struct {
+		mark
+		rank int
+	}
+	var all []ranked
+	for _, t := range tempos {
+		if t.BPM <= 0 || song.InsideRamp(t.Tick) {
+			continue
+		}
+		all = append(all, ranked{mark{tick: t.Tick, text: fmt.Sprintf("\\tempo 4 = %d", int(t.BPM+0.5))}, 1})
+	}
+	for _, r := range song.Ramps {
+		start := fmt.Sprintf("\\once \\override TextSpanner.bound-details.left.text = %s <>\\startTextSpan", quote(rampWord(r)))
+		all = append(all,
+			ranked{mark{tick: r.Start, text: start}, 2},
+			ranked{mark{tick: r.End, text: "<>\\stopTextSpan", closing: true}, 0})
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].tick != all[j].tick {
+			return all[i].tick < all[j].tick
+		}
+		return all[i].rank < all[j].rank
+	})
+	marks := make([]mark, len(all))
+	for i, m := range all {
+		marks[i] = m.mark
+	}
+	return marks
+}
+
+// rampWord is the engraved text for a tempo ramp.
+func rampWord(r elaborator.TempoRamp) string {
+	if r.To < r.From {
+		return "rit."
+	}
+	return "accel."
+}
+
+// hairpinMarks turns one track's crescendos and diminuendos into hairpins,
+// each opening on its starting dynamic and closed by its target dynamic (or
+// by \! when written as velocity numbers). A hairpin that picks up on the
+// dynamic the previous one ended on does not restate it.
+func hairpinMarks(song elaborator.Song, track int) []mark {
+	var marks []mark
+	var prev *elaborator.Hairpin
+	for i := range song.Hairpins {
+		h := &song.Hairpins[i]
+		if h.Track != track {
+			continue
+		}
+		open := "\\<"
+		if h.Dim {
+			open = "\\>"
+		}
+		if h.FromMark != "" && (prev == nil || prev.End != h.Start || prev.ToMark != h.FromMark) {
+			open = "\\" + h.FromMark + open
+		}
+		end := "\\!"
+		if h.ToMark != "" {
+			end = "\\" + h.ToMark
+		}
+		marks = append(marks,
+			mark{tick: h.Start, text: "<>" + open},
+			mark{tick: h.End, text: "<>" + end, closing: true})
+		prev = h
+	}
+	// A hairpin ending where the next begins closes before that one opens.
+	sort.SliceStable(marks, func(i, j int) bool {
+		if marks[i].tick != marks[j].tick {
+			return marks[i].tick < marks[j].tick
+		}
+		return marks[i].closing && !marks[j].closing
+	})
+	return marks
+}
+
+// meterMarks turns the meter changes after the opening one into time-signature
+// marks.
+func meterMarks(meters []elaborator.MeterChange) []mark {
+	var marks []mark
+	for _, c := range meters[1:] {
+		marks = append(marks, mark{tick: c.Tick, text: timeSignature(c)})
+	}
+	return marks
+}
+
+// timeSignature writes a meter as LilyPond source. An additive meter becomes a
+// \compoundMeter (engraved "3+3+2 over 8") whose beams follow the groups.
+func timeSignature(c elaborator.MeterChange) string {
+	if len(c.Groups) == 0 {
+		return fmt.Sprintf("\\time %d/%d", c.Beats, c.Unit)
+	}
+	groups := make([]string, len(c.Groups))
+	for i, g := range c.Groups {
+		groups[i] = fmt.Sprint(g)
+	}
+	return fmt.Sprintf("\\compoundMeter #'((%s %d)) \\set Timing.beamExceptions = #'() \\set Timing.beatStructure = %s",
+		strings.Join(groups, " "), c.Unit, strings.Join(groups, ","))
+}
+
+// keyMarks turns one track's key changes after the opening key into \key
+// marks: the project's and the track's own.
+func keyMarks(song elaborator.Song, track int) []mark {
+	var marks []mark
+	for _, c := range song.Keys {
+		if c.Tick > 0 && (c.Track == -1 || c.Track == track) {
+			marks = append(marks, mark{tick: c.Tick, text: keySignature(c.Key)})
+		}
+	}
+	return marks
+}
+
+// keySignature writes a key as LilyPond source, e.g. `\key d \minor`;
+// LilyPond knows every mode a key can be written in.
+func keySignature(k value.Key) string {
+	alter := strings.Count(k.Tonic, "#") - strings.Count(k.Tonic[1:], "b")
+	return fmt.Sprintf("\\key %s \\%s", noteName(k.Tonic[:1], alter), k.Mode)
+}
+
+// trackTuplets returns the tuplets one track played, in time order.
+func trackTuplets(song elaborator.Song, track int) []elaborator.Tuplet {
+	var out []elaborator.Tuplet
+	for _, t := range song.Tuplets {
+		if t.Track == track && t.End > t.Start && t.Actual > 0 && t.Normal > 0 {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// renderStaff emits one \new Staff { ... } block. marks are written at their
+// ticks; rests are split so a mark that falls in a silent stretch lands exactly,
+// while one that falls under a sounding note waits for the next onset.
+//
+// Each tuplet span is wrapped in \tuplet actual/normal { ... }, with the
+// durations inside scaled up to the note values they are written as (a
+// quarter-grid triplet note lasts 640 ticks and is written as a quarter).
+// Notes are cut at tuplet boundaries so the bracket holds exactly its span.
+func renderStaff(song elaborator.Song, track int, name string, notes []note, marks []mark, tuplets []elaborator.Tuplet) string {
 	var b strings.Builder
 	fmt.Fprintf(&b, "    \\new Staff {\n")
 	if name != "" {
 		fmt.Fprintf(&b, "      \\set Staff.instrumentName = %s\n", quote(name))
 	}
 	fmt.Fprintf(&b, "      \\clef %s\n", clefFor(notes))
-	fmt.Fprintf(&b, "      \\time %d/%d\n", beats, unit)
-	if first && bpm > 0 {
-		fmt.Fprintf(&b, "      \\tempo 4 = %d\n", int(bpm+0.5))
+	fmt.Fprintf(&b, "      %s\n", timeSignature(song.MeterMap()[0]))
+	if k := song.KeyAt(track, 0); k.Tonic != "" {
+		fmt.Fprintf(&b, "      %s\n", keySignature(k))
+	}
+	for len(marks) > 0 && marks[0].tick == 0 {
+		fmt.Fprintf(&b, "      %s\n", marks[0].text)
+		marks = marks[1:]
 	}
 
 	chords := groupChords(notes)
 	b.WriteString("      ")
 	cursor := uint32(0) // absolute tick we've written up to
+	flush := func() {
+		for len(marks) > 0 && marks[0].tick <= cursor {
+			b.WriteString(marks[0].text + " ")
+			marks = marks[1:]
+		}
+	}
+	var open *elaborator.Tuplet // the tuplet being written, if any
+	// bracket closes a finished tuplet and opens one starting at the cursor.
+	bracket := func() {
+		if open != nil && cursor >= open.End {
+			b.WriteString("} ")
+			open = nil
+		}
+		for open == nil && len(tuplets) > 0 && tuplets[0].Start <= cursor {
+			t := tuplets[0]
+			tuplets = tuplets[1:]
+			if t.Start == cursor { // one we already wrote past is dropped
+				fmt.Fprintf(&b, "\\tuplet %d/%d { ", t.Actual, t.Normal)
+				open = &t
+			}
+		}
+	}
+	// until returns the nearest tuplet boundary after the cursor, capped at to.
+	until := func(to uint32) uint32 {
+		if open != nil && open.End < to {
+			return open.End
+		}
+		if open == nil && len(tuplets) > 0 && tuplets[0].Start > cursor && tuplets[0].Start < to {
+			return tuplets[0].Start
+		}
+		return to
+	}
+	// written scales a real duration to the value it is written as.
+	written := func(dur uint32) uint32 {
+		if open == nil {
+			return dur
+		}
+		a, n := uint32(open.Actual), uint32(open.Normal)
+		return (dur*a + n/2) / n
+	}
+	restTo := func(to uint32) {
+		for cursor < to {
+			bracket()
+			flush()
+			end := until(to)
+			if len(marks) > 0 && marks[0].tick < end {
+				end = marks[0].tick
+			}
+			writeDurations(&b, written(end-cursor), "r")
+			cursor = end
+		}
+	}
 	for _, c := range chords {
 		// rest to fill the gap before this chord
 		if c.tick > cursor {
-			writeDurations(&b, c.tick-cursor, "r")
-			cursor = c.tick
+			restTo(c.tick)
 		} else if c.tick < cursor {
 			// overlap (legato/voicing we can't notate simply): skip to keep
 			// the bar arithmetic honest.
 			continue
 		}
+		bracket()
+		flush()
 		dur := c.dur
 		if dur == 0 {
 			dur = ppq
 		}
-		writeChord(&b, c.keys, dur)
+		dur = until(cursor+dur) - cursor
+		writeChord(&b, song.KeyAt(track, cursor), c.keys, written(dur))
 		cursor += dur
 	}
 	// pad the final bar with a rest so it's complete
-	if rem := cursor % ticksPerBar; rem != 0 {
-		writeDurations(&b, ticksPerBar-rem, "r")
+	if _, start, end := song.BarAt(cursor); start != cursor {
+		restTo(end)
+	}
+	bracket()
+	for _, m := range marks {
+		if m.closing {
+			b.WriteString(m.text + " ")
+		}
 	}
 	b.WriteString("\n      \\bar \"|.\"\n    }\n")
 	return b.String()
 }
 
-// writeChord writes a single note or a <...> chord with quantized duration(s).
-func writeChord(b *strings.Builder, keys []uint8, dur uint32) {
+// writeChord writes a single note or a <...> chord with quantized duration(s),
+// spelled in key k.
+func writeChord(b *strings.Builder, k value.Key, keys []uint8, dur uint32) {
 	var body string
 	if len(keys) == 1 {
-		body = pitch(keys[0])
+		body = pitch(k, keys[0])
 	} else {
 		parts := make([]string, len(keys))
-		for i, k := range keys {
-			parts[i] = pitch(k)
+		for i, key := range keys {
+			parts[i] = pitch(k, key)
 		}
 		body = "<" + strings.Join(parts, " ") + ">"
 	}
@@ -237,12 +461,12 @@ func quantize(dur uint32) []string {
 	return out
 }
 
-// pitch maps a MIDI key to a LilyPond pitch (Dutch note names + octave marks).
-// MIDI 60 = middle C = c'. Accidentals always use sharps for simplicity.
-func pitch(key uint8) string {
-	names := []string{"c", "cis", "d", "dis", "e", "f", "fis", "g", "gis", "a", "ais", "b"}
-	name := names[key%12]
-	octave := int(key)/12 - 1 // MIDI octave (60 -> 4)
+// pitch maps a MIDI key to a LilyPond pitch (Dutch note names + octave marks),
+// spelled in key k: Bb in F major is bes, A# in B major ais. MIDI 60 = middle
+// C = c'.
+func pitch(k value.Key, key uint8) string {
+	step, alter, octave := k.Spell(key)
+	name := noteName(step, alter)
 	// LilyPond: c' is middle C (octave 4). Marks relative to octave 3 (c).
 	marks := octave - 3
 	var suffix string
@@ -254,6 +478,21 @@ func pitch(key uint8) string {
 	return name + suffix
 }
 
+// noteName writes a letter and alteration as a Dutch note name: cis, bes, and
+// the contracted es and as for E and A flat.
+func noteName(step string, alter int) string {
+	name := strings.ToLower(step)
+	switch {
+	case alter > 0:
+		return name + strings.Repeat("is", alter)
+	case alter < 0 && (name == "e" || name == "a"):
+		return name + "s" + strings.Repeat("es", -alter-1)
+	case alter < 0:
+		return name + strings.Repeat("es", -alter)
+	}
+	return name
+}
+
 // clefFor picks treble or bass from the average pitch of the notes.
 func clefFor(notes []note) string {
 	if len(notes) == 0 {
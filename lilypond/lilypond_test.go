@@ -6,6 +6,7 @@ import (
 
 	"github.com/poolpOrg/earmuff/elaborator"
 	"github.com/poolpOrg/earmuff/parser"
+	"github.com/poolpOrg/earmuff/value"
 )
 
 func render(t *testing.T, src string) string {
@@ -82,8 +83,156 @@ func TestQuantize(t *testing.T) {
 func TestPitch(t *testing.T) {
 	cases := map[uint8]string{60: "c'", 62: "d'", 48: "c", 72: "c''", 61: "cis'"}
 	for key, want := range cases {
-		if got := pitch(key); got != want {
+		if got := pitch(value.Key{}, key); got != want {
 			t.Errorf("pitch(%d) = %q, want %q", key, got, want)
 		}
 	}
 }
+
+func TestPitch_InKey(t *testing.T) {
+	cases := []struct {
+		tonic, mode string
+		key         uint8
+		want        string
+	}{
+		{"F", "major", 70, "bes'"},
+		{"F", "major", 61, "des'"},
+		{"D", "minor", 61, "cis'"},
+		{"Eb", "major", 63, "es'"},
+		{"Ab", "major", 68, "as'"},
+		{"Gb", "major", 59, "ces'"},
+		{"C#", "major", 60, "bis"},
+		{"B", "major", 70, "ais'"},
+		{"D", "dorian", 70, "ais'"},
+	}
+	for _, c := range cases {
+		k, err := value.ParseKey(c.tonic, c.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pitch(k, c.key); got != c.want {
+			t.Errorf("pitch(%s, %d) = %q, want %q", k, c.key, got, c.want)
+		}
+	}
+}
+
+func TestRender_KeySignature(t *testing.T) {
+	ly := render(t, `project "p" { key D minor;
+		track "a" instrument "piano" {
+			bar quarter { D E F C# }
+			key Bb major;
+			bar quarter { Bb A# Eb D# }
+		}
+		track "b" instrument "piano" { key E dorian; bar quarter { F# G A Bb } }
+	}`)
+	for _, want := range []string{
+		"\\key d \\minor\n",
+		"d'4 e'4 f'4 cis'4 \\key bes \\major bes'4 bes'4 es'4 es'4",
+		"\\key e \\dorian\n      fis'4 g'4 a'4 ais'4",
+	} {
+		if !strings.Contains(ly, want) {
+			t.Errorf("expected %q in:\n%s", want, ly)
+		}
+	}
+}
+
+func TestRender_TempoChange(t *testing.T) {
+	ly := render(t, `project "p" { bpm 120; time 4 4;
+		track "a" instrument "piano" {
+			bar quarter { C D E F }
+			bpm 80;
+			bar quarter { C D E F }
+		}
+	}`)
+	if !strings.Contains(ly, "\\tempo 4 = 120") || !strings.Contains(ly, "\\tempo 4 = 80") {
+		t.Fatalf("expected both tempo marks:\n%s", ly)
+	}
+	if strings.Index(ly, "\\tempo 4 = 80") < strings.Index(ly, "f'4") {
+		t.Fatalf("the tempo change should follow the first bar:\n%s", ly)
+	}
+}
+
+func TestRender_TempoRamp(t *testing.T) {
+	ly := render(t, `project "p" { bpm 120; time 4 4;
+		track "a" instrument "piano" {
+			bar quarter { C D E F }
+			bpm 120 to 90 over 1 bar;
+			bar quarter { C D E F }
+			bar quarter { C D E F }
+		}
+	}`)
+	if !strings.Contains(ly, `left.text = "rit."`) {
+		t.Fatalf("expected a rit. spanner:\n%s", ly)
+	}
+	start, stop := strings.Index(ly, "\\startTextSpan"), strings.Index(ly, "\\stopTextSpan")
+	if start < 0 || stop < start {
+		t.Fatalf("expected the spanner to open then close:\n%s", ly)
+	}
+	if strings.Count(ly, "\\tempo") != 2 || !strings.Contains(ly[stop:], "\\tempo 4 = 90") {
+		t.Fatalf("expected only the opening and target tempo marks:\n%s", ly)
+	}
+}
+
+func TestRender_MeterChange(t *testing.T) {
+	ly := render(t, `project "p" { time 4 4;
+		track "a" instrument "piano" {
+			bar quarter { C D E F }
+			time 3 4;
+			bar quarter { C D _ }
+		}
+	}`)
+	i := strings.Index(ly, "\\time 3/4")
+	if !strings.Contains(ly, "\\time 4/4") || i < 0 {
+		t.Fatalf("expected both time signatures:\n%s", ly)
+	}
+	// The 3/4 bar is padded to three beats, not four.
+	if !strings.Contains(ly[i:], "d'4 r4 \n") {
+		t.Fatalf("expected the last bar padded to 3/4:\n%s", ly[i:])
+	}
+}
+
+func TestRender_AdditiveMeter(t *testing.T) {
+	ly := render(t, `project "p" { time 3+3+2 8;
+		track "a" instrument "piano" { bar 8 { C D E F G A B C } }
+	}`)
+	if !strings.Contains(ly, "\\compoundMeter #'((3 3 2 8))") || !strings.Contains(ly, "beatStructure = 3,3,2") {
+		t.Fatalf("expected a compound meter with matching beams:\n%s", ly)
+	}
+}
+
+func TestRender_Tuplets(t *testing.T) {
+	ly := render(t, `project "p" { time 4 4;
+		track "a" instrument "piano" {
+			bar quarter { 3:2 { C D E } F G }
+			bar 16 { C D E F 5:4 { C D E F G } 8: C _ 3:2 { D _ F } }
+		}
+	}`)
+	for _, want := range []string{
+		"\\tuplet 3/2 { c'4 d'4 e'4 } f'4 g'4",
+		"\\tuplet 5/4 { c'16 d'16 e'16 f'16 g'16 }",
+		"\\tuplet 3/2 { d'8 r8 f'8 }",
+	} {
+		if !strings.Contains(ly, want) {
+			t.Errorf("expected %q in:\n%s", want, ly)
+		}
+	}
+}
+
+func TestRender_Hairpins(t *testing.T) {
+	ly := render(t, `project "p" { time 4 4;
+		track "a" instrument "piano" {
+			cresc p to ff over 1 bar;
+			bar quarter { C D E F }
+			dim ff to 40 over 1 bar;
+			bar quarter { C D E F }
+		}
+		track "b" instrument "piano" { bar quarter { C D E F } }
+	}`)
+	want := "<>\\p\\< c'4 d'4 e'4 f'4 <>\\ff <>\\> c'4 d'4 e'4 f'4 <>\\!"
+	if !strings.Contains(strings.Join(strings.Fields(ly), " "), want) {
+		t.Fatalf("expected %q:\n%s", want, ly)
+	}
+	if strings.Count(ly, "\\<") != 1 {
+		t.Fatalf("expected the hairpins on their own track only:\n%s", ly)
+	}
+}
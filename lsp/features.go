@@ -2,55 +2,71 @@ package lsp
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/poolpOrg/earmuff/ast"
+	"github.com/poolpOrg/earmuff/elaborator"
 	"github.com/poolpOrg/earmuff/midi"
 	"github.com/poolpOrg/earmuff/parser"
 	"github.com/poolpOrg/earmuff/token"
+	"github.com/poolpOrg/earmuff/value"
 )
 
 // keywords offered by completion, with a one-line doc each.
 var keywordDocs = map[string]string{
 	"project":    "Top-level container: `project \"name\" { ... }`.",
+	"import":     "Use another file's patterns: `import \"lib/grooves.ear\";`, or namespaced `import \"lib/grooves.ear\" as grooves;` called as `grooves.bossa()`. Paths are relative to the importing file.",
 	"track":      "A part on one channel: `track \"name\" instrument \"...\" { ... }`.",
 	"pattern":    "Reusable body: `pattern name(params) { ... }`, called as `name(args)`.",
+	"fn":         "Value function: `fn tritoneSub(ch) = ch + dim5;`, called in any expression as `tritoneSub(G7)`. Closes over the lets in scope where it is defined.",
 	"bar":        "A measure: `bar quarter { C E G _ }`. The duration sets the step grid.",
 	"instrument": "Track header clause selecting a General MIDI instrument.",
 	"channel":    "Track header clause setting the MIDI channel (1..16; 10 = drums).",
 	"port":       "Track header clause selecting an output port.",
 	"kit":        "Percussion aliases: `kit { hh = \"closed hi-hat\"; }`.",
-	"bpm":        "Tempo in beats per minute: `bpm 120;`.",
-	"time":       "Time signature: `time 4 4;`.",
+	"bpm":        "Tempo in beats per minute: `bpm 120;`. In a body it changes the tempo from the next bar on; `bpm 120 to 90 over 4 bars [curve exp];` ramps it gradually (rit./accel.).",
+	"time":       "Time signature: `time 4 4;`, or additive `time 3+3+2 8;` whose groups are the beats. In a body it changes the meter from the next bar on.",
 	"copyright":  "Project copyright meta text.",
 	"text":       "A text meta event.",
+	"seed":       "Seed for `random`, `choose`, `shuffle` and `chance`: `seed 42;`. The same seed always renders the same song; in a track body it restarts that track's draws.",
+	"key":        "Key signature: `key D minor;` (the mode defaults to major; dorian, lydian and the other church modes work too). It is written to the MIDI file, spells the score's accidentals and resolves roman numerals (`ii7 V7 Imaj7`) and scale degrees (`^3`, `b7`); in a track body it changes that track's key from there on.",
 	"lyric":      "A lyric meta event.",
 	"marker":     "A marker meta event.",
 	"cue":        "A cue-point meta event.",
-	"for":        "Bounded loop: `for i in 1..4 { ... }` (bound) or `for each 1..4 { ... }` (unbound). Iterates a range, bare sequence (`C E G`), or list.",
+	"for":        "Bounded loop: `for i in 1..4 { ... }` (bound), `for i, ch in changes { ... }` (enumerated, i from 0) or `for each 1..4 { ... }` (unbound). Iterates a range (`16..1 step -4` counts down by 4), bare sequence (`C E G`), or list.",
 	"each":       "Marks an unbound loop: `for each 1..12 { ... }` iterates with no variable.",
 	"repeat":     "Counted-repeat sugar: `repeat 12 { ... }` runs the body 12 times (same as `for each 1..12`).",
 	"section":    "Named arrangement block: `section head { ... }`. Replay it by name (`head solo head`). Sugar for a zero-arg pattern.",
+	"arp":        "Arpeggio in a bar: `arp Am7 up-down octaves 2 rate 16 gate 50%` plays the tones one per step (modes up, down, up-down, random, as-played) to the end of the bar, or for `over half`.",
 	"swing":      "Swing feel for following bars: `swing 67;` delays each off-beat. 50 is straight, ~67 is triplet swing (50–75).",
+	"humanize":   "Random feel for following steps: `humanize timing 10% velocity 8 gate 5%;` moves onsets (ticks or % of a step), velocities and gates by up to that much, reproducibly from the `seed`. `humanize off;` stops it.",
+	"cresc":      "Crescendo: `cresc p to ff over 2 bars;` ramps the velocity of each onset in the span (the target holds after it); add `expression` to ramp CC 11 too. Engraved as a hairpin.",
+	"dim":        "Diminuendo: `dim ff to p over 1 bar;` ramps the velocity of each onset in the span down (the target holds after it); add `expression` to ramp CC 11 too. Engraved as a hairpin.",
 	"in":         "Separates the loop variable from its range/list/sequence in a `for`.",
 	"if":         "Elaboration-time conditional: `if cond { ... } else { ... }`.",
 	"else":       "Alternative branch of an `if`.",
 	"let":        "Immutable binding: `let changes = [Am7, D7, Gmaj7];`.",
 	"on":         "Absolute placement: `on beat 2.5 play ...` (escape hatch).",
 	"beat":       "Used after `on` to place an event at an absolute beat.",
-	"cc":         "Control change: `cc 74 = 64`.",
-	"bend":       "Pitch bend in semitones: `bend +2` (auto RPN range). Also `bend raw N`.",
-	"pressure":   "Channel aftertouch: `pressure 90`.",
+	"cc":         "Control change: `cc 74 = 64`. Ramp it with `cc 74 from 0 to 127 over 2 bars [curve exp] [every 32]`.",
+	"bend":       "Pitch bend in semitones: `bend +2` (auto RPN range). Also `bend raw N`. Ramp it with `bend 0 to +2 over quarter`.",
+	"pressure":   "Channel aftertouch: `pressure 90`. Polyphonic aftertouch on a key: `pressure C^4 = 90`.",
 	"program":    "Program (patch) change: `program \"violin\";`.",
 	"sysex":      "Raw system-exclusive bytes: `sysex F0 7E 7F 09 01 F7;`.",
+	"voicelead":  "Smooth voice leading: each chord in `voicelead { ... }` takes the inversion and octave that moves least from the one before. Set the range with `voicelead C^3 to C^6 { ... }` (the default).",
+	"inv":        "Chord inversion: `Cmaj7 inv 2` moves its 2 lowest tones up an octave. Other voicings: `drop 2`, `open`, `octave 3`.",
+	"rpn":        "Registered parameter, 14-bit: `rpn finetune = 8192;`. Add `reset` to send the null RPN after it.",
+	"nrpn":       "Non-registered parameter, 14-bit: `nrpn 300 = 64;`. Add `reset` to send the null RPN after it.",
+	"cc14":       "14-bit control change on a controller 0..31 and its LSB pair: `cc14 modulation = 9000;`.",
 }
 
 var durationWords = []string{"whole", "half", "quarter", "eighth", "sixteenth", "thirtysecond", "sixtyfourth"}
 var dynamicWords = []string{"ppp", "pp", "p", "mp", "mf", "f", "ff", "fff"}
 var intervalWords = []string{"min2", "maj2", "min3", "maj3", "fourth", "fifth", "min6", "maj6", "min7", "maj7", "octave"}
 
-// completion offers keywords, durations, dynamics, intervals, GM instruments,
-// and percussion names. It is context-light by design: it returns the full
+// completion offers keywords, durations, dynamics, intervals, built-in
+// functions, GM instruments, and percussion names. It is context-light by design: it returns the full
 // vocabulary and lets the editor filter by the typed prefix.
 func (s *Server) completion(p textDocumentPositionParams) []CompletionItem {
 	var items []CompletionItem
@@ -67,18 +83,30 @@ func (s *Server) completion(p textDocumentPositionParams) []CompletionItem {
 	for _, iv := range intervalWords {
 		items = append(items, CompletionItem{Label: iv, Kind: KindConstant, Detail: "interval"})
 	}
+	for _, name := range value.BuiltinNames() {
+		b := value.Builtins[name]
+		items = append(items, CompletionItem{Label: name, Kind: KindFunction, Detail: b.Signature(), Doc: b.Doc})
+	}
 	for _, name := range midi.GetInstruments() {
 		items = append(items, CompletionItem{Label: name, Kind: KindValue, Detail: "GM instrument"})
 	}
 	for _, name := range midi.GetPercussions() {
 		items = append(items, CompletionItem{Label: name, Kind: KindValue, Detail: "percussion"})
 	}
+	for _, name := range midi.GetControllers() {
+		n, _ := midi.ControllerNumber(name)
+		items = append(items, CompletionItem{Label: name, Kind: KindConstant, Detail: fmt.Sprintf("controller %d", n)})
+	}
+	for _, name := range midi.GetRPNs() {
+		n, _ := midi.RPNNumber(name)
+		items = append(items, CompletionItem{Label: name, Kind: KindConstant, Detail: fmt.Sprintf("rpn %d", n)})
+	}
 
-	// Also offer patterns and lets visible anywhere in the document (cheap and
-	// usually correct for this small language).
+	// Also offer patterns, functions and lets visible anywhere in the document
+	// (cheap and usually correct for this small language), and imported ones.
 	if text, ok := s.doc(p.TextDocument.URI); ok {
-		prog, _ := parser.New(text, p.TextDocument.URI).Parse()
-		for _, sym := range collectDefs(prog) {
+		prog := s.program(p.TextDocument.URI, text)
+		for _, sym := range append(collectDefs(prog), importedDefs(prog)...) {
 			kind := KindFunction
 			if sym.kind == defLet {
 				kind = KindVariable
@@ -90,7 +118,8 @@ func (s *Server) completion(p textDocumentPositionParams) []CompletionItem {
 }
 
 // hover describes the word under the cursor: a keyword's doc, an instrument's
-// program number, a percussion key, or a note/chord's MIDI/quality.
+// program number, a percussion key, a note/chord's MIDI/quality, a definition,
+// or a built-in function.
 func (s *Server) hover(p textDocumentPositionParams) *Hover {
 	text, ok := s.doc(p.TextDocument.URI)
 	if !ok {
@@ -101,6 +130,15 @@ func (s *Server) hover(p textDocumentPositionParams) *Hover {
 		return nil
 	}
 
+	if word == "arp" {
+		if n := arpAt(s.program(p.TextDocument.URI, text), p.Position); n != nil {
+			return md(describeArp(n))
+		}
+	}
+	// a voiced chord, hovered on the chord or on one of its voicings
+	if n := voicedAt(s.program(p.TextDocument.URI, text), p.Position); n != nil {
+		return md(describeVoicing(n, keyAt(s.program(p.TextDocument.URI, text), p.Position)))
+	}
 	if doc, ok := keywordDocs[word]; ok {
 		return md(fmt.Sprintf("**%s** — %s", word, doc))
 	}
@@ -111,6 +149,16 @@ func (s *Server) hover(p textDocumentPositionParams) *Hover {
 	if key, err := midi.PercussionKeyMap(word); err == nil {
 		return md(fmt.Sprintf("**percussion** `%s` — MIDI key %d", word, key))
 	}
+	if n, err := midi.ControllerNumber(word); err == nil {
+		info := fmt.Sprintf("**controller** `%s` — CC %d: `cc %s = 64`", word, n, word)
+		switch {
+		case word == "pan":
+			info += "; `pan -20;` in a track sets it from -64 (left) to 63 (right)"
+		case ast.MixerNames[word]:
+			info += fmt.Sprintf("; `%s 100;` in a track sets it", word)
+		}
+		return md(info)
+	}
 	for _, d := range durationWords {
 		if word == d {
 			return md(fmt.Sprintf("**duration** `%s`", word))
@@ -120,20 +168,30 @@ func (s *Server) hover(p textDocumentPositionParams) *Hover {
 	if info := describePitch(word); info != "" {
 		return md(info)
 	}
-	// a pattern/let definition in this document
-	if text, ok := s.doc(p.TextDocument.URI); ok {
-		prog, _ := parser.New(text, p.TextDocument.URI).Parse()
-		for _, sym := range collectDefs(prog) {
-			if sym.name == word {
-				return md(fmt.Sprintf("**%s** %s", sym.kindLabel(), sym.detail))
-			}
+	// a pattern/function/let definition in this document, or an imported one
+	prog := s.program(p.TextDocument.URI, text)
+	for _, sym := range collectDefs(prog) {
+		if sym.name == word {
+			return md(fmt.Sprintf("**%s** %s", sym.kindLabel(), sym.detail))
+		}
+	}
+	for _, sym := range importedDefs(prog) {
+		if sym.name == word {
+			return md(fmt.Sprintf("**%s** %s — from `%s`", sym.kindLabel(), sym.detail, sym.pos.Filename))
 		}
 	}
+	// a roman numeral or scale degree, in the key in force at the cursor
+	if info := describeDegree(word, keyAt(prog, p.Position)); info != "" {
+		return md(info)
+	}
+	if b, ok := value.Builtins[word]; ok {
+		return md(fmt.Sprintf("**built-in** `%s` — %s", b.Signature(), b.Doc))
+	}
 	return nil
 }
 
-// definition jumps to the pattern/let definition named by the word under the
-// cursor.
+// definition jumps to the pattern/function/let definition named by the word
+// under the cursor, in this document or in an imported file.
 func (s *Server) definition(p textDocumentPositionParams) []Location {
 	text, ok := s.doc(p.TextDocument.URI)
 	if !ok {
@@ -143,7 +201,7 @@ func (s *Server) definition(p textDocumentPositionParams) []Location {
 	if word == "" {
 		return nil
 	}
-	prog, _ := parser.New(text, p.TextDocument.URI).Parse()
+	prog := s.program(p.TextDocument.URI, text)
 	for _, sym := range collectDefs(prog) {
 		if sym.name == word {
 			return []Location{{
@@ -152,17 +210,28 @@ func (s *Server) definition(p textDocumentPositionParams) []Location {
 			}}
 		}
 	}
+	// an imported pattern or function: jump into its file
+	for _, sym := range importedDefs(prog) {
+		if sym.name == word {
+			src, _ := s.readFile(sym.pos.Filename)
+			return []Location{{
+				URI:   pathURI(sym.pos.Filename),
+				Range: rangeAt(sym.pos, string(src)),
+			}}
+		}
+	}
 	return nil
 }
 
-// documentSymbols builds the outline: projects -> (tracks, patterns); tracks ->
-// nested patterns.
+// documentSymbols builds the outline: projects -> (functions, tracks,
+// patterns); tracks -> nested patterns, functions and loops, which nest the
+// same way.
 func (s *Server) documentSymbols(uri string) []DocumentSymbol {
 	text, ok := s.doc(uri)
 	if !ok {
 		return nil
 	}
-	prog, _ := parser.New(text, uri).Parse()
+	prog, _ := parser.New(text, uriPath(uri)).Parse()
 	if prog == nil {
 		return nil
 	}
@@ -177,6 +246,9 @@ func (s *Server) documentSymbols(uri string) []DocumentSymbol {
 				Range:          rangeAt(n.Position, text),
 				SelectionRange: rangeAt(n.Position, text),
 			}
+			for _, fd := range n.Funcs {
+				proj.Children = append(proj.Children, funcSymbol(fd, text))
+			}
 			for _, pd := range n.Patterns {
 				proj.Children = append(proj.Children, patternSymbol(pd, text))
 			}
@@ -186,6 +258,8 @@ func (s *Server) documentSymbols(uri string) []DocumentSymbol {
 			syms = append(syms, proj)
 		case *ast.PatternDef:
 			syms = append(syms, patternSymbol(n, text))
+		case *ast.FuncDef:
+			syms = append(syms, funcSymbol(n, text))
 		}
 	}
 	return syms
@@ -199,12 +273,53 @@ func trackSymbol(tr *ast.Track, text string) DocumentSymbol {
 		Range:          rangeAt(tr.Position, text),
 		SelectionRange: rangeAt(tr.Position, text),
 	}
-	for _, st := range tr.Body {
-		if pd, ok := st.(*ast.PatternDef); ok {
-			sym.Children = append(sym.Children, patternSymbol(pd, text))
+	sym.Children = bodySymbols(tr.Body, text)
+	return sym
+}
+
+func bodySymbols(body []ast.Stmt, text string) []DocumentSymbol {
+	var syms []DocumentSymbol
+	for _, st := range body {
+		switch n := st.(type) {
+		case *ast.PatternDef:
+			syms = append(syms, patternSymbol(n, text))
+		case *ast.FuncDef:
+			syms = append(syms, funcSymbol(n, text))
+		case *ast.For:
+			syms = append(syms, DocumentSymbol{
+				Name:           loopHeader(n.Position, text),
+				Detail:         "loop",
+				Kind:           SymbolNamespace,
+				Range:          rangeAt(n.Position, text),
+				SelectionRange: rangeAt(n.Position, text),
+				Children:       bodySymbols(n.Body, text),
+			})
+		case *ast.VoiceLead:
+			syms = append(syms, DocumentSymbol{
+				Name:           loopHeader(n.Position, text),
+				Detail:         "voice leading",
+				Kind:           SymbolNamespace,
+				Range:          rangeAt(n.Position, text),
+				SelectionRange: rangeAt(n.Position, text),
+				Children:       bodySymbols(n.Body, text),
+			})
 		}
 	}
-	return sym
+	return syms
+}
+
+// loopHeader is the source of a loop up to its body, e.g.
+// `for i, ch in changes` or `repeat 4`.
+func loopHeader(pos token.Position, text string) string {
+	lines := strings.Split(text, "\n")
+	if pos.Line-1 < 0 || pos.Line-1 >= len(lines) || pos.Column-1 >= len(lines[pos.Line-1]) {
+		return "for"
+	}
+	head := lines[pos.Line-1][pos.Column-1:]
+	if i := strings.IndexByte(head, '{'); i >= 0 {
+		head = head[:i]
+	}
+	return strings.TrimSpace(head)
 }
 
 func patternSymbol(pd *ast.PatternDef, text string) DocumentSymbol {
@@ -221,12 +336,23 @@ func patternSymbol(pd *ast.PatternDef, text string) DocumentSymbol {
 	}
 }
 
+func funcSymbol(fd *ast.FuncDef, text string) DocumentSymbol {
+	return DocumentSymbol{
+		Name:           fd.Name,
+		Detail:         "fn(" + strings.Join(fd.Params, ", ") + ")",
+		Kind:           SymbolFunction,
+		Range:          rangeAt(fd.Position, text),
+		SelectionRange: rangeAt(fd.Position, text),
+	}
+}
+
 // --- definition/symbol collection helpers ---
 
 type defKind int
 
 const (
 	defPattern defKind = iota
+	defFunc
 	defLet
 )
 
@@ -238,13 +364,22 @@ type defSym struct {
 }
 
 func (d defSym) kindLabel() string {
-	if d.kind == defLet {
+	switch d.kind {
+	case defLet:
 		return "binding"
+	case defFunc:
+		return "function"
 	}
 	return "pattern"
 }
 
-// collectDefs walks the whole program for pattern and let definitions.
+func funcDef(name string, fd *ast.FuncDef) defSym {
+	detail := "(" + strings.Join(fd.Params, ", ") + ") = ..."
+	return defSym{name: name, kind: defFunc, pos: fd.Position, detail: detail}
+}
+
+// collectDefs walks the whole program for pattern, function and let
+// definitions.
 func collectDefs(prog *ast.Program) []defSym {
 	if prog == nil {
 		return nil
@@ -264,9 +399,19 @@ func collectDefs(prog *ast.Program) []defSym {
 			case *ast.PatternDef:
 				addPattern(n)
 				walkStmts(n.Body)
+			case *ast.FuncDef:
+				out = append(out, funcDef(n.Name, n))
 			case *ast.Let:
 				out = append(out, defSym{name: n.Name, kind: defLet, pos: n.Position, detail: "= ..."})
 			case *ast.For:
+				if n.Index != "" {
+					out = append(out, defSym{name: n.Index, kind: defLet, pos: n.Position, detail: "(loop index)"})
+				}
+				if n.Var != "" {
+					out = append(out, defSym{name: n.Var, kind: defLet, pos: n.Position, detail: "(loop variable)"})
+				}
+				walkStmts(n.Body)
+			case *ast.VoiceLead:
 				walkStmts(n.Body)
 			case *ast.If:
 				walkStmts(n.Then)
@@ -280,6 +425,9 @@ func collectDefs(prog *ast.Program) []defSym {
 	for _, it := range prog.Items {
 		switch n := it.(type) {
 		case *ast.Project:
+			for _, fd := range n.Funcs {
+				out = append(out, funcDef(fd.Name, fd))
+			}
 			for _, pd := range n.Patterns {
 				addPattern(pd)
 				walkStmts(pd.Body)
@@ -290,8 +438,37 @@ func collectDefs(prog *ast.Program) []defSym {
 		case *ast.PatternDef:
 			addPattern(n)
 			walkStmts(n.Body)
+		case *ast.FuncDef:
+			out = append(out, funcDef(n.Name, n))
+		}
+	}
+	return out
+}
+
+// importedDefs lists the patterns and functions prog imports, under the names
+// they are called by (`grooves.bossa` for a namespaced import), each
+// positioned in its own file.
+func importedDefs(prog *ast.Program) []defSym {
+	if prog == nil {
+		return nil
+	}
+	var out []defSym
+	for name, pd := range prog.Patterns() {
+		if pd.Position.Filename == prog.Position.Filename {
+			continue
+		}
+		detail := "()"
+		if len(pd.Params) > 0 {
+			detail = "(" + strings.Join(pd.Params, ", ") + ")"
 		}
+		out = append(out, defSym{name: name, kind: defPattern, pos: pd.Position, detail: detail})
 	}
+	for name, fd := range prog.Funcs() {
+		if fd.Position.Filename != prog.Position.Filename {
+			out = append(out, funcDef(name, fd))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
 	return out
 }
 
@@ -312,13 +489,18 @@ func wordAt(text string, pos Position) string {
 		return ""
 	}
 	isWord := func(b byte) bool {
-		return b == '_' || b == '#' || b == '/' ||
+		// bytes from 0x80 up belong to a multibyte rune such as the ø of viiø7
+		return b == '_' || b == '#' || b == '/' || b == '.' || b >= 0x80 ||
 			(b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
 	}
 	start := pos.Character
 	for start > 0 && isWord(line[start-1]) {
 		start--
 	}
+	// the caret of a scale degree (^3), but not the octave mark of C^4
+	if start > 0 && line[start-1] == '^' && (start == 1 || !isWord(line[start-2])) {
+		start--
+	}
 	end := pos.Character
 	for end < len(line) && isWord(line[end]) {
 		end++
@@ -329,6 +511,300 @@ func wordAt(text string, pos Position) string {
 	return line[start:end]
 }
 
+// arpAt finds the arp statement whose keyword is at pos in prog's own file.
+func arpAt(prog *ast.Program, pos Position) *ast.Arp {
+	var found *ast.Arp
+	walkBarItems(prog, func(it ast.BarItem) {
+		if n, ok := it.(*ast.Arp); ok {
+			p := n.Position
+			if p.Filename == prog.Position.Filename && p.Line-1 == pos.Line &&
+				pos.Character >= p.Column-1 && pos.Character <= p.Column-1+len("arp") {
+				found = n
+			}
+		}
+	})
+	return found
+}
+
+// voicedAt finds the voiced note or chord (`Cmaj7 inv 2`) written at pos in
+// prog's own file, from its first letter to the end of its last voicing.
+func voicedAt(prog *ast.Program, pos Position) *ast.NoteRef {
+	var found *ast.NoteRef
+	var visit func(p ast.Playable)
+	visit = func(p ast.Playable) {
+		switch n := p.(type) {
+		case *ast.NoteRef:
+			if len(n.Voicing) == 0 || n.Position.Filename != prog.Position.Filename || n.Position.Line-1 != pos.Line {
+				return
+			}
+			last := n.Voicing[len(n.Voicing)-1]
+			if last.Position.Line == n.Position.Line && pos.Character >= n.Position.Column-1 &&
+				pos.Character <= last.Position.Column-1+len(last.String()) {
+				found = n
+			}
+		case *ast.Group:
+			for _, v := range n.Voices {
+				visit(v)
+			}
+		}
+	}
+	walkBarItems(prog, func(it ast.BarItem) {
+		switch n := it.(type) {
+		case *ast.Step:
+			visit(n.Play)
+		case *ast.Tuplet:
+			for _, st := range n.Steps {
+				visit(st.Play)
+			}
+		case *ast.Arp:
+			visit(n.Play)
+		case *ast.Absolute:
+			if st, ok := n.Event.(*ast.Step); ok {
+				visit(st.Play)
+			}
+		}
+	})
+	return found
+}
+
+// walkBarItems calls visit on every bar item in prog's own bodies: tracks,
+// patterns and the control flow inside them.
+func walkBarItems(prog *ast.Program, visit func(ast.BarItem)) {
+	if prog == nil {
+		return
+	}
+	var walk func(nodes []ast.Node)
+	walkStmts := func(stmts []ast.Stmt) {
+		nodes := make([]ast.Node, len(stmts))
+		for i, st := range stmts {
+			nodes[i] = st
+		}
+		walk(nodes)
+	}
+	walk = func(nodes []ast.Node) {
+		for _, node := range nodes {
+			switch n := node.(type) {
+			case *ast.Bar:
+				for _, it := range n.Items {
+					visit(it)
+				}
+			case *ast.Absolute:
+				// `on beat N ...` straight in a body
+				visit(n)
+			case *ast.PatternDef:
+				walkStmts(n.Body)
+			case *ast.For:
+				walkStmts(n.Body)
+			case *ast.VoiceLead:
+				walkStmts(n.Body)
+			case *ast.If:
+				walkStmts(n.Then)
+				walkStmts(n.Else)
+				if n.ElseIf != nil {
+					walk([]ast.Node{n.ElseIf})
+				}
+			}
+		}
+	}
+	for _, it := range prog.Items {
+		switch n := it.(type) {
+		case *ast.Project:
+			for _, pd := range n.Patterns {
+				walkStmts(pd.Body)
+			}
+			for _, tr := range n.Tracks {
+				walkStmts(tr.Body)
+			}
+		case *ast.PatternDef:
+			walkStmts(n.Body)
+		}
+	}
+}
+
+// describeArp explains how an arp expands: its order, pace and length, and,
+// when the tones are written literally, the keys of one cycle.
+func describeArp(n *ast.Arp) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**arp** — `%s` %s", playableText(n.Play), n.Mode)
+	if n.Octaves > 1 {
+		fmt.Fprintf(&b, " over %d octaves", n.Octaves)
+	}
+	if n.Rate > 0 {
+		fmt.Fprintf(&b, ", one %s per tone", noteValueName(n.Rate))
+	} else {
+		b.WriteString(", one grid step per tone")
+	}
+	fmt.Fprintf(&b, ", gate %g%%", n.Gate)
+	if n.Over > 0 {
+		fmt.Fprintf(&b, ", for a %s.", noteValueName(n.Over))
+	} else {
+		b.WriteString(", to the end of the bar.")
+	}
+	if keys, ok := literalKeys(n.Play); ok {
+		seq := elaborator.ArpOrder(keys, n.Mode, n.Octaves)
+		if n.Mode == ast.ArpRandom {
+			fmt.Fprintf(&b, "\n\nDraws each tone from MIDI %v, seeded.", seq)
+		} else {
+			fmt.Fprintf(&b, "\n\nPlays MIDI %v, then repeats.", seq)
+		}
+	}
+	return b.String()
+}
+
+// describeVoicing explains what each voicing of a note or chord does and,
+// when it is written literally or against key k, the keys it sounds.
+func describeVoicing(n *ast.NoteRef, k value.Key) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**voicing** `%s`\n", playableText(n))
+	for _, v := range n.Voicing {
+		fmt.Fprintf(&b, "\n- `%s`: ", v)
+		switch v.Kind {
+		case ast.VoiceInvert:
+			fmt.Fprintf(&b, "inversion %d, the %d lowest tones move up an octave", v.N, v.N)
+		case ast.VoiceDrop:
+			fmt.Fprintf(&b, "drop-%d, tone %d from the top moves down an octave", v.N, v.N)
+		case ast.VoiceOpen:
+			b.WriteString("open, every other tone from the bottom moves up an octave")
+		case ast.VoiceOctave:
+			fmt.Fprintf(&b, "the lowest tone moves to octave %d, the others with it", v.N)
+		}
+	}
+	if keys, ok := literalKeys(&ast.NoteRef{Text: absoluteText(n.Text, k)}); ok {
+		if voiced, err := value.VoiceAll(keys, n.Voicing); err == nil {
+			fmt.Fprintf(&b, "\n\nMIDI %v, voiced as %v.", keys, voiced)
+		} else {
+			fmt.Fprintf(&b, "\n\nCannot be voiced: %v.", err)
+		}
+	}
+	return b.String()
+}
+
+// playableText renders a playable roughly as written.
+func playableText(p ast.Playable) string {
+	switch n := p.(type) {
+	case *ast.NoteRef:
+		text := n.Text
+		for _, v := range n.Voicing {
+			text += " " + v.String()
+		}
+		return text
+	case *ast.Group:
+		voices := make([]string, len(n.Voices))
+		for i, v := range n.Voices {
+			voices[i] = playableText(v)
+		}
+		return "(" + strings.Join(voices, ", ") + ")"
+	}
+	return "(...)"
+}
+
+// literalKeys resolves a playable written as note or chord literals.
+func literalKeys(p ast.Playable) ([]uint8, bool) {
+	switch n := p.(type) {
+	case *ast.NoteRef:
+		var keys []uint8
+		if k, err := notesParse(n.Text); err == nil {
+			keys = []uint8{k}
+		} else if keys, _, err = chordParse(n.Text); err != nil {
+			return nil, false
+		}
+		keys, err := value.VoiceAll(keys, n.Voicing)
+		return keys, err == nil
+	case *ast.Group:
+		var keys []uint8
+		for _, v := range n.Voices {
+			k, ok := literalKeys(v)
+			if !ok {
+				return nil, false
+			}
+			keys = append(keys, k...)
+		}
+		return keys, true
+	}
+	return nil, false
+}
+
+// noteValueName spells a note value: 16 is "sixteenth".
+func noteValueName(v int) string {
+	for i, w := range durationWords {
+		if 1<<i == v {
+			return w
+		}
+	}
+	return fmt.Sprintf("1/%d", v)
+}
+
+// keyAt returns the key in force at pos in prog's own file: the project's key,
+// then any key statement before pos in the body of the track pos is in.
+func keyAt(prog *ast.Program, pos Position) value.Key {
+	var k value.Key
+	if prog == nil {
+		return k
+	}
+	before := func(p token.Position) bool {
+		return p.Filename == prog.Position.Filename &&
+			(p.Line-1 < pos.Line || p.Line-1 == pos.Line && p.Column-1 < pos.Character)
+	}
+	set := func(st ast.Setting) {
+		if st.Kind != ast.SettingKey {
+			return
+		}
+		if key, err := value.ParseKey(st.Tonic, st.Mode); err == nil {
+			k = key
+		}
+	}
+	for _, it := range prog.Items {
+		pr, ok := it.(*ast.Project)
+		if !ok {
+			continue
+		}
+		for _, st := range pr.Settings {
+			set(st)
+		}
+		var track *ast.Track
+		for _, tr := range pr.Tracks {
+			if before(tr.Position) {
+				track = tr
+			}
+		}
+		if track == nil {
+			continue
+		}
+		for _, st := range track.Body {
+			if ss, ok := st.(*ast.SettingStmt); ok && before(ss.Position) {
+				set(ss.Setting)
+			}
+		}
+	}
+	return k
+}
+
+// absoluteText resolves a roman numeral or scale degree against k into a
+// spelling notesParse or chordParse reads (^3 in D major is F#4); any other
+// text is returned as is.
+func absoluteText(text string, k value.Key) string {
+	if abs, ok := k.ResolveDegree(text); ok {
+		return strings.Replace(abs, "^", "", 1)
+	}
+	return text
+}
+
+// describeDegree returns a hover string if word is a roman numeral or scale
+// degree, with the note or chord it resolves to in key k.
+func describeDegree(word string, k value.Key) string {
+	if _, ok := k.ResolveDegree(word); !ok {
+		return ""
+	}
+	abs := absoluteText(word, k)
+	if n, err := notesParse(abs); err == nil {
+		return fmt.Sprintf("**scale degree** `%s` in %s — `%s`, MIDI %d", word, k, abs, n)
+	}
+	if pitches, name, err := chordParse(abs); err == nil {
+		return fmt.Sprintf("**chord** `%s` in %s — `%s` (%s), MIDI %v", word, k, abs, name, pitches)
+	}
+	return fmt.Sprintf("`%s` in %s would be `%s`, which is not a valid note or chord", word, k, abs)
+}
+
 // describePitch returns a hover string if word parses as a note or chord.
 func describePitch(word string) string {
 	if n, err := notesParse(word); err == nil {
@@ -163,3 +163,180 @@ func TestDocumentSymbols(t *testing.T) {
 	}
 	t.Fatalf("track 'lead' missing nested pattern 'riff'")
 }
+
+func TestImports_DefinitionAndDiagnostics(t *testing.T) {
+	const lib = "pattern bossa(n) {\n\tbar quarter { n _ n _ }\n\tmissing\n}\n"
+	main := "import \"lib/grooves.ear\" as grooves;\nproject \"p\" { track \"t\" instrument \"piano\" { grooves.bossa(C) } }\n"
+	s := newTestServer("file:///song.ear", main)
+	s.setDoc("file:///lib/grooves.ear", lib) // served from the open buffer
+
+	col := strings.Index(strings.Split(main, "\n")[1], "bossa")
+	locs := s.definition(textDocumentPositionParams{
+		TextDocument: textDocumentIdentifier{URI: "file:///song.ear"},
+		Position:     Position{Line: 1, Character: col},
+	})
+	if len(locs) != 1 || locs[0].URI != "file:///lib/grooves.ear" || locs[0].Range.Start.Line != 0 {
+		t.Fatalf("definition of grooves.bossa = %+v, want lib/grooves.ear line 0", locs)
+	}
+
+	h := s.hover(textDocumentPositionParams{
+		TextDocument: textDocumentIdentifier{URI: "file:///song.ear"},
+		Position:     Position{Line: 1, Character: col},
+	})
+	if h == nil || !strings.Contains(h.Contents.Value, "grooves.ear") {
+		t.Errorf("hover on grooves.bossa = %v", h)
+	}
+
+	// The library's undefined call is reported on the import line.
+	diags := diagnose(main, "file:///song.ear", s.readFile)
+	if len(diags) != 1 || diags[0].Range.Start.Line != 0 ||
+		!strings.Contains(diags[0].Message, "/lib/grooves.ear:3:2") {
+		t.Errorf("diagnostics = %+v, want one on the import line", diags)
+	}
+}
+
+func TestFunctions_HoverAndOutline(t *testing.T) {
+	src := "fn tritoneSub(ch) = ch + dim5;\nproject \"p\" { track \"t\" instrument \"piano\" { let x = tritoneSub(G7); } }\n"
+	s := newTestServer("file:///t.ear", src)
+	col := strings.Index(strings.Split(src, "\n")[1], "tritoneSub")
+	h := s.hover(textDocumentPositionParams{
+		TextDocument: textDocumentIdentifier{URI: "file:///t.ear"},
+		Position:     Position{Line: 1, Character: col + 2},
+	})
+	if h == nil || !strings.Contains(h.Contents.Value, "**function** (ch)") {
+		t.Fatalf("hover = %+v, want the function signature", h)
+	}
+	syms := s.documentSymbols("file:///t.ear")
+	if len(syms) != 2 || syms[0].Name != "tritoneSub" || syms[0].Detail != "fn(ch)" {
+		t.Fatalf("symbols = %+v, want tritoneSub then the project", syms)
+	}
+}
+
+func TestBuiltins_CompletionAndHover(t *testing.T) {
+	src := "project \"p\" { track \"t\" { let s = scale(D, \"dorian\"); } }\n"
+	s := newTestServer("file:///t.ear", src)
+	pos := textDocumentPositionParams{
+		TextDocument: textDocumentIdentifier{URI: "file:///t.ear"},
+		Position:     Position{Line: 0, Character: strings.Index(src, "scale") + 1},
+	}
+	var found bool
+	for _, it := range s.completion(pos) {
+		if it.Label == "transpose" && it.Kind == KindFunction && it.Detail == "transpose(x, by)" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("completion misses the transpose built-in")
+	}
+	h := s.hover(pos)
+	if h == nil || !strings.Contains(h.Contents.Value, "`scale(root, mode)`") || !strings.Contains(h.Contents.Value, `"dorian"`) {
+		t.Fatalf("hover = %+v, want the scale built-in's doc", h)
+	}
+}
+
+func TestDocumentSymbols_Loops(t *testing.T) {
+	src := "project \"p\" { track \"t\" instrument \"piano\" {\n\tfor i, ch in changes {\n\t\trepeat 2 { pattern fill { bar quarter { C } } }\n\t}\n} }\n"
+	s := newTestServer("file:///t.ear", src)
+	tr := s.documentSymbols("file:///t.ear")[0].Children[0]
+	if len(tr.Children) != 1 || tr.Children[0].Name != "for i, ch in changes" || tr.Children[0].Kind != SymbolNamespace {
+		t.Fatalf("track children = %+v, want the for loop", tr.Children)
+	}
+	rep := tr.Children[0].Children
+	if len(rep) != 1 || rep[0].Name != "repeat 2" || len(rep[0].Children) != 1 || rep[0].Children[0].Name != "fill" {
+		t.Errorf("loop children = %+v, want repeat 2 holding fill", rep)
+	}
+}
+
+func TestArp_HoverExplainsExpansion(t *testing.T) {
+	src := "project \"p\" { track \"t\" {\n\tbar { arp Am7 up-down rate 16 gate 50% }\n\tbar { arp ch random over half }\n} }\n"
+	s := newTestServer("file:///t.ear", src)
+	at := func(line, char int) string {
+		h := s.hover(textDocumentPositionParams{
+			TextDocument: textDocumentIdentifier{URI: "file:///t.ear"},
+			Position:     Position{Line: line, Character: char},
+		})
+		if h == nil {
+			t.Fatalf("no hover at %d:%d", line, char)
+		}
+		return h.Contents.Value
+	}
+	h := at(1, 8)
+	for _, want := range []string{"`Am7` up-down", "one sixteenth per tone", "gate 50%", "to the end of the bar", "MIDI [69 72 76 79 76 72]"} {
+		if !strings.Contains(h, want) {
+			t.Errorf("hover = %q, missing %q", h, want)
+		}
+	}
+	if h := at(2, 8); !strings.Contains(h, "`ch` random") || !strings.Contains(h, "for a half") || strings.Contains(h, "MIDI") {
+		t.Errorf("hover = %q, want a random arp over a half without keys", h)
+	}
+}
+
+func TestVoicing_Hover(t *testing.T) {
+	src := "project \"p\" { track \"t\" {\n\tbar { Cmaj7 inv 2 drop 2 }\n} }\n"
+	s := newTestServer("file:///t.ear", src)
+	for _, char := range []int{8, 14, 20} { // on the chord, inv and drop
+		h := s.hover(textDocumentPositionParams{
+			TextDocument: textDocumentIdentifier{URI: "file:///t.ear"},
+			Position:     Position{Line: 1, Character: char},
+		})
+		if h == nil {
+			t.Fatalf("no hover at 1:%d", char)
+		}
+		for _, want := range []string{"`Cmaj7 inv 2 drop 2`", "inversion 2", "drop-2", "MIDI [60 64 67 71], voiced as [60 67 71 76]"} {
+			if !strings.Contains(h.Contents.Value, want) {
+				t.Errorf("hover at %d = %q, missing %q", char, h.Contents.Value, want)
+			}
+		}
+	}
+}
+
+func TestControllers_CompletionAndHover(t *testing.T) {
+	src := "project \"p\" { track \"t\" {\n\tpan -20;\n\tcc cutoff = 64;\n} }\n"
+	s := newTestServer("file:///t.ear", src)
+	pos := textDocumentPositionParams{TextDocument: textDocumentIdentifier{URI: "file:///t.ear"}}
+	found := false
+	for _, it := range s.completion(pos) {
+		if it.Label == "sustain" && it.Detail == "controller 64" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("completion missing the sustain controller")
+	}
+	pos.Position = Position{Line: 1, Character: 2}
+	if h := s.hover(pos); h == nil || !strings.Contains(h.Contents.Value, "CC 10") || !strings.Contains(h.Contents.Value, "-64 (left)") {
+		t.Errorf("pan hover = %+v", h)
+	}
+	pos.Position = Position{Line: 2, Character: 6}
+	if h := s.hover(pos); h == nil || !strings.Contains(h.Contents.Value, "CC 74") {
+		t.Errorf("cutoff hover = %+v", h)
+	}
+}
+
+func TestHover_RomanNumeralInKey(t *testing.T) {
+	src := "project \"p\" { key C; track \"t\" {\n  bar 1 { V7 }\n  key D minor;\n  bar 1 { V7 } bar quarter { ^3 _ _ _ }\n  bar 1 { iiø7 }\n} }\n"
+	s := newTestServer("file:///t.ear", src)
+	hover := func(line int, word string) string {
+		col := strings.Index(strings.Split(src, "\n")[line], word)
+		h := s.hover(textDocumentPositionParams{
+			TextDocument: textDocumentIdentifier{URI: "file:///t.ear"},
+			Position:     Position{Line: line, Character: col + 1},
+		})
+		if h == nil {
+			t.Fatalf("no hover on %q, line %d", word, line)
+		}
+		return h.Contents.Value
+	}
+	if got := hover(1, "V7"); !strings.Contains(got, "in C major — `G7`") {
+		t.Errorf("hover on V7 in C = %q, want it resolved to G7", got)
+	}
+	if got := hover(3, "V7"); !strings.Contains(got, "in D minor — `A7`") {
+		t.Errorf("hover on V7 in D minor = %q, want it resolved to A7", got)
+	}
+	if got := hover(3, "^3"); !strings.Contains(got, "**scale degree** `^3` in D minor — `F4`, MIDI 65") {
+		t.Errorf("hover on ^3 = %q, want F4", got)
+	}
+	if got := hover(4, "iiø7"); !strings.Contains(got, "`iiø7` in D minor — `Em7b5`") {
+		t.Errorf("hover on iiø7 = %q, want Em7b5", got)
+	}
+}
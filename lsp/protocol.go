@@ -196,10 +196,11 @@ type MarkupContent struct {
 type SymbolKind int
 
 const (
-	SymbolModule   SymbolKind = 2
-	SymbolClass    SymbolKind = 5
-	SymbolFunction SymbolKind = 12
-	SymbolVariable SymbolKind = 13
+	SymbolModule    SymbolKind = 2
+	SymbolNamespace SymbolKind = 3
+	SymbolClass     SymbolKind = 5
+	SymbolFunction  SymbolKind = 12
+	SymbolVariable  SymbolKind = 13
 )
 
 type DocumentSymbol struct {
@@ -5,11 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/poolpOrg/earmuff/analyzer"
+	"github.com/poolpOrg/earmuff/ast"
 	"github.com/poolpOrg/earmuff/parser"
 	"github.com/poolpOrg/earmuff/token"
 )
@@ -196,6 +200,35 @@ func (s *Server) doc(uri string) (string, bool) {
 	return t, ok
 }
 
+// readFile reads an imported file, preferring the editor's unsaved buffer
+// when the file is open.
+func (s *Server) readFile(path string) ([]byte, error) {
+	if text, ok := s.doc(pathURI(path)); ok {
+		return []byte(text), nil
+	}
+	return os.ReadFile(path)
+}
+
+// program parses a document together with the files it imports.
+func (s *Server) program(uri, text string) *ast.Program {
+	prog, _ := (&parser.Loader{ReadFile: s.readFile}).Load(text, uriPath(uri))
+	return prog
+}
+
+// uriPath returns the filesystem path of a file:// URI, or the URI itself for
+// any other scheme. Positions in parsed documents carry this path.
+func uriPath(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		return filepath.FromSlash(u.Path)
+	}
+	return uri
+}
+
+// pathURI is the file:// URI of a filesystem path.
+func pathURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
 // --- diagnostics ---
 
 // publishDiagnostics parses + analyzes the document and pushes diagnostics.
@@ -204,7 +237,7 @@ func (s *Server) publishDiagnostics(uri string) {
 	if !ok {
 		return
 	}
-	diags := Diagnose(text, uri)
+	diags := diagnose(text, uri, s.readFile)
 	s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
 		URI:         uri,
 		Diagnostics: diags,
@@ -212,18 +245,27 @@ func (s *Server) publishDiagnostics(uri string) {
 }
 
 // Diagnose runs the parser and analyzer over src and converts their findings to
-// LSP diagnostics. Exported so it can be unit-tested without the wire layer.
+// LSP diagnostics. Imported files are read from disk. Exported so it can be
+// unit-tested without the wire layer.
 func Diagnose(src, uri string) []Diagnostic {
+	return diagnose(src, uri, nil)
+}
+
+// diagnose is Diagnose with the reader for imported files (nil = disk).
+// Findings inside an imported file are reported on the import statement that
+// pulled it in, prefixed with their own position.
+func diagnose(src, uri string, read func(string) ([]byte, error)) []Diagnostic {
 	out := []Diagnostic{}
+	file := uriPath(uri)
 
-	p := parser.New(src, uri)
-	prog, parseDiags := p.Parse()
+	prog, parseDiags := (&parser.Loader{ReadFile: read}).Load(src, file)
 	for _, d := range parseDiags {
+		pos, msg := localize(prog, file, d.Pos, d.Msg)
 		out = append(out, Diagnostic{
-			Range:    rangeAt(d.Pos, src),
+			Range:    rangeAt(pos, src),
 			Severity: SeverityError,
 			Source:   "earmuff",
-			Message:  d.Msg,
+			Message:  msg,
 		})
 	}
 
@@ -236,17 +278,50 @@ func Diagnose(src, uri string) []Diagnostic {
 			if d.Severity == analyzer.Warning {
 				sev = SeverityWarning
 			}
+			pos, msg := localize(prog, file, d.Pos, d.Msg)
 			out = append(out, Diagnostic{
-				Range:    rangeAt(d.Pos, src),
+				Range:    rangeAt(pos, src),
 				Severity: sev,
 				Source:   "earmuff",
-				Message:  d.Msg,
+				Message:  msg,
 			})
 		}
 	}
 	return out
 }
 
+// localize maps a finding to a position in the document file: findings in an
+// imported file move to the document's import statement that reaches it.
+func localize(prog *ast.Program, file string, pos token.Position, msg string) (token.Position, string) {
+	if pos.Filename == file || prog == nil {
+		return pos, msg
+	}
+	for _, it := range prog.Items {
+		if imp, ok := it.(*ast.Import); ok && imports(imp.Program, pos.Filename, map[*ast.Program]bool{}) {
+			return imp.Position, fmt.Sprintf("%s: %s", pos, msg)
+		}
+	}
+	return pos, msg
+}
+
+// imports reports whether prog is the file named file or imports it, directly
+// or not.
+func imports(prog *ast.Program, file string, seen map[*ast.Program]bool) bool {
+	if prog == nil || seen[prog] {
+		return false
+	}
+	seen[prog] = true
+	if prog.Position.Filename == file {
+		return true
+	}
+	for _, it := range prog.Items {
+		if imp, ok := it.(*ast.Import); ok && imports(imp.Program, file, seen) {
+			return true
+		}
+	}
+	return false
+}
+
 // rangeAt converts a 1-based token.Position into an LSP range covering the word
 // (or single character) at that position.
 func rangeAt(pos token.Position, src string) Range {
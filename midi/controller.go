@@ -0,0 +1,92 @@
+package midi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// controllerNumbers names the standard MIDI continuous controllers, so a song
+// can write `cc cutoff = 64` instead of `cc 74 = 64`. Some controllers go by
+// two names (brightness and cutoff are both 74).
+var controllerNumbers = map[string]uint8{
+	"bank":        0,
+	"modulation":  1,
+	"breath":      2,
+	"foot":        4,
+	"glide":       5,
+	"data":        6,
+	"volume":      7,
+	"balance":     8,
+	"pan":         10,
+	"expression":  11,
+	"sustain":     64,
+	"portamento":  65,
+	"sostenuto":   66,
+	"soft":        67,
+	"legato":      68,
+	"resonance":   71,
+	"release":     72,
+	"attack":      73,
+	"brightness":  74,
+	"cutoff":      74,
+	"decay":       75,
+	"vibrato":     77,
+	"reverb":      91,
+	"tremolo":     92,
+	"chorus":      93,
+	"detune":      94,
+	"phaser":      95,
+	"soundoff":    120,
+	"resetall":    121,
+	"allnotesoff": 123,
+}
+
+// GetControllers returns the controller names ControllerNumber knows, sorted.
+func GetControllers() []string {
+	names := make([]string, 0, len(controllerNumbers))
+	for name := range controllerNumbers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ControllerNumber maps a controller name such as "volume" or "cutoff" to its
+// MIDI controller number.
+func ControllerNumber(name string) (uint8, error) {
+	if n, ok := controllerNumbers[strings.ToLower(name)]; ok {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown controller %s", name)
+}
+
+// rpnNumbers names the registered parameters of General MIDI and its
+// successors.
+var rpnNumbers = map[string]uint16{
+	"bendrange":  0,
+	"finetune":   1,
+	"coarsetune": 2,
+	"tuningprog": 3,
+	"tuningbank": 4,
+	"modrange":   5,
+}
+
+// GetRPNs returns the parameter names RPNNumber knows, sorted.
+func GetRPNs() []string {
+	names := make([]string, 0, len(rpnNumbers))
+	for name := range rpnNumbers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RPNNumber maps a registered parameter name such as "finetune" to its
+// 14-bit parameter number.
+func RPNNumber(name string) (uint16, error) {
+	if n, ok := rpnNumbers[strings.ToLower(name)]; ok {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown registered parameter %s", name)
+}
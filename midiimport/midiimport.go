@@ -22,6 +22,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/poolpOrg/earmuff/elaborator"
 	"github.com/poolpOrg/earmuff/midi"
 	"github.com/poolpOrg/go-harmony/chords"
 	"github.com/poolpOrg/go-harmony/notes"
@@ -30,7 +31,7 @@ import (
 
 // PPQ is earmuff's ticks-per-quarter; the importer rescales the source file's
 // resolution to this so the emitted durations line up with the language.
-const PPQ = 960
+const PPQ = elaborator.PPQ
 
 // Options controls how the MIDI is rendered to source.
 type Options struct {
@@ -118,12 +119,21 @@ type timedNote struct {
 	vel   uint8
 }
 
+// timedPressure is one polyphonic aftertouch message, its tick in earmuff
+// ticks (PPQ).
+type timedPressure struct {
+	tick  uint32
+	key   uint8
+	value uint8
+}
+
 type track struct {
 	name       string
 	instrument string
 	channel    uint8 // 0-based; 9 == GM percussion
 	percussion bool
 	notes      []timedNote
+	pressures  []timedPressure
 }
 
 func readTracks(s *gm.SMF, srcPPQ uint32) []track {
@@ -136,7 +146,7 @@ func readTracks(s *gm.SMF, srcPPQ uint32) []track {
 			abs += ev.Delta
 			et := rescale(abs, srcPPQ) // earmuff ticks
 			m := ev.Message
-			var ch, key, vel uint8
+			var ch, key, vel, val uint8
 			var name string
 			switch {
 			case m.GetNoteOn(&ch, &key, &vel) && vel > 0:
@@ -154,6 +164,8 @@ func readTracks(s *gm.SMF, srcPPQ uint32) []track {
 					gate = 1
 				}
 				tr.notes = append(tr.notes, timedNote{onset: onset, gate: gate, key: key, vel: vel})
+			case m.GetPolyAfterTouch(&ch, &key, &val):
+				tr.pressures = append(tr.pressures, timedPressure{tick: et, key: key, value: val})
 			case m.GetMetaTrackName(&name), m.GetMetaInstrument(&name):
 				if tr.name == "" {
 					tr.name = name
@@ -250,7 +262,7 @@ func renderTrack(b *strings.Builder, opts Options, h header, tr *track) {
 // inside one bar per measure, so the output recompiles to the same timing.
 func renderFaithful(b *strings.Builder, h header, tr *track, ticksPerBar uint32) {
 	groups := groupChords(tr.notes)
-	beatTicks := PPQ * 4 / uint32(h.unit)
+	beats := elaborator.BeatLens(h.beats, h.unit, nil)
 	byBar := map[uint32][]chordGroup{}
 	var bars []uint32
 	for _, g := range groups {
@@ -260,12 +272,18 @@ func renderFaithful(b *strings.Builder, h header, tr *track, ticksPerBar uint32)
 		}
 		byBar[bar] = append(byBar[bar], g)
 	}
+	for _, p := range tr.pressures {
+		if bar := p.tick / ticksPerBar; byBar[bar] == nil {
+			byBar[bar] = []chordGroup{}
+			bars = append(bars, bar)
+		}
+	}
 	sort.Slice(bars, func(i, j int) bool { return bars[i] < bars[j] })
 	for _, bar := range bars {
 		b.WriteString("        bar {\n")
 		for _, g := range byBar[bar] {
 			within := g.onset - bar*ticksPerBar
-			beat := 1 + float64(within)/float64(beatTicks)
+			beat := beatOf(beats, within)
 			gateVal := nearestNoteValue(g.gate)
 			// `on beat <n> <playable>:<gate>` — a bar item, space-separated, no
 			// `play` keyword and no terminating `;`. `on beat` does not accept a
@@ -276,6 +294,9 @@ func renderFaithful(b *strings.Builder, h header, tr *track, ticksPerBar uint32)
 				fmt.Fprintf(b, "            on beat %s %s:%d\n", trimFloat(beat), tok, gateVal)
 			}
 		}
+		for _, item := range pressureItems(tr, bar, ticksPerBar, beats, 1) {
+			b.WriteString("            " + item + "\n")
+		}
 		b.WriteString("        }\n")
 	}
 }
@@ -307,6 +328,11 @@ func renderGridded(b *strings.Builder, opts Options, h header, tr *track, ticksP
 	}
 
 	totalBars := maxStep/stepsPerBar + 1
+	for _, p := range tr.pressures {
+		tick := uint32(math.Round(float64(p.tick)/float64(step))) * step
+		totalBars = max(totalBars, int(tick/ticksPerBar)+1)
+	}
+	beats := elaborator.BeatLens(h.beats, h.unit, nil)
 	for bar := 0; bar < totalBars; bar++ {
 		fmt.Fprintf(b, "        bar %d {", opts.Grid)
 		for s := 0; s < stepsPerBar; s++ {
@@ -322,10 +348,54 @@ func renderGridded(b *strings.Builder, opts Options, h header, tr *track, ticksP
 				b.WriteString(" _")
 			}
 		}
+		for _, item := range pressureItems(tr, uint32(bar), ticksPerBar, beats, step) {
+			b.WriteString(" " + item)
+		}
 		b.WriteString(" }\n")
 	}
 }
 
+// pressureItems renders the polyphonic aftertouch of one bar as `on beat <n>
+// pressure <key> = <value>;` items. Ticks are rounded to a multiple of step
+// (1 keeps them exact) and then belong to the bar they land in.
+func pressureItems(tr *track, bar, ticksPerBar uint32, beats []uint32, step uint32) []string {
+	var items []string
+	for _, p := range tr.pressures {
+		tick := uint32(math.Round(float64(p.tick)/float64(step))) * step
+		if tick/ticksPerBar != bar {
+			continue
+		}
+		beat := beatOf(beats, tick-bar*ticksPerBar)
+		items = append(items, fmt.Sprintf("on beat %s pressure %s = %d;", trimFloat(beat), keyToken(tr, p.key), p.value))
+	}
+	return items
+}
+
+// beatOf maps a within-bar tick to the `on beat` number that places it there,
+// counting the beats `on beat` counts in the meter (dotted beats in 6/8).
+func beatOf(beats []uint32, within uint32) float64 {
+	n := 1.0
+	for i, l := range beats {
+		if within < l || i == len(beats)-1 {
+			return n + float64(within)/float64(l)
+		}
+		within -= l
+		n++
+	}
+	return n
+}
+
+// keyToken names a single key: a percussion alias on a percussion track, a
+// note otherwise.
+func keyToken(tr *track, key uint8) string {
+	if tr.percussion {
+		if name, err := midi.KeyToPercussion(key); err == nil {
+			return percAlias(name)
+		}
+	}
+	return noteName(key)
+}
+
 // renderPercussionKit emits a `kit { ... }` aliasing every percussion key the
 // track uses to its GM name, so the bars can refer to short aliases.
 func renderPercussionKit(b *strings.Builder, tr *track) {
@@ -541,5 +611,5 @@ func trimFloat(f float64) string {
 	if f == math.Trunc(f) {
 		return fmt.Sprintf("%d", int(f))
 	}
-	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", f), "0"), ".")
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.6f", f), "0"), ".")
 }
@@ -1,6 +1,7 @@
 package midiimport
 
 import (
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -74,6 +75,32 @@ func TestImport_FaithfulRoundTrip(t *testing.T) {
 	}
 }
 
+func TestImport_FaithfulCompoundMeter(t *testing.T) {
+	// on beat counts dotted quarters in 6/8, so six eighths are beats 1 to
+	// 2.666667, not 1 to 6.
+	src := `project "p" { time 6 8; track "t" instrument "piano" {
+        bar eighth { C D E F G A }
+        bar eighth { on beat 2 pressure E^4 = 90; C _ _ D _ _ }
+    } }`
+	orig := compile(t, src)
+	out, err := Import(smfwriter.Write(orig), Options{Faithful: true})
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if strings.Contains(out, "on beat 6") {
+		t.Errorf("6/8 beats counted in eighths:\n%s", out)
+	}
+	round := compile(t, out)
+	if got, want := noteOnsets(round), noteOnsets(orig); !reflect.DeepEqual(got, want) {
+		t.Errorf("onsets = %v, want %v\n%s", got, want, out)
+	}
+	for _, ev := range round.Events {
+		if ev.Msg.Kind == elaborator.MsgPolyPressure && ev.Tick != 2880+1440 {
+			t.Errorf("pressure at %d, want %d\n%s", ev.Tick, 2880+1440, out)
+		}
+	}
+}
+
 func TestImport_ReadableCompiles(t *testing.T) {
 	src := `project "p" { bpm 100; time 4 4;
         track "lead" instrument "piano" { bar 8 { C^ E^ G^ C^ E^ G^ C^ E^ } }
@@ -98,3 +125,34 @@ func TestImport_ChordNames(t *testing.T) {
 		t.Fatalf("expected chord name Cmaj7 in:\n%s", out)
 	}
 }
+
+func TestImport_PolyPressureRoundTrip(t *testing.T) {
+	src := `project "p" { time 4 4; track "t" instrument "piano" {
+        bar quarter { C^4 E^4 on beat 2 pressure E^4 = 90; G^4 _ }
+        on beat 3 pressure (G^4) = 40;
+    } }`
+	pressures := func(song elaborator.Song) [][3]int {
+		var out [][3]int
+		for _, ev := range song.Events {
+			if ev.Msg.Kind == elaborator.MsgPolyPressure {
+				out = append(out, [3]int{int(ev.Tick), int(ev.Msg.Key), int(ev.Msg.Value)})
+			}
+		}
+		return out
+	}
+	orig := compile(t, src)
+	want := pressures(orig)
+	if len(want) != 2 {
+		t.Fatalf("poly pressure events = %v, want 2", want)
+	}
+	mid := smfwriter.Write(orig)
+	for _, opts := range []Options{{Faithful: true}, {}} {
+		out, err := Import(mid, opts)
+		if err != nil {
+			t.Fatalf("import: %v", err)
+		}
+		if got := pressures(compile(t, out)); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("faithful=%v: poly pressure = %v, want %v\n%s", opts.Faithful, got, want, out)
+		}
+	}
+}
@@ -5,8 +5,9 @@
 // NoteOn/NoteOff into notes, groups simultaneous notes into chords, fills gaps
 // with rests, and lays one part per track. Durations that don't land on a clean
 // note value are split (and tied) into representable pieces; anything that
-// crosses a barline is split at the barline and tied across it. One <part> per
-// track, treble or bass clef chosen from the register.
+// crosses a barline is split at the barline and tied across it. Tuplets the
+// source wrote as such keep their exact durations under a <time-modification>.
+// One <part> per track, treble or bass clef chosen from the register.
 package musicxml
 
 import (
@@ -15,6 +16,7 @@ import (
 	"strings"
 
 	"github.com/poolpOrg/earmuff/elaborator"
+	"github.com/poolpOrg/earmuff/value"
 )
 
 const ppq = elaborator.PPQ // 960 ticks per quarter note
@@ -25,15 +27,6 @@ const divisions = ppq
 
 // Render returns MusicXML for song.
 func Render(song elaborator.Song) string {
-	beats, unit := song.TimeBeats, song.TimeUnit
-	if beats == 0 {
-		beats = 4
-	}
-	if unit == 0 {
-		unit = 4
-	}
-	ticksPerBar := uint32(beats) * (ppq * 4 / uint32(unit))
-
 	var b strings.Builder
 	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
 	b.WriteString(`<!DOCTYPE score-partwise PUBLIC "-//Recordare//DTD MusicXML 3.1 Partwise//EN" "http://www.musicxml.org/dtds/partwise.dtd">` + "\n")
@@ -50,6 +43,7 @@ func Render(song elaborator.Song) string {
 		name  string
 		clef  string
 		notes []note
+		track int
 	}
 	var parts []part
 	for i, tr := range song.Tracks {
@@ -62,6 +56,7 @@ func Render(song elaborator.Song) string {
 			name:  tr.Name,
 			clef:  clefFor(notes),
 			notes: notes,
+			track: i,
 		})
 	}
 
@@ -73,9 +68,13 @@ func Render(song elaborator.Song) string {
 	}
 	b.WriteString("  </part-list>\n")
 
+	tempos := tempoDirections(song)
 	for _, p := range parts {
+		// Every part carries the tempo directions and its own track's hairpins.
+		dirs := append(append([]direction(nil), tempos...), hairpinDirections(song, p.track)...)
+		sort.SliceStable(dirs, func(i, j int) bool { return dirs[i].tick < dirs[j].tick })
 		b.WriteString("  <part id=\"" + p.id + "\">\n")
-		writeMeasures(&b, p.notes, beats, unit, ticksPerBar, p.clef, song.BPM)
+		writeMeasures(&b, song, p.track, p.notes, p.clef, dirs, trackTuplets(song, p.track))
 		b.WriteString("  </part>\n")
 	}
 
@@ -161,14 +160,190 @@ func groupChords(notes []note) []chord {
 // segment is one chord (or rest, keys==nil) occupying a contiguous span that
 // does not cross a barline.
 type segment struct {
+	start   uint32 // absolute tick where the segment begins
 	dur     uint32
-	keys    []uint8 // nil = rest
-	tieStop bool    // this segment ends a tie started by the previous one
-	tieCont bool    // this segment is tied to the next (same chord, split)
+	keys    []uint8            // nil = rest
+	tieStop bool               // this segment ends a tie started by the previous one
+	tieCont bool               // this segment is tied to the next (same chord, split)
+	tuplet  *elaborator.Tuplet // the tuplet this segment belongs to, if any
+}
+
+// direction is a <direction> element (a tempo change, ...) attached to an
+// absolute tick. It is written before the first segment starting at or after
+// that tick, so one that falls under a sounding note waits for the next onset.
+// A closing direction ends a spanner, so it is written even past the last note.
+type direction struct {
+	tick    uint32
+	xml     string
+	closing bool
+}
+
+// tempoDirections turns the song's tempo map into metronome directions. A ramp
+// becomes "rit."/"accel." words with dashes up to a metronome mark for its
+// target tempo, instead of one mark per expanded step.
+func tempoDirections(song elaborator.Song) []direction {
+	tempos := song.Tempos
+	if len(tempos) == 0 && song.BPM > 0 {
+		tempos = []elaborator.TempoChange{{Tick: 0, BPM: song.BPM}}
+	}
+	// Same-tick directions go in this order: close a spanner, state a tempo,
+	// open the next spanner.
+	type ranked struct {
+		direction
+		rank int
+	}
+	var all []ranked
+	for _, t := range tempos {
+		if t.BPM <= 0 || song.InsideRamp(t.Tick) {
+			continue
+		}
+		bpm := int(t.BPM + 0.5)
+		all = append(all, ranked{direction{tick: t.Tick, xml: fmt.Sprintf("<direction placement=\"above\"><direction-type><metronome><beat-unit>quarter</beat-unit><per-minute>%d</per-minute></metronome></direction-type><sound tempo=\"%d\"/></direction>", bpm, bpm)}, 1})
+	}
+	for _, r := range song.Ramps {
+		word := "accel."
+		if r.To < r.From {
+			word = "rit."
+		}
+		all = append(all,
+			ranked{direction{tick: r.Start, xml: "<direction placement=\"above\"><direction-type><words>" + word + "</words></direction-type><direction-type><dashes type=\"start\" number=\"1\"/></direction-type></direction>"}, 2},
+			ranked{direction{tick: r.End, xml: "<direction placement=\"above\"><direction-type><dashes type=\"stop\" number=\"1\"/></direction-type></direction>", closing: true}, 0})
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].tick != all[j].tick {
+			return all[i].tick < all[j].tick
+		}
+		return all[i].rank < all[j].rank
+	})
+	dirs := make([]direction, len(all))
+	for i, d := range all {
+		dirs[i] = d.direction
+	}
+	return dirs
+}
+
+// hairpinDirections turns one track's crescendos and diminuendos into wedges,
+// each opening on its starting dynamic and stopping on its target dynamic (a
+// bare stop when written as velocity numbers). A wedge that picks up on the
+// dynamic the previous one ended on does not restate it.
+func hairpinDirections(song elaborator.Song, track int) []direction {
+	var dirs []direction
+	var prev *elaborator.Hairpin
+	for i := range song.Hairpins {
+		h := &song.Hairpins[i]
+		if h.Track != track {
+			continue
+		}
+		wedge := "crescendo"
+		if h.Dim {
+			wedge = "diminuendo"
+		}
+		start := "<direction placement=\"below\">"
+		if h.FromMark != "" && (prev == nil || prev.End != h.Start || prev.ToMark != h.FromMark) {
+			start += dynamics(h.FromMark)
+		}
+		start += "<direction-type><wedge type=\"" + wedge + "\" number=\"1\"/></direction-type></direction>"
+		stop := "<direction placement=\"below\"><direction-type><wedge type=\"stop\" number=\"1\"/></direction-type>"
+		if h.ToMark != "" {
+			stop += dynamics(h.ToMark)
+		}
+		stop += "</direction>"
+		dirs = append(dirs,
+			direction{tick: h.Start, xml: start},
+			direction{tick: h.End, xml: stop, closing: true})
+		prev = h
+	}
+	// A wedge ending where the next begins stops before that one starts.
+	sort.SliceStable(dirs, func(i, j int) bool {
+		if dirs[i].tick != dirs[j].tick {
+			return dirs[i].tick < dirs[j].tick
+		}
+		return dirs[i].closing && !dirs[j].closing
+	})
+	return dirs
+}
+
+// dynamics is a <direction-type> holding one dynamic mark such as "mf".
+func dynamics(mark string) string {
+	return "<direction-type><dynamics><" + mark + "/></dynamics></direction-type>"
+}
+
+// meterChangeAt returns the meter change that starts exactly at tick, if any.
+func meterChangeAt(song elaborator.Song, tick uint32) (elaborator.MeterChange, bool) {
+	for _, c := range song.MeterMap() {
+		if c.Tick == tick {
+			return c, true
+		}
+	}
+	return elaborator.MeterChange{}, false
+}
+
+// timeSignature writes a meter as a <time> element. An additive meter spells
+// its groups in <beats> ("3+3+2"), which engravers print as such.
+func timeSignature(c elaborator.MeterChange) string {
+	beats := fmt.Sprint(c.Beats)
+	if len(c.Groups) > 0 {
+		groups := make([]string, len(c.Groups))
+		for i, g := range c.Groups {
+			groups[i] = fmt.Sprint(g)
+		}
+		beats = strings.Join(groups, "+")
+	}
+	return fmt.Sprintf("<time><beats>%s</beats><beat-type>%d</beat-type></time>", beats, c.Unit)
+}
+
+// keySignature writes a key as a <key> element. A song that sets no key gets
+// a bare C major signature.
+func keySignature(k value.Key) string {
+	if k.Mode == "" {
+		return fmt.Sprintf("<key><fifths>%d</fifths></key>", k.Fifths)
+	}
+	return fmt.Sprintf("<key><fifths>%d</fifths><mode>%s</mode></key>", k.Fifths, k.Mode)
+}
+
+// trackTuplets returns the tuplets one track played, in time order (mirrors the
+// lilypond emitter).
+func trackTuplets(song elaborator.Song, track int) []elaborator.Tuplet {
+	var out []elaborator.Tuplet
+	for _, t := range song.Tuplets {
+		if t.Track == track && t.End > t.Start && t.Actual > 0 && t.Normal > 0 {
+			out = append(out, t)
+		}
+	}
+	return out
 }
 
-func writeMeasures(b *strings.Builder, notes []note, beats, unit int, ticksPerBar uint32, clef string, bpm float64) {
+func writeMeasures(b *strings.Builder, song elaborator.Song, track int, notes []note, clef string, dirs []direction, tuplets []elaborator.Tuplet) {
 	chords := groupChords(notes)
+	// keyTicks are the ticks of the track's key changes after the opening key.
+	var keyTicks []uint32
+	for _, c := range song.Keys {
+		if c.Tick > 0 && (c.Track == -1 || c.Track == track) {
+			keyTicks = append(keyTicks, c.Tick)
+		}
+	}
+
+	// tupletAt returns the tuplet covering tick, if any.
+	tupletAt := func(tick uint32) *elaborator.Tuplet {
+		for i := range tuplets {
+			if tick >= tuplets[i].Start && tick < tuplets[i].End {
+				return &tuplets[i]
+			}
+		}
+		return nil
+	}
+	// until returns the first tuplet boundary after from, capped at to, so no
+	// segment straddles one.
+	until := func(from, to uint32) uint32 {
+		for _, t := range tuplets {
+			for _, edge := range []uint32{t.Start, t.End} {
+				if edge > from && edge < to {
+					to = edge
+				}
+			}
+		}
+		return to
+	}
 
 	// Walk the timeline, emitting chords and rest-fills, splitting anything that
 	// crosses a barline into tied pieces, and bucket the pieces by measure.
@@ -187,13 +362,12 @@ func writeMeasures(b *strings.Builder, notes []note, beats, unit int, ticksPerBa
 		end := start + dur
 		first := true
 		for t < end {
-			bar := int(t / ticksPerBar)
-			barEnd := uint32(bar+1) * ticksPerBar
+			bar, _, barEnd := song.BarAt(t)
 			pieceEnd := end
 			if barEnd < pieceEnd {
 				pieceEnd = barEnd
 			}
-			seg := segment{dur: pieceEnd - t, keys: keys}
+			seg := segment{start: t, dur: pieceEnd - t, keys: keys, tuplet: tupletAt(t)}
 			if keys != nil {
 				if !first {
 					seg.tieStop = true
@@ -209,10 +383,31 @@ func writeMeasures(b *strings.Builder, notes []note, beats, unit int, ticksPerBa
 		}
 	}
 
+	// restTo fills silence up to a tick, split at direction and key-change
+	// ticks so each lands exactly where it belongs, and at tuplet boundaries.
+	restTo := func(to uint32) {
+		for cursor < to {
+			end := until(cursor, to)
+			for _, d := range dirs {
+				if d.tick > cursor && d.tick < end {
+					end = d.tick
+					break
+				}
+			}
+			for _, k := range keyTicks {
+				if k > cursor && k < end {
+					end = k
+					break
+				}
+			}
+			emit(cursor, end-cursor, nil)
+			cursor = end
+		}
+	}
+
 	for _, c := range chords {
 		if c.tick > cursor {
-			emit(cursor, c.tick-cursor, nil) // rest fill
-			cursor = c.tick
+			restTo(c.tick) // rest fill
 		} else if c.tick < cursor {
 			continue // overlap we can't notate simply; keep bar math honest
 		}
@@ -220,37 +415,65 @@ func writeMeasures(b *strings.Builder, notes []note, beats, unit int, ticksPerBa
 		if dur == 0 {
 			dur = ppq
 		}
+		dur = until(cursor, cursor+dur) - cursor
 		emit(cursor, dur, c.keys)
 		cursor += dur
 	}
 	// Pad the final measure with a rest so it's complete.
-	if rem := cursor % ticksPerBar; rem != 0 {
-		emit(cursor, ticksPerBar-rem, nil)
+	if _, start, end := song.BarAt(cursor); start != cursor {
+		restTo(end)
 	}
 	if len(measures) == 0 {
+		_, _, end := song.BarAt(0)
 		ensure(0)
-		measures[0].segs = append(measures[0].segs, segment{dur: ticksPerBar})
+		measures[0].segs = append(measures[0].segs, segment{dur: end})
 	}
 
+	// Key changes after the opening key go in an <attributes> before the first
+	// segment they reach.
+	changes := keyTicks
 	for mi, m := range measures {
 		b.WriteString("    <measure number=\"" + fmt.Sprintf("%d", mi+1) + "\">\n")
 		if mi == 0 {
 			b.WriteString("      <attributes>\n")
 			b.WriteString(fmt.Sprintf("        <divisions>%d</divisions>\n", divisions))
-			b.WriteString("        <key><fifths>0</fifths></key>\n")
-			b.WriteString(fmt.Sprintf("        <time><beats>%d</beats><beat-type>%d</beat-type></time>\n", beats, unit))
+			b.WriteString("        " + keySignature(song.KeyAt(track, 0)) + "\n")
+			b.WriteString("        " + timeSignature(song.MeterMap()[0]) + "\n")
 			if clef == "bass" {
 				b.WriteString("        <clef><sign>F</sign><line>4</line></clef>\n")
 			} else {
 				b.WriteString("        <clef><sign>G</sign><line>2</line></clef>\n")
 			}
 			b.WriteString("      </attributes>\n")
-			if bpm > 0 {
-				b.WriteString(fmt.Sprintf("      <direction placement=\"above\"><direction-type><metronome><beat-unit>quarter</beat-unit><per-minute>%d</per-minute></metronome></direction-type></direction>\n", int(bpm+0.5)))
-			}
+		}
+		_, measStart, measEnd := song.BarAt(m.segs[0].start)
+		if c, ok := meterChangeAt(song, measStart); ok && mi > 0 {
+			b.WriteString("      <attributes>" + timeSignature(c) + "</attributes>\n")
 		}
 		for _, s := range m.segs {
-			writeSegment(b, s)
+			if len(changes) > 0 && changes[0] <= s.start {
+				for len(changes) > 0 && changes[0] <= s.start {
+					changes = changes[1:]
+				}
+				b.WriteString("      <attributes>" + keySignature(song.KeyAt(track, s.start)) + "</attributes>\n")
+			}
+			for len(dirs) > 0 && dirs[0].tick <= s.start {
+				b.WriteString("      " + dirs[0].xml + "\n")
+				dirs = dirs[1:]
+			}
+			writeSegment(b, song.KeyAt(track, s.start), s)
+		}
+		// A direction under a note held to the barline goes at the measure's end.
+		for len(dirs) > 0 && dirs[0].tick < measEnd {
+			b.WriteString("      " + dirs[0].xml + "\n")
+			dirs = dirs[1:]
+		}
+		if mi == len(measures)-1 {
+			for _, d := range dirs {
+				if d.closing {
+					b.WriteString("      " + d.xml + "\n")
+				}
+			}
 		}
 		b.WriteString("    </measure>\n")
 	}
@@ -258,12 +481,30 @@ func writeMeasures(b *strings.Builder, notes []note, beats, unit int, ticksPerBa
 
 // writeSegment writes one chord or rest as MusicXML <note> element(s). A chord
 // of N keys becomes one <note> plus N-1 <note><chord/> elements. Durations that
-// aren't a single note value are split into tied pieces.
-func writeSegment(b *strings.Builder, s segment) {
+// aren't a single note value are split into tied pieces. Inside a tuplet each
+// note carries a <time-modification>, and the first and last open and close
+// the bracket. Pitches are spelled in key k.
+func writeSegment(b *strings.Builder, k value.Key, s segment) {
 	pieces := quantize(s.dur)
+	var timeMod string
+	if t := s.tuplet; t != nil {
+		pieces = tupletPieces(s.dur, t)
+		timeMod = fmt.Sprintf("<time-modification><actual-notes>%d</actual-notes><normal-notes>%d</normal-notes></time-modification>", t.Actual, t.Normal)
+	}
+	bracket := func(pi int) string {
+		switch t := s.tuplet; {
+		case t == nil:
+			return ""
+		case pi == 0 && s.start == t.Start:
+			return `<tuplet type="start" bracket="yes"/>`
+		case pi == len(pieces)-1 && s.start+s.dur == t.End:
+			return `<tuplet type="stop"/>`
+		}
+		return ""
+	}
 	if s.keys == nil {
 		// Rest: one <note><rest/> per piece (ties don't apply to rests).
-		for _, p := range pieces {
+		for pi, p := range pieces {
 			b.WriteString("      <note>")
 			b.WriteString("<rest/>")
 			b.WriteString(fmt.Sprintf("<duration>%d</duration>", p.ticks))
@@ -271,6 +512,10 @@ func writeSegment(b *strings.Builder, s segment) {
 			if p.dots == 1 {
 				b.WriteString("<dot/>")
 			}
+			b.WriteString(timeMod)
+			if br := bracket(pi); br != "" {
+				b.WriteString("<notations>" + br + "</notations>")
+			}
 			b.WriteString("</note>\n")
 		}
 		return
@@ -285,7 +530,7 @@ func writeSegment(b *strings.Builder, s segment) {
 			if ki > 0 {
 				b.WriteString("<chord/>")
 			}
-			st, alter, oct := pitch(key)
+			st, alter, oct := pitch(k, key)
 			b.WriteString("<pitch><step>" + st + "</step>")
 			if alter != 0 {
 				b.WriteString(fmt.Sprintf("<alter>%d</alter>", alter))
@@ -302,16 +547,42 @@ func writeSegment(b *strings.Builder, s segment) {
 			if p.dots == 1 {
 				b.WriteString("<dot/>")
 			}
+			b.WriteString(timeMod)
+			var notations string
 			if tieStop {
-				b.WriteString("<notations><tied type=\"stop\"/></notations>")
+				notations = "<tied type=\"stop\"/>"
 			} else if tieStart {
-				b.WriteString("<notations><tied type=\"start\"/></notations>")
+				notations = "<tied type=\"start\"/>"
+			}
+			if ki == 0 {
+				notations += bracket(pi)
+			}
+			if notations != "" {
+				b.WriteString("<notations>" + notations + "</notations>")
 			}
 			b.WriteString("</note>\n")
 		}
 	}
 }
 
+// tupletPieces splits a segment inside a tuplet into pieces typed by the note
+// value they are written as (a 640-tick triplet note is a quarter), while their
+// <duration>s stay in real ticks and add up exactly to the segment.
+func tupletPieces(dur uint32, t *elaborator.Tuplet) []piece {
+	a, n := uint32(t.Actual), uint32(t.Normal)
+	pieces := quantize((dur*a + n/2) / n)
+	var sum uint32
+	for i := range pieces {
+		if i == len(pieces)-1 {
+			pieces[i].ticks = dur - sum
+			break
+		}
+		pieces[i].ticks = pieces[i].ticks * n / a
+		sum += pieces[i].ticks
+	}
+	return pieces
+}
+
 // ---------------------------------------------------------------------------
 // Duration quantization + pitch
 // ---------------------------------------------------------------------------
@@ -359,21 +630,11 @@ func quantize(dur uint32) []piece {
 	return out
 }
 
-// pitch maps a MIDI key to a MusicXML (step, alter, octave). Accidentals are
-// spelled as sharps (alter=+1), matching the rest of the toolchain. MIDI 60 =
+// pitch maps a MIDI key to a MusicXML (step, alter, octave) spelled in key k:
+// flats in a flat key (alter=-1), sharps in a sharp key or C major. MIDI 60 =
 // middle C = octave 4.
-func pitch(key uint8) (step string, alter int, octave int) {
-	// step + alter for each pitch class (sharps).
-	type pc struct {
-		step  string
-		alter int
-	}
-	table := []pc{
-		{"C", 0}, {"C", 1}, {"D", 0}, {"D", 1}, {"E", 0}, {"F", 0},
-		{"F", 1}, {"G", 0}, {"G", 1}, {"A", 0}, {"A", 1}, {"B", 0},
-	}
-	p := table[key%12]
-	return p.step, p.alter, int(key)/12 - 1
+func pitch(k value.Key, key uint8) (step string, alter int, octave int) {
+	return k.Spell(key)
 }
 
 func clefFor(notes []note) string {
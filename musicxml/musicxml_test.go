@@ -66,3 +66,131 @@ func TestRender_TieAcrossBar(t *testing.T) {
 		t.Logf("%s", xmlOut)
 	}
 }
+
+func TestRender_TempoChange(t *testing.T) {
+	src := `project "p" { bpm 120; time 4 4; track "t" instrument "piano" {
+		bar quarter { C D E F }
+		bpm 72;
+		bar quarter { C _ _ _ }
+	} }`
+	xmlOut := Render(compile(t, src))
+	m2 := strings.Index(xmlOut, `<measure number="2">`)
+	if m2 < 0 {
+		t.Fatalf("expected a second measure:\n%s", xmlOut)
+	}
+	if !strings.Contains(xmlOut[m2:], "<per-minute>72</per-minute>") {
+		t.Fatalf("expected the tempo change in measure 2:\n%s", xmlOut)
+	}
+	if !strings.Contains(xmlOut[:m2], "<per-minute>120</per-minute>") {
+		t.Fatalf("expected the opening tempo in measure 1:\n%s", xmlOut)
+	}
+}
+
+func TestRender_TempoRamp(t *testing.T) {
+	src := `project "p" { bpm 100; time 4 4; track "t" instrument "piano" {
+		bpm 100 to 160 over 2 bars curve exp;
+		bar quarter { C D E F }
+	} }`
+	xmlOut := Render(compile(t, src))
+	if !strings.Contains(xmlOut, "<words>accel.</words>") || !strings.Contains(xmlOut, `<dashes type="start"`) {
+		t.Fatalf("expected accel. with dashes:\n%s", xmlOut)
+	}
+	// The ramp outlasts the music, but its dashes must still be closed.
+	if !strings.Contains(xmlOut, `<dashes type="stop"`) {
+		t.Fatalf("expected the dashes to be stopped:\n%s", xmlOut)
+	}
+	if strings.Count(xmlOut, "<metronome>") != 1 {
+		t.Fatalf("expected no metronome marks for the ramp's steps:\n%s", xmlOut)
+	}
+}
+
+func TestRender_MeterChange(t *testing.T) {
+	src := `project "p" { time 4 4; track "t" instrument "piano" {
+		bar quarter { C D E F }
+		time 3 4;
+		bar quarter { C:2 _ E }
+		bar quarter { C _ _ }
+	} }`
+	xmlOut := Render(compile(t, src))
+	m2 := strings.Index(xmlOut, `<measure number="2">`)
+	m3 := strings.Index(xmlOut, `<measure number="3">`)
+	if m2 < 0 || m3 < 0 || strings.Contains(xmlOut, `<measure number="4">`) {
+		t.Fatalf("expected exactly three measures:\n%s", xmlOut)
+	}
+	if !strings.Contains(xmlOut[m2:m3], "<beats>3</beats>") {
+		t.Fatalf("expected the 3/4 signature at measure 2:\n%s", xmlOut)
+	}
+	if strings.Contains(xmlOut[m3:], "<beats>") {
+		t.Fatalf("measure 3 should not restate the signature:\n%s", xmlOut)
+	}
+}
+
+func TestRender_KeySignature(t *testing.T) {
+	src := `project "p" { key F; track "t" instrument "piano" {
+		bar quarter { F Bb C# Db }
+		key A minor;
+		bar quarter { A G# E C }
+	} }`
+	xmlOut := Render(compile(t, src))
+	m2 := strings.Index(xmlOut, `<measure number="2">`)
+	if m2 < 0 {
+		t.Fatalf("expected two measures:\n%s", xmlOut)
+	}
+	if !strings.Contains(xmlOut[:m2], "<key><fifths>-1</fifths><mode>major</mode></key>") {
+		t.Fatalf("expected F major in the opening attributes:\n%s", xmlOut)
+	}
+	if !strings.Contains(xmlOut[m2:], "<attributes><key><fifths>0</fifths><mode>minor</mode></key></attributes>") {
+		t.Fatalf("expected the A minor change at measure 2:\n%s", xmlOut)
+	}
+	if strings.Count(xmlOut[:m2], "<step>D</step><alter>-1</alter>") != 2 || !strings.Contains(xmlOut[:m2], "<step>B</step><alter>-1</alter>") {
+		t.Fatalf("expected F major to spell Bb, and C# and Db both as Db:\n%s", xmlOut)
+	}
+	if !strings.Contains(xmlOut[m2:], "<step>G</step><alter>1</alter>") {
+		t.Fatalf("expected the leading tone of A minor spelled G#:\n%s", xmlOut)
+	}
+}
+
+func TestRender_AdditiveMeter(t *testing.T) {
+	xmlOut := Render(compile(t, `project "p" { time 3+3+2 8; track "t" instrument "piano" {
+		bar 8 { C D E F G A B C }
+	} }`))
+	if !strings.Contains(xmlOut, "<time><beats>3+3+2</beats><beat-type>8</beat-type></time>") {
+		t.Fatalf("expected additive <time>:\n%s", xmlOut)
+	}
+}
+
+func TestRender_Tuplet(t *testing.T) {
+	xmlOut := Render(compile(t, `project "p" { time 4 4; track "t" instrument "piano" {
+		bar quarter { 3:2 { C D E } F G }
+	} }`))
+	if n := strings.Count(xmlOut, "<time-modification><actual-notes>3</actual-notes><normal-notes>2</normal-notes></time-modification>"); n != 3 {
+		t.Fatalf("expected 3 triplet notes, got %d:\n%s", n, xmlOut)
+	}
+	if strings.Count(xmlOut, "<duration>640</duration><type>quarter</type>") != 3 {
+		t.Fatalf("expected triplet quarters lasting 640 ticks:\n%s", xmlOut)
+	}
+	start, stop := strings.Index(xmlOut, `<tuplet type="start"`), strings.Index(xmlOut, `<tuplet type="stop"/>`)
+	if start < 0 || stop < start {
+		t.Fatalf("expected an opened and closed tuplet bracket:\n%s", xmlOut)
+	}
+}
+
+func TestRender_Hairpins(t *testing.T) {
+	src := `project "p" { time 4 4; track "t" instrument "piano" {
+		cresc p to ff over 2 bars;
+		bar quarter { C D E F }
+	} }`
+	xmlOut := Render(compile(t, src))
+	if err := xml.Unmarshal([]byte(xmlOut), new(struct{})); err != nil {
+		t.Fatalf("not well-formed: %v\n%s", err, xmlOut)
+	}
+	start := strings.Index(xmlOut, `<wedge type="crescendo"`)
+	if start < 0 || !strings.Contains(xmlOut[:start], "<dynamics><p/></dynamics>") {
+		t.Fatalf("expected a crescendo wedge opening on p:\n%s", xmlOut)
+	}
+	// The hairpin outlasts the music, but its wedge must still be stopped.
+	stop := strings.Index(xmlOut, `<wedge type="stop"`)
+	if stop < start || !strings.Contains(xmlOut[stop:], "<dynamics><ff/></dynamics>") {
+		t.Fatalf("expected the wedge to stop on ff:\n%s", xmlOut)
+	}
+}
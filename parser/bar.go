@@ -1,6 +1,8 @@
 package parser
 
 import (
+	"strings"
+
 	"github.com/poolpOrg/earmuff/ast"
 	"github.com/poolpOrg/earmuff/token"
 )
@@ -96,12 +98,15 @@ func (p *Parser) parseBarItem() ast.BarItem {
 		return p.parseMetaStmt()
 
 	case token.NUMBER:
-		// a grid switch  `16:`
+		// a grid switch  `16:`, or a tuplet  `3:2 { ... }`
 		if p.peekIs(token.COLON) {
 			v := int(parseFloat(p.cur.Literal))
 			pos := p.cur.Pos
 			p.next() // number
 			p.next() // ':'
+			if p.curIs(token.NUMBER) {
+				return p.parseTuplet(pos, v)
+			}
 			if !durationValues[v] {
 				p.errorf(pos, "invalid grid duration %d", v)
 			}
@@ -120,6 +125,15 @@ func (p *Parser) parseBarItem() ast.BarItem {
 				return &ast.GridSwitch{Position: pos, Grid: v}
 			}
 		}
+		if p.curIsParam() {
+			return p.parseEventStmt(false)
+		}
+		if p.curIsArp() {
+			if n := p.parseArp(); n != nil {
+				return n
+			}
+			return nil
+		}
 		return p.parseStep()
 
 	case token.LPAREN, token.TILDE:
@@ -131,6 +145,32 @@ func (p *Parser) parseBarItem() ast.BarItem {
 	}
 }
 
+// parseTuplet parses the `<normal> { steps }` rest of a tuplet whose actual
+// count (and ':') the caller consumed. Only steps may appear inside.
+func (p *Parser) parseTuplet(pos token.Position, actual int) *ast.Tuplet {
+	n := &ast.Tuplet{Position: pos, Actual: actual, Normal: int(parseFloat(p.cur.Literal))}
+	p.next() // normal
+	if !p.expect(token.LBRACE) {
+		return n
+	}
+	for !p.curIs(token.RBRACE) && !p.curIs(token.EOF) {
+		switch p.cur.Type {
+		case token.IDENT, token.LPAREN, token.TILDE:
+			if st := p.parseStep(); st != nil {
+				n.Steps = append(n.Steps, st)
+				continue
+			}
+		default:
+			p.errorf(p.cur.Pos, "expected a step inside a tuplet, found %q", p.cur.Literal)
+		}
+		if !p.curIs(token.RBRACE) {
+			p.next()
+		}
+	}
+	p.expect(token.RBRACE)
+	return n
+}
+
 // parseStep parses a step-grid token: playable [":" gate] [velocity] ["*" k].
 func (p *Parser) parseStep() *ast.Step {
 	n := &ast.Step{Position: p.cur.Pos, Repeat: 1}
@@ -192,7 +232,14 @@ func (p *Parser) parsePlayable() ast.Playable {
 			return g
 		}
 		p.expect(token.RPAREN)
-		return exprToPlayable(first)
+		play := exprToPlayable(first)
+		switch n := play.(type) {
+		case *ast.NoteRef:
+			n.Voicing = p.parseVoicings()
+		case *ast.ExprPlay:
+			n.Voicing = p.parseVoicings()
+		}
+		return play
 
 	case token.TILDE:
 		pos := p.cur.Pos
@@ -216,6 +263,7 @@ func (p *Parser) parsePlayable() ast.Playable {
 				p.errorf(p.cur.Pos, "expected channel number after '@', found %q", p.cur.Literal)
 			}
 		}
+		ref.Voicing = p.parseVoicings()
 		return ref
 
 	default:
@@ -224,6 +272,40 @@ func (p *Parser) parsePlayable() ast.Playable {
 	}
 }
 
+// parseVoicings parses the voicings that may follow a note or chord: `inv 2`,
+// `drop 2`, `open` and `octave 3`, in any number and order. Like the arp
+// clauses, the words are recognized contextually; inv, drop and octave only
+// with a number after them.
+func (p *Parser) parseVoicings() []ast.Voicing {
+	var vs []ast.Voicing
+	for p.curIs(token.IDENT) {
+		kind, ok := ast.VoicingNames[p.cur.Literal]
+		if !ok {
+			break
+		}
+		v := ast.Voicing{Position: p.cur.Pos, Kind: kind}
+		if kind != ast.VoiceOpen && !p.peekIs(token.NUMBER) && !(kind == ast.VoiceOctave && p.peekIs(token.MINUS)) {
+			break
+		}
+		p.next()
+		if kind != ast.VoiceOpen {
+			neg := p.curIs(token.MINUS)
+			if neg {
+				p.next()
+			}
+			v.N, _ = p.parseIntToken()
+			if neg {
+				v.N = -v.N
+			}
+		}
+		if kind == ast.VoiceDrop && v.N < 2 {
+			p.errorf(v.Position, "drop %d: the dropped voice counts from the top, starting at 2", v.N)
+		}
+		vs = append(vs, v)
+	}
+	return vs
+}
+
 // exprToPlayable converts an expression used in playable position into the
 // appropriate Playable: a bare note/chord/binding becomes a NoteRef; anything
 // computed (transposition, etc.) becomes an ExprPlay.
@@ -240,6 +322,93 @@ func exprToPlayable(e ast.Expr) ast.Playable {
 	}
 }
 
+// curIsArp reports whether the current token starts an arp. "arp" is not
+// reserved: it is an arp only before a note, chord or group, so a step bound
+// with `let arp = C;` still plays, even before a rest or a tie.
+func (p *Parser) curIsArp() bool {
+	if !p.curIs(token.IDENT) || p.cur.Literal != "arp" {
+		return false
+	}
+	return p.peekIs(token.LPAREN) || p.peekIs(token.IDENT) && p.peek.Literal != "_"
+}
+
+// parseArp parses `arp <playable>` and its optional clauses, in any order: a
+// mode (up, down, up-down, random, as-played), `octaves <n>`, `rate
+// <duration>`, `gate <percent>%`, `over <duration>` and a velocity. Like the
+// tempo ramp words, the clause words are recognized contextually.
+func (p *Parser) parseArp() *ast.Arp {
+	n := &ast.Arp{Position: p.cur.Pos, Octaves: 1, Gate: 100}
+	p.next() // 'arp'
+	if n.Play = p.parsePlayable(); n.Play == nil {
+		return nil
+	}
+	for {
+		switch {
+		case p.curIs(token.OVER):
+			p.next()
+			if v, ok := p.curDuration(); ok {
+				n.Over = v
+				p.next()
+			} else {
+				p.errorf(p.cur.Pos, "expected arp length after 'over', found %q", p.cur.Literal)
+				return nil
+			}
+		case p.curIsVelocity():
+			n.Velocity = p.parseVelocity()
+		case p.curIs(token.IDENT):
+			word := p.cur.Literal
+			if p.peekIs(token.MINUS) && (word == "up" || word == "as") {
+				// up-down and as-played lex as three tokens
+				p.next()
+				p.next()
+				word += "-"
+				if p.curIs(token.IDENT) {
+					word += p.cur.Literal
+				}
+			}
+			if mode, ok := ast.ArpModeNames[word]; ok {
+				n.Mode = mode
+				p.next()
+				continue
+			}
+			switch word {
+			case "octaves":
+				p.next()
+				if n.Octaves, _ = p.parseIntToken(); n.Octaves < 1 {
+					p.errorf(p.cur.Pos, "arp spans at least 1 octave")
+					n.Octaves = 1
+				}
+			case "rate":
+				p.next()
+				v, ok := p.curDuration()
+				if !ok {
+					p.errorf(p.cur.Pos, "expected arp rate as a note value, found %q", p.cur.Literal)
+					return nil
+				}
+				n.Rate = v
+				p.next()
+			case "gate":
+				p.next()
+				g, ok := p.parseNumberToken()
+				if !ok {
+					return nil
+				}
+				p.expect(token.PERCENT)
+				n.Gate = g
+			default:
+				if strings.Contains(word, "-") {
+					p.errorf(p.cur.Pos, "unknown arp mode %q", word)
+					p.next()
+					continue
+				}
+				return n
+			}
+		default:
+			return n
+		}
+	}
+}
+
 // parseAbsolute parses `on beat <expr> <event>`.
 func (p *Parser) parseAbsolute() *ast.Absolute {
 	n := &ast.Absolute{Position: p.cur.Pos}
@@ -258,7 +427,11 @@ func (p *Parser) parseAbsolute() *ast.Absolute {
 	case token.TEXT, token.LYRIC, token.MARKER, token.CUE:
 		n.Event = p.parseMetaStmt()
 	case token.IDENT, token.LPAREN:
-		n.Event = p.parseStep()
+		if p.curIsParam() {
+			n.Event = p.parseEventStmt(true)
+		} else {
+			n.Event = p.parseStep()
+		}
 	default:
 		p.errorf(p.cur.Pos, "expected an event after 'on beat', found %q", p.cur.Literal)
 	}
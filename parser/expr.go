@@ -15,27 +15,30 @@ const (
 	COMPARISON // == != < <= > >=
 	RANGE      // ..
 	SUM        // + -
-	PRODUCT    // * /
+	PRODUCT    // * / % div
 	PREFIX     // -x !x
-	CALL       // f(...)
+	CALL       // f(...) xs[i]
 )
 
 // infixPrec maps an infix operator token to its binding power.
 var infixPrec = map[token.Type]int{
-	token.OR:     OR,
-	token.AND:    AND,
-	token.EQ:     COMPARISON,
-	token.NEQ:    COMPARISON,
-	token.LT:     COMPARISON,
-	token.LTE:    COMPARISON,
-	token.GT:     COMPARISON,
-	token.GTE:    COMPARISON,
-	token.DOTDOT: RANGE,
-	token.PLUS:   SUM,
-	token.MINUS:  SUM,
-	token.STAR:   PRODUCT,
-	token.SLASH:  PRODUCT,
-	token.LPAREN: CALL,
+	token.OR:       OR,
+	token.AND:      AND,
+	token.EQ:       COMPARISON,
+	token.NEQ:      COMPARISON,
+	token.LT:       COMPARISON,
+	token.LTE:      COMPARISON,
+	token.GT:       COMPARISON,
+	token.GTE:      COMPARISON,
+	token.DOTDOT:   RANGE,
+	token.PLUS:     SUM,
+	token.MINUS:    SUM,
+	token.STAR:     PRODUCT,
+	token.SLASH:    PRODUCT,
+	token.PERCENT:  PRODUCT,
+	token.DIV:      PRODUCT,
+	token.LPAREN:   CALL,
+	token.LBRACKET: CALL,
 }
 
 // intervalNames are the interval keywords recognized in expression position.
@@ -62,6 +65,10 @@ func (p *Parser) parseExpr(prec int) ast.Expr {
 	}
 	for {
 		op := p.cur.Type
+		if op == token.IDENT && p.cur.Literal == "div" {
+			// integer division is a word, like the contextual "to"
+			op = token.DIV
+		}
 		lp, ok := infixPrec[op]
 		if !ok || lp <= prec {
 			break
@@ -91,10 +98,9 @@ func (p *Parser) parsePrefix() ast.Expr {
 		p.next()
 		return n
 	case token.STRING:
-		// strings are not first-class values in expressions; treat as ident-like
-		p.errorf(p.cur.Pos, "string literal not valid in expression")
+		n := &ast.StringLit{Position: p.cur.Pos, Value: p.cur.Literal}
 		p.next()
-		return nil
+		return n
 	case token.IDENT:
 		return p.parseIdentExpr()
 	case token.MINUS, token.NOT:
@@ -123,28 +129,31 @@ func (p *Parser) parsePrefix() ast.Expr {
 }
 
 // parseIdentExpr disambiguates an identifier in expression position into a
-// pattern call, an interval/dynamic keyword, a note/chord literal, or a plain
+// function call, an interval/dynamic keyword, a note/chord literal, or a plain
 // binding reference. The analyzer makes the final note-vs-chord call; here we
 // only tag obvious keyword classes.
 func (p *Parser) parseIdentExpr() ast.Expr {
 	lit := p.cur.Literal
 	pos := p.cur.Pos
 
-	if p.peekIs(token.LPAREN) {
-		// pattern call as a value
+	if p.peekIs(token.DOT) {
+		// a namespaced function from an import: `voicings.shell(ch)`
 		p.next() // ident
-		call := &ast.Call{Position: pos, Name: lit}
-		p.expect(token.LPAREN)
-		for !p.curIs(token.RPAREN) && !p.curIs(token.EOF) {
-			call.Args = append(call.Args, p.parseExpr(LOWEST))
-			if p.curIs(token.COMMA) {
-				p.next()
-			} else {
-				break
-			}
+		for p.curIs(token.DOT) && p.peekIs(token.IDENT) {
+			p.next() // '.'
+			lit += "." + p.cur.Literal
+			p.next()
 		}
-		p.expect(token.RPAREN)
-		return call
+		if !p.curIs(token.LPAREN) {
+			p.errorf(p.cur.Pos, "expected '(' after %q, found %q", lit, p.cur.Literal)
+			return nil
+		}
+		return p.parseCallArgs(&ast.Call{Position: pos, Name: lit})
+	}
+	if p.peekIs(token.LPAREN) {
+		// a function call
+		p.next() // ident
+		return p.parseCallArgs(&ast.Call{Position: pos, Name: lit})
 	}
 
 	p.next()
@@ -160,13 +169,36 @@ func (p *Parser) parseIdentExpr() ast.Expr {
 	}
 }
 
+// parseCallArgs parses the `(args)` of a call; cur is '('.
+func (p *Parser) parseCallArgs(call *ast.Call) *ast.Call {
+	p.expect(token.LPAREN)
+	for !p.curIs(token.RPAREN) && !p.curIs(token.EOF) {
+		call.Args = append(call.Args, p.parseExpr(LOWEST))
+		if p.curIs(token.COMMA) {
+			p.next()
+		} else {
+			break
+		}
+	}
+	p.expect(token.RPAREN)
+	return call
+}
+
 func (p *Parser) parseInfix(left ast.Expr, op token.Type, lp int) ast.Expr {
 	pos := p.cur.Pos
 
 	if op == token.DOTDOT {
 		p.next()
 		hi := p.parseExpr(lp) // right-assoc-ish; ranges don't chain
-		return &ast.Range{Position: left.Pos(), Lo: left, Hi: hi}
+		r := &ast.Range{Position: left.Pos(), Lo: left, Hi: hi}
+		if p.curIs(token.IDENT) && p.cur.Literal == "step" {
+			p.next()
+			r.Step = p.parseExpr(lp)
+		}
+		return r
+	}
+	if op == token.LBRACKET {
+		return p.parseIndex(left)
 	}
 
 	p.next()
@@ -174,6 +206,23 @@ func (p *Parser) parseInfix(left ast.Expr, op token.Type, lp int) ast.Expr {
 	return &ast.Binary{Position: pos, Op: op, Left: left, Right: right}
 }
 
+// parseIndex parses the `[i]` or `[lo..hi]` after a value; cur is '['.
+func (p *Parser) parseIndex(x ast.Expr) ast.Expr {
+	pos := p.cur.Pos
+	p.next() // '['
+	idx := p.parseExpr(LOWEST)
+	if !p.expect(token.RBRACKET) || idx == nil {
+		return nil
+	}
+	if r, ok := idx.(*ast.Range); ok {
+		if r.Step != nil {
+			p.errorf(r.Step.Pos(), "a slice takes no step")
+		}
+		return &ast.Slice{Position: pos, X: x, Lo: r.Lo, Hi: r.Hi}
+	}
+	return &ast.Index{Position: pos, X: x, Index: idx}
+}
+
 func (p *Parser) parseListLit() ast.Expr {
 	n := &ast.ListLit{Position: p.cur.Pos}
 	p.next() // '['
@@ -190,9 +239,14 @@ func (p *Parser) parseListLit() ast.Expr {
 }
 
 // curIsVelocity reports whether the current token begins a velocity clause.
-// The sigil `v` lexes as a plain IDENT, so it is recognized by literal.
+// The sigil `v` lexes as a plain IDENT, so it is recognized by literal, and
+// only when a number or dynamic follows: otherwise it is the numeral v, as in
+// `bar quarter { i iv v i }`.
 func (p *Parser) curIsVelocity() bool {
-	return p.curIs(token.IDENT) && p.cur.Literal == "v"
+	if !p.curIs(token.IDENT) || p.cur.Literal != "v" {
+		return false
+	}
+	return p.peekIs(token.NUMBER) || p.peekIs(token.IDENT) && dynamicNames[p.peek.Literal]
 }
 
 // parseVelocity parses `v <number|dynamic>`. The sigil `v` lexes as IDENT.
@@ -203,18 +257,35 @@ func (p *Parser) parseVelocity() *ast.Velocity {
 	}
 	n := &ast.Velocity{Position: p.cur.Pos}
 	p.next() // 'v'
+	if !p.parseVelocityValue(n) {
+		p.errorf(p.cur.Pos, "expected velocity number or dynamic, found %q", p.cur.Literal)
+	}
+	return n
+}
+
+// parseLevel parses a bare velocity number or dynamic, as in `cresc p to 100`.
+func (p *Parser) parseLevel(after string) *ast.Velocity {
+	n := &ast.Velocity{Position: p.cur.Pos}
+	if !p.parseVelocityValue(n) {
+		p.errorf(p.cur.Pos, "expected dynamic or velocity after %s, found %q", after, p.cur.Literal)
+		return nil
+	}
+	return n
+}
+
+// parseVelocityValue fills n from a velocity number or dynamic.
+func (p *Parser) parseVelocityValue(n *ast.Velocity) bool {
 	switch {
 	case p.curIs(token.NUMBER):
 		n.HasNumber = true
 		n.Number = int(parseFloat(p.cur.Literal))
-		p.next()
 	case p.curIs(token.IDENT) && dynamicNames[p.cur.Literal]:
 		n.Dynamic = p.cur.Literal
-		p.next()
 	default:
-		p.errorf(p.cur.Pos, "expected velocity number or dynamic, found %q", p.cur.Literal)
+		return false
 	}
-	return n
+	p.next()
+	return true
 }
 
 // --- small helpers --------------------------------------------------------
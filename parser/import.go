@@ -0,0 +1,90 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/poolpOrg/earmuff/ast"
+	"github.com/poolpOrg/earmuff/token"
+)
+
+// Loader parses a source file together with the files it imports. The Parser
+// itself never touches the filesystem; a Loader reads each `import` relative
+// to the importing file and hangs the parsed file on ast.Import.Program.
+type Loader struct {
+	// ReadFile reads an imported file; nil means os.ReadFile. The language
+	// server supplies one that prefers open editor buffers, the playground one
+	// that always fails.
+	ReadFile func(path string) ([]byte, error)
+
+	loaded map[string]*ast.Program // by cleaned path; nil while still loading
+	errors []Diagnostic
+}
+
+// Load parses src, the contents of filename, and resolves its imports
+// recursively. A file imported from several places is parsed once and shared;
+// an import that would close a cycle is reported and left unresolved. The
+// diagnostics cover every file read, each carrying its own file name.
+func (l *Loader) Load(src, filename string) (*ast.Program, []Diagnostic) {
+	l.loaded = map[string]*ast.Program{}
+	l.errors = nil
+	prog := l.parse(src, filename, nil)
+	return prog, l.errors
+}
+
+// parse parses one file and, depth first, the files it imports. stack holds
+// the chain of files being loaded, for cycle reports.
+func (l *Loader) parse(src, filename string, stack []string) *ast.Program {
+	prog, diags := New(src, filename).Parse()
+	l.errors = append(l.errors, diags...)
+
+	key := filepath.Clean(filename)
+	stack = append(stack, key)
+	l.loaded[key] = nil
+	for _, it := range prog.Items {
+		imp, ok := it.(*ast.Import)
+		if !ok {
+			continue
+		}
+		path := imp.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(filename), path)
+		}
+		path = filepath.Clean(path)
+		if done, seen := l.loaded[path]; seen {
+			if done == nil {
+				l.errorf(imp.Position, "import cycle: %s", cycle(stack, path))
+			}
+			imp.Program = done
+			continue
+		}
+		read := l.ReadFile
+		if read == nil {
+			read = os.ReadFile
+		}
+		data, err := read(path)
+		if err != nil {
+			l.errorf(imp.Position, "cannot import %q: %v", imp.Path, err)
+			continue
+		}
+		imp.Program = l.parse(string(data), path, stack)
+	}
+	l.loaded[key] = prog
+	return prog
+}
+
+func (l *Loader) errorf(pos token.Position, format string, args ...interface{}) {
+	l.errors = append(l.errors, Diagnostic{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// cycle renders the import chain from path's first appearance back to path.
+func cycle(stack []string, path string) string {
+	for i, f := range stack {
+		if f == path {
+			return strings.Join(append(stack[i:len(stack):len(stack)], path), " -> ")
+		}
+	}
+	return path
+}
@@ -0,0 +1,87 @@
+package parser
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/poolpOrg/earmuff/ast"
+)
+
+// memLoader serves imports from an in-memory file set.
+func memLoader(files map[string]string) *Loader {
+	return &Loader{ReadFile: func(path string) ([]byte, error) {
+		src, ok := files[filepath.ToSlash(path)]
+		if !ok {
+			return nil, fmt.Errorf("no such file")
+		}
+		return []byte(src), nil
+	}}
+}
+
+func TestParse_Import(t *testing.T) {
+	prog := parseOK(t, `import "lib/grooves.ear" as grooves;
+import "common.ear";
+project "p" { track "d" { grooves.bossa() grooves.fill common } }`)
+	imp, ok := prog.Items[0].(*ast.Import)
+	if !ok || imp.Path != "lib/grooves.ear" || imp.Alias != "grooves" {
+		t.Fatalf("first item = %#v, want import of lib/grooves.ear as grooves", prog.Items[0])
+	}
+	if imp := prog.Items[1].(*ast.Import); imp.Alias != "" {
+		t.Errorf("unaliased import has alias %q", imp.Alias)
+	}
+	body := prog.Items[2].(*ast.Project).Tracks[0].Body
+	var names []string
+	for _, st := range body {
+		names = append(names, st.(*ast.PatternCall).Name)
+	}
+	if got := strings.Join(names, " "); got != "grooves.bossa grooves.fill common" {
+		t.Errorf("calls = %q", got)
+	}
+
+	parseErr(t, `import grooves;`)
+	parseErr(t, `import "x.ear" as;`)
+}
+
+func TestLoader_ResolvesRelativeToImporter(t *testing.T) {
+	l := memLoader(map[string]string{
+		"songs/lib/grooves.ear":  `import "../shared/clave.ear"; pattern bossa { clave }`,
+		"songs/shared/clave.ear": `pattern clave { bar quarter { C _ C _ } }`,
+	})
+	prog, diags := l.Load(`import "lib/grooves.ear" as g; project "p" { track "t" { g.bossa } }`, "songs/song.ear")
+	if len(diags) != 0 {
+		t.Fatalf("diagnostics: %v", diags)
+	}
+	pats := prog.Patterns()
+	if pats["g.bossa"] == nil || pats["g.clave"] == nil {
+		t.Fatalf("visible patterns = %v, want g.bossa and g.clave", pats)
+	}
+	if got := pats["g.clave"].Position.Filename; filepath.ToSlash(got) != "songs/shared/clave.ear" {
+		t.Errorf("g.clave defined in %q, want songs/shared/clave.ear", got)
+	}
+}
+
+func TestLoader_ReportsCyclesAndMissingFiles(t *testing.T) {
+	l := memLoader(map[string]string{
+		"a.ear": `import "b.ear"; pattern a { bar quarter { C } }`,
+		"b.ear": `import "a.ear"; pattern b { bar quarter { D } }`,
+	})
+	_, diags := l.Load(`import "a.ear"; import "gone.ear";`, "main.ear")
+	if len(diags) != 2 {
+		t.Fatalf("diagnostics = %v, want a cycle and a missing file", diags)
+	}
+	if d := diags[0]; d.Pos.Filename != "b.ear" || !strings.Contains(d.Msg, "a.ear -> b.ear -> a.ear") {
+		t.Errorf("cycle diagnostic = %s", d)
+	}
+	if d := diags[1]; d.Pos.Filename != "main.ear" || !strings.Contains(d.Msg, `cannot import "gone.ear"`) {
+		t.Errorf("missing-file diagnostic = %s", d)
+	}
+
+	// Parse errors inside an imported file carry that file's name.
+	l = memLoader(map[string]string{"bad.ear": `pattern { }`})
+	_, diags = l.Load(`import "bad.ear";`, "main.ear")
+	if len(diags) == 0 || diags[0].Pos.Filename != "bad.ear" {
+		t.Errorf("diagnostics = %v, want one in bad.ear", diags)
+	}
+}
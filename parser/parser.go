@@ -56,6 +56,13 @@ func (p *Parser) next() {
 func (p *Parser) curIs(t token.Type) bool  { return p.cur.Type == t }
 func (p *Parser) peekIs(t token.Type) bool { return p.peek.Type == t }
 
+// peekNext returns the token after peek without consuming anything, for the
+// contextual words that are told from a name only two tokens ahead.
+func (p *Parser) peekNext() token.Token {
+	l := *p.lex
+	return l.Next()
+}
+
 // expect consumes cur if it matches t, else records an error and returns false.
 func (p *Parser) expect(t token.Type) bool {
 	if p.cur.Type == t {
@@ -72,6 +79,10 @@ func (p *Parser) Parse() (*ast.Program, []Diagnostic) {
 	prog := &ast.Program{Position: p.cur.Pos}
 	for !p.curIs(token.EOF) {
 		switch p.cur.Type {
+		case token.IMPORT:
+			if imp := p.parseImport(); imp != nil {
+				prog.Items = append(prog.Items, imp)
+			}
 		case token.PROJECT:
 			if proj := p.parseProject(); proj != nil {
 				prog.Items = append(prog.Items, proj)
@@ -80,8 +91,12 @@ func (p *Parser) Parse() (*ast.Program, []Diagnostic) {
 			if pat := p.parsePatternDef(); pat != nil {
 				prog.Items = append(prog.Items, pat)
 			}
+		case token.FN:
+			if fd := p.parseFuncDef(); fd != nil {
+				prog.Items = append(prog.Items, fd)
+			}
 		default:
-			p.errorf(p.cur.Pos, "expected 'project' or 'pattern', found %q", p.cur.Literal)
+			p.errorf(p.cur.Pos, "expected 'import', 'project', 'pattern' or 'fn', found %q", p.cur.Literal)
 			p.syncTopLevel()
 		}
 	}
@@ -90,7 +105,8 @@ func (p *Parser) Parse() (*ast.Program, []Diagnostic) {
 
 // syncTopLevel skips tokens until the next top-level keyword or EOF.
 func (p *Parser) syncTopLevel() {
-	for !p.curIs(token.EOF) && !p.curIs(token.PROJECT) && !p.curIs(token.PATTERN) {
+	for !p.curIs(token.EOF) && !p.curIs(token.PROJECT) && !p.curIs(token.PATTERN) &&
+		!p.curIs(token.IMPORT) && !p.curIs(token.FN) {
 		p.next()
 	}
 }
@@ -111,7 +127,7 @@ func (p *Parser) syncStmt() {
 			}
 			depth--
 		case token.BAR, token.TRACK, token.FOR, token.IF, token.LET, token.ON,
-			token.PATTERN, token.KIT:
+			token.PATTERN, token.FN, token.KIT:
 			if depth == 0 {
 				return
 			}
@@ -120,6 +136,32 @@ func (p *Parser) syncStmt() {
 	}
 }
 
+// parseImport parses `import "path" [as name];`. The word "as" is recognized
+// contextually, like `beat`. The file itself is read by a Loader.
+func (p *Parser) parseImport() *ast.Import {
+	imp := &ast.Import{Position: p.cur.Pos}
+	p.next() // 'import'
+	if !p.curIs(token.STRING) {
+		p.errorf(p.cur.Pos, "expected a file path string after 'import', found %q", p.cur.Literal)
+		p.syncTopLevel()
+		return nil
+	}
+	imp.Path = p.cur.Literal
+	p.next()
+	if p.curIs(token.IDENT) && p.cur.Literal == "as" {
+		p.next()
+		if !p.curIs(token.IDENT) {
+			p.errorf(p.cur.Pos, "expected a namespace name after 'as', found %q", p.cur.Literal)
+			p.syncTopLevel()
+			return nil
+		}
+		imp.Alias = p.cur.Literal
+		p.next()
+	}
+	p.expect(token.SEMICOLON)
+	return imp
+}
+
 func (p *Parser) parseProject() *ast.Project {
 	proj := &ast.Project{Position: p.cur.Pos}
 	p.next() // 'project'
@@ -142,6 +184,15 @@ func (p *Parser) parseProject() *ast.Project {
 			if s := p.parseSetting(); s != nil {
 				proj.Settings = append(proj.Settings, *s)
 			}
+		case token.IDENT:
+			if !p.curIsSeed() && !p.curIsKey() {
+				p.errorf(p.cur.Pos, "expected bpm/time/key/seed/track/pattern/fn or '}', found %q", p.cur.Literal)
+				p.syncStmt()
+				break
+			}
+			if s := p.parseSetting(); s != nil {
+				proj.Settings = append(proj.Settings, *s)
+			}
 		case token.TRACK:
 			if tr := p.parseTrack(); tr != nil {
 				proj.Tracks = append(proj.Tracks, tr)
@@ -150,8 +201,12 @@ func (p *Parser) parseProject() *ast.Project {
 			if pat := p.parsePatternDef(); pat != nil {
 				proj.Patterns = append(proj.Patterns, pat)
 			}
+		case token.FN:
+			if fd := p.parseFuncDef(); fd != nil {
+				proj.Funcs = append(proj.Funcs, fd)
+			}
 		default:
-			p.errorf(p.cur.Pos, "expected bpm/time/track/pattern or '}', found %q", p.cur.Literal)
+			p.errorf(p.cur.Pos, "expected bpm/time/key/seed/track/pattern/fn or '}', found %q", p.cur.Literal)
 			p.syncStmt()
 		}
 	}
@@ -171,11 +226,28 @@ func (p *Parser) parseSetting() *ast.Setting {
 			return nil
 		}
 		s.Number = n
+		if p.curIs(token.IDENT) && p.cur.Literal == "to" {
+			if s.Ramp = p.parseTempoRamp(); s.Ramp == nil {
+				p.syncStmt()
+				return nil
+			}
+		}
 		p.expect(token.SEMICOLON)
 	case token.TIME:
 		s.Kind = ast.SettingTime
 		p.next()
 		b, ok1 := p.parseIntToken()
+		// additive meter: `time 3+3+2 8` sums its groups into the numerator
+		if ok1 && p.curIs(token.PLUS) {
+			s.TimeGroups = []int{b}
+			for ok1 && p.curIs(token.PLUS) {
+				p.next()
+				var g int
+				g, ok1 = p.parseIntToken()
+				s.TimeGroups = append(s.TimeGroups, g)
+				b += g
+			}
+		}
 		u, ok2 := p.parseIntToken()
 		if !ok1 || !ok2 {
 			p.syncStmt()
@@ -193,10 +265,130 @@ func (p *Parser) parseSetting() *ast.Setting {
 		p.next()
 		s.Text = p.parseStringLike()
 		p.expect(token.SEMICOLON)
+	case token.IDENT:
+		switch p.cur.Literal {
+		case "seed":
+			// `seed N`, recognized contextually (see curIsSeed); N may be
+			// negative, as -seed on the command line may.
+			s.Kind = ast.SettingSeed
+			p.next()
+			sign := 1
+			if p.curIs(token.MINUS) {
+				sign = -1
+				p.next()
+			}
+			n, ok := p.parseIntToken()
+			if !ok {
+				p.syncStmt()
+				return nil
+			}
+			s.Number = float64(sign * n)
+			p.expect(token.SEMICOLON)
+		case "key":
+			// `key <tonic> [<mode>]`, recognized contextually (see
+			// curIsKey): the tonic is a bare pitch such as D, Bb or F#; the
+			// mode defaults to major.
+			s.Kind = ast.SettingKey
+			p.next()
+			s.Tonic, s.Mode = p.cur.Literal, "major"
+			p.next()
+			if p.curIs(token.IDENT) {
+				s.Mode = p.cur.Literal
+				p.next()
+			}
+			p.expect(token.SEMICOLON)
+		}
 	}
 	return s
 }
 
+// curIsSeed reports whether the current token starts a `seed N` setting.
+// Like `step` and `every`, "seed" is not reserved: it is a setting only when a
+// number or a minus sign follows, so `let seed = 3;` still binds a name.
+func (p *Parser) curIsSeed() bool {
+	return p.curIs(token.IDENT) && p.cur.Literal == "seed" && (p.peekIs(token.NUMBER) || p.peekIs(token.MINUS))
+}
+
+// curIsKey reports whether the current token starts a `key <tonic> [<mode>]`
+// setting. "key" is not reserved either: it is a setting only before a capital
+// letter and its accidentals, so `let key = C;` still binds a name. The letter
+// is not limited to A-G here so that `key H` reaches the analyzer's tonic check.
+func (p *Parser) curIsKey() bool {
+	if !p.curIs(token.IDENT) || p.cur.Literal != "key" || !p.peekIs(token.IDENT) {
+		return false
+	}
+	tonic := p.peek.Literal
+	if tonic[0] < 'A' || tonic[0] > 'Z' {
+		return false
+	}
+	for i := 1; i < len(tonic); i++ {
+		if tonic[i] != '#' && tonic[i] != 'b' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTempoRamp parses the `to <bpm> over <span> [curve <shape>]` tail of a
+// bpm setting. Like `beat`, the words "to" and "curve" are recognized
+// contextually so they stay usable as names.
+func (p *Parser) parseTempoRamp() *ast.TempoRamp {
+	r := &ast.TempoRamp{}
+	p.next() // 'to'
+	to, ok := p.parseNumberToken()
+	if !ok {
+		return nil
+	}
+	r.To = to
+	if !p.expect(token.OVER) {
+		return nil
+	}
+	r.Over, ok = p.parseSpan()
+	if !ok {
+		return nil
+	}
+	r.Curve = p.parseCurve()
+	return r
+}
+
+// parseSpan parses the length of a ramp after `over`: `<n> bars` (or `bar`)
+// or a single note value such as `quarter` or `2`.
+func (p *Parser) parseSpan() (ast.Span, bool) {
+	if (p.curIs(token.NUMBER) || p.curIs(token.FLOAT)) &&
+		(p.peekIs(token.BAR) || (p.peekIs(token.IDENT) && p.peek.Literal == "bars")) {
+		n := parseFloat(p.cur.Literal)
+		p.next()
+		p.next() // 'bar' / 'bars'
+		return ast.Span{Bars: n}, true
+	}
+	if v, ok := p.curDuration(); ok {
+		p.next()
+		return ast.Span{Note: v}, true
+	}
+	p.errorf(p.cur.Pos, "expected '<n> bars' or a note value after 'over', found %q", p.cur.Literal)
+	return ast.Span{}, false
+}
+
+// parseCurve parses an optional `curve linear|exp`; without it a ramp is linear.
+func (p *Parser) parseCurve() ast.Curve {
+	if !p.curIs(token.IDENT) || p.cur.Literal != "curve" {
+		return ast.CurveLinear
+	}
+	p.next() // 'curve'
+	if p.curIs(token.IDENT) {
+		switch p.cur.Literal {
+		case "linear":
+			p.next()
+			return ast.CurveLinear
+		case "exp":
+			p.next()
+			return ast.CurveExp
+		}
+	}
+	p.errorf(p.cur.Pos, "expected 'linear' or 'exp' after 'curve', found %q", p.cur.Literal)
+	return ast.CurveLinear
+}
+
 func (p *Parser) parseStringLike() string {
 	if p.curIs(token.STRING) || p.curIs(token.IDENT) {
 		v := p.cur.Literal
@@ -281,20 +473,7 @@ func (p *Parser) parsePatternDef() *ast.PatternDef {
 	// The parameter list is optional: `pattern I { ... }` and
 	// `pattern walk(root, third) { ... }` are both valid.
 	if p.curIs(token.LPAREN) {
-		p.next()
-		for !p.curIs(token.RPAREN) && !p.curIs(token.EOF) {
-			if p.curIs(token.IDENT) {
-				pat.Params = append(pat.Params, p.cur.Literal)
-				p.next()
-			} else {
-				p.errorf(p.cur.Pos, "expected parameter name, found %q", p.cur.Literal)
-				break
-			}
-			if p.curIs(token.COMMA) {
-				p.next()
-			}
-		}
-		p.expect(token.RPAREN)
+		pat.Params = p.parseParams()
 	}
 	if !p.expect(token.LBRACE) {
 		p.syncStmt()
@@ -304,3 +483,53 @@ func (p *Parser) parsePatternDef() *ast.PatternDef {
 	p.expect(token.RBRACE)
 	return pat
 }
+
+// parseParams parses a parenthesized parameter-name list; cur is '('.
+func (p *Parser) parseParams() []string {
+	var params []string
+	p.next() // '('
+	for !p.curIs(token.RPAREN) && !p.curIs(token.EOF) {
+		if p.curIs(token.IDENT) {
+			params = append(params, p.cur.Literal)
+			p.next()
+		} else {
+			p.errorf(p.cur.Pos, "expected parameter name, found %q", p.cur.Literal)
+			break
+		}
+		if p.curIs(token.COMMA) {
+			p.next()
+		}
+	}
+	p.expect(token.RPAREN)
+	return params
+}
+
+// parseFuncDef parses `fn name(params) = expr;`. Unlike a pattern, a function
+// always has a parameter list, possibly empty.
+func (p *Parser) parseFuncDef() *ast.FuncDef {
+	fd := &ast.FuncDef{Position: p.cur.Pos}
+	p.next() // 'fn'
+	if !p.curIs(token.IDENT) {
+		p.errorf(p.cur.Pos, "expected function name, found %q", p.cur.Literal)
+		p.syncStmt()
+		return nil
+	}
+	fd.Name = p.cur.Literal
+	p.next()
+	if !p.curIs(token.LPAREN) {
+		p.errorf(p.cur.Pos, "expected '(' after function name %q, found %q", fd.Name, p.cur.Literal)
+		p.syncStmt()
+		return nil
+	}
+	fd.Params = p.parseParams()
+	if !p.expect(token.ASSIGN) {
+		p.syncStmt()
+		return nil
+	}
+	if fd.Body = p.parseExpr(LOWEST); fd.Body == nil {
+		p.syncStmt()
+		return nil
+	}
+	p.expect(token.SEMICOLON)
+	return fd
+}
@@ -1,9 +1,11 @@
 package parser
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/poolpOrg/earmuff/ast"
+	"github.com/poolpOrg/earmuff/token"
 )
 
 func parseOK(t *testing.T, src string) *ast.Program {
@@ -155,3 +157,449 @@ func TestParse_DiagnosticPosition(t *testing.T) {
 		t.Fatalf("diagnostic at line %d, want 2 (%s)", errs[0].Pos.Line, errs[0])
 	}
 }
+
+func TestParse_TempoRamp(t *testing.T) {
+	prog := parseOK(t, `project "p" {
+		track "t" instrument "piano" {
+			bpm 120 to 90 over 4 bars;
+			bpm 90 to 140 over half curve exp;
+		}
+	}`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	rit := body[0].(*ast.SettingStmt).Setting
+	if rit.Number != 120 || rit.Ramp == nil || rit.Ramp.To != 90 || rit.Ramp.Over.Bars != 4 || rit.Ramp.Curve != ast.CurveLinear {
+		t.Fatalf("rit = %+v / %+v", rit, rit.Ramp)
+	}
+	acc := body[1].(*ast.SettingStmt).Setting
+	if acc.Ramp == nil || acc.Ramp.Over.Note != 2 || acc.Ramp.Curve != ast.CurveExp {
+		t.Fatalf("accel = %+v / %+v", acc, acc.Ramp)
+	}
+	parseErr(t, `project "p" { track "t" { bpm 120 to 90 over 3; } }`)
+	parseErr(t, `project "p" { track "t" { bpm 120 to 90 over 1 bar curve sine; } }`)
+}
+
+func TestParse_AdditiveMeter(t *testing.T) {
+	prog := parseOK(t, `project "p" { time 3+3+2 8; }`)
+	s := prog.Items[0].(*ast.Project).Settings[0]
+	if s.TimeBeats != 8 || s.TimeUnit != 8 || len(s.TimeGroups) != 3 || s.TimeGroups[2] != 2 {
+		t.Fatalf("setting = %+v", s)
+	}
+	parseErr(t, `project "p" { time 3+ 8; }`)
+}
+
+func TestParse_Key(t *testing.T) {
+	prog := parseOK(t, `project "p" { key D minor; track "t" { key Bb; } }`)
+	proj := prog.Items[0].(*ast.Project)
+	if s := proj.Settings[0]; s.Kind != ast.SettingKey || s.Tonic != "D" || s.Mode != "minor" {
+		t.Fatalf("project setting = %+v", s)
+	}
+	if s := proj.Tracks[0].Body[0].(*ast.SettingStmt).Setting; s.Kind != ast.SettingKey || s.Tonic != "Bb" || s.Mode != "major" {
+		t.Fatalf("track setting = %+v", s)
+	}
+	parseErr(t, `project "p" { key 4; }`)
+
+	// "key" is only a setting before a tonic; elsewhere it is a name
+	prog = parseOK(t, `project "p" { track "t" { let key = C; bar { key } } }`)
+	if l, ok := prog.Items[0].(*ast.Project).Tracks[0].Body[0].(*ast.Let); !ok || l.Name != "key" {
+		t.Fatalf("body[0] = %+v, want let key", prog.Items[0].(*ast.Project).Tracks[0].Body[0])
+	}
+}
+
+func TestParse_Degrees(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" { bar quarter { ii7 bVII ^3 b7 } } }`)
+	bar := prog.Items[0].(*ast.Project).Tracks[0].Body[0].(*ast.Bar)
+	for i, want := range []string{"ii7", "bVII", "^3", "b7"} {
+		if ref, ok := bar.Items[i].(*ast.Step).Play.(*ast.NoteRef); !ok || ref.Text != want {
+			t.Errorf("step %d = %+v, want %q", i, bar.Items[i], want)
+		}
+	}
+
+	// A bare v is the numeral unless a velocity number or dynamic follows.
+	prog = parseOK(t, `project "p" { track "t" { bar quarter { i iv v i v mf } } }`)
+	bar = prog.Items[0].(*ast.Project).Tracks[0].Body[0].(*ast.Bar)
+	if len(bar.Items) != 4 {
+		t.Fatalf("%d steps, want 4: %+v", len(bar.Items), bar.Items)
+	}
+	for i, want := range []string{"i", "iv", "v", "i"} {
+		if ref, ok := bar.Items[i].(*ast.Step).Play.(*ast.NoteRef); !ok || ref.Text != want {
+			t.Errorf("step %d = %+v, want %q", i, bar.Items[i], want)
+		}
+	}
+	if v := bar.Items[3].(*ast.Step).Velocity; v == nil || v.Dynamic != "mf" {
+		t.Errorf("last step velocity = %+v, want mf", v)
+	}
+}
+
+func TestParse_Seed(t *testing.T) {
+	prog := parseOK(t, `project "p" { seed 42; track "t" { seed 7; } }`)
+	proj := prog.Items[0].(*ast.Project)
+	if s := proj.Settings[0]; s.Kind != ast.SettingSeed || s.Number != 42 {
+		t.Fatalf("project setting = %+v", s)
+	}
+	if s := proj.Tracks[0].Body[0].(*ast.SettingStmt).Setting; s.Kind != ast.SettingSeed || s.Number != 7 {
+		t.Fatalf("track setting = %+v", s)
+	}
+	parseErr(t, `project "p" { seed 1.5; }`)
+	prog = parseOK(t, `project "p" { seed -3; }`)
+	if s := prog.Items[0].(*ast.Project).Settings[0]; s.Kind != ast.SettingSeed || s.Number != -3 {
+		t.Fatalf("negative seed = %+v", s)
+	}
+	parseErr(t, `project "p" { seed -x; }`)
+
+	// "seed" is only a setting before a number; elsewhere it is a name
+	prog = parseOK(t, `project "p" { track "t" { let seed = 3; bar 4 { (C + seed) } } }`)
+	if l, ok := prog.Items[0].(*ast.Project).Tracks[0].Body[0].(*ast.Let); !ok || l.Name != "seed" {
+		t.Fatalf("body[0] = %+v, want let seed", prog.Items[0].(*ast.Project).Tracks[0].Body[0])
+	}
+}
+
+func TestParse_Humanize(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" {
+		humanize velocity 8 timing 10%;
+		humanize gate 30;
+		humanize off;
+	} }`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	h := body[0].(*ast.Humanize)
+	if h.Velocity != 8 || h.Timing != (ast.Jitter{Amount: 10, Percent: true}) || h.Gate.Amount != 0 {
+		t.Fatalf("humanize = %+v", h)
+	}
+	if h := body[1].(*ast.Humanize); h.Gate != (ast.Jitter{Amount: 30}) {
+		t.Fatalf("humanize = %+v", h)
+	}
+	if h := body[2].(*ast.Humanize); !h.Off() {
+		t.Fatalf("humanize off = %+v", h)
+	}
+	parseErr(t, `project "p" { track "t" { humanize timing; } }`)
+	parseErr(t, `project "p" { track "t" { humanize timing 5 timing 6; } }`)
+	parseErr(t, `project "p" { track "t" { humanize velocity 10%; } }`)
+
+	// "humanize" is only a statement before a clause; elsewhere it is a name
+	prog = parseOK(t, `project "p" { track "t" { let humanize = 3; bar 4 { (C + humanize) } } }`)
+	if l, ok := prog.Items[0].(*ast.Project).Tracks[0].Body[0].(*ast.Let); !ok || l.Name != "humanize" {
+		t.Fatalf("body[0] = %+v, want let humanize", prog.Items[0].(*ast.Project).Tracks[0].Body[0])
+	}
+}
+
+func TestParse_Arp(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" {
+		bar { arp Am7 up-down octaves 2 rate 16 gate 50% over half v ff C }
+		bar 8 { arp (C, G, E) as-played }
+	} }`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	items := body[0].(*ast.Bar).Items
+	a, ok := items[0].(*ast.Arp)
+	if !ok || len(items) != 2 {
+		t.Fatalf("items = %#v, want an arp and a step", items)
+	}
+	if ref, _ := a.Play.(*ast.NoteRef); ref == nil || ref.Text != "Am7" || a.Mode != ast.ArpUpDown ||
+		a.Octaves != 2 || a.Rate != 16 || a.Gate != 50 || a.Over != 2 || a.Velocity == nil {
+		t.Fatalf("arp = %+v", a)
+	}
+	b := body[1].(*ast.Bar).Items[0].(*ast.Arp)
+	if _, ok := b.Play.(*ast.Group); !ok || b.Mode != ast.ArpAsPlayed || b.Octaves != 1 || b.Rate != 0 || b.Gate != 100 {
+		t.Fatalf("arp = %+v", b)
+	}
+	parseErr(t, `project "p" { track "t" { bar { arp C up-sideways } } }`)
+	parseErr(t, `project "p" { track "t" { bar { arp C rate 3 } } }`)
+
+	// "arp" is only an arp before something to arpeggiate; elsewhere it is a name
+	prog = parseOK(t, `project "p" { track "t" { let arp = C; bar { arp _ ~ arp } } }`)
+	items = prog.Items[0].(*ast.Project).Tracks[0].Body[1].(*ast.Bar).Items
+	if len(items) != 4 {
+		t.Fatalf("items = %#v, want four steps", items)
+	}
+	for _, it := range items {
+		if _, ok := it.(*ast.Step); !ok {
+			t.Fatalf("item = %#v, want a step", it)
+		}
+	}
+}
+
+func TestParse_Hairpin(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" {
+		cresc p to ff over 2 bars curve exp expression;
+		dim 100 to pp over half;
+	} }`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	c := body[0].(*ast.Hairpin)
+	if c.Dim || c.From.Dynamic != "p" || c.To.Dynamic != "ff" || c.Over != (ast.Span{Bars: 2}) ||
+		c.Curve != ast.CurveExp || !c.Expression {
+		t.Fatalf("cresc = %+v", c)
+	}
+	d := body[1].(*ast.Hairpin)
+	if !d.Dim || !d.From.HasNumber || d.From.Number != 100 || d.To.Dynamic != "pp" || d.Over != (ast.Span{Note: 2}) || d.Expression {
+		t.Fatalf("dim = %+v", d)
+	}
+	parseErr(t, `project "p" { track "t" { cresc p ff over 2 bars; } }`)
+	parseErr(t, `project "p" { track "t" { cresc loud to ff over 2 bars; } }`)
+	parseErr(t, `project "p" { track "t" { dim f to p; } }`)
+
+	// "cresc" and "dim" are only hairpins before a level and "to"; elsewhere
+	// they are names
+	prog = parseOK(t, `project "p" { track "t" { let dim = E; let cresc = 2; bar { (dim + cresc) dim } } }`)
+	body = prog.Items[0].(*ast.Project).Tracks[0].Body
+	if l, ok := body[0].(*ast.Let); !ok || l.Name != "dim" {
+		t.Fatalf("body[0] = %+v, want let dim", body[0])
+	}
+	if _, ok := body[2].(*ast.Bar); !ok {
+		t.Fatalf("body[2] = %+v, want a bar", body[2])
+	}
+}
+
+func TestParse_Ramps(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" {
+		cc 74 from 0 to 127 over 2 bars curve exp;
+		bend raw 8192 to 0 over half every 32;
+		bar 4 { C bend 0 to +2 over quarter D }
+	} }`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	cc := body[0].(*ast.CC)
+	if cc.Ramp == nil || cc.Ramp.Over != (ast.Span{Bars: 2}) || cc.Ramp.Curve != ast.CurveExp || cc.Ramp.Every != 0 {
+		t.Fatalf("cc = %+v", cc)
+	}
+	if b := body[1].(*ast.Bend); b.Mode != ast.BendRaw || b.Ramp == nil || b.Ramp.Every != 32 {
+		t.Fatalf("bend = %+v", b)
+	}
+	items := body[2].(*ast.Bar).Items
+	if b, ok := items[1].(*ast.Bend); !ok || len(items) != 3 || b.Ramp == nil || b.Ramp.Over != (ast.Span{Note: 4}) {
+		t.Fatalf("items = %#v", items)
+	}
+	parseErr(t, `project "p" { track "t" { cc 74 from 0 over 1 bar; } }`)
+	parseErr(t, `project "p" { track "t" { bend range 2 to 12 over 1 bar; } }`)
+	parseErr(t, `project "p" { track "t" { bend 0 to 2 over 1 bar every 3; } }`)
+}
+
+func TestParse_Mixer(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" {
+		pattern volume() { bar { C } }
+		volume 100;
+		pan -20;
+		volume
+		cc sustain = 127;
+		let loud = 110;
+		volume loud;
+		volume(loud)
+	} }`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	if m, ok := body[1].(*ast.Mixer); !ok || m.Name != "volume" {
+		t.Fatalf("body[1] = %#v, want volume", body[1])
+	}
+	if m, ok := body[2].(*ast.Mixer); !ok || m.Name != "pan" {
+		t.Fatalf("body[2] = %#v, want pan", body[2])
+	}
+	// Without a value the word is still a pattern call.
+	if c, ok := body[3].(*ast.PatternCall); !ok || c.Name != "volume" {
+		t.Fatalf("body[3] = %#v, want a call", body[3])
+	}
+	if cc := body[4].(*ast.CC); cc.Controller.(*ast.Ident).Name != "sustain" {
+		t.Fatalf("cc = %+v", cc)
+	}
+	// A binding is a value too; a parenthesized argument list is a call.
+	if m, ok := body[6].(*ast.Mixer); !ok || m.Value.(*ast.Ident).Name != "loud" {
+		t.Fatalf("body[6] = %#v, want volume loud", body[6])
+	}
+	if c, ok := body[7].(*ast.PatternCall); !ok || len(c.Args) != 1 {
+		t.Fatalf("body[7] = %#v, want a call with one argument", body[7])
+	}
+}
+
+func TestParse_VoiceLead(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" {
+		voicelead { bar { Dm7 G7 } }
+		voicelead E^2 to 72 { for ch in [Dm7, G7] { bar { ch } } }
+	} }`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	if vl, ok := body[0].(*ast.VoiceLead); !ok || vl.Lo != nil || len(vl.Body) != 1 {
+		t.Fatalf("body[0] = %#v, want a voicelead with the default range", body[0])
+	}
+	vl := body[1].(*ast.VoiceLead)
+	if vl.Lo == nil || vl.Hi == nil || len(vl.Body) != 1 {
+		t.Fatalf("body[1] = %#v, want a voicelead with a range", vl)
+	}
+
+	parseErr(t, `project "p" { track "t" { voicelead C^3 C^5 { } } }`)
+
+	// "voicelead" is only a block before "{" or a range; elsewhere it is a name
+	prog = parseOK(t, `project "p" { track "t" { let voicelead = 3; bar 4 { (C + voicelead) } } }`)
+	if l, ok := prog.Items[0].(*ast.Project).Tracks[0].Body[0].(*ast.Let); !ok || l.Name != "voicelead" {
+		t.Fatalf("body[0] = %+v, want let voicelead", prog.Items[0].(*ast.Project).Tracks[0].Body[0])
+	}
+}
+
+func TestParse_Voicings(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" {
+		bar { Cmaj7 inv 2 drop 2 (ch) open octave -1 D }
+		bar { arp Am7 inv 1 up }
+	} }`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	items := body[0].(*ast.Bar).Items
+	ref := items[0].(*ast.Step).Play.(*ast.NoteRef)
+	want := []ast.Voicing{{Kind: ast.VoiceInvert, N: 2}, {Kind: ast.VoiceDrop, N: 2}}
+	if len(ref.Voicing) != 2 || ref.Voicing[0].Kind != want[0].Kind || ref.Voicing[0].N != 2 || ref.Voicing[1].Kind != want[1].Kind {
+		t.Fatalf("voicing = %+v, want inv 2 drop 2", ref.Voicing)
+	}
+	par := items[1].(*ast.Step).Play.(*ast.NoteRef)
+	if len(par.Voicing) != 2 || par.Voicing[1].String() != "octave -1" {
+		t.Fatalf("voicing = %+v, want open octave -1", par.Voicing)
+	}
+	if d := items[2].(*ast.Step).Play.(*ast.NoteRef); d.Text != "D" || len(d.Voicing) != 0 {
+		t.Fatalf("items[2] = %+v, want a plain D", d)
+	}
+	arp := body[1].(*ast.Bar).Items[0].(*ast.Arp)
+	if arp.Mode != ast.ArpUp || len(arp.Play.(*ast.NoteRef).Voicing) != 1 {
+		t.Fatalf("arp = %+v, want a voiced Am7 going up", arp)
+	}
+
+	errs := parseErr(t, `project "p" { track "t" { bar { Cmaj7 drop 1 } } }`)
+	if !strings.Contains(errs[0].Msg, "starting at 2") {
+		t.Fatalf("diagnostic = %s, want the drop error", errs[0])
+	}
+}
+
+func TestParse_Params(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" {
+		rpn finetune = 8192 reset;
+		nrpn 300 = 64;
+		bar { C cc14 modulation = 9000 }
+	} }`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	if p, ok := body[0].(*ast.Param); !ok || p.Kind != ast.ParamRPN || !p.Reset {
+		t.Fatalf("body[0] = %#v, want rpn with reset", body[0])
+	}
+	if p, ok := body[1].(*ast.Param); !ok || p.Kind != ast.ParamNRPN || p.Reset {
+		t.Fatalf("body[1] = %#v, want nrpn", body[1])
+	}
+	bar := body[2].(*ast.Bar)
+	if p, ok := bar.Items[1].(*ast.Param); !ok || p.Kind != ast.ParamCC14 {
+		t.Fatalf("bar item = %#v, want cc14", bar.Items[1])
+	}
+
+	errs := parseErr(t, `project "p" { track "t" { cc14 1 = 9000 reset; } }`)
+	if !strings.Contains(errs[0].Msg, "cc14 has no null RPN reset") {
+		t.Fatalf("diagnostic = %s, want the cc14 reset error", errs[0])
+	}
+
+	// the words are only parameters before a number or name and "="; elsewhere
+	// they are names
+	prog = parseOK(t, `project "p" { track "t" {
+		let rpn = 3; let cc14 = C;
+		bar { cc14 on beat rpn cc14 }
+	} }`)
+	body = prog.Items[0].(*ast.Project).Tracks[0].Body
+	if l, ok := body[0].(*ast.Let); !ok || l.Name != "rpn" {
+		t.Fatalf("body[0] = %#v, want let rpn", body[0])
+	}
+	items := body[2].(*ast.Bar).Items
+	if _, ok := items[0].(*ast.Step); !ok {
+		t.Fatalf("items[0] = %#v, want a step", items[0])
+	}
+	if a, ok := items[1].(*ast.Absolute); !ok {
+		t.Fatalf("items[1] = %#v, want an absolute step", items[1])
+	} else if _, ok := a.Event.(*ast.Step); !ok {
+		t.Fatalf("event = %#v, want a step", a.Event)
+	}
+}
+
+func TestParse_PolyPressure(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" {
+		pressure 90;
+		pressure C^4 = 90;
+		bar { C on beat 2 pressure Cmaj7 = 40; }
+	} }`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	if p := body[0].(*ast.Pressure); p.Key != nil {
+		t.Fatalf("channel pressure has a key: %+v", p)
+	}
+	if ref, ok := body[1].(*ast.Pressure).Key.(*ast.NoteRef); !ok || ref.Text != "C^4" {
+		t.Fatalf("poly pressure key = %#v", body[1].(*ast.Pressure).Key)
+	}
+	abs := body[2].(*ast.Bar).Items[1].(*ast.Absolute)
+	if ref, ok := abs.Event.(*ast.Pressure).Key.(*ast.NoteRef); !ok || ref.Text != "Cmaj7" {
+		t.Fatalf("on beat pressure = %#v", abs.Event)
+	}
+}
+
+func TestParse_Tuplet(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" instrument "piano" {
+		bar 8 { 16: C D | 3:2 { C (E, G) ~ } 5:4 { C*5 } }
+	} }`)
+	items := prog.Items[0].(*ast.Project).Tracks[0].Body[0].(*ast.Bar).Items
+	tup, ok := items[4].(*ast.Tuplet)
+	if !ok || tup.Actual != 3 || tup.Normal != 2 || len(tup.Steps) != 3 {
+		t.Fatalf("items[4] = %#v", items[4])
+	}
+	parseErr(t, `project "p" { track "t" { bar 8 { 3:2 { C cc 1 = 2; } } } }`)
+}
+
+func TestParse_FuncDef(t *testing.T) {
+	prog := parseOK(t, `fn tritoneSub(ch) = ch + dim5;
+project "p" {
+	fn pair(a, b) = [a, b];
+	track "t" instrument "piano" {
+		fn none() = C;
+		let x = tritoneSub(pair(C, voicings.shell(D)));
+	}
+}`)
+	fd, ok := prog.Items[0].(*ast.FuncDef)
+	if !ok || fd.Name != "tritoneSub" || len(fd.Params) != 1 {
+		t.Fatalf("items[0] = %#v", prog.Items[0])
+	}
+	proj := prog.Items[1].(*ast.Project)
+	if len(proj.Funcs) != 1 || len(proj.Funcs[0].Params) != 2 {
+		t.Fatalf("project funcs = %#v", proj.Funcs)
+	}
+	body := proj.Tracks[0].Body
+	if fd := body[0].(*ast.FuncDef); fd.Name != "none" || len(fd.Params) != 0 {
+		t.Errorf("body[0] = %#v", fd)
+	}
+	parseErr(t, `fn x = 1;`)
+	parseErr(t, `fn x(a) a;`)
+	parseErr(t, `project "p" { track "t" { let x = lib.pat; } }`)
+}
+
+func TestParse_IndexSliceAndIntDiv(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" {
+		let a = changes[i % 4];
+		let b = -xs[1..2][0];
+		let c = n div 2 + 1;
+	} }`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	idx, ok := body[0].(*ast.Let).Value.(*ast.Index)
+	if !ok {
+		t.Fatalf("a = %#v, want an index", body[0].(*ast.Let).Value)
+	}
+	if mod, ok := idx.Index.(*ast.Binary); !ok || mod.Op != token.PERCENT {
+		t.Errorf("index = %#v, want i %% 4", idx.Index)
+	}
+	neg := body[1].(*ast.Let).Value.(*ast.Unary)
+	if sl, ok := neg.Operand.(*ast.Index).X.(*ast.Slice); !ok || sl.Lo == nil || sl.Hi == nil {
+		t.Errorf("b operand = %#v, want an index of a slice", neg.Operand)
+	}
+	sum := body[2].(*ast.Let).Value.(*ast.Binary)
+	if div, ok := sum.Left.(*ast.Binary); sum.Op != token.PLUS || !ok || div.Op != token.DIV {
+		t.Errorf("c = %#v, want (n div 2) + 1", sum)
+	}
+	parseErr(t, `project "p" { track "t" { let x = xs[1; } }`)
+}
+
+func TestParse_EnumeratedAndSteppedFor(t *testing.T) {
+	prog := parseOK(t, `project "p" { track "t" {
+		for i, ch in changes { }
+		for i in 16..1 step 4 { }
+		for n in C E G { }
+	} }`)
+	body := prog.Items[0].(*ast.Project).Tracks[0].Body
+	if f := body[0].(*ast.For); f.Index != "i" || f.Var != "ch" {
+		t.Errorf("enumerated for binds index %q, var %q", f.Index, f.Var)
+	}
+	r, ok := body[1].(*ast.For).Iterable.(*ast.Range)
+	if !ok || r.Step == nil {
+		t.Fatalf("stepped for iterable = %#v", body[1].(*ast.For).Iterable)
+	}
+	if l, ok := body[2].(*ast.For).Iterable.(*ast.ListLit); !ok || len(l.Elements) != 3 {
+		t.Errorf("bare sequence = %#v", body[2].(*ast.For).Iterable)
+	}
+	parseErr(t, `project "p" { track "t" { for i, in xs { } } }`)
+	parseErr(t, `project "p" { track "t" { let x = xs[0..4 step 2]; } }`)
+}
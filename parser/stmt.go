@@ -43,6 +43,12 @@ func (p *Parser) parseStmt() ast.Stmt {
 	case token.PATTERN:
 		// track-local pattern definition
 		return p.parsePatternDef()
+	case token.FN:
+		// body-local function, visible to the statements after it
+		if fd := p.parseFuncDef(); fd != nil {
+			return fd
+		}
+		return nil
 	case token.SECTION:
 		// a named arrangement block: sugar for a zero-arg pattern
 		return p.parseSection()
@@ -77,15 +83,50 @@ func (p *Parser) parseStmt() ast.Stmt {
 	case token.CC, token.BEND, token.PRESSURE, token.PROGRAM, token.SYSEX:
 		return p.parseEventStmt(true)
 	case token.IDENT:
+		if p.curIsSeed() || p.curIsKey() {
+			s := p.parseSetting()
+			if s == nil {
+				return nil
+			}
+			return &ast.SettingStmt{Setting: *s}
+		}
+		if p.curIsVoiceLead() {
+			if vl := p.parseVoiceLead(); vl != nil {
+				return vl
+			}
+			return nil
+		}
+		if p.curIsHumanize() {
+			if h := p.parseHumanize(); h != nil {
+				return h
+			}
+			return nil
+		}
+		if p.curIsHairpin() {
+			if h := p.parseHairpin(); h != nil {
+				return h
+			}
+			return nil
+		}
+		if p.curIsParam() {
+			return p.parseEventStmt(true)
+		}
+		// `volume 100;` and friends: a mixer word followed by a value, which
+		// may be any expression not opening with '(' (`volume loud;`). A bare
+		// name followed by '(', ';' or the next statement stays a pattern call.
+		if ast.MixerNames[p.cur.Literal] &&
+			(p.peekIs(token.NUMBER) || p.peekIs(token.FLOAT) || p.peekIs(token.MINUS) || p.peekIs(token.PLUS) ||
+				p.peekIs(token.IDENT)) {
+			n := &ast.Mixer{Position: p.cur.Pos, Name: p.cur.Literal}
+			p.next()
+			n.Value = p.parseExpr(LOWEST)
+			p.expect(token.SEMICOLON)
+			return n
+		}
 		// A pattern/section call. With arguments: `name(a, b)`. Without: a bare
 		// `name` plays a zero-arg pattern or a section — the natural way to lay
 		// out song structure (`head head solo head`).
-		if p.peekIs(token.LPAREN) {
-			return p.parsePatternCall()
-		}
-		n := &ast.PatternCall{Position: p.cur.Pos, Name: p.cur.Literal}
-		p.next()
-		return n
+		return p.parsePatternCall()
 	default:
 		p.errorf(p.cur.Pos, "unexpected %q in body", p.cur.Literal)
 		return nil
@@ -136,13 +177,15 @@ func (p *Parser) parseKit() *ast.Kit {
 	return n
 }
 
-// parseFor handles two forms:
+// parseFor handles three forms:
 //
-//	for i in <iterable> { ... }   // bound: i takes each value
-//	for each <iterable> { ... }   // unbound: iterate, no variable
+//	for i in <iterable> { ... }       // bound: i takes each value
+//	for i, ch in <iterable> { ... }   // enumerated: i counts 0, 1, ... too
+//	for each <iterable> { ... }       // unbound: iterate, no variable
 //
 // The iterable is a bare space-separated sequence (1 2 3, C E G, Am7 Dm7), a
-// range (1..4), a [..] list literal, or a binding/expression yielding a list.
+// range (1..4, 16..1 step 4), a [..] list literal, or a binding/expression
+// yielding a list.
 func (p *Parser) parseFor() *ast.For {
 	n := &ast.For{Position: p.cur.Pos}
 	p.next() // 'for'
@@ -152,6 +195,15 @@ func (p *Parser) parseFor() *ast.For {
 	} else if p.curIs(token.IDENT) {
 		n.Var = p.cur.Literal
 		p.next()
+		if p.curIs(token.COMMA) {
+			p.next()
+			if !p.curIs(token.IDENT) {
+				p.errorf(p.cur.Pos, "expected a loop variable after ',', found %q", p.cur.Literal)
+				return nil
+			}
+			n.Index, n.Var = n.Var, p.cur.Literal
+			p.next()
+		}
 		if !p.expect(token.IN) {
 			return nil
 		}
@@ -193,7 +245,9 @@ func (p *Parser) parseIterable() ast.Expr {
 // element of a bare for-sequence (a value), as opposed to the loop body.
 func (p *Parser) iterableSeqContinues() bool {
 	switch p.cur.Type {
-	case token.NUMBER, token.FLOAT, token.IDENT, token.MINUS, token.LPAREN:
+	case token.IDENT:
+		return p.cur.Literal != "step"
+	case token.NUMBER, token.FLOAT, token.MINUS, token.LPAREN:
 		return true
 	default:
 		return false
@@ -214,13 +268,44 @@ func (p *Parser) parseRepeat() *ast.For {
 		Iterable: &ast.Range{
 			Position: pos,
 			Lo:       &ast.NumberLit{Position: pos, Value: 1},
-			Hi:       count,
+			Hi:       count, // repeat 0 runs nothing
 		},
 	}
 	n.Body = p.parseBlock()
 	return n
 }
 
+// curIsVoiceLead reports whether the current token starts a voicelead block.
+// "voicelead" is not reserved: it starts one only before "{" or before a note
+// or number and "to", so `let voicelead = 3;` still binds a name.
+func (p *Parser) curIsVoiceLead() bool {
+	if !p.curIs(token.IDENT) || p.cur.Literal != "voicelead" {
+		return false
+	}
+	if p.peekIs(token.LBRACE) {
+		return true
+	}
+	next := p.peekNext()
+	return (p.peekIs(token.IDENT) || p.peekIs(token.NUMBER)) && next.Type == token.IDENT && next.Literal == "to"
+}
+
+// parseVoiceLead parses `voicelead [<lo> to <hi>] { ... }`.
+func (p *Parser) parseVoiceLead() *ast.VoiceLead {
+	n := &ast.VoiceLead{Position: p.cur.Pos}
+	p.next() // 'voicelead'
+	if !p.curIs(token.LBRACE) {
+		n.Lo = p.parseExpr(LOWEST)
+		if !p.curIs(token.IDENT) || p.cur.Literal != "to" {
+			p.errorf(p.cur.Pos, "expected 'to' and the top of the voicelead range, found %q", p.cur.Literal)
+			return nil
+		}
+		p.next()
+		n.Hi = p.parseExpr(LOWEST)
+	}
+	n.Body = p.parseBlock()
+	return n
+}
+
 // parseSwing parses `swing <percent>;`, a running feel modifier for the bars
 // that follow it in the body. `swing 50` (straight) turns it off.
 func (p *Parser) parseSwing() *ast.Swing {
@@ -231,6 +316,122 @@ func (p *Parser) parseSwing() *ast.Swing {
 	return n
 }
 
+// curIsHumanize reports whether the current token starts a humanize statement.
+// Like "seed", "humanize" is not reserved: it is a statement only when "off" or
+// a clause word follows, so `let humanize = 3;` still binds a name.
+func (p *Parser) curIsHumanize() bool {
+	if !p.curIs(token.IDENT) || p.cur.Literal != "humanize" || !p.peekIs(token.IDENT) {
+		return false
+	}
+	switch p.peek.Literal {
+	case "off", "timing", "velocity", "gate":
+		return true
+	}
+	return false
+}
+
+// parseHumanize parses `humanize off;` or `humanize` followed by any of
+// `timing <n>[%]`, `velocity <n>` and `gate <n>[%]`, each at most once. The
+// clause words are recognized contextually so they stay usable as names.
+func (p *Parser) parseHumanize() *ast.Humanize {
+	n := &ast.Humanize{Position: p.cur.Pos}
+	p.next() // 'humanize'
+	if p.curIs(token.IDENT) && p.cur.Literal == "off" {
+		p.next()
+		p.expect(token.SEMICOLON)
+		return n
+	}
+	seen := map[string]bool{}
+	for p.curIs(token.IDENT) {
+		word := p.cur.Literal
+		if word != "timing" && word != "velocity" && word != "gate" {
+			break
+		}
+		if seen[word] {
+			p.errorf(p.cur.Pos, "humanize %s given twice", word)
+		}
+		seen[word] = true
+		p.next()
+		amount, ok := p.parseNumberToken()
+		if !ok {
+			p.syncStmt()
+			return nil
+		}
+		pct := p.curIs(token.PERCENT)
+		if pct {
+			p.next()
+		}
+		switch word {
+		case "timing":
+			n.Timing = ast.Jitter{Amount: amount, Percent: pct}
+		case "gate":
+			n.Gate = ast.Jitter{Amount: amount, Percent: pct}
+		case "velocity":
+			if pct {
+				p.errorf(p.cur.Pos, "humanize velocity is in velocity units, not a percentage")
+			}
+			n.Velocity = amount
+		}
+	}
+	if len(seen) == 0 {
+		p.errorf(p.cur.Pos, "expected timing, velocity, gate or off after humanize, found %q", p.cur.Literal)
+		p.syncStmt()
+		return nil
+	}
+	p.expect(token.SEMICOLON)
+	return n
+}
+
+// curIsHairpin reports whether the current token starts a hairpin. Neither
+// "cresc" nor "dim" is reserved: they start one only before a level and "to",
+// so `let dim = E;` still binds a name.
+func (p *Parser) curIsHairpin() bool {
+	if !p.curIs(token.IDENT) || p.cur.Literal != "cresc" && p.cur.Literal != "dim" {
+		return false
+	}
+	if !p.peekIs(token.NUMBER) && !(p.peekIs(token.IDENT) && dynamicNames[p.peek.Literal]) {
+		return false
+	}
+	next := p.peekNext()
+	return next.Type == token.IDENT && next.Literal == "to"
+}
+
+// parseHairpin parses `cresc|dim <level> to <level> over <span> [curve
+// <shape>] [expression];`, where a level is a dynamic or a velocity number.
+func (p *Parser) parseHairpin() *ast.Hairpin {
+	n := &ast.Hairpin{Position: p.cur.Pos, Dim: p.cur.Literal == "dim"}
+	kw := p.cur.Literal
+	p.next() // 'cresc' / 'dim'
+	n.From = p.parseLevel(kw)
+	if n.From == nil {
+		p.syncStmt()
+		return nil
+	}
+	if !p.curIs(token.IDENT) || p.cur.Literal != "to" {
+		p.errorf(p.cur.Pos, "expected 'to' after %s level, found %q", kw, p.cur.Literal)
+		p.syncStmt()
+		return nil
+	}
+	p.next() // 'to'
+	n.To = p.parseLevel("to")
+	if n.To == nil || !p.expect(token.OVER) {
+		p.syncStmt()
+		return nil
+	}
+	var ok bool
+	if n.Over, ok = p.parseSpan(); !ok {
+		p.syncStmt()
+		return nil
+	}
+	n.Curve = p.parseCurve()
+	if p.curIs(token.IDENT) && p.cur.Literal == "expression" {
+		n.Expression = true
+		p.next()
+	}
+	p.expect(token.SEMICOLON)
+	return n
+}
+
 // parseSection parses `section <name> { ... }`. A section is a named block of
 // arrangement that you replay by name (`head`, `solo`, ...) — sugar for a
 // zero-parameter pattern, so it shares all of the pattern machinery.
@@ -268,10 +469,20 @@ func (p *Parser) parseIf() *ast.If {
 	return n
 }
 
+// parsePatternCall parses `name`, `name(args)`, or a namespaced
+// `lib.name(args)` from a namespaced import.
 func (p *Parser) parsePatternCall() *ast.PatternCall {
 	n := &ast.PatternCall{Position: p.cur.Pos, Name: p.cur.Literal}
 	p.next() // ident
-	p.expect(token.LPAREN)
+	for p.curIs(token.DOT) && p.peekIs(token.IDENT) {
+		p.next() // '.'
+		n.Name += "." + p.cur.Literal
+		p.next()
+	}
+	if !p.curIs(token.LPAREN) {
+		return n
+	}
+	p.next() // '('
 	for !p.curIs(token.RPAREN) && !p.curIs(token.EOF) {
 		n.Args = append(n.Args, p.parseExpr(LOWEST))
 		if p.curIs(token.COMMA) {
@@ -315,6 +526,52 @@ func (p *Parser) endEvent(term bool) {
 	}
 }
 
+// parseRamp parses the `to <value> over <span> [curve <shape>] [every
+// <duration>]` tail of a cc or bend ramp. Like "from", the words "to" and
+// "every" are recognized contextually.
+func (p *Parser) parseRamp(what string) *ast.Ramp {
+	if !p.curIs(token.IDENT) || p.cur.Literal != "to" {
+		p.errorf(p.cur.Pos, "expected 'to' in %s ramp, found %q", what, p.cur.Literal)
+		return nil
+	}
+	p.next() // 'to'
+	r := &ast.Ramp{To: p.parseExpr(LOWEST)}
+	if !p.expect(token.OVER) {
+		return nil
+	}
+	var ok bool
+	if r.Over, ok = p.parseSpan(); !ok {
+		return nil
+	}
+	r.Curve = p.parseCurve()
+	if p.curIs(token.IDENT) && p.cur.Literal == "every" {
+		p.next() // 'every'
+		v, ok := p.curDuration()
+		if !ok {
+			p.errorf(p.cur.Pos, "expected a note value after 'every', found %q", p.cur.Literal)
+			return nil
+		}
+		p.next()
+		r.Every = v
+	}
+	return r
+}
+
+// curIsParam reports whether the current token starts an rpn, nrpn or cc14
+// statement. The words are not reserved: they start one only before a number
+// or a name and "=", so `let rpn = 3;` still binds a name.
+func (p *Parser) curIsParam() bool {
+	if !p.curIs(token.IDENT) {
+		return false
+	}
+	switch p.cur.Literal {
+	case "rpn", "nrpn", "cc14":
+	default:
+		return false
+	}
+	return (p.peekIs(token.NUMBER) || p.peekIs(token.IDENT)) && p.peekNext().Type == token.ASSIGN
+}
+
 // parseEventStmt parses a raw-MIDI event (cc/bend/pressure/program/sysex). When
 // term is true it consumes a terminating ';' (track-statement context); when
 // false it does not (inline bar-item context).
@@ -324,6 +581,15 @@ func (p *Parser) parseEventStmt(term bool) ast.Stmt {
 		n := &ast.CC{Position: p.cur.Pos}
 		p.next()
 		n.Controller = p.parseExpr(LOWEST)
+		if p.curIs(token.IDENT) && p.cur.Literal == "from" {
+			p.next() // 'from'
+			n.Value = p.parseExpr(LOWEST)
+			if n.Ramp = p.parseRamp("cc"); n.Ramp == nil {
+				return nil
+			}
+			p.endEvent(term)
+			return n
+		}
 		if !p.expect(token.ASSIGN) {
 			return nil
 		}
@@ -346,12 +612,54 @@ func (p *Parser) parseEventStmt(term bool) ast.Stmt {
 			n.Mode = ast.BendSemitones
 			n.Value = p.parseExpr(LOWEST)
 		}
+		if p.curIs(token.IDENT) && p.cur.Literal == "to" {
+			if n.Mode == ast.BendRange {
+				p.errorf(p.cur.Pos, "bend range cannot ramp")
+				return nil
+			}
+			if n.Ramp = p.parseRamp("bend"); n.Ramp == nil {
+				return nil
+			}
+		}
+		p.endEvent(term)
+		return n
+	case token.IDENT:
+		// `rpn finetune = 8192 [reset]`, `nrpn 300 = 64`, `cc14 1 = 9000`,
+		// reached only when curIsParam holds
+		n := &ast.Param{Position: p.cur.Pos}
+		switch p.cur.Literal {
+		case "nrpn":
+			n.Kind = ast.ParamNRPN
+		case "cc14":
+			n.Kind = ast.ParamCC14
+		}
+		kw := p.cur.Literal
+		p.next()
+		n.Number = p.parseExpr(LOWEST)
+		if !p.expect(token.ASSIGN) {
+			return nil
+		}
+		n.Value = p.parseExpr(LOWEST)
+		if p.curIs(token.IDENT) && p.cur.Literal == "reset" {
+			if n.Kind == ast.ParamCC14 {
+				p.errorf(p.cur.Pos, "%s has no null RPN reset", kw)
+			}
+			n.Reset = true
+			p.next()
+		}
 		p.endEvent(term)
 		return n
 	case token.PRESSURE:
+		// `pressure 90` is channel pressure; `pressure C^4 = 90` presses
+		// one key (or each key of a chord).
 		n := &ast.Pressure{Position: p.cur.Pos}
 		p.next()
 		n.Value = p.parseExpr(LOWEST)
+		if p.curIs(token.ASSIGN) {
+			p.next()
+			n.Key = exprToPlayable(n.Value)
+			n.Value = p.parseExpr(LOWEST)
+		}
 		p.endEvent(term)
 		return n
 	case token.PROGRAM:
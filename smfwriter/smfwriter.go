@@ -1,10 +1,16 @@
 // Package smfwriter turns an elaborated Song into Standard MIDI File bytes.
 //
 // It writes one smf.Track per elaborated track at PPQ 960 (MetricTicks), with
-// per-track meta headers (tempo/time-signature/copyright on track 0, then
-// sequence name, instrument, and an initial program change). Channel and meta
-// events are converted from the Song's absolute ticks to SMF delta times after
-// a deterministic sort (NoteOff before NoteOn at equal tick).
+// per-track meta headers (tempo/time-signature/key/copyright on track 0, then
+// sequence name, instrument, and an initial program change). Later entries of
+// the Song's tempo and meter maps become MetaTempo and MetaMeter events on
+// track 0 at their ticks; a track's own key changes become MetaKey events on
+// that track.
+// Channel and meta events are converted from the Song's absolute ticks to SMF
+// delta times after a deterministic sort (NoteOff before NoteOn at equal tick).
+//
+// WriteSequences bundles several Songs (one per project) into a format 2 file,
+// where each SMF track is an independent sequence holding one whole Song.
 package smfwriter
 
 import (
@@ -13,6 +19,7 @@ import (
 
 	"github.com/poolpOrg/earmuff/ast"
 	"github.com/poolpOrg/earmuff/elaborator"
+	"github.com/poolpOrg/earmuff/value"
 	"gitlab.com/gomidi/midi/v2"
 	"gitlab.com/gomidi/midi/v2/smf"
 )
@@ -31,21 +38,7 @@ func Write(song elaborator.Song) []byte {
 		var tr smf.Track
 
 		if ti == 0 {
-			beats, unit := song.TimeBeats, song.TimeUnit
-			if beats == 0 {
-				beats = 4
-			}
-			if unit == 0 {
-				unit = 4
-			}
-			tr.Add(0, smf.MetaMeter(uint8(beats), uint8(unit)))
-			tr.Add(0, smf.MetaTempo(song.BPM))
-			if song.Copyright != "" {
-				tr.Add(0, smf.MetaCopyright(song.Copyright))
-			}
-			for _, t := range song.Texts {
-				tr.Add(0, smf.MetaText(t))
-			}
+			songHeader(&tr, song)
 		}
 
 		if info.Name != "" {
@@ -59,19 +52,63 @@ func Write(song elaborator.Song) []byte {
 		}
 
 		events := byTrack[ti]
+		timeline := make([]timed, 0, len(events))
+		if ti == 0 {
+			// Song-level meta goes first so it precedes channel events at the
+			// same tick.
+			timeline = append(timeline, meterChanges(song)...)
+			timeline = append(timeline, tempoChanges(song)...)
+		}
+		timeline = append(timeline, keyChanges(song, ti)...)
+		for _, ev := range events {
+			timeline = append(timeline, timed{tick: ev.Tick, msg: message(ev.Msg)})
+		}
 		// Stable sort by tick (Song is already globally sorted with NoteOff
 		// before NoteOn at equal tick; this keeps that order within the track).
-		sort.SliceStable(events, func(i, j int) bool {
-			return events[i].Tick < events[j].Tick
+		sort.SliceStable(timeline, func(i, j int) bool {
+			return timeline[i].tick < timeline[j].tick
 		})
 
-		var lastTick uint32
-		for _, ev := range events {
-			delta := ev.Tick - lastTick
-			tr.Add(delta, message(ev.Msg))
-			lastTick = ev.Tick
+		addTimeline(&tr, timeline)
+		s.Add(tr)
+	}
+
+	var bf bytes.Buffer
+	s.WriteTo(&bf)
+	return bf.Bytes()
+}
+
+// WriteSequences serializes several Songs to one SMF format 2 file. Each Song
+// becomes a single self-contained track: the song header and the Song's name,
+// every track's initial program change, then all of its events merged in
+// order. Per-track names, instruments and key changes have no place in a
+// merged sequence and are dropped.
+func WriteSequences(songs []elaborator.Song) []byte {
+	s := smf.NewSMF2()
+	s.TimeFormat = smf.MetricTicks(elaborator.PPQ)
+
+	for _, song := range songs {
+		var tr smf.Track
+		songHeader(&tr, song)
+		if song.Name != "" {
+			tr.Add(0, smf.MetaTrackSequenceName(song.Name))
+		}
+		for _, info := range song.Tracks {
+			if info.HasProgram {
+				tr.Add(0, midi.ProgramChange(info.Channel, info.Program))
+			}
+		}
+
+		timeline := make([]timed, 0, len(song.Events))
+		timeline = append(timeline, meterChanges(song)...)
+		timeline = append(timeline, tempoChanges(song)...)
+		for _, ev := range song.Events {
+			timeline = append(timeline, timed{tick: ev.Tick, msg: message(ev.Msg)})
 		}
-		tr.Close(0)
+		sort.SliceStable(timeline, func(i, j int) bool {
+			return timeline[i].tick < timeline[j].tick
+		})
+		addTimeline(&tr, timeline)
 		s.Add(tr)
 	}
 
@@ -80,6 +117,104 @@ func Write(song elaborator.Song) []byte {
 	return bf.Bytes()
 }
 
+// songHeader adds the song-level meta events at tick 0: the opening meter,
+// tempo and key, the copyright and any text lines.
+func songHeader(tr *smf.Track, song elaborator.Song) {
+	beats, unit := song.TimeBeats, song.TimeUnit
+	if beats == 0 {
+		beats = 4
+	}
+	if unit == 0 {
+		unit = 4
+	}
+	tr.Add(0, smf.MetaMeter(uint8(beats), uint8(unit)))
+	tr.Add(0, smf.MetaTempo(openingTempo(song)))
+	for _, k := range song.Keys {
+		if k.Track == -1 {
+			tr.Add(0, keySignature(k.Key))
+		}
+	}
+	if song.Copyright != "" {
+		tr.Add(0, smf.MetaCopyright(song.Copyright))
+	}
+	for _, t := range song.Texts {
+		tr.Add(0, smf.MetaText(t))
+	}
+}
+
+// addTimeline appends a tick-sorted timeline to tr as delta times and closes
+// the track.
+func addTimeline(tr *smf.Track, timeline []timed) {
+	var lastTick uint32
+	for _, m := range timeline {
+		tr.Add(m.tick-lastTick, m.msg)
+		lastTick = m.tick
+	}
+	tr.Close(0)
+}
+
+// timed is an SMF message at an absolute tick, before delta conversion.
+type timed struct {
+	tick uint32
+	msg  smf.Message
+}
+
+// openingTempo is the tempo written in track 0's header.
+func openingTempo(song elaborator.Song) float64 {
+	if len(song.Tempos) > 0 && song.Tempos[0].Tick == 0 {
+		return song.Tempos[0].BPM
+	}
+	return song.BPM
+}
+
+// tempoChanges returns a MetaTempo for every tempo-map entry after the opening
+// one (which the header already carries).
+func tempoChanges(song elaborator.Song) []timed {
+	var out []timed
+	for _, t := range song.Tempos {
+		if t.Tick == 0 {
+			continue
+		}
+		out = append(out, timed{tick: t.Tick, msg: smf.MetaTempo(t.BPM)})
+	}
+	return out
+}
+
+// meterChanges returns a MetaMeter for every meter-map entry after the opening
+// one (which the header already carries).
+func meterChanges(song elaborator.Song) []timed {
+	var out []timed
+	for _, m := range song.Meters {
+		if m.Tick == 0 {
+			continue
+		}
+		out = append(out, timed{tick: m.Tick, msg: smf.MetaMeter(uint8(m.Beats), uint8(m.Unit))})
+	}
+	return out
+}
+
+// keyChanges returns a MetaKey for every key change of one track.
+func keyChanges(song elaborator.Song, track int) []timed {
+	var out []timed
+	for _, k := range song.Keys {
+		if k.Track == track {
+			out = append(out, timed{tick: k.Tick, msg: keySignature(k.Key)})
+		}
+	}
+	return out
+}
+
+// keySignature writes a key as a MetaKey. The MIDI key signature only knows
+// major and minor, so a modal key is written as the major key sharing its
+// sharps or flats.
+func keySignature(k value.Key) smf.Message {
+	n, flat := k.Fifths, k.Fifths < 0
+	if flat {
+		n = -n
+	}
+	return smf.MetaKey(uint8(k.TonicKey()), !k.Minor(), uint8(n), flat)
+}
+
 // message converts a MIDIMsg to its SMF wire bytes.
 func message(m elaborator.MIDIMsg) smf.Message {
 	switch m.Kind {
@@ -93,6 +228,8 @@ func message(m elaborator.MIDIMsg) smf.Message {
 		return smf.Message(midi.Pitchbend(m.Channel, m.Bend))
 	case elaborator.MsgPressure:
 		return smf.Message(midi.AfterTouch(m.Channel, m.Value))
+	case elaborator.MsgPolyPressure:
+		return smf.Message(midi.PolyAfterTouch(m.Channel, m.Key, m.Value))
 	case elaborator.MsgProgram:
 		return smf.Message(midi.ProgramChange(m.Channel, m.Program))
 	case elaborator.MsgSysex:
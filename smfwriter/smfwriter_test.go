@@ -0,0 +1,85 @@
+package smfwriter
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/poolpOrg/earmuff/elaborator"
+	"github.com/poolpOrg/earmuff/parser"
+	"gitlab.com/gomidi/midi/v2/smf"
+)
+
+// elaborate parses and elaborates src, failing the test on any error.
+func elaborate(t *testing.T, src string) []elaborator.Song {
+	t.Helper()
+	prog, diags := parser.New(src, "<test>").Parse()
+	if len(diags) != 0 {
+		t.Fatalf("parse: %v", diags)
+	}
+	songs, errs := elaborator.Elaborate(prog)
+	if len(errs) != 0 {
+		t.Fatalf("elaborate: %v", errs)
+	}
+	return songs
+}
+
+func TestWriteSequences(t *testing.T) {
+	songs := elaborate(t, `
+project "one" { track "a" instrument "piano" { bar quarter { C E } } track "b" { bar 1 { G } } }
+project "two" { bpm 90; track "a" instrument "violin" { bar 1 { D } } }`)
+	out := WriteSequences(songs)
+	if format := int(out[8])<<8 | int(out[9]); format != 2 {
+		t.Fatalf("SMF format %d, want 2", format)
+	}
+	s, err := smf.ReadFrom(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("read back: %v", err)
+	}
+	if len(s.Tracks) != 2 {
+		t.Fatalf("%d sequences, want one per project", len(s.Tracks))
+	}
+	for i, want := range []struct {
+		name  string
+		bpm   float64
+		notes []uint8
+	}{
+		{"one", 120, []uint8{60, 67, 64}}, // both tracks merged in time order
+		{"two", 90, []uint8{62}},
+	} {
+		var name string
+		var bpm float64
+		var notes []uint8
+		for _, ev := range s.Tracks[i] {
+			var ch, key, vel uint8
+			switch {
+			case ev.Message.GetMetaTrackName(&name):
+			case ev.Message.GetMetaTempo(&bpm):
+			case ev.Message.GetNoteOn(&ch, &key, &vel) && vel > 0:
+				notes = append(notes, key)
+			}
+		}
+		if name != want.name || math.Round(bpm) != want.bpm || !bytes.Equal(notes, want.notes) {
+			t.Errorf("sequence %d: %q at %g bpm playing %v, want %q at %g playing %v",
+				i, name, bpm, notes, want.name, want.bpm, want.notes)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	for _, tc := range []struct {
+		msg  elaborator.MIDIMsg
+		want []byte
+	}{
+		{elaborator.MIDIMsg{Kind: elaborator.MsgNoteOn, Channel: 1, Key: 60, Velocity: 100}, []byte{0x91, 60, 100}},
+		{elaborator.MIDIMsg{Kind: elaborator.MsgNoteOff, Channel: 1, Key: 60}, []byte{0x81, 60, 0}},
+		{elaborator.MIDIMsg{Kind: elaborator.MsgCC, Channel: 0, Controller: 74, Value: 64}, []byte{0xB0, 74, 64}},
+		{elaborator.MIDIMsg{Kind: elaborator.MsgPressure, Channel: 2, Value: 90}, []byte{0xD2, 90}},
+		{elaborator.MIDIMsg{Kind: elaborator.MsgPolyPressure, Channel: 2, Key: 64, Value: 100}, []byte{0xA2, 64, 100}},
+		{elaborator.MIDIMsg{Kind: elaborator.MsgProgram, Channel: 9, Program: 40}, []byte{0xC9, 40}},
+	} {
+		if got := message(tc.msg); !bytes.Equal(got, tc.want) {
+			t.Errorf("message(%+v) = % X, want % X", tc.msg, []byte(got), tc.want)
+		}
+	}
+}
@@ -22,9 +22,11 @@ const (
 
 	// structural keywords
 	PROJECT
+	IMPORT
 	TRACK
 	BAR
 	PATTERN
+	FN
 	KIT
 	INSTRUMENT
 	CHANNEL
@@ -87,8 +89,11 @@ const (
 	AT      // @
 	STAR    // *
 	SLASH   // /
+	PERCENT // %
+	DIV     // div  (integer division; lexes as IDENT, recognized by the parser)
 	PLUS    // +
 	MINUS   // -
+	DOT     // .
 	DOTDOT  // ..
 	ASSIGN  // =
 	EQ      // ==
@@ -129,9 +134,11 @@ type Token struct {
 // literals are NOT keywords — they are recognized structurally by the lexer.
 var keywords = map[string]Type{
 	"project":    PROJECT,
+	"import":     IMPORT,
 	"track":      TRACK,
 	"bar":        BAR,
 	"pattern":    PATTERN,
+	"fn":         FN,
 	"kit":        KIT,
 	"instrument": INSTRUMENT,
 	"channel":    CHANNEL,
@@ -193,7 +200,7 @@ var typeNames = map[Type]string{
 	ILLEGAL: "ILLEGAL", EOF: "EOF",
 	IDENT: "IDENT", NUMBER: "NUMBER", FLOAT: "FLOAT", STRING: "STRING",
 	NOTE: "NOTE", CHORD: "CHORD", HEXBYTE: "HEXBYTE",
-	PROJECT: "project", TRACK: "track", BAR: "bar", PATTERN: "pattern",
+	PROJECT: "project", IMPORT: "import", TRACK: "track", BAR: "bar", PATTERN: "pattern", FN: "fn",
 	KIT: "kit", INSTRUMENT: "instrument", CHANNEL: "channel", PORT: "port",
 	BPM: "bpm", TIME: "time", COPYRIGHT: "copyright", TEXT: "text",
 	LYRIC: "lyric", MARKER: "marker", CUE: "cue",
@@ -205,8 +212,8 @@ var typeNames = map[Type]string{
 	TRUE: "true", FALSE: "false",
 	LBRACE: "{", RBRACE: "}", LBRACKET: "[", RBRACKET: "]",
 	LPAREN: "(", RPAREN: ")", SEMICOLON: ";", COMMA: ",", COLON: ":",
-	BAR_SEP: "|", TILDE: "~", AT: "@", STAR: "*", SLASH: "/", PLUS: "+", MINUS: "-",
-	DOTDOT: "..", ASSIGN: "=", EQ: "==", NEQ: "!=", LT: "<", LTE: "<=",
+	BAR_SEP: "|", TILDE: "~", AT: "@", STAR: "*", SLASH: "/", PERCENT: "%", DIV: "div", PLUS: "+", MINUS: "-",
+	DOT: ".", DOTDOT: "..", ASSIGN: "=", EQ: "==", NEQ: "!=", LT: "<", LTE: "<=",
 	GT: ">", GTE: ">=", AND: "&&", OR: "||", NOT: "!", VELO: "v",
 }
 
@@ -0,0 +1,487 @@
+package value
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/poolpOrg/earmuff/ast"
+	"github.com/poolpOrg/earmuff/token"
+	"github.com/poolpOrg/go-harmony/intervals"
+	"github.com/poolpOrg/go-harmony/notes"
+)
+
+// Builtin is a function predefined in every expression scope. A user function
+// of the same name shadows it.
+type Builtin struct {
+	Name   string
+	Params []string // parameter names; the arity is fixed
+	Doc    string   // one-line description, Markdown
+
+	fn func(c *call) (Value, error)
+}
+
+// Signature renders the call shape, e.g. `transpose(x, by)`.
+func (b *Builtin) Signature() string {
+	return b.Name + "(" + strings.Join(b.Params, ", ") + ")"
+}
+
+// Builtins maps each built-in function name to its definition.
+var Builtins = map[string]*Builtin{}
+
+// BuiltinNames returns the built-in function names in sorted order.
+func BuiltinNames() []string {
+	names := make([]string, 0, len(Builtins))
+	for name := range Builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	for _, b := range []*Builtin{
+		{Name: "transpose", Params: []string{"x", "by"}, fn: builtinTranspose,
+			Doc: "Transposes a note, chord, or list of them by an interval (`transpose(ch, maj2)`) or a number of semitones (`transpose(ch, -3)`)."},
+		{Name: "reverse", Params: []string{"list"}, fn: builtinReverse,
+			Doc: "The list in reverse order: `reverse([C, E, G])` is `[G, E, C]`."},
+		{Name: "rotate", Params: []string{"list", "n"}, fn: builtinRotate,
+			Doc: "The list rotated left by n places (right when n is negative): `rotate([C, E, G], 1)` is `[E, G, C]`."},
+		{Name: "len", Params: []string{"x"}, fn: builtinLen,
+			Doc: "The number of elements in a list, or of tones in a chord."},
+		{Name: "invert", Params: []string{"chord", "n"}, fn: builtinInvert,
+			Doc: "The chord's nth inversion: its n lowest tones move up an octave. `invert(Cmaj, 1)` sounds E G C, like `Cmaj inv 1`."},
+		{Name: "drop", Params: []string{"chord", "n"}, fn: builtinDrop,
+			Doc: "The chord's drop-n voicing: its nth tone from the top moves down an octave. `drop(Cmaj7, 2)` sounds G C E B, like `Cmaj7 drop 2`."},
+		{Name: "open", Params: []string{"chord"}, fn: builtinOpen,
+			Doc: "The chord spread open: its second, fourth, ... tones from the bottom move up an octave. `open(Cmaj)` sounds C G E, like `Cmaj open`."},
+		{Name: "root", Params: []string{"chord"}, fn: builtinRoot,
+			Doc: "The chord's root as a note: `root(Dm7)` is `D`."},
+		{Name: "tones", Params: []string{"chord"}, fn: builtinTones,
+			Doc: "The chord's tones as a list of notes, lowest first: `tones(C7)` is `[C, E, G, Bb]`."},
+		{Name: "octave", Params: []string{"x", "n"}, fn: builtinOctave,
+			Doc: "The note placed in octave n: `octave(E, 3)` is `E^3`. A chord moves whole so its lowest tone is in octave n, like `Cmaj7 octave 3`."},
+		{Name: "scale", Params: []string{"root", "mode"}, fn: builtinScale,
+			Doc: "One octave of a scale from root as a list of notes: `scale(D, \"dorian\")`. Modes: " + modeList() + "."},
+		{Name: "random", Params: []string{"lo", "hi"}, fn: builtinRandom,
+			Doc: "A seeded random number from lo to hi: a whole number when both bounds are whole (`random(60, 72)`), otherwise a fraction."},
+		{Name: "choose", Params: []string{"list"}, fn: builtinChoose,
+			Doc: "A seeded random element of the list: `choose([C, E, G])`."},
+		{Name: "shuffle", Params: []string{"list"}, fn: builtinShuffle,
+			Doc: "The list in a seeded random order."},
+		{Name: "chance", Params: []string{"p"}, fn: builtinChance,
+			Doc: "True with probability p, from 0 to 1: `if chance(0.3) { ... }`."},
+	} {
+		Builtins[b.Name] = b
+	}
+}
+
+// ScaleIntervals lists, for each mode accepted by scale(), the intervals of
+// its degrees above the root.
+var ScaleIntervals = map[string][]string{
+	"major":            {"maj2", "maj3", "fourth", "fifth", "maj6", "maj7"},
+	"ionian":           {"maj2", "maj3", "fourth", "fifth", "maj6", "maj7"},
+	"dorian":           {"maj2", "min3", "fourth", "fifth", "maj6", "min7"},
+	"phrygian":         {"min2", "min3", "fourth", "fifth", "min6", "min7"},
+	"lydian":           {"maj2", "maj3", "aug4", "fifth", "maj6", "maj7"},
+	"mixolydian":       {"maj2", "maj3", "fourth", "fifth", "maj6", "min7"},
+	"minor":            {"maj2", "min3", "fourth", "fifth", "min6", "min7"},
+	"aeolian":          {"maj2", "min3", "fourth", "fifth", "min6", "min7"},
+	"locrian":          {"min2", "min3", "fourth", "dim5", "min6", "min7"},
+	"harmonic minor":   {"maj2", "min3", "fourth", "fifth", "min6", "maj7"},
+	"melodic minor":    {"maj2", "min3", "fourth", "fifth", "maj6", "maj7"},
+	"major pentatonic": {"maj2", "maj3", "fifth", "maj6"},
+	"minor pentatonic": {"min3", "fourth", "fifth", "min7"},
+	"blues":            {"min3", "fourth", "dim5", "fifth", "min7"},
+}
+
+func modeList() string {
+	modes := make([]string, 0, len(ScaleIntervals))
+	for m := range ScaleIntervals {
+		modes = append(modes, fmt.Sprintf("%q", m))
+	}
+	sort.Strings(modes)
+	return strings.Join(modes, ", ")
+}
+
+// call is one application of a built-in: its evaluated arguments and where
+// each was written, so type errors point at the offending argument.
+type call struct {
+	name string
+	pos  token.Position
+	args []Value
+	at   []token.Position
+	rng  *Random
+}
+
+// apply evaluates n's arguments in env and runs the built-in on them.
+func (b *Builtin) apply(n *ast.Call, env *Env) (Value, error) {
+	if len(n.Args) != len(b.Params) {
+		return Value{}, posErr(n.Position, "function %q expects %d args, got %d", b.Name, len(b.Params), len(n.Args))
+	}
+	c := &call{name: b.Name, pos: n.Position, rng: env.random()}
+	for _, arg := range n.Args {
+		v, err := Eval(arg, env)
+		if err != nil {
+			return Value{}, err
+		}
+		c.args = append(c.args, v)
+		c.at = append(c.at, arg.Pos())
+	}
+	return b.fn(c)
+}
+
+// site identifies the call in the source, for seeded draws.
+func (c *call) site() string { return site(c.pos) }
+
+// errorf reports a problem with argument i.
+func (c *call) errorf(i int, format string, args ...interface{}) error {
+	return posErr(c.at[i], "%s: %s", c.name, fmt.Sprintf(format, args...))
+}
+
+// want checks that argument i has one of the given kinds.
+func (c *call) want(i int, kinds ...Kind) error {
+	for _, k := range kinds {
+		if c.args[i].Kind == k {
+			return nil
+		}
+	}
+	names := make([]string, len(kinds))
+	for j, k := range kinds {
+		names[j] = article(k)
+	}
+	return c.errorf(i, "argument %d is %s, want %s", i+1, article(c.args[i].Kind), strings.Join(names, " or "))
+}
+
+// article renders a kind with its indefinite article: "a note", "an interval".
+func article(k Kind) string {
+	if strings.IndexByte("aeiou", k.String()[0]) >= 0 {
+		return "an " + k.String()
+	}
+	return "a " + k.String()
+}
+
+// integer checks that argument i is a whole number and returns it.
+func (c *call) integer(i int) (int, error) {
+	if err := c.want(i, KindNumber); err != nil {
+		return 0, err
+	}
+	n := c.args[i].Num
+	if n != float64(int(n)) {
+		return 0, c.errorf(i, "argument %d must be a whole number, got %g", i+1, n)
+	}
+	return int(n), nil
+}
+
+func builtinTranspose(c *call) (Value, error) {
+	if err := c.want(1, KindInterval, KindNumber); err != nil {
+		return Value{}, err
+	}
+	by := c.args[1]
+	if by.Kind == KindNumber {
+		if _, err := c.integer(1); err != nil {
+			return Value{}, err
+		}
+	}
+	if err := c.want(0, KindNote, KindChord, KindList); err != nil {
+		return Value{}, err
+	}
+	var walk func(v Value) (Value, error)
+	walk = func(v Value) (Value, error) {
+		switch v.Kind {
+		case KindNote:
+			t := shiftNote(v.Note, by)
+			if t == nil {
+				return Value{}, c.errorf(0, "%s transposed out of MIDI range", v.Note.OctaveName())
+			}
+			return NotePitch(t), nil
+		case KindChord:
+			return shiftChord(c, v, by)
+		case KindList:
+			out := make([]Value, len(v.List))
+			for i, el := range v.List {
+				t, err := walk(el)
+				if err != nil {
+					return Value{}, err
+				}
+				out[i] = t
+			}
+			return ListVal(out), nil
+		}
+		return Value{}, c.errorf(0, "cannot transpose a %s", v.Kind)
+	}
+	return walk(c.args[0])
+}
+
+// shiftNote transposes n by an interval, keeping its spelling, or by a number
+// of semitones, spelled with sharps. It returns nil outside the MIDI range.
+func shiftNote(n *notes.Note, by Value) *notes.Note {
+	if by.Kind == KindInterval {
+		return n.Interval(by.Interval)
+	}
+	return noteFromKey(int(n.MIDI()) + int(by.Num))
+}
+
+// shiftChord transposes a chord's keys, its root and the root and bass names
+// in its text.
+func shiftChord(c *call, v Value, by Value) (Value, error) {
+	semis := int(by.Num)
+	if by.Kind == KindInterval {
+		semis = semitones(by.Interval)
+	}
+	keys := make([]uint8, len(v.Chord))
+	for i, k := range v.Chord {
+		t := int(k) + semis
+		if t < 0 || t > 127 {
+			return Value{}, c.errorf(0, "%s transposed out of MIDI range", v.Text)
+		}
+		keys[i] = uint8(t)
+	}
+	out := ChordVal(keys, v.Text)
+	if v.Root != nil {
+		out.Root = shiftNote(v.Root, by)
+	}
+	parts := strings.SplitN(v.Text, "/", 2)
+	for i, part := range parts {
+		head := pitchPrefix(part)
+		if n, err := notes.Parse(head + "4"); err == nil && head != "" {
+			if t := shiftNote(n, by); t != nil {
+				parts[i] = t.Name() + part[len(head):]
+			}
+		}
+	}
+	out.Text = strings.Join(parts, "/")
+	return out, nil
+}
+
+// pitchPrefix returns the leading note name (letter plus accidentals) of s.
+func pitchPrefix(s string) string {
+	if s == "" || s[0] < 'A' || s[0] > 'G' {
+		return ""
+	}
+	i := 1
+	for i < len(s) && (s[i] == '#' || s[i] == 'b') {
+		i++
+	}
+	return s[:i]
+}
+
+func builtinReverse(c *call) (Value, error) {
+	if err := c.want(0, KindList); err != nil {
+		return Value{}, err
+	}
+	in := c.args[0].List
+	out := make([]Value, len(in))
+	for i, v := range in {
+		out[len(in)-1-i] = v
+	}
+	return ListVal(out), nil
+}
+
+func builtinRotate(c *call) (Value, error) {
+	if err := c.want(0, KindList); err != nil {
+		return Value{}, err
+	}
+	n, err := c.integer(1)
+	if err != nil {
+		return Value{}, err
+	}
+	in := c.args[0].List
+	if len(in) == 0 {
+		return ListVal(nil), nil
+	}
+	n = ((n % len(in)) + len(in)) % len(in)
+	return ListVal(append(append([]Value(nil), in[n:]...), in[:n]...)), nil
+}
+
+func builtinLen(c *call) (Value, error) {
+	if err := c.want(0, KindList, KindChord); err != nil {
+		return Value{}, err
+	}
+	if c.args[0].Kind == KindChord {
+		return Number(float64(len(c.args[0].Chord))), nil
+	}
+	return Number(float64(len(c.args[0].List))), nil
+}
+
+func builtinInvert(c *call) (Value, error) {
+	if err := c.want(0, KindChord); err != nil {
+		return Value{}, err
+	}
+	n, err := c.integer(1)
+	if err != nil {
+		return Value{}, err
+	}
+	if n < 0 {
+		return Value{}, c.errorf(1, "inversion must not be negative, got %d", n)
+	}
+	return voiceChord(c, ast.Voicing{Kind: ast.VoiceInvert, N: n})
+}
+
+func builtinDrop(c *call) (Value, error) {
+	if err := c.want(0, KindChord); err != nil {
+		return Value{}, err
+	}
+	n, err := c.integer(1)
+	if err != nil {
+		return Value{}, err
+	}
+	if n < 2 {
+		return Value{}, c.errorf(1, "the dropped voice counts from the top, starting at 2, got %d", n)
+	}
+	return voiceChord(c, ast.Voicing{Kind: ast.VoiceDrop, N: n})
+}
+
+func builtinOpen(c *call) (Value, error) {
+	if err := c.want(0, KindChord); err != nil {
+		return Value{}, err
+	}
+	return voiceChord(c, ast.Voicing{Kind: ast.VoiceOpen})
+}
+
+// voiceChord revoices the chord in argument 0 and names the result the way
+// the playable modifier reads: `Cmaj7 drop 2`.
+func voiceChord(c *call, v ast.Voicing) (Value, error) {
+	ch := c.args[0]
+	keys, err := Voice(ch.Chord, v)
+	if err != nil {
+		return Value{}, c.errorf(0, "%s: %v", ch.Text, err)
+	}
+	out := ChordVal(keys, ch.Text+" "+v.String())
+	out.Root = ch.Root
+	return out, nil
+}
+
+func builtinRoot(c *call) (Value, error) {
+	if err := c.want(0, KindChord); err != nil {
+		return Value{}, err
+	}
+	if c.args[0].Root == nil {
+		return Value{}, c.errorf(0, "%s has no known root", c.args[0].Text)
+	}
+	return NotePitch(c.args[0].Root), nil
+}
+
+func builtinTones(c *call) (Value, error) {
+	if err := c.want(0, KindChord); err != nil {
+		return Value{}, err
+	}
+	ch := c.args[0]
+	keys := append([]uint8(nil), ch.Chord...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	out := make([]Value, 0, len(keys))
+	for _, k := range keys {
+		n := spellKey(ch.Root, int(k))
+		if n == nil {
+			return Value{}, c.errorf(0, "tone %d of %s is out of MIDI range", k, ch.Text)
+		}
+		out = append(out, NotePitch(n))
+	}
+	return ListVal(out), nil
+}
+
+func builtinOctave(c *call) (Value, error) {
+	if err := c.want(0, KindNote, KindChord); err != nil {
+		return Value{}, err
+	}
+	oct, err := c.integer(1)
+	if err != nil {
+		return Value{}, err
+	}
+	if c.args[0].Kind == KindChord {
+		return voiceChord(c, ast.Voicing{Kind: ast.VoiceOctave, N: oct})
+	}
+	n := inOctave(c.args[0].Note, oct)
+	if n == nil {
+		return Value{}, c.errorf(1, "octave %d puts %s out of MIDI range", oct, c.args[0].Note.Name())
+	}
+	return NotePitch(n), nil
+}
+
+func builtinScale(c *call) (Value, error) {
+	if err := c.want(0, KindNote); err != nil {
+		return Value{}, err
+	}
+	if err := c.want(1, KindString); err != nil {
+		return Value{}, err
+	}
+	mode := strings.ToLower(c.args[1].Str)
+	ivs, ok := ScaleIntervals[mode]
+	if !ok {
+		return Value{}, c.errorf(1, "unknown mode %q (known: %s)", c.args[1].Str, modeList())
+	}
+	root := c.args[0].Note
+	out := []Value{NotePitch(root)}
+	for _, name := range ivs {
+		n := root.Interval(IntervalByName[name])
+		if n == nil {
+			return Value{}, c.errorf(0, "scale of %s runs out of MIDI range", root.OctaveName())
+		}
+		out = append(out, NotePitch(n))
+	}
+	return ListVal(out), nil
+}
+
+// sharpNames spells the twelve pitch classes when no better spelling is known.
+var sharpNames = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// noteFromKey returns the note sounding MIDI key k, spelled with sharps, or
+// nil outside 0..127.
+func noteFromKey(k int) *notes.Note {
+	if k < 0 || k > 127 {
+		return nil
+	}
+	n, err := notes.Parse(fmt.Sprintf("%s%d", sharpNames[k%12], k/12-1))
+	if err != nil {
+		return nil
+	}
+	return n
+}
+
+// chordIntervals spell a chord tone by its distance in semitones above the
+// root, so tones(Bb7) reads Bb D F Ab rather than A# D F G#.
+var chordIntervals = []string{1: "min2", 2: "maj2", 3: "min3", 4: "maj3",
+	5: "fourth", 6: "dim5", 7: "fifth", 8: "min6", 9: "maj6", 10: "min7", 11: "maj7"}
+
+// spellKey returns the note sounding key k, spelled relative to root when the
+// root is known.
+func spellKey(root *notes.Note, k int) *notes.Note {
+	if root == nil {
+		return noteFromKey(k)
+	}
+	d := ((k-int(root.MIDI()))%12 + 12) % 12
+	n := root
+	if d != 0 {
+		n = root.Interval(IntervalByName[chordIntervals[d]])
+		if n == nil {
+			return noteFromKey(k)
+		}
+	}
+	// move the spelled pitch class to the octave that sounds k; B# and Cb sit
+	// in the neighbouring octave
+	for o := k/12 - 2; o <= k/12; o++ {
+		if t := inOctave(n, o); t != nil && int(t.MIDI()) == k {
+			return t
+		}
+	}
+	return noteFromKey(k)
+}
+
+// inOctave returns n's pitch class in octave oct, or nil outside the MIDI
+// range.
+func inOctave(n *notes.Note, oct int) *notes.Note {
+	if oct < -1 || oct > 9 {
+		return nil
+	}
+	t, err := notes.Parse(fmt.Sprintf("%s%d", n.Name(), oct))
+	if err != nil || t.MIDI() > 127 {
+		return nil
+	}
+	return t
+}
+
+// semitones measures an interval in semitones.
+func semitones(iv intervals.Interval) int {
+	c4, _ := notes.Parse("C4")
+	return int(c4.Interval(iv).MIDI()) - int(c4.MIDI())
+}
@@ -0,0 +1,300 @@
+package value
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Key is a key signature (`key D minor`): a tonic, a mode, and the number of
+// sharps (Fifths > 0) or flats (Fifths < 0) that spell it. The zero Key is C
+// major.
+type Key struct {
+	Tonic  string
+	Mode   string
+	Fifths int
+}
+
+// keyModes lists the modes a key signature accepts, each with how far round
+// the circle of fifths its signature sits from the major key on the same
+// tonic: D dorian shares C major's signature, two fifths flatter than D major.
+var keyModes = map[string]int{
+	"major":      0,
+	"ionian":     0,
+	"dorian":     -2,
+	"phrygian":   -4,
+	"lydian":     1,
+	"mixolydian": -1,
+	"minor":      -3,
+	"aeolian":    -3,
+	"locrian":    -5,
+}
+
+// KeyModes returns the modes ParseKey accepts, sorted.
+func KeyModes() []string {
+	modes := make([]string, 0, len(keyModes))
+	for m := range keyModes {
+		modes = append(modes, m)
+	}
+	sort.Strings(modes)
+	return modes
+}
+
+// letterFifths places each natural note on the circle of fifths, from C.
+var letterFifths = map[byte]int{'F': -1, 'C': 0, 'G': 1, 'D': 2, 'A': 3, 'E': 4, 'B': 5}
+
+// letterKeys is the pitch class of each natural note.
+var letterKeys = map[byte]int{'C': 0, 'D': 2, 'E': 4, 'F': 5, 'G': 7, 'A': 9, 'B': 11}
+
+// ParseKey builds the key of a `key <tonic> <mode>` setting. The tonic is a
+// note name without octave (D, Bb, F#); a key whose signature would need more
+// than seven sharps or flats, such as G# major, is refused in favour of its
+// enharmonic twin.
+func ParseKey(tonic, mode string) (Key, error) {
+	if !isBarePitch(tonic) {
+		return Key{}, fmt.Errorf("%q is not a tonic; expected a note name such as D, Bb or F#", tonic)
+	}
+	m := strings.ToLower(mode)
+	shift, ok := keyModes[m]
+	if !ok {
+		return Key{}, fmt.Errorf("unknown key mode %q (known: %s)", mode, strings.Join(KeyModes(), ", "))
+	}
+	fifths := letterFifths[tonic[0]] + 7*accidentals(tonic) + shift
+	if fifths > 7 {
+		return Key{}, fmt.Errorf("%s %s has no key signature: it would need %d sharps", tonic, m, fifths)
+	}
+	if fifths < -7 {
+		return Key{}, fmt.Errorf("%s %s has no key signature: it would need %d flats", tonic, m, -fifths)
+	}
+	return Key{Tonic: tonic, Mode: m, Fifths: fifths}, nil
+}
+
+// SetKey makes *k the key that roman numerals and scale degrees resolve
+// against in this scope and the scopes and function calls nested in it. The
+// caller may change *k as the key changes.
+func (e *Env) SetKey(k *Key) { e.key = k }
+
+// Key returns the innermost key, C major when no scope sets one.
+func (e *Env) Key() Key {
+	if k := e.keyRef(); k != nil {
+		return *k
+	}
+	return Key{}
+}
+
+func (e *Env) keyRef() *Key {
+	for s := e; s != nil; s = s.parent {
+		if s.key != nil {
+			return s.key
+		}
+	}
+	return nil
+}
+
+// accidentals counts a note name's sharps as +1 and flats as -1.
+func accidentals(name string) int {
+	n := 0
+	for i := 1; i < len(name); i++ {
+		switch name[i] {
+		case '#':
+			n++
+		case 'b':
+			n--
+		}
+	}
+	return n
+}
+
+// Minor reports whether the key is a minor (aeolian) key, as the MIDI key
+// signature records it.
+func (k Key) Minor() bool {
+	return k.Mode == "minor" || k.Mode == "aeolian"
+}
+
+func (k Key) String() string {
+	if k.Tonic == "" {
+		return "C major"
+	}
+	return k.Tonic + " " + k.Mode
+}
+
+// TonicKey is the pitch class of the tonic, 0 (C) through 11 (B).
+func (k Key) TonicKey() int {
+	if k.Tonic == "" {
+		return 0
+	}
+	return ((letterKeys[k.Tonic[0]]+accidentals(k.Tonic))%12 + 12) % 12
+}
+
+// signature returns the alteration the key signature gives a letter: +1 for
+// a sharp, -1 for a flat, 0 for a natural.
+func (k Key) signature(letter byte) int {
+	if k.Fifths > 0 && strings.IndexByte("FCGDAEB", letter) < k.Fifths {
+		return 1
+	}
+	if k.Fifths < 0 && strings.IndexByte("BEADGCF", letter) < -k.Fifths {
+		return -1
+	}
+	return 0
+}
+
+// Spell names MIDI key key in this key: its letter (C..B), alteration
+// (sharps positive, flats negative) and octave, with MIDI 60 as C4. A pitch of
+// the scale is spelled as the signature has it (F# in D major, Cb in Gb
+// major). Any other pitch is the scale pitch below raised or the one above
+// lowered, whichever needs the fewer accidentals; on a tie sharp keys raise
+// and flat keys lower, except that a minor key always raises its leading tone
+// (C# in D minor).
+func (k Key) Spell(key uint8) (step string, alter, octave int) {
+	pc := int(key) % 12
+	var letter byte
+	best := 3
+	for i := 0; i < 7; i++ {
+		l := "CDEFGAB"[i]
+		sig := k.signature(l)
+		// distance from the scale pitch on this letter, in -6..5
+		d := ((pc-letterKeys[l]-sig)%12+18)%12 - 6
+		if d < -1 || d > 1 {
+			continue
+		}
+		a := sig + d
+		if d == 0 {
+			letter, alter = l, a
+			break
+		}
+		if abs(a) < best || (abs(a) == best && k.prefersRaise(pc) == (d > 0)) {
+			letter, alter, best = l, a, abs(a)
+		}
+	}
+	return string(letter), alter, (int(key)-alter-letterKeys[letter])/12 - 1
+}
+
+// prefersRaise reports whether a chromatic pitch that could be written either
+// way is spelled by raising the scale pitch below it.
+func (k Key) prefersRaise(pc int) bool {
+	if k.Minor() && pc == (k.TonicKey()+11)%12 {
+		return true
+	}
+	return k.Fifths >= 0
+}
+
+// numerals are the roman numerals of the seven degrees, longest first so IV
+// is not read as I.
+var numerals = []struct {
+	text   string
+	degree int
+}{{"VII", 7}, {"III", 3}, {"VI", 6}, {"IV", 4}, {"II", 2}, {"V", 5}, {"I", 1}}
+
+// ResolveDegree rewrites text written against the key into the absolute
+// spelling it stands for, reporting false when text is neither form:
+//
+//   - A scale degree, `^3` or `b7`: a digit 1-7 after a caret, accidentals or
+//     both, is the note on that degree of the key's scale, altered by the
+//     accidentals, in the octave rising from the tonic at octave 4. In D
+//     major ^3 is F#^4; in A minor ^3 is C^5 and #7 the leading tone G#^5.
+//   - A roman numeral, `ii7`, `V7`, `bVII`: the chord on that degree, major
+//     in upper case and minor in lower case, with an optional quality after
+//     it (7, maj7, 9, sus4, o or dim for diminished, ø for half-diminished,
+//     aug). In C major ii7 is Dm7 and V7 is G7.
+//
+// Degrees follow the key's own scale, so in a minor key III is the relative
+// major and VII the chord a tone below the tonic.
+func (k Key) ResolveDegree(text string) (string, bool) {
+	caret := strings.HasPrefix(text, "^")
+	rest := strings.TrimPrefix(text, "^")
+	acc := 0
+	for len(rest) > 0 && (rest[0] == 'b' || rest[0] == '#') {
+		if rest[0] == '#' {
+			acc++
+		} else {
+			acc--
+		}
+		rest = rest[1:]
+	}
+	if len(rest) == 1 && rest[0] >= '1' && rest[0] <= '7' {
+		if !caret && acc == 0 {
+			return "", false
+		}
+		name, octave := k.degree(int(rest[0]-'0'), acc)
+		return fmt.Sprintf("%s^%d", name, octave), true
+	}
+	if caret {
+		return "", false
+	}
+	for _, n := range numerals {
+		lower := strings.ToLower(n.text)
+		var minor bool
+		switch {
+		case strings.HasPrefix(rest, n.text):
+		case strings.HasPrefix(rest, lower):
+			minor = true
+		default:
+			continue
+		}
+		quality, ok := romanQuality(rest[len(n.text):], minor)
+		if !ok {
+			return "", false
+		}
+		name, _ := k.degree(n.degree, acc)
+		return name + quality, true
+	}
+	return "", false
+}
+
+// romanQuality turns what follows a roman numeral into a chord quality: the
+// bare numeral is a major or minor triad, and a lower-case numeral makes an
+// extension minor (ii7 is m7, ii9 is m9). Anything that does not start like a
+// quality means the word is not a roman numeral.
+func romanQuality(suffix string, minor bool) (string, bool) {
+	switch suffix {
+	case "":
+		if minor {
+			return "m", true
+		}
+		return "maj", true
+	case "o", "°", "dim":
+		return "dim", true
+	case "o7", "°7", "dim7":
+		return "dim7", true
+	case "ø", "ø7":
+		return "m7b5", true
+	case "aug":
+		return "aug", true
+	}
+	switch {
+	case suffix[0] >= '0' && suffix[0] <= '9', strings.HasPrefix(suffix, "maj"), strings.HasPrefix(suffix, "add"):
+		if minor {
+			return "m" + suffix, true
+		}
+		return suffix, true
+	case strings.HasPrefix(suffix, "sus"):
+		return suffix, true
+	}
+	return "", false
+}
+
+// degree spells degree d (1-7) of the key's scale, raised or lowered by acc
+// semitones, and returns it with its octave counted from the tonic at octave 4.
+func (k Key) degree(d, acc int) (name string, octave int) {
+	tonic := "C"
+	if k.Tonic != "" {
+		tonic = k.Tonic
+	}
+	i := strings.IndexByte("CDEFGAB", tonic[0]) + d - 1
+	letter := "CDEFGAB"[i%7]
+	alter := k.signature(letter) + acc
+	name = string(letter)
+	if alter > 0 {
+		name += strings.Repeat("#", alter)
+	} else if alter < 0 {
+		name += strings.Repeat("b", -alter)
+	}
+	return name, 4 + i/7
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,143 @@
+package value
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+
+	"github.com/poolpOrg/earmuff/token"
+)
+
+// Random is the seeded source behind random(), choose(), shuffle() and
+// chance(). A draw is a pure function of the seed, the stream (the elaborator
+// uses the track name, so tracks do not disturb each other), the call site,
+// and how many times that call site has drawn before: the same program and
+// seed always yield the same values, and editing one call leaves the others
+// alone.
+type Random struct {
+	seed   int64
+	stream string
+	draws  map[string]uint64 // per call site
+}
+
+// NewRandom returns a source for seed and stream.
+func NewRandom(seed int64, stream string) *Random {
+	return &Random{seed: seed, stream: stream, draws: map[string]uint64{}}
+}
+
+// Reseed restarts the source from seed, as if newly created: a call site
+// draws the same values after `seed N` as after an earlier `seed N`.
+func (r *Random) Reseed(seed int64) {
+	r.seed = seed
+	r.draws = map[string]uint64{}
+}
+
+// source returns the generator for the next draw at site.
+func (r *Random) source(site string) *splitmix {
+	n := r.draws[site]
+	r.draws[site] = n + 1
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%d", r.seed, r.stream, site, n)
+	s := splitmix(h.Sum64())
+	return &s
+}
+
+// Float returns the next draw in [0, 1) for the construct at pos. The tag
+// tells apart several quantities drawn for one construct.
+func (r *Random) Float(pos token.Position, tag string) float64 {
+	return r.source(site(pos) + " " + tag).float()
+}
+
+// site identifies a position in the source for seeded draws. Only the file's
+// base name counts, so a song sounds the same wherever it is rendered from.
+func site(pos token.Position) string {
+	return fmt.Sprintf("%s:%d:%d", filepath.Base(pos.Filename), pos.Line, pos.Column)
+}
+
+// splitmix is the SplitMix64 generator: tiny, and stable across Go releases.
+type splitmix uint64
+
+func (s *splitmix) next() uint64 {
+	*s += 0x9e3779b97f4a7c15
+	z := uint64(*s)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// float returns a number in [0, 1).
+func (s *splitmix) float() float64 {
+	return float64(s.next()>>11) / (1 << 53)
+}
+
+// intn returns a number in [0, n).
+func (s *splitmix) intn(n int) int {
+	return int(s.float() * float64(n))
+}
+
+// SetRandom makes r the source for draws in this scope and the scopes and
+// function calls nested in it.
+func (e *Env) SetRandom(r *Random) { e.rng = r }
+
+// random returns the innermost source, or a fresh unseeded one.
+func (e *Env) random() *Random {
+	for s := e; s != nil; s = s.parent {
+		if s.rng != nil {
+			return s.rng
+		}
+	}
+	return NewRandom(0, "")
+}
+
+func builtinRandom(c *call) (Value, error) {
+	if err := c.want(0, KindNumber); err != nil {
+		return Value{}, err
+	}
+	if err := c.want(1, KindNumber); err != nil {
+		return Value{}, err
+	}
+	lo, hi := c.args[0].Num, c.args[1].Num
+	if lo > hi {
+		return Value{}, c.errorf(1, "upper bound %g is below lower bound %g", hi, lo)
+	}
+	src := c.rng.source(c.site())
+	if lo == float64(int(lo)) && hi == float64(int(hi)) {
+		return Number(lo + float64(src.intn(int(hi-lo)+1))), nil
+	}
+	return Number(lo + src.float()*(hi-lo)), nil
+}
+
+func builtinChoose(c *call) (Value, error) {
+	if err := c.want(0, KindList); err != nil {
+		return Value{}, err
+	}
+	xs := c.args[0].List
+	if len(xs) == 0 {
+		return Value{}, c.errorf(0, "cannot choose from an empty list")
+	}
+	return xs[c.rng.source(c.site()).intn(len(xs))], nil
+}
+
+func builtinShuffle(c *call) (Value, error) {
+	if err := c.want(0, KindList); err != nil {
+		return Value{}, err
+	}
+	out := append([]Value(nil), c.args[0].List...)
+	src := c.rng.source(c.site())
+	for i := len(out) - 1; i > 0; i-- {
+		j := src.intn(i + 1)
+		out[i], out[j] = out[j], out[i]
+	}
+	return ListVal(out), nil
+}
+
+func builtinChance(c *call) (Value, error) {
+	if err := c.want(0, KindNumber); err != nil {
+		return Value{}, err
+	}
+	p := c.args[0].Num
+	if p < 0 || p > 1 {
+		return Value{}, c.errorf(0, "probability %g is outside 0..1", p)
+	}
+	return Boolean(c.rng.source(c.site()).float() < p), nil
+}
@@ -1,14 +1,16 @@
 // Package value is the elaboration-time value model for earmuff v2.
 //
 // Expressions in earmuff are evaluated during elaboration (never at runtime) to
-// musical values: numbers, booleans, notes, chords, intervals, and lists. This
-// package defines that tagged-union Value type, a lexical Env scope chain, and
-// Eval, which reduces an ast.Expr to a Value following the semantics in
-// website/content/docs/language-reference.md §3.
+// musical values: numbers, booleans, strings, notes, chords, intervals, lists,
+// and user functions. This package defines that tagged-union Value type, a
+// lexical Env scope chain, Eval, which reduces an ast.Expr to a Value following
+// the semantics in website/content/docs/language-reference.md §3, and the
+// built-in functions every expression can call (builtins.go).
 package value
 
 import (
 	"fmt"
+	"math"
 	"strings"
 
 	"github.com/poolpOrg/earmuff/ast"
@@ -28,6 +30,8 @@ const (
 	KindChord
 	KindInterval
 	KindList
+	KindFunc
+	KindString
 )
 
 // Value is a tagged union of every elaboration-time musical value.
@@ -39,6 +43,8 @@ const (
 //   - KindChord    -> Chord (pitches as MIDI keys) and Text (original spelling)
 //   - KindInterval -> Interval and IntervalName
 //   - KindList     -> List (uniform element kind, not enforced here)
+//   - KindFunc     -> Func
+//   - KindString   -> Str
 type Value struct {
 	Kind Kind
 
@@ -51,13 +57,26 @@ type Value struct {
 	MIDI uint8
 
 	// Chord: the resolved MIDI keys plus original text for diagnostics/equality.
+	// Root is the chord's root, when known, for root() and transposition.
 	Chord []uint8
 	Text  string
+	Root  *notes.Note
 
 	Interval     intervals.Interval
 	IntervalName string
 
 	List []Value
+
+	Func *Closure
+
+	Str string
+}
+
+// Closure is a user function (`fn`) together with the scope it was defined
+// in, which its body sees when called.
+type Closure struct {
+	Def *ast.FuncDef
+	Env *Env
 }
 
 // Constructors ---------------------------------------------------------------
@@ -75,6 +94,9 @@ func ChordVal(keys []uint8, text string) Value {
 	return Value{Kind: KindChord, Chord: keys, Text: text}
 }
 
+// StringVal wraps a string literal.
+func StringVal(s string) Value { return Value{Kind: KindString, Str: s} }
+
 // IntervalVal wraps an interval keyword.
 func IntervalVal(iv intervals.Interval, name string) Value {
 	return Value{Kind: KindInterval, Interval: iv, IntervalName: name}
@@ -83,6 +105,11 @@ func IntervalVal(iv intervals.Interval, name string) Value {
 // List wraps a slice of values.
 func ListVal(elems []Value) Value { return Value{Kind: KindList, List: elems} }
 
+// FuncVal closes a function definition over the scope it is defined in.
+func FuncVal(def *ast.FuncDef, env *Env) Value {
+	return Value{Kind: KindFunc, Func: &Closure{Def: def, Env: env}}
+}
+
 // Keys returns the MIDI keys this value sounds as (a note -> one key, a chord ->
 // its tones). It reports false for values that are not playable as pitches.
 func (v Value) Keys() ([]uint8, bool) {
@@ -115,6 +142,10 @@ func (k Kind) String() string {
 		return "interval"
 	case KindList:
 		return "list"
+	case KindFunc:
+		return "function"
+	case KindString:
+		return "string"
 	}
 	return "unknown"
 }
@@ -126,14 +157,25 @@ func (k Kind) String() string {
 // Env is a lexical scope chain: a map of bindings plus an optional parent. A new
 // child shadows outer bindings; lookups walk outward. Bindings are immutable in
 // the language (let), but Env itself does not enforce that.
+//
+// An Env also counts the function calls it is nested in, so runaway recursion
+// stops at MaxCallDepth, and may carry the Random that random() and friends
+// draw from and the Key that roman numerals and scale degrees resolve against.
 type Env struct {
 	parent *Env
 	vars   map[string]Value
+	depth  int
+	rng    *Random
+	key    *Key
 }
 
 // NewEnv returns a fresh scope chained to parent (nil for a root scope).
 func NewEnv(parent *Env) *Env {
-	return &Env{parent: parent, vars: map[string]Value{}}
+	e := &Env{parent: parent, vars: map[string]Value{}}
+	if parent != nil {
+		e.depth = parent.depth
+	}
+	return e
 }
 
 // Set binds name to v in this scope.
@@ -179,15 +221,17 @@ var DynamicVelocity = map[string]int{
 // Evaluation
 // ---------------------------------------------------------------------------
 
-// Eval reduces an expression to a Value over the lexical scope env. Pattern
-// calls in expression position are an error: patterns are statements, not
-// values (docs §3).
+// Eval reduces an expression to a Value over the lexical scope env. A call in
+// expression position applies a user function; patterns are statements, not
+// values, and cannot be called here (docs §3).
 func Eval(ex ast.Expr, env *Env) (Value, error) {
 	switch n := ex.(type) {
 	case *ast.NumberLit:
 		return Number(n.Value), nil
 	case *ast.BoolLit:
 		return Boolean(n.Value), nil
+	case *ast.StringLit:
+		return StringVal(n.Value), nil
 	case *ast.IntervalLit:
 		iv, ok := IntervalByName[n.Name]
 		if !ok {
@@ -221,7 +265,11 @@ func Eval(ex ast.Expr, env *Env) (Value, error) {
 	case *ast.Binary:
 		return evalBinary(n, env)
 	case *ast.Call:
-		return Value{}, posErr(n.Position, "pattern call %q is not valid as a value (patterns are statements)", n.Name)
+		return evalCall(n, env)
+	case *ast.Index:
+		return evalIndex(n, env)
+	case *ast.Slice:
+		return evalSlice(n, env)
 	default:
 		return Value{}, posErr(ex.Pos(), "cannot evaluate expression %T", ex)
 	}
@@ -292,7 +340,7 @@ func parsePitch(text string) (Value, bool) {
 		}
 	}
 	if c, err := chords.Parse(text); err == nil {
-		return ChordVal(chordKeys(c), text), true
+		return rooted(ChordVal(chordKeys(c), text), c), true
 	}
 	// Slash chord with a non-chord-tone bass (e.g. "Dm7/G"): go-harmony refuses
 	// it, so build the chord plus the bass note placed below it.
@@ -311,7 +359,7 @@ func parsePitch(text string) (Value, bool) {
 					for int(bass)+12 <= int(low) {
 						bass += 12
 					}
-					return ChordVal(append([]uint8{bass}, keys...), text), true
+					return rooted(ChordVal(append([]uint8{bass}, keys...), text), c), true
 				}
 			}
 		}
@@ -352,9 +400,54 @@ func evalIdent(name string, pos token.Position, env *Env) (Value, error) {
 	if v, ok := parsePitch(name); ok {
 		return v, nil
 	}
+	if abs, ok := env.Key().ResolveDegree(name); ok {
+		if v, ok := parsePitch(abs); ok {
+			return v, nil
+		}
+		return Value{}, posErr(pos, "%q in %s is %q, not a valid note or chord", name, env.Key(), abs)
+	}
 	return Value{}, posErr(pos, "undefined identifier %q", name)
 }
 
+// MaxCallDepth bounds nested function calls, so a function that calls itself
+// without end fails with an error instead of exhausting the stack.
+const MaxCallDepth = 64
+
+// evalCall applies a user function or, failing one, a built-in: the arguments
+// are evaluated in the caller's scope, then a user function's body in a child
+// of the function's own scope.
+func evalCall(n *ast.Call, env *Env) (Value, error) {
+	fv, ok := env.Lookup(n.Name)
+	if b, isBuiltin := Builtins[n.Name]; isBuiltin && (!ok || fv.Kind != KindFunc) {
+		return b.apply(n, env)
+	}
+	if !ok {
+		return Value{}, posErr(n.Position, "undefined function %q", n.Name)
+	}
+	if fv.Kind != KindFunc {
+		return Value{}, posErr(n.Position, "%q is a %s, not a function", n.Name, fv.Kind)
+	}
+	def := fv.Func.Def
+	if len(n.Args) != len(def.Params) {
+		return Value{}, posErr(n.Position, "function %q expects %d args, got %d", n.Name, len(def.Params), len(n.Args))
+	}
+	if env.depth >= MaxCallDepth {
+		return Value{}, posErr(n.Position, "function %q: calls nested deeper than %d (unbounded recursion?)", n.Name, MaxCallDepth)
+	}
+	call := NewEnv(fv.Func.Env)
+	call.depth = env.depth + 1
+	call.rng = env.random() // draws follow the caller, not the definition
+	call.key = env.keyRef() // and so does the key
+	for i, p := range def.Params {
+		v, err := Eval(n.Args[i], env)
+		if err != nil {
+			return Value{}, err
+		}
+		call.Set(p, v)
+	}
+	return Eval(def.Body, call)
+}
+
 func evalRange(n *ast.Range, env *Env) (Value, error) {
 	lo, err := Eval(n.Lo, env)
 	if err != nil {
@@ -367,8 +460,26 @@ func evalRange(n *ast.Range, env *Env) (Value, error) {
 	if lo.Kind != KindNumber || hi.Kind != KindNumber {
 		return Value{}, posErr(n.Position, "range endpoints must be numbers")
 	}
+	step := 1
+	if n.Step != nil {
+		s, err := EvalNumber(n.Step, env)
+		if err != nil {
+			return Value{}, err
+		}
+		if s == 0 || s != math.Trunc(s) {
+			return Value{}, posErr(n.Step.Pos(), "range step must be a non-zero whole number, got %g", s)
+		}
+		step = int(s)
+	}
 	var out []Value
-	for i := int(lo.Num); i <= int(hi.Num); i++ {
+	from, to := int(lo.Num), int(hi.Num)
+	if step < 0 {
+		for i := from; i >= to; i += step {
+			out = append(out, Number(float64(i)))
+		}
+		return ListVal(out), nil
+	}
+	for i := from; i <= to; i += step {
 		out = append(out, Number(float64(i)))
 	}
 	return ListVal(out), nil
@@ -457,12 +568,97 @@ func evalBinary(n *ast.Binary, env *Env) (Value, error) {
 			return Number(l.Num / r.Num), nil
 		}
 		return Value{}, posErr(n.Position, "/ requires numbers")
+	case token.PERCENT, token.DIV:
+		return evalIntDiv(n, l, r)
 	case token.EQ, token.NEQ, token.LT, token.LTE, token.GT, token.GTE:
 		return evalCompare(n, l, r)
 	}
 	return Value{}, posErr(n.Position, "unsupported binary operator")
 }
 
+// evalIntDiv is `%` and `div` on whole numbers. Both floor, so `-1 % 4` is 3
+// and `-1 div 4` is -1, which keeps `i % n` a valid index.
+func evalIntDiv(n *ast.Binary, l, r Value) (Value, error) {
+	op := n.Op.String()
+	if l.Kind != KindNumber || r.Kind != KindNumber || l.Num != math.Trunc(l.Num) || r.Num != math.Trunc(r.Num) {
+		return Value{}, posErr(n.Position, "%s requires whole numbers", op)
+	}
+	if r.Num == 0 {
+		return Value{}, posErr(n.Position, "%s by zero", op)
+	}
+	q := math.Floor(l.Num / r.Num)
+	if n.Op == token.DIV {
+		return Number(q), nil
+	}
+	return Number(l.Num - q*r.Num), nil
+}
+
+// evalIndex is `xs[i]` on a list.
+func evalIndex(n *ast.Index, env *Env) (Value, error) {
+	xs, err := evalList(n.X, env)
+	if err != nil {
+		return Value{}, err
+	}
+	i, raw, err := evalPosition(n.Index, len(xs), env)
+	if err != nil {
+		return Value{}, err
+	}
+	if i < 0 || i >= len(xs) {
+		return Value{}, posErr(n.Index.Pos(), "index %d out of range for a list of %d", raw, len(xs))
+	}
+	return xs[i], nil
+}
+
+// evalSlice is `xs[lo..hi]` on a list, hi inclusive.
+func evalSlice(n *ast.Slice, env *Env) (Value, error) {
+	xs, err := evalList(n.X, env)
+	if err != nil {
+		return Value{}, err
+	}
+	lo, rawLo, err := evalPosition(n.Lo, len(xs), env)
+	if err != nil {
+		return Value{}, err
+	}
+	hi, rawHi, err := evalPosition(n.Hi, len(xs), env)
+	if err != nil {
+		return Value{}, err
+	}
+	if lo < 0 || hi >= len(xs) || lo > hi+1 {
+		return Value{}, posErr(n.Position, "slice %d..%d out of range for a list of %d", rawLo, rawHi, len(xs))
+	}
+	return ListVal(append([]Value(nil), xs[lo:hi+1]...)), nil
+}
+
+// evalList evaluates an indexed operand, which must be a list.
+func evalList(ex ast.Expr, env *Env) ([]Value, error) {
+	v, err := Eval(ex, env)
+	if err != nil {
+		return nil, err
+	}
+	if v.Kind != KindList {
+		return nil, posErr(ex.Pos(), "cannot index a %s", v.Kind)
+	}
+	return v.List, nil
+}
+
+// evalPosition evaluates a list position: a whole number, negative ones
+// counting back from the end of a list of length size. It returns the
+// position from the front and, for error messages, the one written.
+func evalPosition(ex ast.Expr, size int, env *Env) (int, int, error) {
+	f, err := EvalNumber(ex, env)
+	if err != nil {
+		return 0, 0, err
+	}
+	if f != math.Trunc(f) {
+		return 0, 0, posErr(ex.Pos(), "list index %g is not a whole number", f)
+	}
+	i := int(f)
+	if i < 0 {
+		return i + size, i, nil
+	}
+	return i, i, nil
+}
+
 // evalAdd is numeric addition, or note+interval transposition.
 func evalAdd(n *ast.Binary, l, r Value) (Value, error) {
 	if l.Kind == KindNumber && r.Kind == KindNumber {
@@ -530,10 +726,19 @@ func equal(a, b Value) bool {
 		return a.Text == b.Text
 	case KindInterval:
 		return a.Interval == b.Interval
+	case KindString:
+		return a.Str == b.Str
 	}
 	return false
 }
 
+// rooted records c's root on the chord value v.
+func rooted(v Value, c *chords.Chord) Value {
+	root := c.Root()
+	v.Root = &root
+	return v
+}
+
 func chordKeys(c *chords.Chord) []uint8 {
 	ns := c.Notes()
 	out := make([]uint8, 0, len(ns))
@@ -0,0 +1,78 @@
+package value
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/poolpOrg/earmuff/ast"
+)
+
+// Voice applies a voicing to a chord's keys and returns the revoiced keys,
+// lowest first. The input is not modified.
+//
+//   - inv N moves the N lowest tones up an octave, one at a time, so Cmaj7
+//     inv 2 sounds G B C E.
+//   - drop N moves the Nth tone from the top down an octave: drop 2 of C E G B
+//     sounds G C E B.
+//   - open moves the second, fourth, ... tones from the bottom up an octave,
+//     spreading a close chord over two octaves: C E G becomes C G E.
+//   - octave N moves the chord by whole octaves so its lowest tone sits in
+//     octave N (C^N through B^N).
+func Voice(keys []uint8, v ast.Voicing) ([]uint8, error) {
+	out := append([]uint8(nil), keys...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	if len(out) == 0 {
+		return out, nil
+	}
+	switch v.Kind {
+	case ast.VoiceInvert:
+		if v.N < 0 {
+			return nil, fmt.Errorf("inversion must not be negative, got %d", v.N)
+		}
+		for i := 0; i < v.N; i++ {
+			if out[0]+12 > 127 {
+				return nil, fmt.Errorf("inversion %d is out of MIDI range", v.N)
+			}
+			out = append(out[1:], out[0]+12)
+		}
+	case ast.VoiceDrop:
+		if v.N < 2 || v.N > len(out) {
+			return nil, fmt.Errorf("drop %d needs a chord of at least %d tones, this one has %d", v.N, max(v.N, 2), len(out))
+		}
+		i := len(out) - v.N
+		if out[i] < 12 {
+			return nil, fmt.Errorf("drop %d is out of MIDI range", v.N)
+		}
+		out[i] -= 12
+	case ast.VoiceOpen:
+		for i := 1; i < len(out); i += 2 {
+			if out[i]+12 > 127 {
+				return nil, fmt.Errorf("open voicing is out of MIDI range")
+			}
+			out[i] += 12
+		}
+	case ast.VoiceOctave:
+		shift := (v.N+1)*12 - int(out[0])/12*12
+		for i, k := range out {
+			t := int(k) + shift
+			if t < 0 || t > 127 {
+				return nil, fmt.Errorf("octave %d is out of MIDI range", v.N)
+			}
+			out[i] = uint8(t)
+		}
+		return out, nil
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, nil
+}
+
+// VoiceAll applies each voicing in turn.
+func VoiceAll(keys []uint8, vs []ast.Voicing) ([]uint8, error) {
+	for _, v := range vs {
+		var err error
+		if keys, err = Voice(keys, v); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
@@ -292,7 +292,7 @@
     }
   }
 
-  var KIND = ["on", "off", "cc", "bend", "press", "prog", "meta", "sysex"];
+  var KIND = ["on", "off", "cc", "bend", "press", "prog", "meta", "sysex", "polypress"];
   function renderEvents(res) {
     var evs = res.events || [];
     var rows = evs.slice(0, 2000).map(function (e) {